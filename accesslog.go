@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// Values of --web.log-requests-level.
+const (
+	requestLogDebug = "debug"
+	requestLogInfo  = "info"
+)
+
+// withRequestLog logs every request to next, except those for the excluded
+// paths, with its method, path, status, response size, duration and remote
+// address, at the given level.
+func withRequestLog(next http.Handler, logLevel string, exclude []string, logger log.Logger) http.Handler {
+	if logLevel == requestLogInfo {
+		logger = level.Info(logger)
+	} else {
+		logger = level.Debug(logger)
+	}
+	excluded := make(map[string]bool, len(exclude))
+	for _, p := range exclude {
+		excluded[p] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Handlers below a route prefix see a stripped path, but the path
+		// is logged and excluded as requested.
+		path := r.URL.Path
+		if excluded[path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		rw := &loggingResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(rw, r)
+		if rw.status == 0 {
+			rw.status = http.StatusOK
+		}
+		logger.Log("msg", "HTTP request", "method", r.Method, "path", path, "status", rw.status, "bytes", rw.bytes, "duration", time.Since(start), "remote", r.RemoteAddr)
+	})
+}
+
+// loggingResponseWriter records the status and size of a response. It
+// passes on flushes for /api/v1/stream and hijacking for /api/v1/ws.
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *loggingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *loggingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *loggingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection cannot be hijacked")
+	}
+	conn, rw, err := h.Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+func TestRequestLog(t *testing.T) {
+	hello := func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "hello") }
+	for _, tc := range []struct {
+		name     string
+		logLevel string
+		allow    level.Option
+		path     string
+		handler  http.HandlerFunc
+		// want are the expected parts of the logged line, none if the
+		// request must not be logged.
+		want []string
+	}{
+		{
+			name: "info", logLevel: requestLogInfo, allow: level.AllowInfo(), path: "/metrics", handler: hello,
+			want: []string{"level=info", `msg="HTTP request"`, "method=GET", "path=/metrics", "status=200", "bytes=5", "remote=192.0.2.1:1234"},
+		},
+		{
+			name: "error status", logLevel: requestLogInfo, allow: level.AllowInfo(), path: "/api/v1/current", handler: http.NotFound,
+			want: []string{"path=/api/v1/current", "status=404", "bytes=19"},
+		},
+		{
+			name: "empty response", logLevel: requestLogInfo, allow: level.AllowInfo(), path: "/-/ready",
+			handler: func(w http.ResponseWriter, r *http.Request) {},
+			want:    []string{"status=200", "bytes=0"},
+		},
+		{name: "excluded path", logLevel: requestLogInfo, allow: level.AllowInfo(), path: "/-/healthy", handler: hello},
+		{name: "debug filtered out", logLevel: requestLogDebug, allow: level.AllowInfo(), path: "/metrics", handler: hello},
+		{name: "debug", logLevel: requestLogDebug, allow: level.AllowDebug(), path: "/metrics", handler: hello, want: []string{"level=debug", "status=200"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := level.NewFilter(log.NewLogfmtLogger(&buf), tc.allow)
+			handler := withRequestLog(tc.handler, tc.logLevel, []string{"/-/healthy"}, logger)
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			line := buf.String()
+			if len(tc.want) == 0 && line != "" {
+				t.Errorf("request was logged: %s", line)
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(line, want) {
+					t.Errorf("log line lacks %s: %s", want, line)
+				}
+			}
+		})
+	}
+}
+
+// TestRequestLogKeepsFlushing checks that logging does not break streaming
+// responses, such as /api/v1/stream.
+func TestRequestLogKeepsFlushing(t *testing.T) {
+	handler := withRequestLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "data: {}\n\n")
+		w.(http.Flusher).Flush()
+	}), requestLogInfo, nil, log.NewNopLogger())
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/stream", nil))
+	if !w.Flushed {
+		t.Error("the response was not flushed through the request log")
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// parseCIDRs parses a comma-separated list of networks in CIDR notation, as
+// given to --web.allowed-cidrs and --web.trusted-proxies. A bare IP address
+// stands for itself.
+func parseCIDRs(spec string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IPAllowlist rejects HTTP requests from clients outside the allowed
+// networks with 403 Forbidden.
+type IPAllowlist struct {
+	allowed []*net.IPNet
+	// trustedProxies may name the client in X-Forwarded-For.
+	trustedProxies []*net.IPNet
+	rejected       prometheus.Counter
+}
+
+// NewIPAllowlist returns an allowlist of the allowed networks. The client is
+// the socket peer unless that is one of trustedProxies.
+func NewIPAllowlist(allowed, trustedProxies []*net.IPNet) *IPAllowlist {
+	return &IPAllowlist{
+		allowed:        allowed,
+		trustedProxies: trustedProxies,
+		rejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "http_requests_rejected_total",
+			Help:      "Number of HTTP requests rejected because the client is not in --web.allowed-cidrs.",
+		}),
+	}
+}
+
+// clientIP returns the address of the client that sent r, or nil if it
+// cannot be told. Behind trusted proxies, that is the last address in
+// X-Forwarded-For that is not a trusted proxy itself: the addresses before
+// it are set by the client and cannot be trusted.
+func (a *IPAllowlist) clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	ip := parseIPWithZone(host)
+	if ip == nil || !containsIP(a.trustedProxies, ip) {
+		return ip
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := parseIPWithZone(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			// Without a valid address the chain cannot be followed further.
+			return nil
+		}
+		ip = hop
+		if !containsIP(a.trustedProxies, ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// parseIPWithZone parses an IP address, dropping the zone of IPv6 link-local
+// addresses such as fe80::1%eth0.
+func parseIPWithZone(s string) net.IP {
+	if i := strings.Index(s, "%"); i >= 0 {
+		s = s[:i]
+	}
+	return net.ParseIP(s)
+}
+
+// Wrap returns a handler passing requests from allowed clients to next.
+// Requests received on a Unix domain socket are always passed on, as the
+// socket's file mode controls who may connect.
+func (a *IPAllowlist) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, ok := r.Context().Value(connContextKey{}).(net.Conn); ok && c.LocalAddr().Network() == "unix" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ip := a.clientIP(r); ip == nil || !containsIP(a.allowed, ip) {
+			a.rejected.Inc()
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Describe implements prometheus.Collector.
+func (a *IPAllowlist) Describe(ch chan<- *prometheus.Desc) {
+	a.rejected.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (a *IPAllowlist) Collect(ch chan<- prometheus.Metric) {
+	a.rejected.Collect(ch)
+}
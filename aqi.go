@@ -0,0 +1,39 @@
+package main
+
+import (
+	"math"
+)
+
+// aqiBreakpoint maps a PM2.5 concentration range to an AQI range.
+type aqiBreakpoint struct {
+	concLow, concHigh float64
+	aqiLow, aqiHigh   float64
+}
+
+// pm25AQIBreakpoints are the US EPA PM2.5 breakpoints, matching the default
+// PM2.5 histogram buckets.
+var pm25AQIBreakpoints = []aqiBreakpoint{
+	{0.0, 12.0, 0, 50},
+	{12.1, 35.4, 51, 100},
+	{35.5, 55.4, 101, 150},
+	{55.5, 150.4, 151, 200},
+	{150.5, 250.4, 201, 300},
+	{250.5, 350.4, 301, 400},
+	{350.5, 500.4, 401, 500},
+}
+
+// usAQI returns the US EPA Air Quality Index for a PM2.5 concentration in
+// µg/m³. Concentrations beyond the scale are reported as 500.
+func usAQI(pm25 float64) int {
+	// The EPA truncates concentrations to one decimal place.
+	c := math.Floor(pm25*10) / 10
+	if c < 0 {
+		c = 0
+	}
+	for _, bp := range pm25AQIBreakpoints {
+		if c <= bp.concHigh {
+			return int(math.Round((bp.aqiHigh-bp.aqiLow)/(bp.concHigh-bp.concLow)*(c-bp.concLow) + bp.aqiLow))
+		}
+	}
+	return 500
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// autoLabelFields are the device settings that --iqair.auto-labels can turn
+// into labels, by label name.
+var autoLabelFields = map[string]func(Settings) string{
+	"node_name": func(s Settings) string { return s.NodeName },
+	"city":      func(s Settings) string { return s.City },
+	"latitude":  func(s Settings) string { return formatCoordinate(s.Latitude) },
+	"longitude": func(s Settings) string { return formatCoordinate(s.Longitude) },
+}
+
+// parseAutoLabels parses the comma-separated value of --iqair.auto-labels.
+func parseAutoLabels(spec string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(spec, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if _, ok := autoLabelFields[name]; !ok {
+			known := make([]string, 0, len(autoLabelFields))
+			for k := range autoLabelFields {
+				known = append(known, k)
+			}
+			sort.Strings(known)
+			return nil, fmt.Errorf("unknown auto label %q, expected one of %s", name, strings.Join(known, ", "))
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// autoLabelPairs returns the label pairs for the auto labels taken from
+// settings. Empty values are left out, as for any label.
+func autoLabelPairs(names []string, settings Settings, maxLength int) []*dto.LabelPair {
+	var pairs []*dto.LabelPair
+	for _, name := range names {
+		if value := truncateLabelValue(autoLabelFields[name](settings), maxLength); value != "" {
+			pairs = append(pairs, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+		}
+	}
+	return pairs
+}
+
+// autoLabeledMetric adds labels to a metric. Labels the metric already has
+// keep their value.
+type autoLabeledMetric struct {
+	prometheus.Metric
+	labels []*dto.LabelPair
+}
+
+func (m autoLabeledMetric) Write(out *dto.Metric) error {
+	if err := m.Metric.Write(out); err != nil {
+		return err
+	}
+	existing := make(map[string]bool, len(out.Label))
+	for _, l := range out.Label {
+		existing[l.GetName()] = true
+	}
+	for _, l := range m.labels {
+		if !existing[l.GetName()] {
+			out.Label = append(out.Label, l)
+		}
+	}
+	sort.Slice(out.Label, func(i, j int) bool { return out.Label[i].GetName() < out.Label[j].GetName() })
+	return nil
+}
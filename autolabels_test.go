@@ -0,0 +1,72 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAutoLabelsFollowDeviceSettings(t *testing.T) {
+	const reading = `"current":{"co":500,"p2":3,"p1":4,"tp":21.5,"hm":40}`
+	uri := writeResponse(t, "")
+	e := newTestExporter(t, uri, ExporterOptions{AutoLabels: []string{"node_name", "city", "latitude"}})
+
+	// Each step is a scrape, after which iqair_up carries labels.
+	for _, step := range []struct {
+		name   string
+		body   string
+		labels map[string]string
+	}{
+		{
+			name:   "first scrape",
+			body:   `{"settings":{"node_name":"Bedroom","city":"Zurich","latitude":47.3769},` + reading + `}`,
+			labels: map[string]string{"node_name": "Bedroom", "city": "Zurich", "latitude": "47.3769"},
+		},
+		{
+			name:   "renamed while up",
+			body:   `{"settings":{"node_name":"Office","city":"Zurich","latitude":47.3769},` + reading + `}`,
+			labels: map[string]string{"node_name": "Bedroom", "city": "Zurich", "latitude": "47.3769"},
+		},
+		{
+			name:   "down",
+			body:   "<html>Rebooting</html>",
+			labels: map[string]string{"node_name": "Bedroom", "city": "Zurich", "latitude": "47.3769"},
+		},
+		{
+			name:   "back with new settings",
+			body:   `{"settings":{"node_name":"Office"},` + reading + `}`,
+			labels: map[string]string{"node_name": "Office"},
+		},
+	} {
+		rewriteResponse(t, uri, step.body)
+		families := gather(t, e)
+		up, ok := families["iqair_up"]
+		if !ok {
+			t.Fatalf("%s: no iqair_up", step.name)
+		}
+		labels := map[string]string{}
+		for _, l := range up.Metric[0].Label {
+			labels[l.GetName()] = l.GetValue()
+		}
+		if !reflect.DeepEqual(labels, step.labels) {
+			t.Errorf("%s: iqair_up labels = %v, want %v", step.name, labels, step.labels)
+		}
+	}
+}
+
+func TestParseAutoLabels(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		want []string
+		err  bool
+	}{
+		{spec: "", want: nil},
+		{spec: "node_name, city,,", want: []string{"node_name", "city"}},
+		{spec: "latitude,longitude", want: []string{"latitude", "longitude"}},
+		{spec: "node_name,country", err: true},
+	} {
+		got, err := parseAutoLabels(tc.spec)
+		if (err != nil) != tc.err || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseAutoLabels(%q) = %v, %v, want %v, error %v", tc.spec, got, err, tc.want, tc.err)
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// awsCredentials are the credentials requests to AWS are signed with.
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// Expires is zero for credentials that do not expire.
+	Expires time.Time
+}
+
+// awsCredentialRefreshWindow is how long before they expire temporary
+// credentials are refreshed.
+const awsCredentialRefreshWindow = 5 * time.Minute
+
+// awsCredentialProvider resolves credentials the way the AWS SDKs do, trying
+// in order: the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment
+// variables, web identity federation (AWS_WEB_IDENTITY_TOKEN_FILE and
+// AWS_ROLE_ARN, as used by EKS), the shared credentials file, the ECS
+// container credentials endpoint and the EC2 instance metadata service.
+// Credentials are cached until shortly before they expire.
+type awsCredentialProvider struct {
+	region string
+	client *http.Client
+
+	mutex  sync.Mutex
+	cached *awsCredentials
+}
+
+func newAWSCredentialProvider(region string) *awsCredentialProvider {
+	return &awsCredentialProvider{
+		region: region,
+		// The metadata endpoints are link-local and answer quickly if they
+		// exist at all.
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Credentials returns valid credentials, resolving them again if the cached
+// ones are about to expire.
+func (p *awsCredentialProvider) Credentials(ctx context.Context) (awsCredentials, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if c := p.cached; c != nil && (c.Expires.IsZero() || time.Until(c.Expires) > awsCredentialRefreshWindow) {
+		return *c, nil
+	}
+	c, err := p.resolve(ctx)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	p.cached = &c
+	return c, nil
+}
+
+func (p *awsCredentialProvider) resolve(ctx context.Context) (awsCredentials, error) {
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		return awsCredentials{AccessKeyID: id, SecretAccessKey: secret, SessionToken: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+	if tokenFile, role := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), os.Getenv("AWS_ROLE_ARN"); tokenFile != "" && role != "" {
+		return p.webIdentityCredentials(ctx, tokenFile, role)
+	}
+	if c, ok, err := sharedFileCredentials(); ok || err != nil {
+		return c, err
+	}
+	if os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") != "" || os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") != "" {
+		return p.containerCredentials(ctx)
+	}
+	c, err := p.instanceCredentials(ctx)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("no AWS credentials found in the environment, shared credentials file, or instance metadata: %v", err)
+	}
+	return c, nil
+}
+
+// sharedFileCredentials reads the profile selected by AWS_PROFILE from the
+// shared credentials file. It reports false if the file or profile does not
+// exist.
+func sharedFileCredentials() (awsCredentials, bool, error) {
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return awsCredentials{}, false, nil
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return awsCredentials{}, false, nil
+	}
+	if err != nil {
+		return awsCredentials{}, false, err
+	}
+	defer f.Close()
+
+	var c awsCredentials
+	found, section := false, ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			found = found || section == profile
+			continue
+		}
+		if section != profile {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+		switch strings.TrimSpace(parts[0]) {
+		case "aws_access_key_id":
+			c.AccessKeyID = value
+		case "aws_secret_access_key":
+			c.SecretAccessKey = value
+		case "aws_session_token":
+			c.SessionToken = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return awsCredentials{}, false, err
+	}
+	if !found {
+		return awsCredentials{}, false, nil
+	}
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return awsCredentials{}, true, fmt.Errorf("profile %q in %s has no access key", profile, path)
+	}
+	return c, true, nil
+}
+
+// awsMetadataCredentials is the credentials document served by the ECS and
+// EC2 metadata endpoints.
+type awsMetadataCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+func (p *awsCredentialProvider) containerCredentials(ctx context.Context) (awsCredentials, error) {
+	uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if rel := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); rel != "" {
+		uri = "http://169.254.170.2" + rel
+	}
+	headers := http.Header{}
+	if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+		headers.Set("Authorization", token)
+	}
+	var doc awsMetadataCredentials
+	if err := p.getJSON(ctx, uri, headers, &doc); err != nil {
+		return awsCredentials{}, fmt.Errorf("fetching container credentials: %v", err)
+	}
+	return awsCredentials{AccessKeyID: doc.AccessKeyID, SecretAccessKey: doc.SecretAccessKey, SessionToken: doc.Token, Expires: doc.Expiration}, nil
+}
+
+// instanceCredentials fetches the credentials of the instance's IAM role
+// from the EC2 instance metadata service, using IMDSv2.
+func (p *awsCredentialProvider) instanceCredentials(ctx context.Context) (awsCredentials, error) {
+	const imds = "http://169.254.169.254/latest"
+	req, err := http.NewRequest(http.MethodPut, imds+"/api/token", nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	token, err := p.getString(req.WithContext(ctx))
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	headers := http.Header{}
+	headers.Set("X-aws-ec2-metadata-token", token)
+
+	if req, err = http.NewRequest(http.MethodGet, imds+"/meta-data/iam/security-credentials/", nil); err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header = headers
+	roles, err := p.getString(req.WithContext(ctx))
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	role := strings.TrimSpace(strings.SplitN(roles, "\n", 2)[0])
+	if role == "" {
+		return awsCredentials{}, fmt.Errorf("instance has no IAM role")
+	}
+
+	var doc awsMetadataCredentials
+	if err := p.getJSON(ctx, imds+"/meta-data/iam/security-credentials/"+role, headers, &doc); err != nil {
+		return awsCredentials{}, err
+	}
+	return awsCredentials{AccessKeyID: doc.AccessKeyID, SecretAccessKey: doc.SecretAccessKey, SessionToken: doc.Token, Expires: doc.Expiration}, nil
+}
+
+// webIdentityCredentials exchanges the token in tokenFile for temporary
+// credentials of role.
+func (p *awsCredentialProvider) webIdentityCredentials(ctx context.Context, tokenFile, role string) (awsCredentials, error) {
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	session := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if session == "" {
+		session = "iqair_exporter"
+	}
+	params := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {role},
+		"RoleSessionName":  {session},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	req, err := http.NewRequest(http.MethodPost, "https://sts."+p.region+".amazonaws.com/", strings.NewReader(params.Encode()))
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return awsCredentials{}, fmt.Errorf("assuming role %s: %v", role, parseAWSError(resp))
+	}
+
+	var result struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return awsCredentials{}, err
+	}
+	c := result.Credentials
+	return awsCredentials{AccessKeyID: c.AccessKeyID, SecretAccessKey: c.SecretAccessKey, SessionToken: c.SessionToken, Expires: c.Expiration}, nil
+}
+
+func (p *awsCredentialProvider) getString(req *http.Request) (string, error) {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned HTTP status %s", req.URL, resp.Status)
+	}
+	return string(body), nil
+}
+
+func (p *awsCredentialProvider) getJSON(ctx context.Context, uri string, headers http.Header, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return err
+	}
+	req.Header = headers
+	body, err := p.getString(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(body), v)
+}
+
+// awsError is an error returned by an AWS query API.
+type awsError struct {
+	StatusCode int
+	Code       string `xml:"Error>Code"`
+	Message    string `xml:"Error>Message"`
+}
+
+func (e *awsError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("server returned HTTP status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// throttled reports whether the request was rejected for exceeding the rate
+// limit.
+func (e *awsError) throttled() bool {
+	return e.StatusCode == http.StatusTooManyRequests || strings.HasPrefix(e.Code, "Throttling") || e.Code == "RequestLimitExceeded"
+}
+
+// parseAWSError returns the error in resp's XML error document.
+func parseAWSError(resp *http.Response) *awsError {
+	e := &awsError{StatusCode: resp.StatusCode}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	xml.Unmarshal(body, e)
+	return e
+}
+
+// signAWSRequest signs req with Signature Version 4. body must be req's
+// payload.
+func signAWSRequest(req *http.Request, body []byte, creds awsCredentials, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	payloadHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		// url.Values.Encode sorts by key, as SigV4 requires.
+		strings.Replace(req.URL.Query().Encode(), "+", "%20", -1),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.AccessKeyID+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsRegion returns region, or the region from the AWS_REGION or
+// AWS_DEFAULT_REGION environment variables if it is empty.
+func awsRegion(region string) string {
+	if region != "" {
+		return region
+	}
+	if region = os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+	return os.Getenv("AWS_DEFAULT_REGION")
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var iqAirWorkingPath = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "working_path"), "Always 1, with the candidate path the device last returned a parseable response on as the path label.", []string{"path"}, nil)
+
+// validateCandidatePaths checks the candidate paths given with
+// --iqair.candidate-path or a device's paths.
+func validateCandidatePaths(paths []string) error {
+	for _, path := range paths {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("candidate path %q must start with /", path)
+		}
+		if _, err := url.Parse(path); err != nil {
+			return fmt.Errorf("invalid candidate path %q: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// withPath returns uri with its path and query replaced by those of path.
+func withPath(uri, path string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(path)
+	if err != nil {
+		return "", err
+	}
+	u.Path, u.RawPath, u.RawQuery = ref.Path, ref.RawPath, ref.RawQuery
+	return u.String(), nil
+}
+
+// candidateOrder returns the candidate paths in the order they are tried:
+// the one that worked last first, then the others as configured. Must be
+// called with e.mutex held.
+func (e *Exporter) candidateOrder() []string {
+	if e.workingPath == "" {
+		return e.candidatePaths
+	}
+	order := []string{e.workingPath}
+	for _, path := range e.candidatePaths {
+		if path != e.workingPath {
+			order = append(order, path)
+		}
+	}
+	return order
+}
+
+// scrapeCandidates fetches the candidate paths on uri's host in turn and
+// parses the first response holding a current block, remembering which path
+// returned it. Must be called with e.mutex held.
+func (e *Exporter) scrapeCandidates(uri string, start time.Time) (float64, *APIResponse, error) {
+	var lastErr error
+	// answered reports whether any path returned a body that could have
+	// been a device response.
+	answered := false
+	for _, path := range e.candidateOrder() {
+		candidate, err := withPath(uri, path)
+		if err != nil {
+			return 0, nil, redactURLError(err)
+		}
+		if e.trace != nil {
+			e.trace.uri = candidate
+		}
+		body, err := e.fetch(candidate, start)
+		if _, ok := err.(statusError); ok {
+			// Firmware not serving the API on this path answers e.g. 404.
+			level.Debug(e.logger).Log("msg", "Candidate path returned no device response", "path", path, "err", err)
+			lastErr = fmt.Errorf("%s: %v", path, err)
+			continue
+		}
+		if err != nil {
+			// Other paths on an unreachable device fare no better.
+			return 0, nil, err
+		}
+		e.responseBytes.Add(float64(len(body)))
+		answered = true
+
+		// A device known to answer on this path may be booting.
+		if e.emptyBodyOK && path == e.workingPath && len(strings.TrimSpace(string(body))) == 0 {
+			return 1, nil, nil
+		}
+		parsed, err := parseCandidateResponse(body)
+		if err != nil {
+			level.Debug(e.logger).Log("msg", "Candidate path returned no device response", "path", path, "err", err)
+			lastErr = fmt.Errorf("%s: %v", path, err)
+			continue
+		}
+		if path != e.workingPath {
+			level.Info(e.logger).Log("msg", "Found working candidate path", "path", path)
+			e.workingPath = path
+		}
+		return 1, parsed, nil
+	}
+	if !answered {
+		return 0, nil, fmt.Errorf("no candidate path returned a device response, last error: %v", lastErr)
+	}
+	e.jsonParseFailures.Inc()
+	return 0, nil, parseError{fmt.Errorf("no candidate path returned a device response, last error: %v", lastErr)}
+}
+
+// parseCandidateResponse parses body as a device response. Unlike a plain
+// scrape, it requires a current block, as any JSON object would otherwise
+// parse, e.g. the error of a firmware serving a different API on the path.
+func parseCandidateResponse(body []byte) (*APIResponse, error) {
+	var blocks map[string]json.RawMessage
+	if err := json.Unmarshal(body, &blocks); err != nil {
+		return nil, fmt.Errorf("parsing response body: %v", err)
+	}
+	if _, ok := blocks["current"]; !ok {
+		return nil, fmt.Errorf("response has no current block")
+	}
+	var parsed APIResponse
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return nil, fmt.Errorf("parsing response body: %v", err)
+	}
+	return &parsed, nil
+}
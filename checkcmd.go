@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+)
+
+// Values of the check command's --output.
+const (
+	checkOutputText = "text"
+	checkOutputJSON = "json"
+)
+
+// sensorFields maps the keys of the current block to sensor names.
+var sensorFields = []struct{ key, name string }{
+	{"co", "co2"},
+	{"p2", "pm2.5"},
+	{"p1", "pm10"},
+	{"tp", "temperature"},
+	{"hm", "humidity"},
+}
+
+// deviceCheck is a device's entry in the report of the check command.
+type deviceCheck struct {
+	Device string `json:"device"`
+	// URL is the scraped URL without credentials or API key.
+	URL string `json:"url"`
+	OK  bool   `json:"ok"`
+	// Reachable is true if the device answered, even if the scrape failed
+	// later, e.g. because the response did not parse.
+	Reachable           bool     `json:"reachable"`
+	Error               string   `json:"error,omitempty"`
+	StatusCode          int      `json:"status_code,omitempty"`
+	ResponseTimeSeconds float64  `json:"response_time_seconds"`
+	API                 string   `json:"api"`
+	Model               string   `json:"model,omitempty"`
+	Serial              string   `json:"serial,omitempty"`
+	UpdateAvailable     *bool    `json:"update_available,omitempty"`
+	Sensors             []string `json:"sensors"`
+	Warnings            []string `json:"warnings"`
+}
+
+// newDeviceCheck summarizes the diagnostic of a scrape for the check
+// command.
+func newDeviceCheck(d scrapeDiagnostic) deviceCheck {
+	c := deviceCheck{
+		Device:              Reading{Device: d.Device}.DeviceName(),
+		URL:                 fingerprintURI(d.URL),
+		OK:                  d.Up,
+		Reachable:           d.Parse.Attempted,
+		Error:               redactAPIKey(d.Error, d.URL),
+		StatusCode:          d.StatusCode,
+		ResponseTimeSeconds: d.Timing.Total,
+		API:                 apiKind(d.URL),
+		Sensors:             []string{},
+		Warnings:            []string{},
+	}
+	if d.Status != nil {
+		c.Model, c.Serial, c.UpdateAvailable = d.Status.Model, d.Status.SerialNumber, d.Status.UpdateAvailable
+	}
+	if d.StatusCode != 0 && (d.StatusCode < 200 || d.StatusCode > 299) {
+		c.Warnings = append(c.Warnings, fmt.Sprintf("the device answered with HTTP status %d", d.StatusCode))
+	}
+	if d.Current != nil {
+		missing := missingCurrentFields([]byte(d.Body))
+		for _, f := range sensorFields {
+			if _, ok := missing[f.key]; !ok {
+				c.Sensors = append(c.Sensors, f.name)
+			}
+		}
+		if d.Status != nil && d.Status.SerialNumber == "" {
+			c.Warnings = append(c.Warnings, "the status block has no serial_number")
+		}
+	}
+	for _, m := range d.Metrics {
+		if m.Produced && m.Reason != "" {
+			c.Warnings = append(c.Warnings, m.Name+": "+m.Reason)
+		}
+	}
+	return c
+}
+
+// redactAPIKey replaces the API key of uri, if it is an AirVisual API link,
+// in s.
+func redactAPIKey(s, uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || !strings.HasPrefix(u.Path, airVisualKeyPrefix) {
+		return s
+	}
+	key := strings.TrimPrefix(u.Path, airVisualKeyPrefix)
+	if key == "" {
+		return s
+	}
+	return strings.ReplaceAll(s, key, "<redacted>")
+}
+
+// apiKind tells which API uri is scraped from.
+func apiKind(uri string) string {
+	scheme, _, path := uriFingerprint(uri)
+	switch {
+	case scheme == "file":
+		return "saved response file"
+	case strings.HasPrefix(path, airVisualKeyPrefix):
+		return "AirVisual cloud API v2"
+	}
+	return "device API at " + path
+}
+
+// runCheck scrapes each device once like the exporter does, writes a report
+// to w in the given format and returns the exit code: 0 if all devices were
+// scraped successfully, 1 otherwise.
+func runCheck(w io.Writer, devices []DeviceConfig, opts ExporterOptions, format string, logger log.Logger) int {
+	checks := make([]deviceCheck, 0, len(devices))
+	failed := 0
+	for _, device := range devices {
+		exporter, err := NewExporter(device, opts, log.With(logger, "device", device.Name))
+		if err != nil {
+			fmt.Fprintf(w, "Error creating an exporter for device %q: %v\n", device.Name, err)
+			return 1
+		}
+		c := newDeviceCheck(exporter.DebugScrape())
+		if !c.OK {
+			failed++
+		}
+		checks = append(checks, c)
+	}
+
+	if format == checkOutputJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		enc.Encode(map[string][]deviceCheck{"devices": checks})
+	} else {
+		printDeviceChecks(w, checks)
+		fmt.Fprintf(w, "%d of %d devices OK.\n", len(checks)-failed, len(checks))
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// printDeviceChecks writes checks as plain text, meant to be pasted into bug
+// reports.
+func printDeviceChecks(w io.Writer, checks []deviceCheck) {
+	yesNo := map[bool]string{true: "yes", false: "no"}
+	for _, c := range checks {
+		fmt.Fprintf(w, "%s (%s)\n", c.Device, c.URL)
+		if c.OK {
+			fmt.Fprintln(w, "  result:           OK")
+		} else {
+			fmt.Fprintf(w, "  result:           FAILED: %s\n", c.Error)
+		}
+		fmt.Fprintf(w, "  reachable:        %s\n", yesNo[c.Reachable])
+		if c.StatusCode != 0 {
+			fmt.Fprintf(w, "  HTTP status:      %d\n", c.StatusCode)
+		}
+		fmt.Fprintf(w, "  response time:    %.3fs\n", c.ResponseTimeSeconds)
+		fmt.Fprintf(w, "  API:              %s\n", c.API)
+		if c.Model != "" {
+			fmt.Fprintf(w, "  model:            %s\n", c.Model)
+		}
+		if c.Serial != "" {
+			fmt.Fprintf(w, "  serial:           %s\n", c.Serial)
+		}
+		if c.UpdateAvailable != nil {
+			fmt.Fprintf(w, "  firmware update:  %s\n", yesNo[*c.UpdateAvailable])
+		}
+		if c.OK {
+			sensors := "none"
+			if len(c.Sensors) > 0 {
+				sensors = strings.Join(c.Sensors, ", ")
+			}
+			fmt.Fprintf(w, "  sensors:          %s\n", sensors)
+		}
+		for _, warning := range c.Warnings {
+			fmt.Fprintf(w, "  warning:          %s\n", warning)
+		}
+		fmt.Fprintln(w)
+	}
+}
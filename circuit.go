@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// circuitState is the state of a device's circuit breaker.
+type circuitState int
+
+const (
+	// circuitClosed scrapes the device as usual.
+	circuitClosed circuitState = iota
+	// circuitOpen skips scrapes until the cooldown has passed.
+	circuitOpen
+	// circuitHalfOpen lets a single scrape through to probe the device.
+	circuitHalfOpen
+)
+
+var circuitStates = []circuitState{circuitClosed, circuitOpen, circuitHalfOpen}
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+var iqAirCircuitState = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "circuit_state"), "State of the device's circuit breaker: 1 for the current state, 0 for the others.", []string{"state"}, nil)
+
+// circuitBreaker stops scraping a device after consecutive failures. Once a
+// cooldown has passed, the next scrape is let through: if it succeeds the
+// circuit closes, otherwise it opens again.
+type circuitBreaker struct {
+	// failures is the number of consecutive failed scrapes that open the
+	// circuit. Zero disables the breaker.
+	failures int
+	cooldown time.Duration
+
+	state    circuitState
+	failed   int
+	openedAt time.Time
+}
+
+// allow reports whether the device may be scraped at now, moving an open
+// circuit whose cooldown has passed to half-open.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	if b.state != circuitOpen {
+		return true
+	}
+	if now.Sub(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.state = circuitHalfOpen
+	return true
+}
+
+// record updates the circuit with the outcome of a scrape made at now. It
+// reports whether the circuit opened.
+func (b *circuitBreaker) record(success bool, now time.Time) bool {
+	if b.failures <= 0 {
+		return false
+	}
+	if success {
+		b.state, b.failed = circuitClosed, 0
+		return false
+	}
+	b.failed++
+	if b.state == circuitHalfOpen || b.failed >= b.failures {
+		b.state, b.openedAt = circuitOpen, now
+		return true
+	}
+	return false
+}
+
+// errCircuitOpen returns the error reported for scrapes skipped by an open
+// circuit.
+func (b *circuitBreaker) errCircuitOpen(now time.Time) error {
+	return fmt.Errorf("circuit breaker open after %d consecutive failures, next attempt in %v",
+		b.failed, model.Duration(b.cooldown-now.Sub(b.openedAt)).String())
+}
+
+func (b *circuitBreaker) collect(ch chan<- prometheus.Metric) {
+	if b.failures <= 0 {
+		return
+	}
+	for _, s := range circuitStates {
+		ch <- prometheus.MustNewConstMetric(iqAirCircuitState, prometheus.GaugeValue, boolToFloat(s == b.state), s.String())
+	}
+}
+
+// updateSkipped records a scrape skipped by an open circuit. Must be called
+// with e.mutex held.
+func (e *Exporter) updateSkipped(now time.Time) {
+	e.up, e.lastResponse, e.lastError = 0, nil, e.circuit.errCircuitOpen(now)
+	level.Debug(e.logger).Log("msg", "Skipping scrape", "err", e.lastError)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	b := circuitBreaker{failures: 3, cooldown: time.Minute}
+	start := time.Unix(1600000000, 0)
+
+	for i := 0; i < 2; i++ {
+		if !b.allow(start) || b.record(false, start) {
+			t.Fatalf("circuit opened after %d failures, want 3", i+1)
+		}
+	}
+	if !b.allow(start) || !b.record(false, start) || b.state != circuitOpen {
+		t.Fatalf("circuit %v after 3 failures, want open", b.state)
+	}
+	if b.allow(start.Add(59 * time.Second)) {
+		t.Error("open circuit allowed a scrape within the cooldown")
+	}
+
+	probe := start.Add(time.Minute)
+	if !b.allow(probe) || b.state != circuitHalfOpen {
+		t.Fatalf("circuit %v after the cooldown, want half_open", b.state)
+	}
+	if !b.record(false, probe) || b.state != circuitOpen {
+		t.Fatalf("circuit %v after a failed probe, want open", b.state)
+	}
+	if b.allow(probe.Add(30 * time.Second)) {
+		t.Error("reopened circuit allowed a scrape within the new cooldown")
+	}
+
+	if !b.allow(probe.Add(time.Minute)) || b.record(true, probe.Add(time.Minute)) || b.state != circuitClosed {
+		t.Fatalf("circuit %v after a successful probe, want closed", b.state)
+	}
+	if b.record(false, probe.Add(time.Minute)) {
+		t.Error("circuit reopened after a single failure following a success")
+	}
+}
+
+func TestCircuitBreakerSkipsScrapes(t *testing.T) {
+	var requests, healthy int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&healthy) == 0 {
+			http.Error(w, "broken", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"current":{"co":500,"p2":3,"p1":4,"tp":21.5,"hm":40}}`))
+	}))
+	defer server.Close()
+
+	e := newTestExporter(t, server.URL, ExporterOptions{CircuitFailures: 2, CircuitCooldown: time.Minute})
+	now := time.Unix(1600000000, 0)
+	e.nowFunc = func() time.Time { return now }
+	state := func() string {
+		mf := gather(t, e)["iqair_circuit_state"]
+		for _, m := range mf.Metric {
+			if m.GetGauge().GetValue() == 1 {
+				return m.Label[0].GetValue()
+			}
+		}
+		return ""
+	}
+
+	state()
+	if got := state(); got != "open" {
+		t.Fatalf("circuit %s after 2 failed scrapes, want open", got)
+	}
+	state()
+	if got := atomic.LoadInt32(&requests); got != 2 {
+		t.Errorf("device got %d requests with the circuit open, want 2", got)
+	}
+
+	atomic.StoreInt32(&healthy, 1)
+	now = now.Add(time.Minute)
+	if got := state(); got != "closed" {
+		t.Errorf("circuit %s after a successful probe, want closed", got)
+	}
+	if got := atomic.LoadInt32(&requests); got != 3 {
+		t.Errorf("device got %d requests, want 3 after the probe", got)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/version"
+)
+
+// cloudWatchMaxDatums is the maximum number of datums PutMetricData accepts
+// per request.
+const cloudWatchMaxDatums = 1000
+
+// CloudWatchConfig configures pushing readings to Amazon CloudWatch.
+type CloudWatchConfig struct {
+	Namespace string
+	Region    string
+	// Endpoint overrides the regional CloudWatch endpoint, e.g. for VPC
+	// endpoints.
+	Endpoint string
+	// Metrics restricts the pushed values to these field names. Empty
+	// pushes all of them.
+	Metrics []string
+	// SiteLabel is the static label whose value becomes the Site dimension.
+	SiteLabel string
+	// MinInterval is the minimum time between two pushes. Readings arriving
+	// in between are pushed together with the next batch.
+	MinInterval time.Duration
+	MaxRetries  int
+	QueueSize   int
+	Timeout     time.Duration
+}
+
+// validateCloudWatchConfig checks the configuration and fills in the region
+// from the environment.
+func validateCloudWatchConfig(config *CloudWatchConfig) error {
+	if config.Region = awsRegion(config.Region); config.Region == "" {
+		return fmt.Errorf("no AWS region configured; set --cloudwatch.region or AWS_REGION")
+	}
+	fields := map[string]bool{}
+	for _, f := range (Reading{}).Fields() {
+		fields[f.Name] = true
+	}
+	for _, m := range config.Metrics {
+		if !fields[m] {
+			return fmt.Errorf("unknown CloudWatch metric %q", m)
+		}
+	}
+	if config.MinInterval <= 0 {
+		return fmt.Errorf("the minimum CloudWatch push interval must be positive")
+	}
+	return nil
+}
+
+// CloudWatchWriter pushes new readings to CloudWatch with PutMetricData.
+// Readings are queued and pushed from a separate goroutine at most every
+// MinInterval, so CloudWatch being slow or throttling never delays a scrape
+// and the number of billed requests stays bounded.
+type CloudWatchWriter struct {
+	config   CloudWatchConfig
+	endpoint string
+	metrics  map[string]bool
+	creds    *awsCredentialProvider
+	client   *http.Client
+	queue    chan Reading
+	logger   log.Logger
+
+	pushed, dropped, apiErrors prometheus.Counter
+}
+
+// NewCloudWatchWriter returns a CloudWatchWriter for a validated config.
+// Call Run to start pushing.
+func NewCloudWatchWriter(config CloudWatchConfig, logger log.Logger) *CloudWatchWriter {
+	endpoint := config.Endpoint
+	if endpoint == "" {
+		endpoint = "https://monitoring." + config.Region + ".amazonaws.com/"
+	}
+	var metrics map[string]bool
+	if len(config.Metrics) > 0 {
+		metrics = map[string]bool{}
+		for _, m := range config.Metrics {
+			metrics[m] = true
+		}
+	}
+	return &CloudWatchWriter{
+		config:   config,
+		endpoint: endpoint,
+		metrics:  metrics,
+		creds:    newAWSCredentialProvider(config.Region),
+		client:   &http.Client{Timeout: config.Timeout},
+		queue:    make(chan Reading, config.QueueSize),
+		logger:   logger,
+		pushed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_cloudwatch_datapoints_pushed_total",
+			Help:      "Number of datapoints successfully pushed to CloudWatch.",
+		}),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_cloudwatch_datapoints_dropped_total",
+			Help:      "Number of datapoints dropped because the queue was full, CloudWatch rejected them, or all retries failed.",
+		}),
+		apiErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_cloudwatch_api_errors_total",
+			Help:      "Number of failed PutMetricData requests, including retried ones.",
+		}),
+	}
+}
+
+// OnReading queues r for pushing. It implements ReadingListener.
+func (w *CloudWatchWriter) OnReading(r Reading) {
+	select {
+	case w.queue <- r:
+	default:
+		w.dropped.Add(float64(len(w.datums(r))))
+	}
+}
+
+// Run pushes the queued readings every MinInterval until ctx is cancelled.
+// Readings still queued are pushed before it returns, for at most the
+// timeout.
+func (w *CloudWatchWriter) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.config.MinInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// ctx is done, so give the final push a fresh deadline.
+			flushCtx, cancel := context.WithTimeout(context.Background(), w.config.Timeout)
+			w.pushQueued(flushCtx)
+			cancel()
+			return
+		case <-ticker.C:
+			w.pushQueued(ctx)
+		}
+	}
+}
+
+// pushQueued pushes the queued readings, in as few requests as
+// PutMetricData allows.
+func (w *CloudWatchWriter) pushQueued(ctx context.Context) {
+	var datums []cloudWatchDatum
+	for len(w.queue) > 0 {
+		datums = append(datums, w.datums(<-w.queue)...)
+	}
+	for len(datums) > 0 {
+		n := len(datums)
+		if n > cloudWatchMaxDatums {
+			n = cloudWatchMaxDatums
+		}
+		w.put(ctx, datums[:n])
+		datums = datums[n:]
+	}
+}
+
+// cloudWatchDatum is a single value of a PutMetricData request.
+type cloudWatchDatum struct {
+	name       string
+	dimensions [][2]string
+	value      float64
+	timestamp  time.Time
+}
+
+// datums returns the datums for the selected fields of r.
+func (w *CloudWatchWriter) datums(r Reading) []cloudWatchDatum {
+	dimensions := [][2]string{{"Device", r.DeviceName()}}
+	if r.Status.SerialNumber != "" {
+		dimensions = append(dimensions, [2]string{"Serial", r.Status.SerialNumber})
+	}
+	if site := r.Labels[w.config.SiteLabel]; site != "" {
+		dimensions = append(dimensions, [2]string{"Site", site})
+	}
+	var datums []cloudWatchDatum
+	for _, f := range r.Fields() {
+		if w.metrics != nil && !w.metrics[f.Name] {
+			continue
+		}
+		datums = append(datums, cloudWatchDatum{name: f.Name, dimensions: dimensions, value: f.Value, timestamp: r.Timestamp})
+	}
+	return datums
+}
+
+// put sends datums, retrying throttled requests and server errors with
+// exponential backoff. Other errors are not retried as they would fail
+// again.
+func (w *CloudWatchWriter) put(ctx context.Context, datums []cloudWatchDatum) {
+	body := []byte(w.encode(datums))
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		retry, err := w.send(ctx, body)
+		if err == nil {
+			w.pushed.Add(float64(len(datums)))
+			return
+		}
+		w.apiErrors.Inc()
+		if !retry || attempt >= w.config.MaxRetries {
+			level.Error(w.logger).Log("msg", "Dropping datapoints that could not be pushed to CloudWatch", "datapoints", len(datums), "err", err)
+			w.dropped.Add(float64(len(datums)))
+			return
+		}
+		level.Debug(w.logger).Log("msg", "Retrying CloudWatch push", "attempt", attempt+1, "backoff", backoff, "err", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// encode returns the form-encoded PutMetricData request for datums.
+func (w *CloudWatchWriter) encode(datums []cloudWatchDatum) string {
+	params := url.Values{
+		"Action":    {"PutMetricData"},
+		"Version":   {"2010-08-01"},
+		"Namespace": {w.config.Namespace},
+	}
+	for i, d := range datums {
+		prefix := "MetricData.member." + strconv.Itoa(i+1) + "."
+		params.Set(prefix+"MetricName", d.name)
+		params.Set(prefix+"Value", strconv.FormatFloat(d.value, 'f', -1, 64))
+		params.Set(prefix+"Timestamp", d.timestamp.UTC().Format(time.RFC3339))
+		for j, dim := range d.dimensions {
+			dimPrefix := prefix + "Dimensions.member." + strconv.Itoa(j+1) + "."
+			params.Set(dimPrefix+"Name", dim[0])
+			params.Set(dimPrefix+"Value", dim[1])
+		}
+	}
+	return params.Encode()
+}
+
+// send issues a signed PutMetricData request, reporting whether a failure
+// is worth retrying.
+func (w *CloudWatchWriter) send(ctx context.Context, body []byte) (retry bool, err error) {
+	creds, err := w.creds.Credentials(ctx)
+	if err != nil {
+		return true, err
+	}
+	req, err := http.NewRequest(http.MethodPost, w.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	req.Header.Set("User-Agent", "iqair_exporter/"+version.Version)
+	signAWSRequest(req, body, creds, w.config.Region, "monitoring", time.Now())
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	apiErr := parseAWSError(resp)
+	return apiErr.throttled() || resp.StatusCode/100 == 5, apiErr
+}
+
+// Describe implements prometheus.Collector.
+func (w *CloudWatchWriter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- w.pushed.Desc()
+	ch <- w.dropped.Desc()
+	ch <- w.apiErrors.Desc()
+}
+
+// Collect implements prometheus.Collector.
+func (w *CloudWatchWriter) Collect(ch chan<- prometheus.Metric) {
+	ch <- w.pushed
+	ch <- w.dropped
+	ch <- w.apiErrors
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestCloudWatchWriterFlushesOnShutdown(t *testing.T) {
+	requests := make(chan url.Values, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		params, _ := url.ParseQuery(string(body))
+		requests <- params
+	}))
+	defer server.Close()
+
+	w := NewCloudWatchWriter(CloudWatchConfig{
+		Namespace:   "IQAir",
+		Region:      "eu-central-1",
+		Endpoint:    server.URL,
+		Metrics:     []string{"co2"},
+		MinInterval: time.Hour,
+		QueueSize:   10,
+		Timeout:     time.Second,
+	}, log.NewNopLogger())
+	w.creds.cached = &awsCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}
+	w.OnReading(testReading("bedroom", time.Unix(1600000000, 0)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w.Run(ctx)
+
+	select {
+	case params := <-requests:
+		for name, want := range map[string]string{
+			"Action":                                        "PutMetricData",
+			"Namespace":                                     "IQAir",
+			"MetricData.member.1.MetricName":                "co2",
+			"MetricData.member.1.Value":                     "612",
+			"MetricData.member.1.Timestamp":                 "2020-09-13T12:26:40Z",
+			"MetricData.member.1.Dimensions.member.1.Value": "bedroom",
+		} {
+			if got := params.Get(name); got != want {
+				t.Errorf("%s = %q, want %q", name, got, want)
+			}
+		}
+		if params.Get("MetricData.member.2.MetricName") != "" {
+			t.Error("pushed fields not selected with Metrics")
+		}
+	default:
+		t.Fatal("queued readings were not pushed on shutdown")
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the contents of the file given with --config.file.
+type Config struct {
+	Devices []DeviceConfig `yaml:"devices"`
+	// Notifications are webhooks sent when readings breach thresholds.
+	Notifications []NotificationConfig `yaml:"notifications"`
+	// Thresholds are exported as iqair_configured_threshold, replacing
+	// those of --iqair.threshold for the same metric. Re-read on SIGHUP.
+	Thresholds map[string]float64 `yaml:"thresholds"`
+}
+
+// DeviceConfig configures a single device to scrape.
+type DeviceConfig struct {
+	// Name is attached to all of the device's metrics as the device label.
+	Name string `yaml:"name"`
+	URI  string `yaml:"uri"`
+	// URIs can replace URI with several API links for the same device, e.g.
+	// from different AirVisual accounts. Scrapes rotate through them so
+	// that each account's API key stays within its rate limit.
+	URIs []string `yaml:"uris"`
+	// Labels are static labels attached to all of the device's metrics,
+	// e.g. the site or room it is installed in.
+	Labels map[string]string `yaml:"labels"`
+	// Timeout overrides --iqair.timeout for this device, e.g. to give a
+	// slow device more time.
+	Timeout model.Duration `yaml:"timeout"`
+	// TLSServerName overrides --iqair.tls-server-name for this device.
+	TLSServerName string `yaml:"tls_server_name"`
+	// Paths override --iqair.candidate-path for this device: they are
+	// tried in turn on the host of URI until one returns a parseable
+	// response.
+	Paths []string `yaml:"paths"`
+	// Group adds the device to the group of that name, whose readings are
+	// aggregated, e.g. the average PM2.5 of all devices upstairs.
+	Group string `yaml:"group"`
+	// Optional devices being unreachable at startup does not stop the
+	// exporter with --iqair.fail-on-startup-error.
+	Optional bool `yaml:"optional"`
+}
+
+// clientOptions returns opts with the device's overrides applied.
+func (d DeviceConfig) clientOptions(opts ExporterOptions) ExporterOptions {
+	if d.Timeout > 0 {
+		opts.Timeout = time.Duration(d.Timeout)
+	}
+	if d.TLSServerName != "" {
+		opts.TLSServerName = d.TLSServerName
+	}
+	return opts
+}
+
+// candidatePaths returns the paths tried in turn on the device's host, if
+// any. API links in uris are used as they are.
+func (d DeviceConfig) candidatePaths(opts ExporterOptions) []string {
+	if len(d.Paths) > 0 || len(d.URIs) > 0 {
+		return d.Paths
+	}
+	return opts.CandidatePaths
+}
+
+// labels returns the constant labels for all of the device's metrics.
+func (d DeviceConfig) labels() prometheus.Labels {
+	labels := prometheus.Labels{}
+	for name, value := range d.Labels {
+		labels[name] = value
+	}
+	if d.Name != "" {
+		labels["device"] = d.Name
+	}
+	return labels
+}
+
+// scrapeURIs returns the URIs the device is scraped from in turn.
+func (d DeviceConfig) scrapeURIs() []string {
+	if len(d.URIs) > 0 {
+		return d.URIs
+	}
+	return []string{d.URI}
+}
+
+// LoadConfig reads and validates the configuration file at filename. Files
+// ending in .gz are decompressed first.
+func LoadConfig(filename string) (*Config, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(filename, ".gz") {
+		if content, err = gunzip(content); err != nil {
+			return nil, fmt.Errorf("decompressing %s: %v", filename, err)
+		}
+	}
+
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", filename, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("validating %s: %v", filename, err)
+	}
+	return cfg, nil
+}
+
+func gunzip(content []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func (c *Config) validate() error {
+	if len(c.Devices) == 0 {
+		return fmt.Errorf("no devices configured")
+	}
+
+	names := make(map[string]bool, len(c.Devices))
+	for i, d := range c.Devices {
+		if d.Name == "" {
+			return fmt.Errorf("device %d: name is required", i)
+		}
+		if names[d.Name] {
+			return fmt.Errorf("device %q: duplicate name", d.Name)
+		}
+		names[d.Name] = true
+
+		if d.URI != "" && len(d.URIs) > 0 {
+			return fmt.Errorf("device %q: uri and uris are mutually exclusive", d.Name)
+		}
+		if len(d.URIs) > 0 {
+			// The first link identifies the device, e.g. for deduplication.
+			d.URI = d.URIs[0]
+			c.Devices[i].URI = d.URI
+		}
+		if d.URI == "" {
+			return fmt.Errorf("device %q: uri is required", d.Name)
+		}
+		if len(d.Paths) > 0 && len(d.URIs) > 0 {
+			return fmt.Errorf("device %q: paths and uris are mutually exclusive", d.Name)
+		}
+		if err := validateCandidatePaths(d.Paths); err != nil {
+			return fmt.Errorf("device %q: %v", d.Name, err)
+		}
+		for _, uri := range d.scrapeURIs() {
+			if _, err := url.Parse(uri); err != nil {
+				return fmt.Errorf("device %q: invalid uri: %v", d.Name, err)
+			}
+		}
+		for name := range d.Labels {
+			if err := validateLabelName(name); err != nil {
+				return fmt.Errorf("device %q: %v", d.Name, err)
+			}
+			if name == "device" {
+				return fmt.Errorf("device %q: the device label is set from the device name", d.Name)
+			}
+		}
+	}
+
+	for i := range c.Notifications {
+		if err := c.Notifications[i].validate(); err != nil {
+			return fmt.Errorf("notification %d: %v", i, err)
+		}
+	}
+	for metric := range c.Thresholds {
+		if !thresholdMetrics[metric] {
+			return fmt.Errorf("threshold for unknown metric %q (valid: %s)", metric, strings.Join(knownThresholdMetrics(), ", "))
+		}
+	}
+	return nil
+}
+
+// validateLabelName checks that name can be used as a label name on exported
+// metrics.
+func validateLabelName(name string) error {
+	if !model.LabelName(name).IsValid() || strings.HasPrefix(name, "__") {
+		return fmt.Errorf("invalid label name %q", name)
+	}
+	return nil
+}
+
+// parseLabels parses name=value pairs as given on the command line.
+func parseLabels(specs []string) (map[string]string, error) {
+	labels := make(map[string]string, len(specs))
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid label %q, expected name=value", spec)
+		}
+		if err := validateLabelName(parts[0]); err != nil {
+			return nil, err
+		}
+		labels[parts[0]] = parts[1]
+	}
+	return labels, nil
+}
+
+// dedupeDevices drops devices whose URI resolves to the same target as an
+// earlier device, logging a warning for each. Scraping the same device twice
+// doubles the load on hardware that copes badly with concurrent requests.
+func dedupeDevices(devices []DeviceConfig, lookupHost func(string) ([]string, error), logger log.Logger) []DeviceConfig {
+	seen := make(map[string]string, len(devices))
+	deduped := make([]DeviceConfig, 0, len(devices))
+	for _, d := range devices {
+		key := targetKey(d.URI, lookupHost)
+		if first, ok := seen[key]; ok {
+			level.Warn(logger).Log("msg", "Ignoring device with the same target as an earlier device", "device", d.Name, "duplicate_of", first, "uri", fingerprintURI(d.URI))
+			continue
+		}
+		seen[key] = d.Name
+		deduped = append(deduped, d)
+	}
+	return deduped
+}
+
+// defaultPorts are the ports of URIs that do not name one, by scheme.
+var defaultPorts = map[string]string{"http": "80", "https": "443"}
+
+// targetKey identifies the target uri points at, with the host replaced by
+// its resolved addresses so that different names for the same host compare
+// equal. If the host does not resolve, the name itself is used.
+func targetKey(uri string, lookupHost func(string) ([]string, error)) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+
+	host := u.Hostname()
+	if addrs, err := lookupHost(host); err == nil && len(addrs) > 0 {
+		sort.Strings(addrs)
+		host = strings.Join(addrs, ",")
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = defaultPorts[u.Scheme]
+	}
+	return u.Scheme + "://" + net.JoinHostPort(host, port) + u.EscapedPath() + "?" + u.RawQuery
+}
+
+// redactURI strips any password from uri so that it can be logged.
+func redactURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "<invalid uri>"
+	}
+	return u.Redacted()
+}
+
+// airVisualKeyPrefix starts the path of AirVisual API links, followed by
+// the API key.
+const airVisualKeyPrefix = "/api/v2/node/"
+
+// uriFingerprint returns the scheme, host and path of uri, which identify
+// the target without exposing credentials: user info and the query are
+// dropped, and the API key of AirVisual API links is replaced by the start
+// of its SHA-256 hash, which still tells keys apart.
+func uriFingerprint(uri string) (scheme, host, path string) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", "", "<invalid uri>"
+	}
+	path = u.Path
+	if strings.HasPrefix(path, airVisualKeyPrefix) {
+		sum := sha256.Sum256([]byte(strings.TrimPrefix(path, airVisualKeyPrefix)))
+		path = airVisualKeyPrefix + "sha256:" + hex.EncodeToString(sum[:4])
+	}
+	return u.Scheme, u.Host, path
+}
+
+// fingerprintURI returns uri as a URI made of its uriFingerprint.
+func fingerprintURI(uri string) string {
+	scheme, host, path := uriFingerprint(uri)
+	if scheme == "" {
+		return path
+	}
+	return scheme + "://" + host + path
+}
+
+// redactURIs replaces each of uris in msg, as given or as redactURI
+// returns it, by its fingerprintURI. Errors of failed requests include the
+// URI, with an API key in AirVisual API links that redactURI keeps.
+func redactURIs(msg string, uris []string) string {
+	for _, uri := range uris {
+		fingerprint := fingerprintURI(uri)
+		msg = strings.ReplaceAll(msg, uri, fingerprint)
+		msg = strings.ReplaceAll(msg, redactURI(uri), fingerprint)
+	}
+	return msg
+}
+
+// uriFingerprints returns the distinct fingerprints of uris, in order.
+func uriFingerprints(uris []string) [][3]string {
+	var fingerprints [][3]string
+	seen := make(map[[3]string]bool, len(uris))
+	for _, uri := range uris {
+		scheme, host, path := uriFingerprint(uri)
+		f := [3]string{scheme, host, path}
+		if !seen[f] {
+			seen[f] = true
+			fingerprints = append(fingerprints, f)
+		}
+	}
+	return fingerprints
+}
+
+// newTLSConfig builds a client TLS configuration from the given files. All
+// files are optional.
+func newTLSConfig(caFile, certFile, keyFile string, insecureSkipVerify bool) (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+	if caFile != "" {
+		ca, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestDedupeDevices(t *testing.T) {
+	lookupHost := func(host string) ([]string, error) {
+		switch host {
+		case "airvisual.local", "192.168.1.20":
+			return []string{"192.168.1.20"}, nil
+		case "office.local":
+			return []string{"192.168.1.21"}, nil
+		}
+		return nil, fmt.Errorf("no such host %q", host)
+	}
+	devices := []DeviceConfig{
+		{Name: "bedroom", URI: "http://airvisual.local/measurements"},
+		{Name: "bedroom-again", URI: "http://192.168.1.20:80/measurements"},
+		{Name: "office", URI: "http://office.local/measurements"},
+	}
+
+	deduped := dedupeDevices(devices, lookupHost, log.NewNopLogger())
+	if len(deduped) != 2 || deduped[0].Name != "bedroom" || deduped[1].Name != "office" {
+		t.Fatalf("dedupeDevices kept %v, want bedroom and office", deduped)
+	}
+
+}
+
+func TestDeviceTimeout(t *testing.T) {
+	body, err := os.ReadFile(filepath.Join("testdata", "base.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The device takes 200ms to answer, longer than --iqair.timeout.
+	device := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write(body)
+	}))
+	defer device.Close()
+	opts := ExporterOptions{Timeout: 50 * time.Millisecond}
+
+	for _, tc := range []struct {
+		name    string
+		timeout string
+		want    time.Duration
+		up      float64
+	}{
+		{name: "default", want: 50 * time.Millisecond, up: 0},
+		{name: "longer", timeout: "timeout: 5s", want: 5 * time.Second, up: 1},
+		{name: "shorter", timeout: "timeout: 10ms", want: 10 * time.Millisecond, up: 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "iqair.yml")
+			config := fmt.Sprintf("devices:\n- name: bedroom\n  uri: %s\n  %s\n", device.URL, tc.timeout)
+			if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := LoadConfig(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e, err := NewExporter(cfg.Devices[0], opts, log.NewNopLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.client.Timeout != tc.want {
+				t.Errorf("client timeout = %v, want %v", e.client.Timeout, tc.want)
+			}
+			if up, _ := metricValue(gather(t, e), "iqair_up"); up != tc.up {
+				t.Errorf("iqair_up = %v, want %v", up, tc.up)
+			}
+		})
+	}
+}
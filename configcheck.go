@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// targetFlags are the flags choosing the devices to scrape and how to
+// authenticate to them.
+type targetFlags struct {
+	ConfigFile      string
+	ScrapeURI       string
+	DeviceName      string
+	APIKeyFile      string
+	Username        string
+	PasswordFile    string
+	BearerTokenFile string
+	CandidatePaths  []string
+	Timeout         time.Duration
+	PollInterval    time.Duration
+}
+
+// targets are the devices to scrape, as validated by loadTargets.
+type targets struct {
+	Devices       []DeviceConfig
+	Notifications []NotificationConfig
+	// Thresholds are those of the config file, without --iqair.threshold.
+	Thresholds map[string]float64
+	// Credentials is nil unless scrapes are authenticated.
+	Credentials *ScrapeCredentials
+}
+
+// loadTargets validates f, reads the secret files it names and loads
+// --config.file. Both startup and --config.check use it, so that the
+// devices and notifications passing the check also load at startup. The
+// flags of outputs, pushes and the web server are validated by main alone.
+func loadTargets(f targetFlags) (*targets, error) {
+	if f.Timeout <= 0 {
+		return nil, fmt.Errorf("--iqair.timeout must be positive")
+	}
+	if f.PollInterval < 0 {
+		return nil, fmt.Errorf("--iqair.poll-interval must not be negative")
+	}
+	if err := validateCandidatePaths(f.CandidatePaths); err != nil {
+		return nil, fmt.Errorf("--iqair.candidate-path: %v", err)
+	}
+
+	t := &targets{}
+	if f.PasswordFile != "" || f.BearerTokenFile != "" {
+		if f.PasswordFile != "" && f.BearerTokenFile != "" {
+			return nil, fmt.Errorf("--iqair.password-file and --iqair.bearer-token-file are mutually exclusive")
+		}
+		t.Credentials = &ScrapeCredentials{Username: f.Username, PasswordFile: f.PasswordFile, BearerTokenFile: f.BearerTokenFile}
+		if err := t.Credentials.Load(); err != nil {
+			return nil, fmt.Errorf("reading credentials: %v", err)
+		}
+	} else if f.Username != "" {
+		return nil, fmt.Errorf("--iqair.username requires --iqair.password-file")
+	}
+
+	scrapeURI := f.ScrapeURI
+	if f.APIKeyFile != "" {
+		if f.ScrapeURI != "" || f.ConfigFile != "" {
+			return nil, fmt.Errorf("--iqair.api-key-file cannot be combined with --iqair.scrape-uri or --config.file")
+		}
+		key, err := readSecretFile(f.APIKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading API key: %v", err)
+		}
+		scrapeURI = airVisualAPIBase + url.PathEscape(key)
+	}
+
+	if f.ConfigFile == "" {
+		if scrapeURI == "" {
+			return nil, fmt.Errorf("one of --iqair.scrape-uri, --iqair.api-key-file or --config.file is required")
+		}
+		if _, err := url.Parse(scrapeURI); err != nil {
+			return nil, fmt.Errorf("invalid --iqair.scrape-uri: %v", redactURLError(err))
+		}
+		t.Devices = []DeviceConfig{{Name: f.DeviceName, URI: scrapeURI}}
+		return t, nil
+	}
+	if f.ScrapeURI != "" || f.DeviceName != "" {
+		return nil, fmt.Errorf("--config.file cannot be combined with --iqair.scrape-uri or --iqair.device-name")
+	}
+	cfg, err := LoadConfig(f.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	t.Devices, t.Notifications, t.Thresholds = cfg.Devices, cfg.Notifications, cfg.Thresholds
+	return t, nil
+}
+
+// printTargets writes a summary of the effective configuration for
+// --config.check. URIs are shown without credentials and API keys, and
+// secrets only by the file they are read from.
+func printTargets(w io.Writer, t *targets, f targetFlags) {
+	fmt.Fprintln(w, "Configuration is valid.")
+	fmt.Fprintf(w, "\nDevices (%d):\n", len(t.Devices))
+	for _, d := range t.Devices {
+		fmt.Fprintf(w, "  %s\n", Reading{Device: d.Name}.DeviceName())
+		for _, uri := range d.scrapeURIs() {
+			fmt.Fprintf(w, "    uri: %s\n", fingerprintURI(uri))
+		}
+		if paths := d.candidatePaths(ExporterOptions{CandidatePaths: f.CandidatePaths}); len(paths) > 0 {
+			fmt.Fprintf(w, "    candidate paths: %s\n", strings.Join(paths, ", "))
+		}
+		if len(d.Labels) > 0 {
+			fmt.Fprintf(w, "    labels: %s\n", formatLabels(d.Labels))
+		}
+		timeout := model.Duration(f.Timeout)
+		if d.Timeout > 0 {
+			timeout = d.Timeout
+		}
+		fmt.Fprintf(w, "    timeout: %s\n", timeout)
+		if d.TLSServerName != "" {
+			fmt.Fprintf(w, "    TLS server name: %s\n", d.TLSServerName)
+		}
+		if d.Group != "" {
+			fmt.Fprintf(w, "    group: %s\n", d.Group)
+		}
+		if d.Optional {
+			fmt.Fprintln(w, "    optional: true")
+		}
+	}
+
+	fmt.Fprint(w, "\nScrape authentication: ")
+	switch {
+	case t.Credentials == nil:
+		fmt.Fprintln(w, "none")
+	case t.Credentials.PasswordFile != "":
+		fmt.Fprintf(w, "basic, as user %q with the password in %s\n", t.Credentials.Username, t.Credentials.PasswordFile)
+	default:
+		fmt.Fprintf(w, "bearer token in %s\n", t.Credentials.BearerTokenFile)
+	}
+	if f.APIKeyFile != "" {
+		fmt.Fprintf(w, "API key: in %s\n", f.APIKeyFile)
+	}
+	if f.PollInterval > 0 {
+		fmt.Fprintf(w, "Poll interval: %s\n", model.Duration(f.PollInterval))
+	} else {
+		fmt.Fprintln(w, "Poll interval: none, devices are scraped when Prometheus scrapes the exporter")
+	}
+
+	if len(t.Thresholds) > 0 {
+		metrics := make([]string, 0, len(t.Thresholds))
+		for metric := range t.Thresholds {
+			metrics = append(metrics, metric)
+		}
+		sort.Strings(metrics)
+		thresholds := make([]string, len(metrics))
+		for i, metric := range metrics {
+			thresholds[i] = fmt.Sprintf("%s=%g", metric, t.Thresholds[metric])
+		}
+		fmt.Fprintf(w, "Thresholds: %s\n", strings.Join(thresholds, ", "))
+	}
+
+	if len(t.Notifications) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\nNotifications (%d):\n", len(t.Notifications))
+	for _, n := range t.Notifications {
+		condition := "below"
+		threshold := n.Below
+		if n.Above != nil {
+			condition, threshold = "above", n.Above
+		}
+		method := n.Method
+		if method == "" {
+			method = "POST"
+		}
+		fmt.Fprintf(w, "  %s %s %g for %s: %s %s\n", n.Metric, condition, *threshold, n.For, method, fingerprintURI(n.URL))
+		if len(n.Headers) > 0 {
+			// Header values often hold tokens.
+			names := make([]string, 0, len(n.Headers))
+			for name := range n.Headers {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			fmt.Fprintf(w, "    headers: %s\n", strings.Join(names, ", "))
+		}
+	}
+}
+
+// formatLabels formats labels as name="value" pairs sorted by name.
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for name, value := range labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, value))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
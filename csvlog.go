@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// csvHeader is written at the top of every new CSV log file.
+var csvHeader = []string{"timestamp", "device", "pm25", "pm10", "co2", "temperature", "humidity", "aqi"}
+
+// CSVLogConfig configures appending readings to a CSV file.
+type CSVLogConfig struct {
+	Path string
+	// The file is rotated once it exceeds MaxSize bytes or was opened more
+	// than MaxAge ago. Zero disables either check.
+	MaxSize int64
+	MaxAge  time.Duration
+	// MaxFiles is the number of rotated files kept, named <path>.1 (the
+	// newest) to <path>.<MaxFiles>.
+	MaxFiles int
+}
+
+// CSVLogger appends one row per new reading to a CSV file. Rows are written
+// from a single goroutine, so readings from several devices never
+// interleave within a row.
+type CSVLogger struct {
+	config CSVLogConfig
+	queue  chan Reading
+	logger log.Logger
+
+	// File state, only used by the Run goroutine.
+	file     *os.File
+	writer   *csv.Writer
+	size     int64
+	openedAt time.Time
+
+	written, writeErrors, dropped prometheus.Counter
+}
+
+// NewCSVLogger returns a CSVLogger. Call Run to start writing.
+func NewCSVLogger(config CSVLogConfig, logger log.Logger) *CSVLogger {
+	return &CSVLogger{
+		config: config,
+		queue:  make(chan Reading, 100),
+		logger: logger,
+		written: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_csv_written_readings_total",
+			Help:      "Number of readings appended to the CSV log.",
+		}),
+		writeErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_csv_write_errors_total",
+			Help:      "Number of readings that could not be appended to the CSV log.",
+		}),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_csv_dropped_readings_total",
+			Help:      "Number of readings dropped because the write queue was full.",
+		}),
+	}
+}
+
+// OnReading queues r for writing. It implements ReadingListener.
+func (l *CSVLogger) OnReading(r Reading) {
+	select {
+	case l.queue <- r:
+	default:
+		l.dropped.Inc()
+	}
+}
+
+// Run appends queued readings until ctx is cancelled. Pending readings are
+// written and the file is closed before it returns.
+func (l *CSVLogger) Run(ctx context.Context) {
+	defer l.close()
+	for {
+		select {
+		case <-ctx.Done():
+			for len(l.queue) > 0 {
+				l.append(<-l.queue)
+			}
+			return
+		case r := <-l.queue:
+			l.append(r)
+		}
+	}
+}
+
+func (l *CSVLogger) append(r Reading) {
+	if err := l.write(r); err != nil {
+		level.Error(l.logger).Log("msg", "Error writing reading to CSV log", "path", l.config.Path, "err", err)
+		l.writeErrors.Inc()
+		// Start over with a fresh file handle next time.
+		l.close()
+		return
+	}
+	l.written.Inc()
+}
+
+func (l *CSVLogger) write(r Reading) error {
+	if err := l.ensureOpen(); err != nil {
+		return err
+	}
+	if l.needsRotation() {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	return l.writeRow(csvRow(r))
+}
+
+// csvRow returns the CSV columns of r, matching csvHeader.
+func csvRow(r Reading) []string {
+	doc := newReadingDocument(r)
+	return []string{
+		doc.Timestamp.Format(time.RFC3339),
+		doc.Device,
+		strconv.FormatFloat(doc.PM25, 'f', -1, 64),
+		strconv.FormatFloat(doc.PM10, 'f', -1, 64),
+		strconv.FormatFloat(doc.CO2, 'f', -1, 64),
+		strconv.FormatFloat(doc.Temperature, 'f', -1, 64),
+		strconv.FormatFloat(doc.Humidity, 'f', -1, 64),
+		strconv.Itoa(usAQI(doc.PM25)),
+	}
+}
+
+func (l *CSVLogger) writeRow(row []string) error {
+	if err := l.writer.Write(row); err != nil {
+		return err
+	}
+	l.writer.Flush()
+	if err := l.writer.Error(); err != nil {
+		return err
+	}
+	fi, err := l.file.Stat()
+	if err != nil {
+		return err
+	}
+	l.size = fi.Size()
+	return nil
+}
+
+// ensureOpen opens the log file unless it is open and still in place.
+// Another process rotating or deleting the file makes it reopen the path.
+func (l *CSVLogger) ensureOpen() error {
+	if l.file != nil {
+		onDisk, err := os.Stat(l.config.Path)
+		current, err2 := l.file.Stat()
+		if err == nil && err2 == nil && os.SameFile(onDisk, current) {
+			return nil
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		level.Info(l.logger).Log("msg", "CSV log was moved or removed, reopening", "path", l.config.Path)
+		l.close()
+	}
+
+	f, err := os.OpenFile(l.config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.writer = f, csv.NewWriter(f)
+	l.size, l.openedAt = fi.Size(), time.Now()
+	if l.size == 0 {
+		return l.writeRow(csvHeader)
+	}
+	return nil
+}
+
+func (l *CSVLogger) needsRotation() bool {
+	if l.config.MaxSize > 0 && l.size >= l.config.MaxSize {
+		return true
+	}
+	return l.config.MaxAge > 0 && time.Since(l.openedAt) >= l.config.MaxAge
+}
+
+// rotate shifts the rotated files up by one, dropping the oldest, moves the
+// current file to <path>.1 and opens a new one.
+func (l *CSVLogger) rotate() error {
+	l.close()
+	if l.config.MaxFiles < 1 {
+		if err := os.Remove(l.config.Path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return l.ensureOpen()
+	}
+
+	rotated := func(i int) string { return fmt.Sprintf("%s.%d", l.config.Path, i) }
+	if err := os.Remove(rotated(l.config.MaxFiles)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := l.config.MaxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(rotated(i), rotated(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(l.config.Path, rotated(1)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return l.ensureOpen()
+}
+
+func (l *CSVLogger) close() {
+	if l.file == nil {
+		return
+	}
+	l.writer.Flush()
+	l.file.Close()
+	l.file, l.writer = nil, nil
+}
+
+// Describe implements prometheus.Collector.
+func (l *CSVLogger) Describe(ch chan<- *prometheus.Desc) {
+	ch <- l.written.Desc()
+	ch <- l.writeErrors.Desc()
+	ch <- l.dropped.Desc()
+}
+
+// Collect implements prometheus.Collector.
+func (l *CSVLogger) Collect(ch chan<- prometheus.Metric) {
+	ch <- l.written
+	ch <- l.writeErrors
+	ch <- l.dropped
+}
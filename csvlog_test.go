@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestCSVLogger(t *testing.T) {
+	ts := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name string
+		// existing is the content of the log before the exporter starts.
+		existing string
+		// maxSize lets a file take the header and one row, 99 bytes, before
+		// it is rotated.
+		maxSize  int64
+		maxFiles int
+		// files are the devices of the rows each file ends up with, by
+		// suffix of the log's path.
+		files map[string][]string
+	}{
+		{
+			name:  "new file",
+			files: map[string][]string{"": {"r1", "r2", "r3"}},
+		},
+		{
+			name:     "existing file",
+			existing: "timestamp,device,pm25,pm10,co2,temperature,humidity,aqi\n2021-06-01T11:00:00Z,r0,3,4,612,21.5,40,13\n",
+			files:    map[string][]string{"": {"r0", "r1", "r2", "r3"}},
+		},
+		{
+			name:     "rotation by size",
+			maxSize:  90,
+			maxFiles: 2,
+			files:    map[string][]string{"": {"r3"}, ".1": {"r2"}, ".2": {"r1"}},
+		},
+		{
+			name:     "oldest rotated file dropped",
+			maxSize:  90,
+			maxFiles: 1,
+			files:    map[string][]string{"": {"r3"}, ".1": {"r2"}, ".2": nil},
+		},
+		{
+			name:    "rotation keeping no files",
+			maxSize: 90,
+			files:   map[string][]string{"": {"r3"}, ".1": nil},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "readings.csv")
+			if tc.existing != "" {
+				if err := os.WriteFile(path, []byte(tc.existing), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			l := NewCSVLogger(CSVLogConfig{Path: path, MaxSize: tc.maxSize, MaxFiles: tc.maxFiles}, log.NewNopLogger())
+			for _, device := range []string{"r1", "r2", "r3"} {
+				l.OnReading(testReading(device, ts))
+			}
+			// With ctx already cancelled, Run writes the queued readings
+			// and returns.
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			l.Run(ctx)
+
+			for suffix, want := range tc.files {
+				f, err := os.Open(path + suffix)
+				if want == nil {
+					if err == nil {
+						f.Close()
+						t.Errorf("%s exists", path+suffix)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				rows, err := csv.NewReader(f).ReadAll()
+				f.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(rows) == 0 || !reflect.DeepEqual(rows[0], csvHeader) {
+					t.Fatalf("%s does not start with the header: %v", path+suffix, rows)
+				}
+				var devices []string
+				for _, row := range rows[1:] {
+					devices = append(devices, row[1])
+				}
+				if !reflect.DeepEqual(devices, want) {
+					t.Errorf("%s has rows of %v, want %v", path+suffix, devices, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCSVRow(t *testing.T) {
+	got := csvRow(testReading("bedroom", time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)))
+	want := []string{"2021-06-01T12:00:00Z", "bedroom", "3", "4", "612", "21.5", "40", "13"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("csvRow() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// dashboardSchemaVersion is the Grafana dashboard schema version the
+// generated dashboards are written for.
+const dashboardSchemaVersion = 36
+
+// DashboardOptions describes the configuration a dashboard is generated for.
+type DashboardOptions struct {
+	Devices []DeviceConfig
+	// Thresholds are drawn as threshold lines on the matching panels.
+	Thresholds       map[string]float64
+	HumidityFraction bool
+	PM25Histogram    bool
+	UpMetricName     string
+}
+
+// dashboardMetric is a reading shown as one panel per row.
+type dashboardMetric struct {
+	// threshold is the name used by --iqair.threshold.
+	threshold string
+	metric    string
+	title     string
+	unit      string
+}
+
+func (o DashboardOptions) metrics() []dashboardMetric {
+	humidity := dashboardMetric{"humidity", "iqair_humidity", "Humidity", "humidity"}
+	if o.HumidityFraction {
+		humidity.unit = "percentunit"
+	}
+	return []dashboardMetric{
+		{"co2", "iqair_co2", "CO2", "ppm"},
+		{"p25", "iqair_p25", "PM2.5", "conμgm3"},
+		{"p10", "iqair_p10", "PM10", "conμgm3"},
+		{"temperature", "iqair_temperature", "Temperature", "celsius"},
+		humidity,
+	}
+}
+
+// threshold returns the configured threshold for m in the panel's unit.
+func (o DashboardOptions) threshold(m dashboardMetric) (float64, bool) {
+	value, ok := o.Thresholds[m.threshold]
+	// Thresholds are compared against the device's percentage.
+	if ok && m.threshold == "humidity" && o.HumidityFraction {
+		value /= 100
+	}
+	return value, ok
+}
+
+// labelNames returns the sorted names of the static labels of all devices.
+func (o DashboardOptions) labelNames() []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, d := range o.Devices {
+		for name := range d.Labels {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+type grafanaDashboard struct {
+	UID           string             `json:"uid"`
+	Title         string             `json:"title"`
+	Tags          []string           `json:"tags"`
+	Editable      bool               `json:"editable"`
+	SchemaVersion int                `json:"schemaVersion"`
+	Refresh       string             `json:"refresh"`
+	Time          grafanaTimeRange   `json:"time"`
+	Templating    grafanaTemplating  `json:"templating"`
+	Panels        []grafanaPanel     `json:"panels"`
+	Annotations   grafanaAnnotations `json:"annotations"`
+}
+
+type grafanaTimeRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type grafanaAnnotations struct {
+	List []interface{} `json:"list"`
+}
+
+type grafanaTemplating struct {
+	List []grafanaVariable `json:"list"`
+}
+
+type grafanaVariable struct {
+	Name       string          `json:"name"`
+	Label      string          `json:"label,omitempty"`
+	Type       string          `json:"type"`
+	Query      string          `json:"query"`
+	Multi      bool            `json:"multi,omitempty"`
+	IncludeAll bool            `json:"includeAll,omitempty"`
+	Current    *grafanaOption  `json:"current,omitempty"`
+	Options    []grafanaOption `json:"options,omitempty"`
+	AllValue   string          `json:"allValue,omitempty"`
+}
+
+type grafanaOption struct {
+	Text     interface{} `json:"text"`
+	Value    interface{} `json:"value"`
+	Selected bool        `json:"selected"`
+}
+
+type grafanaDatasource struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+}
+
+type grafanaGridPos struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+type grafanaPanel struct {
+	ID          int                 `json:"id"`
+	Type        string              `json:"type"`
+	Title       string              `json:"title"`
+	GridPos     grafanaGridPos      `json:"gridPos"`
+	Datasource  *grafanaDatasource  `json:"datasource,omitempty"`
+	Targets     []grafanaTarget     `json:"targets,omitempty"`
+	FieldConfig *grafanaFieldConfig `json:"fieldConfig,omitempty"`
+	// Collapsed is only set on rows.
+	Collapsed *bool `json:"collapsed,omitempty"`
+}
+
+type grafanaTarget struct {
+	RefID        string             `json:"refId"`
+	Datasource   *grafanaDatasource `json:"datasource"`
+	Expr         string             `json:"expr"`
+	LegendFormat string             `json:"legendFormat,omitempty"`
+	Format       string             `json:"format,omitempty"`
+}
+
+type grafanaFieldConfig struct {
+	Defaults  grafanaFieldDefaults `json:"defaults"`
+	Overrides []interface{}        `json:"overrides"`
+}
+
+type grafanaFieldDefaults struct {
+	Unit       string                 `json:"unit,omitempty"`
+	Min        *float64               `json:"min,omitempty"`
+	Max        *float64               `json:"max,omitempty"`
+	Thresholds *grafanaThresholds     `json:"thresholds,omitempty"`
+	Custom     map[string]interface{} `json:"custom,omitempty"`
+}
+
+type grafanaThresholds struct {
+	Mode  string                 `json:"mode"`
+	Steps []grafanaThresholdStep `json:"steps"`
+}
+
+type grafanaThresholdStep struct {
+	Color string `json:"color"`
+	// Value is null for the base step.
+	Value *float64 `json:"value"`
+}
+
+// dashboardDatasource refers to the datasource picked with the datasource
+// template variable.
+var dashboardDatasource = &grafanaDatasource{Type: "prometheus", UID: "${datasource}"}
+
+// dashboardBuilder lays out panels on Grafana's 24 column grid.
+type dashboardBuilder struct {
+	opts   DashboardOptions
+	panels []grafanaPanel
+	nextID int
+	y      int
+}
+
+const (
+	dashboardPanelWidth  = 8
+	dashboardPanelHeight = 8
+	dashboardGridWidth   = 24
+)
+
+// GenerateDashboard returns a Grafana dashboard for the given configuration
+// as indented JSON. It starts with an overview row comparing all devices
+// selected with the template variables, followed by one row per device.
+func GenerateDashboard(opts DashboardOptions) ([]byte, error) {
+	if opts.UpMetricName == "" {
+		opts.UpMetricName = defaultUpMetricName
+	}
+	b := &dashboardBuilder{opts: opts, nextID: 1}
+
+	named := false
+	for _, d := range opts.Devices {
+		named = named || d.Name != ""
+	}
+	// Without device names there is nothing to tell devices apart, so the
+	// overview would only repeat the single device's row.
+	if named {
+		b.row("Overview", b.selector(nil), "{{device}}")
+	}
+	for _, d := range opts.Devices {
+		title := d.Name
+		if title == "" {
+			title = "iqAir"
+		}
+		b.row(title, b.selector(&d), "")
+	}
+
+	dashboard := grafanaDashboard{
+		UID:           "iqair",
+		Title:         "iqAir",
+		Tags:          []string{"iqair"},
+		Editable:      true,
+		SchemaVersion: dashboardSchemaVersion,
+		Refresh:       "1m",
+		Time:          grafanaTimeRange{From: "now-24h", To: "now"},
+		Templating:    grafanaTemplating{List: b.variables(named)},
+		Panels:        b.panels,
+		Annotations:   grafanaAnnotations{List: []interface{}{}},
+	}
+	out, err := json.MarshalIndent(dashboard, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+// selector returns the label matchers selecting device d, or the devices
+// picked with the template variables if d is nil.
+func (b *dashboardBuilder) selector(d *DeviceConfig) string {
+	var matchers []string
+	if d == nil {
+		matchers = append(matchers, `device=~"$device"`)
+		for _, name := range b.opts.labelNames() {
+			matchers = append(matchers, fmt.Sprintf(`%s=~"$%s"`, name, name))
+		}
+	} else if d.Name != "" {
+		matchers = append(matchers, fmt.Sprintf("device=%q", d.Name))
+	}
+	return "{" + strings.Join(matchers, ",") + "}"
+}
+
+// row adds a row titled title with a panel per metric, all querying series
+// matching selector.
+func (b *dashboardBuilder) row(title, selector, legend string) {
+	b.add(grafanaPanel{
+		Type:      "row",
+		Title:     title,
+		GridPos:   grafanaGridPos{X: 0, Y: b.y, W: dashboardGridWidth, H: 1},
+		Collapsed: new(bool),
+	})
+	b.y++
+
+	var panels []grafanaPanel
+	for _, m := range b.opts.metrics() {
+		p := b.timeseries(m.title, m.unit, m.metric+selector, legend)
+		if value, ok := b.opts.threshold(m); ok {
+			p.FieldConfig.Defaults.Thresholds.Steps = append(p.FieldConfig.Defaults.Thresholds.Steps, grafanaThresholdStep{Color: "red", Value: &value})
+			p.FieldConfig.Defaults.Custom["thresholdsStyle"] = map[string]string{"mode": "line"}
+		}
+		panels = append(panels, p)
+	}
+	if b.opts.PM25Histogram {
+		panels = append(panels, b.heatmap("PM2.5 distribution", fmt.Sprintf("sum by (le) (increase(iqair_pm2_5_ugm3_distribution_bucket%s[$__interval]))", selector)))
+	}
+	up := b.timeseries("Scrape status", "", b.opts.UpMetricName+selector, legend)
+	zero, one := 0.0, 1.0
+	up.FieldConfig.Defaults.Min, up.FieldConfig.Defaults.Max = &zero, &one
+	panels = append(panels, up)
+
+	for i, p := range panels {
+		p.GridPos = grafanaGridPos{
+			X: i % (dashboardGridWidth / dashboardPanelWidth) * dashboardPanelWidth,
+			Y: b.y + i/(dashboardGridWidth/dashboardPanelWidth)*dashboardPanelHeight,
+			W: dashboardPanelWidth,
+			H: dashboardPanelHeight,
+		}
+		b.add(p)
+	}
+	rows := (len(panels) + dashboardGridWidth/dashboardPanelWidth - 1) / (dashboardGridWidth / dashboardPanelWidth)
+	b.y += rows * dashboardPanelHeight
+}
+
+func (b *dashboardBuilder) add(p grafanaPanel) {
+	p.ID = b.nextID
+	b.nextID++
+	b.panels = append(b.panels, p)
+}
+
+func (b *dashboardBuilder) timeseries(title, unit, expr, legend string) grafanaPanel {
+	return grafanaPanel{
+		Type:       "timeseries",
+		Title:      title,
+		Datasource: dashboardDatasource,
+		Targets:    []grafanaTarget{{RefID: "A", Datasource: dashboardDatasource, Expr: expr, LegendFormat: legend}},
+		FieldConfig: &grafanaFieldConfig{
+			Defaults: grafanaFieldDefaults{
+				Unit: unit,
+				Thresholds: &grafanaThresholds{
+					Mode:  "absolute",
+					Steps: []grafanaThresholdStep{{Color: "green"}},
+				},
+				Custom: map[string]interface{}{},
+			},
+			Overrides: []interface{}{},
+		},
+	}
+}
+
+func (b *dashboardBuilder) heatmap(title, expr string) grafanaPanel {
+	return grafanaPanel{
+		Type:       "heatmap",
+		Title:      title,
+		Datasource: dashboardDatasource,
+		Targets:    []grafanaTarget{{RefID: "A", Datasource: dashboardDatasource, Expr: expr, LegendFormat: "{{le}}", Format: "heatmap"}},
+	}
+}
+
+// variables returns the datasource variable and, if devices are named, a
+// variable for the device label and each static label, offering the values
+// from the configuration.
+func (b *dashboardBuilder) variables(named bool) []grafanaVariable {
+	vars := []grafanaVariable{{
+		Name:  "datasource",
+		Label: "Data source",
+		Type:  "datasource",
+		Query: "prometheus",
+	}}
+	if !named {
+		return vars
+	}
+
+	vars = append(vars, customVariable("device", func(d DeviceConfig) string { return d.Name }, b.opts.Devices))
+	for _, name := range b.opts.labelNames() {
+		name := name
+		vars = append(vars, customVariable(name, func(d DeviceConfig) string { return d.Labels[name] }, b.opts.Devices))
+	}
+	return vars
+}
+
+// customVariable returns a multi-value custom variable offering the values
+// value returns for devices, with all of them selected.
+func customVariable(name string, value func(DeviceConfig) string, devices []DeviceConfig) grafanaVariable {
+	seen := map[string]bool{}
+	var values []string
+	for _, d := range devices {
+		if v := value(d); v != "" && !seen[v] {
+			seen[v] = true
+			values = append(values, v)
+		}
+	}
+	sort.Strings(values)
+
+	options := []grafanaOption{{Text: "All", Value: "$__all", Selected: true}}
+	for _, v := range values {
+		options = append(options, grafanaOption{Text: v, Value: v})
+	}
+	return grafanaVariable{
+		Name:       name,
+		Type:       "custom",
+		Query:      strings.Join(values, ","),
+		Multi:      true,
+		IncludeAll: true,
+		// Also match devices without the label.
+		AllValue: ".*",
+		Current:  &grafanaOption{Text: []string{"All"}, Value: []string{"$__all"}, Selected: true},
+		Options:  options,
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// debugBodyLimit is the maximum number of body bytes included in
+// /debug/scrape responses.
+const debugBodyLimit = 64 << 10
+
+// scrapeTrace records the raw exchange of a scrape for /debug/scrape.
+type scrapeTrace struct {
+	uri    string
+	status int
+	header http.Header
+	body   []byte
+}
+
+// scrapeDiagnostic is a device's entry in /debug/scrape responses.
+type scrapeDiagnostic struct {
+	Device string `json:"device"`
+	// URL is the scraped URL without credentials, as by fingerprintURI.
+	URL        string              `json:"url"`
+	Up         bool                `json:"up"`
+	Error      string              `json:"error,omitempty"`
+	StatusCode int                 `json:"status_code,omitempty"`
+	Headers    map[string][]string `json:"headers,omitempty"`
+	Timing     scrapeTimingSeconds `json:"timing"`
+	// Body is the raw response body with secrets redacted, cut off after
+	// debugBodyLimit bytes.
+	Body          string             `json:"body"`
+	BodyTruncated bool               `json:"body_truncated"`
+	Parse         parseOutcome       `json:"parse"`
+	Metrics       []metricDiagnostic `json:"metrics"`
+	Labels        map[string]string  `json:"labels,omitempty"`
+	Status        *Status            `json:"status,omitempty"`
+	Settings      *Settings          `json:"settings,omitempty"`
+	Current       *APIData           `json:"current,omitempty"`
+	Outdoor       *OutdoorData       `json:"outdoor,omitempty"`
+}
+
+// scrapeTimingSeconds is scrapeTiming in seconds. Phases that were not
+// reached are zero.
+type scrapeTimingSeconds struct {
+	Total           float64 `json:"total_seconds"`
+	TimeToFirstByte float64 `json:"time_to_first_byte_seconds"`
+	BodyRead        float64 `json:"body_read_seconds"`
+}
+
+type parseOutcome struct {
+	// Attempted is false if no body was received.
+	Attempted bool   `json:"attempted"`
+	OK        bool   `json:"ok"`
+	Error     string `json:"error,omitempty"`
+}
+
+// metricDiagnostic reports whether a device metric was exported after the
+// scrape and, if it was left out or may be misleading, why.
+type metricDiagnostic struct {
+	Name     string `json:"name"`
+	Produced bool   `json:"produced"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// DebugScrape scrapes the device like Collect does and returns what
+// happened in detail, for diagnosing missing metrics.
+func (e *Exporter) DebugScrape() scrapeDiagnostic {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.trace = &scrapeTrace{}
+	defer func() { e.trace = nil }()
+	e.update()
+
+	d := scrapeDiagnostic{
+		Device: e.name,
+		URL:    fingerprintURI(e.trace.uri),
+		Up:     e.up == 1,
+		Labels: e.labels,
+		Timing: scrapeTimingSeconds{
+			Total:           e.lastTiming.total.Seconds(),
+			TimeToFirstByte: e.lastTiming.timeToFirstByte.Seconds(),
+			BodyRead:        e.lastTiming.bodyRead.Seconds(),
+		},
+		StatusCode: e.trace.status,
+		Headers:    redactHeaders(e.trace.header),
+	}
+	if e.lastError != nil {
+		d.Error = redactURIs(e.lastError.Error(), e.uris)
+	}
+
+	body := redactBody(e.trace.body, e.trace.uri)
+	if len(body) > debugBodyLimit {
+		body, d.BodyTruncated = body[:debugBodyLimit], true
+	}
+	d.Body = string(body)
+
+	// Unless the request itself failed or was answered with an error
+	// status, the body was parsed. Files have no status.
+	d.Parse.Attempted = e.trace.header != nil && (e.trace.status == 0 || e.trace.status/100 == 2)
+	switch {
+	case e.lastResponse != nil:
+		d.Parse.OK = true
+		d.Status = &e.lastResponse.Status
+		d.Settings = &e.lastResponse.Settings
+		d.Current = &e.lastResponse.Current
+		d.Outdoor = e.lastResponse.Outdoor
+	case e.up == 1:
+		// An empty body, accepted with --iqair.empty-body-ok.
+		d.Parse.OK = true
+	case d.Parse.Attempted && e.lastError != nil:
+		d.Parse.Error = redactURIs(e.lastError.Error(), e.uris)
+	}
+	d.Metrics = e.diagnoseMetrics(missingCurrentFields(e.trace.body))
+	return d
+}
+
+// missingCurrentFields returns the keys of the readings absent from the
+// current block of body. Absent readings are exported as zero.
+func missingCurrentFields(body []byte) map[string]struct{} {
+	var raw struct {
+		Current map[string]json.RawMessage `json:"current"`
+	}
+	json.Unmarshal(body, &raw)
+	missing := map[string]struct{}{}
+	for _, key := range []string{"co", "p2", "p1", "tp", "hm"} {
+		if v, ok := raw.Current[key]; !ok || string(v) == "null" {
+			missing[key] = struct{}{}
+		}
+	}
+	return missing
+}
+
+// diagnoseMetrics lists the device metrics Collect exports after the last
+// scrape, and why the others are left out. missing holds the keys absent
+// from the response's current block. Must be called with e.mutex held.
+func (e *Exporter) diagnoseMetrics(missing map[string]struct{}) []metricDiagnostic {
+	name := func(n string) string { return prometheus.BuildFQName(namespace, "", n) }
+
+	var noReading string
+	switch {
+	case e.lastResponse != nil:
+	case e.up == 1:
+		noReading = "the device answered with an empty body"
+	default:
+		noReading = "the scrape failed"
+	}
+	readings := []struct{ name, key string }{
+		{name("co2"), "co"},
+		{name("p25"), "p2"},
+		{name("p10"), "p1"},
+		{name("temperature"), "tp"},
+		{name("humidity"), "hm"},
+	}
+	var metrics []metricDiagnostic
+	for _, r := range readings {
+		m := metricDiagnostic{Name: r.name, Produced: noReading == ""}
+		if !m.Produced {
+			m.Reason = noReading
+		} else if _, ok := missing[r.key]; ok {
+			m.Reason = "field " + r.key + " is missing from the response and exported as 0"
+		}
+		metrics = append(metrics, m)
+	}
+	unchanged := metricDiagnostic{Name: name("aqi_unchanged_scrapes"), Produced: noReading == ""}
+	if !unchanged.Produced {
+		unchanged.Reason = noReading
+	}
+	metrics = append(metrics, unchanged)
+
+	// The remaining metrics depend on optional parts of the response.
+	optional := func(n string, present bool, absent string) metricDiagnostic {
+		m := metricDiagnostic{Name: n, Produced: noReading == "" && present}
+		if noReading != "" {
+			m.Reason = noReading
+		} else if !present {
+			m.Reason = absent
+		}
+		return m
+	}
+	var current APIData
+	var parsed APIResponse
+	if e.lastResponse != nil {
+		parsed = *e.lastResponse
+		current = parsed.Current
+	}
+	_, hasDelta := parsed.temperatureDelta()
+	metrics = append(metrics, optional(name("temperature_indoor_outdoor_delta_celsius"), hasDelta, "the response has no outdoor block with a temperature in a known unit, or no indoor temperature"))
+
+	hasTimestamp := !current.Timestamp.IsZero()
+	metrics = append(metrics, optional(name("device_clock_skew_seconds"), hasTimestamp, "the device reports no measurement timestamp"))
+
+	tolerance := optional(name("reading_within_tolerance"), hasTimestamp && e.readingTolerance > 0, "the device reports no measurement timestamp")
+	if e.readingTolerance <= 0 {
+		tolerance.Produced, tolerance.Reason = false, "disabled, see --iqair.reading-tolerance"
+	} else if tolerance.Produced && e.nowFunc().Sub(current.Timestamp) > e.readingTolerance {
+		tolerance.Reason = "the reading is stale, lagging by more than " + model.Duration(e.readingTolerance).String()
+	}
+	metrics = append(metrics, tolerance)
+
+	metrics = append(metrics,
+		optional(name("firmware_update_available"), parsed.Status.UpdateAvailable != nil, "the status block has no update_available field"),
+		optional(name("device_co2_threshold_warning"), parsed.Settings.CO2Warning != nil, "the settings block has no co2_warning field"),
+		optional(name("device_co2_threshold_critical"), parsed.Settings.CO2Critical != nil, "the settings block has no co2_critical field"),
+	)
+	loc := parsed.Settings.Location
+	metrics = append(metrics, optional(name("location_info"), loc.City != "" || loc.Latitude != nil || loc.Longitude != nil, "the settings block has no location"))
+	return metrics
+}
+
+// redactedHeaders are response headers whose values are never shown.
+var redactedHeaders = []string{"Set-Cookie", "Authorization", "Proxy-Authorization", "WWW-Authenticate"}
+
+func redactHeaders(h http.Header) map[string][]string {
+	if h == nil {
+		return nil
+	}
+	h = h.Clone()
+	for _, name := range redactedHeaders {
+		if _, ok := h[name]; ok {
+			h[name] = []string{"<redacted>"}
+		}
+	}
+	return h
+}
+
+// secretFieldPattern matches JSON string members whose names suggest
+// secrets.
+var secretFieldPattern = regexp.MustCompile(`(?i)("[^"]*(?:password|passwd|secret|token|api_?key)[^"]*"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+
+// redactBody returns body with the values of secret-looking JSON members
+// and the password of uri, should the device echo it, replaced.
+func redactBody(body []byte, uri string) []byte {
+	body = secretFieldPattern.ReplaceAll(body, []byte(`$1"<redacted>"`))
+	if u, err := url.Parse(uri); err == nil {
+		if password, ok := u.User.Password(); ok && password != "" {
+			body = []byte(strings.ReplaceAll(string(body), password, "<redacted>"))
+		}
+	}
+	return body
+}
+
+// newDebugScrapeHandler returns the handler of /debug/scrape, scraping the
+// devices and reporting the raw exchange and the resulting metrics. Like
+// /-/scrape, a device query parameter, which may be repeated, restricts it
+// to the named devices.
+func newDebugScrapeHandler(exporters []*Exporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		selected, unknown := selectExporters(exporters, r.URL.Query()["device"])
+		if unknown != "" {
+			writeAPIError(w, http.StatusNotFound, "unknown device "+unknown)
+			return
+		}
+		results := []scrapeDiagnostic{}
+		for _, exporter := range selected {
+			results = append(results, exporter.DebugScrape())
+		}
+		writeJSON(w, http.StatusOK, map[string][]scrapeDiagnostic{"devices": results})
+	})
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDebugScrapeRedactsURI(t *testing.T) {
+	uri := unreachableURI(t)
+	d := newTestExporter(t, uri, ExporterOptions{}).DebugScrape()
+	if d.Error == "" {
+		t.Fatal("no error reported for an unreachable device")
+	}
+	if want := fingerprintURI(uri); d.URL != want {
+		t.Errorf("URL = %q, want %q", d.URL, want)
+	}
+	body, err := json.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRedacted(t, string(body))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	iqAirDewPoint  = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "dew_point_celsius"), "Dew point in Celsius, derived from the temperature and humidity readings.", nil, nil)
+	iqAirHeatIndex = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "heat_index_celsius"), "Heat index (apparent temperature) in Celsius, derived from the temperature and humidity readings.", nil, nil)
+)
+
+// derivedInputs are the readings the derived values are computed from.
+type derivedInputs struct {
+	temperature    float64
+	hasTemperature bool
+	humidity       int
+}
+
+// derivedValues caches the values derived from a reading, so that collects
+// returning the same reading do not compute them again.
+type derivedValues struct {
+	inputs              derivedInputs
+	dewPoint, heatIndex float64
+	// ok is false if the reading has no temperature or humidity to derive
+	// the values from.
+	ok bool
+}
+
+// derivedFor returns the values derived from data, computing them only if
+// its inputs differ from the cached ones. Must be called with e.mutex held.
+func (e *Exporter) derivedFor(data *APIData) derivedValues {
+	inputs := derivedInputs{temperature: data.Temperature, hasTemperature: data.hasTemperature, humidity: data.Humidity}
+	if e.derived != nil && e.derived.inputs == inputs {
+		return *e.derived
+	}
+	d := derivedValues{inputs: inputs, ok: data.hasTemperature && data.Humidity > 0 && data.Humidity <= 100}
+	if d.ok {
+		d.dewPoint = dewPoint(data.Temperature, float64(data.Humidity))
+		d.heatIndex = heatIndex(data.Temperature, float64(data.Humidity))
+	}
+	e.derived = &d
+	return d
+}
+
+// dewPoint returns the dew point in Celsius for a temperature in Celsius and
+// a relative humidity in percent, using the Magnus formula.
+func dewPoint(celsius, humidity float64) float64 {
+	const b, c = 17.62, 243.12
+	gamma := math.Log(humidity/100) + b*celsius/(c+celsius)
+	return c * gamma / (b - gamma)
+}
+
+// heatIndex returns the heat index in Celsius for a temperature in Celsius
+// and a relative humidity in percent, as computed by the US National Weather
+// Service.
+func heatIndex(celsius, humidity float64) float64 {
+	t := celsius*9/5 + 32
+	hi := 0.5 * (t + 61 + (t-68)*1.2 + humidity*0.094)
+	if (hi+t)/2 >= 80 {
+		hi = -42.379 + 2.04901523*t + 10.14333127*humidity - 0.22475541*t*humidity -
+			6.83783e-3*t*t - 5.481717e-2*humidity*humidity + 1.22874e-3*t*t*humidity +
+			8.5282e-4*t*humidity*humidity - 1.99e-6*t*t*humidity*humidity
+		switch {
+		case humidity < 13 && t >= 80 && t <= 112:
+			hi -= (13 - humidity) / 4 * math.Sqrt((17-math.Abs(t-95))/17)
+		case humidity > 85 && t >= 80 && t <= 87:
+			hi += (humidity - 85) / 10 * (87 - t) / 5
+		}
+	}
+	return (hi - 32) * 5 / 9
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestDerivedValuesUpdateWithReading(t *testing.T) {
+	uri := writeResponse(t, `{"current":{"co":500,"p2":3,"p1":4,"tp":20,"hm":50}}`)
+	e := newTestExporter(t, uri, ExporterOptions{})
+
+	first, ok := metricValue(gather(t, e), "iqair_dew_point_celsius")
+	if !ok || math.Abs(first-9.26) > 0.05 {
+		t.Fatalf("dew point = %v, %v, want 9.26", first, ok)
+	}
+	cached := e.derived
+	gather(t, e)
+	if e.derived != cached {
+		t.Error("derived values were recomputed for an unchanged reading")
+	}
+
+	rewriteResponse(t, uri, `{"current":{"co":500,"p2":3,"p1":4,"tp":30,"hm":50}}`)
+	families := gather(t, e)
+	if got, _ := metricValue(families, "iqair_dew_point_celsius"); math.Abs(got-18.44) > 0.05 {
+		t.Errorf("dew point after the reading changed = %v, want 18.44", got)
+	}
+	if got, _ := metricValue(families, "iqair_heat_index_celsius"); math.Abs(got-31.1) > 0.5 {
+		t.Errorf("heat index after the reading changed = %v, want 31.1", got)
+	}
+}
+
+func TestDerivedValuesFollowTemperaturePresence(t *testing.T) {
+	// Without tp, the temperature reads as 0, as with a reported 0.
+	withTemperature := `{"current":{"co":500,"p2":3,"p1":4,"tp":0,"hm":50}}`
+	withoutTemperature := `{"current":{"co":500,"p2":3,"p1":4,"hm":50}}`
+	uri := writeResponse(t, withTemperature)
+	e := newTestExporter(t, uri, ExporterOptions{})
+	for _, tc := range []struct {
+		body   string
+		exists bool
+	}{
+		{withTemperature, true},
+		{withoutTemperature, false},
+		{withTemperature, true},
+	} {
+		rewriteResponse(t, uri, tc.body)
+		if _, got := metricValue(gather(t, e), "iqair_dew_point_celsius"); got != tc.exists {
+			t.Errorf("%s: dew point exported = %v, want %v", tc.body, got, tc.exists)
+		}
+	}
+}
+
+func TestDerivedValuesNeedTemperatureAndHumidity(t *testing.T) {
+	e := newTestExporter(t, writeResponse(t, `{"current":{"co":500,"p2":3,"p1":4,"hm":50}}`), ExporterOptions{})
+	families := gather(t, e)
+	for _, name := range []string{"iqair_dew_point_celsius", "iqair_heat_index_celsius"} {
+		if _, ok := families[name]; ok {
+			t.Errorf("%s exported without a temperature reading", name)
+		}
+	}
+}
+
+func TestHeatIndex(t *testing.T) {
+	for _, tc := range []struct {
+		celsius, humidity, want float64
+	}{
+		{20, 50, 19.4},
+		// 90 °F at 70% is 106 °F in the NWS heat index chart.
+		{32.22, 70, 41.1},
+		// 86 °F at 50% is 88 °F.
+		{30, 50, 31.1},
+	} {
+		if got := heatIndex(tc.celsius, tc.humidity); math.Abs(got-tc.want) > 0.6 {
+			t.Errorf("heatIndex(%v, %v) = %v, want %v", tc.celsius, tc.humidity, got, tc.want)
+		}
+	}
+}
+
+func BenchmarkCollect(b *testing.B) {
+	e := newTestExporter(b, writeResponse(b, `{"current":{"co":500,"p2":3,"p1":4,"tp":21.5,"hm":40}}`), ExporterOptions{PollInterval: 1})
+	e.update()
+	ch := make(chan prometheus.Metric, 100)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e.Collect(ch)
+		for len(ch) > 0 {
+			<-ch
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// mdnsAddress is the IPv4 mDNS group.
+const mdnsAddress = "224.0.0.251:5353"
+
+// maxScanAddresses limits the addresses a discovery scan probes, so that a
+// mistyped prefix length does not probe a whole /8.
+const maxScanAddresses = 1 << 12
+
+// maxConcurrentProbes limits the devices probed at once.
+const maxConcurrentProbes = 32
+
+// defaultDiscoveryPaths are the paths probed on each address unless
+// --iqair.candidate-path is given.
+var defaultDiscoveryPaths = []string{"/api/v1/status", "/measurements", "/"}
+
+// DiscoveryOptions configure discoverDevices.
+type DiscoveryOptions struct {
+	// MDNSService is the service browsed for, e.g. _http._tcp. mDNS is not
+	// used if it is empty.
+	MDNSService string
+	// Networks are scanned address by address.
+	Networks []*net.IPNet
+	// Timeout bounds the mDNS browse and each probe.
+	Timeout time.Duration
+	// Exporter are the options the addresses are probed with. Their
+	// candidate paths default to defaultDiscoveryPaths.
+	Exporter ExporterOptions
+}
+
+// DiscoveredDevice is a device found by discoverDevices.
+type DiscoveredDevice struct {
+	Address string `json:"address"`
+	// Source is how the address was found, mdns or scan.
+	Source string `json:"source"`
+	// URL is the URL the device answered on, usable as its uri.
+	URL             string `json:"url"`
+	Model           string `json:"model,omitempty"`
+	Serial          string `json:"serial,omitempty"`
+	UpdateAvailable *bool  `json:"update_available,omitempty"`
+}
+
+// discoverDevices finds devices by browsing mDNS and scanning networks, and
+// probes each address found like the exporter scrapes devices, returning
+// those whose response parses, sorted by address.
+func discoverDevices(ctx context.Context, opts DiscoveryOptions) ([]DiscoveredDevice, error) {
+	sources := map[string]string{}
+	var addrs []string
+	add := func(addr, source string) {
+		if _, ok := sources[addr]; !ok {
+			sources[addr] = source
+			addrs = append(addrs, addr)
+		}
+	}
+	if opts.MDNSService != "" {
+		ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+		found, err := browseMDNS(ctx, opts.MDNSService)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("browsing mDNS: %v", err)
+		}
+		for _, addr := range found {
+			add(addr, "mdns")
+		}
+	}
+	hosts, err := scanAddresses(opts.Networks)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range hosts {
+		add(addr, "scan")
+	}
+
+	exporterOpts := opts.Exporter
+	exporterOpts.Timeout = opts.Timeout
+	if len(exporterOpts.CandidatePaths) == 0 {
+		exporterOpts.CandidatePaths = defaultDiscoveryPaths
+	}
+	var (
+		mutex   sync.Mutex
+		devices []DiscoveredDevice
+		wg      sync.WaitGroup
+	)
+	probes := make(chan struct{}, maxConcurrentProbes)
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			select {
+			case probes <- struct{}{}:
+				defer func() { <-probes }()
+			case <-ctx.Done():
+				return
+			}
+			if d, ok := probeDevice(addr, exporterOpts); ok {
+				d.Source = sources[addr]
+				mutex.Lock()
+				devices = append(devices, d)
+				mutex.Unlock()
+			}
+		}(addr)
+	}
+	wg.Wait()
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Address < devices[j].Address })
+	return devices, ctx.Err()
+}
+
+// probeDevice scrapes addr, a host with an optional port, on the candidate
+// paths of opts. It reports false unless one of them returned a device
+// response.
+func probeDevice(addr string, opts ExporterOptions) (DiscoveredDevice, bool) {
+	exporter, err := NewExporter(DeviceConfig{URI: "http://" + addr + "/"}, opts, log.NewNopLogger())
+	if err != nil {
+		return DiscoveredDevice{}, false
+	}
+	defer exporter.client.CloseIdleConnections()
+	diag := exporter.DebugScrape()
+	if !diag.Up || diag.Current == nil {
+		return DiscoveredDevice{}, false
+	}
+	d := DiscoveredDevice{Address: addr, URL: diag.URL}
+	if diag.Status != nil {
+		d.Model, d.Serial, d.UpdateAvailable = diag.Status.Model, diag.Status.SerialNumber, diag.Status.UpdateAvailable
+	}
+	return d, true
+}
+
+// scanAddresses returns the host addresses of networks, leaving out the
+// network and broadcast addresses of IPv4 networks.
+func scanAddresses(networks []*net.IPNet) ([]string, error) {
+	var addrs []string
+	for _, n := range networks {
+		ones, bits := n.Mask.Size()
+		if 1<<uint(bits-ones) > maxScanAddresses {
+			return nil, fmt.Errorf("%s has more than %d addresses to scan", n, maxScanAddresses)
+		}
+		var hosts []string
+		for ip := n.IP.Mask(n.Mask); n.Contains(ip); ip = nextIP(ip) {
+			hosts = append(hosts, ip.String())
+		}
+		// Below a /31, IPv4 networks have network and broadcast addresses.
+		if bits == 8*net.IPv4len && len(hosts) >= 4 {
+			hosts = hosts[1 : len(hosts)-1]
+		}
+		addrs = append(addrs, hosts...)
+		if len(addrs) > maxScanAddresses {
+			return nil, fmt.Errorf("more than %d addresses to scan", maxScanAddresses)
+		}
+	}
+	return addrs, nil
+}
+
+// nextIP returns the address following ip.
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// browseMDNS queries the local network for instances of service, e.g.
+// _http._tcp, and returns the addresses, as host:port or just the host if
+// the port is unknown, of those answering until ctx is done.
+func browseMDNS(ctx context.Context, service string) ([]string, error) {
+	name, err := dnsmessage.NewName(service + ".local.")
+	if err != nil {
+		return nil, err
+	}
+	query := dnsmessage.Message{Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}}}
+	packet, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	group, err := net.ResolveUDPAddr("udp4", mdnsAddress)
+	if err != nil {
+		return nil, err
+	}
+	// Queries from a port other than 5353 get unicast answers, so there is
+	// no need to join the group.
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := conn.WriteToUDP(packet, group); err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+	}
+	go func() {
+		<-ctx.Done()
+		conn.SetReadDeadline(time.Now())
+	}()
+
+	seen := map[string]bool{}
+	var addrs []string
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return addrs, nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return addrs, nil
+			}
+			return addrs, err
+		}
+		for _, addr := range mdnsInstanceAddrs(buf[:n], src.IP) {
+			if !seen[addr] {
+				seen[addr] = true
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+}
+
+// mdnsInstanceAddrs returns the addresses of the service instances in an
+// mDNS response sent from src. Instances whose host has no A record in the
+// response are assumed to run on src.
+func mdnsInstanceAddrs(packet []byte, src net.IP) []string {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(packet); err != nil || !msg.Header.Response {
+		return nil
+	}
+	hosts := map[string][]net.IP{}
+	var services []dnsmessage.SRVResource
+	for _, rr := range append(msg.Answers, msg.Additionals...) {
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			name := rr.Header.Name.String()
+			hosts[name] = append(hosts[name], net.IP(body.A[:]))
+		case *dnsmessage.SRVResource:
+			services = append(services, *body)
+		}
+	}
+	var addrs []string
+	for _, srv := range services {
+		ips := hosts[srv.Target.String()]
+		if len(ips) == 0 {
+			ips = []net.IP{src}
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), strconv.Itoa(int(srv.Port))))
+		}
+	}
+	// A responder that only answered the PTR query still is a candidate.
+	if len(addrs) == 0 && len(msg.Answers) > 0 {
+		addrs = append(addrs, src.String())
+	}
+	return addrs
+}
+
+// printDiscoveredDevices writes devices to w as a table or as JSON.
+func printDiscoveredDevices(w io.Writer, devices []DiscoveredDevice, format string) {
+	if format == checkOutputJSON {
+		if devices == nil {
+			devices = []DiscoveredDevice{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(map[string][]DiscoveredDevice{"devices": devices})
+		return
+	}
+	if len(devices) == 0 {
+		fmt.Fprintln(w, "No devices found.")
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ADDRESS\tSOURCE\tMODEL\tSERIAL\tFIRMWARE UPDATE\tURI")
+	for _, d := range devices {
+		update := "-"
+		if d.UpdateAvailable != nil {
+			update = map[bool]string{true: "available", false: "none"}[*d.UpdateAvailable]
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", d.Address, d.Source, orDash(d.Model), orDash(d.Serial), update, d.URL)
+	}
+	tw.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// runDiscover runs the discover command and returns its exit code.
+func runDiscover(w io.Writer, cidrs string, mdns bool, service string, timeout time.Duration, paths []string, format string) int {
+	networks, err := parseCIDRs(cidrs)
+	if err == nil {
+		err = validateCandidatePaths(paths)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid flags: %v\n", err)
+		return 1
+	}
+	opts := DiscoveryOptions{Networks: networks, Timeout: timeout, Exporter: ExporterOptions{CandidatePaths: paths}}
+	if mdns {
+		opts.MDNSService = service
+	}
+	devices, err := discoverDevices(context.Background(), opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error discovering devices: %v\n", err)
+		return 1
+	}
+	printDiscoveredDevices(w, devices, format)
+	return 0
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// envarPrefix starts the names of the environment variables flags can be
+// set with, e.g. IQAIR_EXPORTER_IQAIR_SCRAPE_URI for --iqair.scrape-uri.
+const envarPrefix = "IQAIR_EXPORTER_"
+
+// fileEnvarSuffix ends the name of the environment variable naming a file
+// to read a secret flag from, e.g. IQAIR_EXPORTER_PUSH_BEARER_TOKEN_FILE.
+const fileEnvarSuffix = "_FILE"
+
+// envarHelp tells in --help how flags and environment variables combine.
+const envarHelp = "Every flag can also be set with the environment variable shown next to it. A flag given on the command line takes precedence over its environment variable, which takes precedence over the default. Flags holding secrets can also be read from the file named by their environment variable plus " + fileEnvarSuffix + ", used only if neither the flag nor the variable is set."
+
+// flagEnvar returns the environment variable for the flag name, of the
+// command cmd unless it is empty.
+func flagEnvar(cmd, name string) string {
+	if cmd != "" {
+		name = cmd + "_" + name
+	}
+	return envarPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(name))
+}
+
+// setFlagEnvars declares the environment variable of every flag of app and
+// its commands, except for hidden flags and those showing help or the
+// version.
+func setFlagEnvars(app *kingpin.Application) {
+	for _, f := range app.Model().Flags {
+		if !f.Hidden && f.Name != "help" && f.Name != "version" {
+			app.GetFlag(f.Name).Envar(flagEnvar("", f.Name))
+		}
+	}
+	for _, c := range app.Model().Commands {
+		cmd := app.GetCommand(c.Name)
+		for _, f := range c.Flags {
+			if !f.Hidden {
+				cmd.GetFlag(f.Name).Envar(flagEnvar(c.Name, f.Name))
+			}
+		}
+	}
+}
+
+// resolveSecretFlags sets each of the secret flags, by name, that is still
+// empty after parsing from the file named by its environment variable plus
+// fileEnvarSuffix, if that is set.
+func resolveSecretFlags(flags map[string]*string) error {
+	for name, value := range flags {
+		envar := flagEnvar("", name) + fileEnvarSuffix
+		path := os.Getenv(envar)
+		if path == "" || *value != "" {
+			continue
+		}
+		secret, err := readSecretFile(path)
+		if err != nil {
+			return fmt.Errorf("reading %s: %v", envar, err)
+		}
+		*value = secret
+	}
+	return nil
+}
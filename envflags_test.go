@@ -0,0 +1,140 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// setenv sets the environment variable name for the duration of the test.
+func setenv(t *testing.T, name, value string) {
+	t.Helper()
+	old, ok := os.LookupEnv(name)
+	if err := os.Setenv(name, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(name, old)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
+
+func TestFlagEnvar(t *testing.T) {
+	for _, tc := range []struct {
+		cmd, name, want string
+	}{
+		{"", "iqair.scrape-uri", "IQAIR_EXPORTER_IQAIR_SCRAPE_URI"},
+		{"", "web.listen-address", "IQAIR_EXPORTER_WEB_LISTEN_ADDRESS"},
+		{"mock-device", "failure-rate", "IQAIR_EXPORTER_MOCK_DEVICE_FAILURE_RATE"},
+	} {
+		if got := flagEnvar(tc.cmd, tc.name); got != tc.want {
+			t.Errorf("flagEnvar(%q, %q) = %q, want %q", tc.cmd, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestFlagPrecedence(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{"default", nil, nil, ":9965"},
+		{"environment over default", map[string]string{"IQAIR_EXPORTER_WEB_LISTEN_ADDRESS": ":1111"}, nil, ":1111"},
+		{"flag over environment", map[string]string{"IQAIR_EXPORTER_WEB_LISTEN_ADDRESS": ":1111"}, []string{"--web.listen-address=:2222"}, ":2222"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for name, value := range tc.env {
+				setenv(t, name, value)
+			}
+			app := kingpin.New("test", "")
+			listen := app.Flag("web.listen-address", "").Default(":9965").String()
+			setFlagEnvars(app)
+			if _, err := app.Parse(tc.args); err != nil {
+				t.Fatal(err)
+			}
+			if *listen != tc.want {
+				t.Errorf("--web.listen-address = %q, want %q", *listen, tc.want)
+			}
+		})
+	}
+}
+
+func TestFlagEnvarsOfCommandsAndHiddenFlags(t *testing.T) {
+	setenv(t, "IQAIR_EXPORTER_MOCK_DEVICE_LISTEN", ":3333")
+	setenv(t, "IQAIR_EXPORTER_DEBUG_INTERNAL", "set")
+	app := kingpin.New("test", "")
+	internal := app.Flag("debug.internal", "").Hidden().String()
+	mock := app.Command("mock-device", "")
+	listen := mock.Flag("listen", "").Default(":9966").String()
+	setFlagEnvars(app)
+	if _, err := app.Parse([]string{"mock-device"}); err != nil {
+		t.Fatal(err)
+	}
+	if *listen != ":3333" {
+		t.Errorf("mock-device --listen = %q, want %q from IQAIR_EXPORTER_MOCK_DEVICE_LISTEN", *listen, ":3333")
+	}
+	if *internal != "" {
+		t.Errorf("hidden flag was set from the environment to %q", *internal)
+	}
+}
+
+func TestResolveSecretFlags(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(secretFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	emptyFile := filepath.Join(dir, "empty")
+	if err := os.WriteFile(emptyFile, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	const envar = "IQAIR_EXPORTER_PUSH_BEARER_TOKEN"
+
+	for _, tc := range []struct {
+		name string
+		env  map[string]string
+		args []string
+		want string
+		err  string
+	}{
+		{name: "unset", want: ""},
+		{name: "file", env: map[string]string{envar + "_FILE": secretFile}, want: "from-file"},
+		{name: "environment over file", env: map[string]string{envar: "from-env", envar + "_FILE": secretFile}, want: "from-env"},
+		{name: "flag over file", env: map[string]string{envar + "_FILE": secretFile}, args: []string{"--push.bearer-token=from-flag"}, want: "from-flag"},
+		{name: "missing file", env: map[string]string{envar + "_FILE": filepath.Join(dir, "missing")}, err: envar + "_FILE"},
+		{name: "empty file", env: map[string]string{envar + "_FILE": emptyFile}, err: "is empty"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for name, value := range tc.env {
+				setenv(t, name, value)
+			}
+			app := kingpin.New("test", "")
+			token := app.Flag("push.bearer-token", "").String()
+			setFlagEnvars(app)
+			if _, err := app.Parse(tc.args); err != nil {
+				t.Fatal(err)
+			}
+			err := resolveSecretFlags(map[string]*string{"push.bearer-token": token})
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("resolveSecretFlags() = %v, want an error mentioning %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *token != tc.want {
+				t.Errorf("--push.bearer-token = %q, want %q", *token, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// exitConsecutiveFailures is the exit code when FailureWatch trips, telling
+// a restart by the supervisor apart from other failures.
+const exitConsecutiveFailures = 3
+
+// FailureWatch trips once every device has failed a number of consecutive
+// scrapes, so that the exporter can exit and be restarted by its supervisor,
+// which is often what unwedges a device interaction on a remote site. It is
+// a ScrapeResultListener.
+type FailureWatch struct {
+	threshold int
+
+	mutex sync.Mutex
+	// failures are the consecutive failed scrapes per device.
+	failures map[string]int
+	tripped  chan struct{}
+}
+
+// NewFailureWatch returns a FailureWatch for the named devices that trips
+// once each of them has failed threshold consecutive scrapes.
+func NewFailureWatch(devices []string, threshold int) *FailureWatch {
+	w := &FailureWatch{
+		threshold: threshold,
+		failures:  make(map[string]int, len(devices)),
+		tripped:   make(chan struct{}),
+	}
+	for _, device := range devices {
+		w.failures[device] = 0
+	}
+	return w
+}
+
+// OnReading implements ReadingListener.
+func (w *FailureWatch) OnReading(Reading) {}
+
+// OnScrapeResult counts a failed scrape of device, or resets its count on a
+// successful one. It implements ScrapeResultListener.
+func (w *FailureWatch) OnScrapeResult(device string, up bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if _, ok := w.failures[device]; !ok {
+		return
+	}
+	if up {
+		w.failures[device] = 0
+		return
+	}
+	w.failures[device]++
+	for _, n := range w.failures {
+		if n < w.threshold {
+			return
+		}
+	}
+	select {
+	case <-w.tripped:
+	default:
+		close(w.tripped)
+	}
+}
+
+// Tripped returns a channel that is closed once every device has failed
+// the threshold number of consecutive scrapes.
+func (w *FailureWatch) Tripped() <-chan struct{} {
+	return w.tripped
+}
+
+// Summary lists the consecutive failed scrapes per device, e.g. for logging
+// why the watch tripped.
+func (w *FailureWatch) Summary() string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	summary := make([]string, 0, len(w.failures))
+	for device, n := range w.failures {
+		summary = append(summary, fmt.Sprintf("%s=%d", Reading{Device: device}.DeviceName(), n))
+	}
+	sort.Strings(summary)
+	return strings.Join(summary, ", ")
+}
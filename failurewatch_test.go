@@ -0,0 +1,64 @@
+package main
+
+import "testing"
+
+// watchedScrape is a scrape outcome fed to a FailureWatch.
+type watchedScrape struct {
+	device string
+	up     bool
+}
+
+func TestFailureWatch(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		scrapes []watchedScrape
+		tripped bool
+	}{
+		{
+			name:    "one device failing",
+			scrapes: []watchedScrape{{"a", false}, {"a", false}, {"a", false}, {"b", true}},
+			tripped: false,
+		},
+		{
+			name:    "all devices failing",
+			scrapes: []watchedScrape{{"a", false}, {"b", false}, {"a", false}, {"b", false}, {"a", false}, {"b", false}},
+			tripped: true,
+		},
+		{
+			name:    "success resets the count",
+			scrapes: []watchedScrape{{"a", false}, {"a", false}, {"b", false}, {"b", false}, {"b", false}, {"a", true}, {"a", false}, {"a", false}},
+			tripped: false,
+		},
+		{
+			name:    "unknown devices are ignored",
+			scrapes: []watchedScrape{{"a", false}, {"a", false}, {"a", false}, {"c", false}, {"c", false}, {"c", false}},
+			tripped: false,
+		},
+	} {
+		w := NewFailureWatch([]string{"a", "b"}, 3)
+		for _, s := range tc.scrapes {
+			w.OnScrapeResult(s.device, s.up)
+		}
+		select {
+		case <-w.Tripped():
+			if !tc.tripped {
+				t.Errorf("%s: tripped, summary %s", tc.name, w.Summary())
+			}
+		default:
+			if tc.tripped {
+				t.Errorf("%s: not tripped, summary %s", tc.name, w.Summary())
+			}
+		}
+	}
+}
+
+func TestFailureWatchTripsOnce(t *testing.T) {
+	w := NewFailureWatch([]string{""}, 1)
+	w.OnScrapeResult("", false)
+	// Further failures must not close the channel again.
+	w.OnScrapeResult("", false)
+	<-w.Tripped()
+	if got, want := w.Summary(), "default=2"; got != want {
+		t.Errorf("Summary() = %q, want %q", got, want)
+	}
+}
@@ -3,9 +3,18 @@ module github.com/packetslave/iqair_exporter
 go 1.16
 
 require (
+	github.com/eclipse/paho.mqtt.golang v1.3.5
 	github.com/go-kit/kit v0.11.0
+	github.com/golang/snappy v0.0.4
+	github.com/gorilla/websocket v1.4.2
+	github.com/mattn/go-sqlite3 v1.14.16
 	github.com/prometheus/client_golang v1.11.0
+	github.com/prometheus/client_model v0.2.0
 	github.com/prometheus/common v0.30.0
 	github.com/prometheus/exporter-toolkit v0.6.1
+	golang.org/x/net v0.0.0-20210525063256-abc453219eb5
+	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1
+	google.golang.org/protobuf v1.27.1
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
+	gopkg.in/yaml.v2 v2.4.0
 )
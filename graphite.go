@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// GraphiteConfig configures sending readings to Graphite.
+type GraphiteConfig struct {
+	// Address is the host:port of a Carbon plaintext listener.
+	Address string
+	// Prefix is prepended to every metric path.
+	Prefix  string
+	Timeout time.Duration
+	// MaxBuffer bounds the number of lines held while Carbon is unreachable.
+	// The oldest lines are dropped when the buffer is full.
+	MaxBuffer int
+}
+
+// GraphiteWriter sends new readings to Graphite using the plaintext
+// protocol, one "<prefix>.<device>.<metric> <value> <timestamp>" line per
+// value.
+type GraphiteWriter struct {
+	config GraphiteConfig
+	logger log.Logger
+
+	mutex  sync.Mutex
+	buffer []string
+	wakeup chan struct{}
+
+	sentLines, droppedLines prometheus.Counter
+}
+
+// NewGraphiteWriter returns a GraphiteWriter. Call Run to start sending.
+func NewGraphiteWriter(config GraphiteConfig, logger log.Logger) *GraphiteWriter {
+	return &GraphiteWriter{
+		config: config,
+		logger: logger,
+		wakeup: make(chan struct{}, 1),
+		sentLines: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_graphite_sent_lines_total",
+			Help:      "Number of lines sent to Graphite.",
+		}),
+		droppedLines: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_graphite_dropped_lines_total",
+			Help:      "Number of lines dropped because the buffer was full.",
+		}),
+	}
+}
+
+// OnReading buffers r for sending. It implements ReadingListener.
+func (w *GraphiteWriter) OnReading(r Reading) {
+	lines := formatGraphiteLines(w.config.Prefix, r)
+
+	w.mutex.Lock()
+	w.buffer = append(w.buffer, lines...)
+	if over := len(w.buffer) - w.config.MaxBuffer; over > 0 {
+		w.buffer = w.buffer[over:]
+		w.droppedLines.Add(float64(over))
+	}
+	w.mutex.Unlock()
+
+	select {
+	case w.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// Run sends buffered lines until ctx is cancelled, reconnecting with
+// exponential backoff whenever the connection fails. Lines still buffered
+// are sent before it returns, for at most the timeout.
+func (w *GraphiteWriter) Run(ctx context.Context) {
+	var conn net.Conn
+	defer func() {
+		w.drain(conn)
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	dialer := &net.Dialer{Timeout: w.config.Timeout}
+	backoff := time.Second
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.wakeup:
+		}
+
+		for w.pending() {
+			if conn == nil {
+				var err error
+				conn, err = dialer.DialContext(ctx, "tcp", w.config.Address)
+				if err != nil {
+					level.Warn(w.logger).Log("msg", "Error connecting to Graphite", "backoff", backoff, "err", err)
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(backoff):
+					}
+					if backoff *= 2; backoff > time.Minute {
+						backoff = time.Minute
+					}
+					continue
+				}
+				backoff = time.Second
+			}
+			if err := w.flush(conn); err != nil {
+				level.Warn(w.logger).Log("msg", "Error sending to Graphite", "err", err)
+				conn.Close()
+				conn = nil
+			}
+		}
+	}
+}
+
+// drain makes a last attempt to send the buffered lines once Run stops,
+// over conn if it is not nil. ctx is done by then, so a new connection is
+// dialed with just the timeout.
+func (w *GraphiteWriter) drain(conn net.Conn) {
+	if !w.pending() {
+		return
+	}
+	if conn == nil {
+		var err error
+		conn, err = net.DialTimeout("tcp", w.config.Address, w.config.Timeout)
+		if err != nil {
+			level.Warn(w.logger).Log("msg", "Dropping lines that could not be sent to Graphite", "err", err)
+			return
+		}
+		defer conn.Close()
+	}
+	if err := w.flush(conn); err != nil {
+		level.Warn(w.logger).Log("msg", "Dropping lines that could not be sent to Graphite", "err", err)
+	}
+}
+
+func (w *GraphiteWriter) pending() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return len(w.buffer) > 0
+}
+
+// flush writes the buffered lines to conn. Lines are only removed from the
+// buffer once they were written, so they are resent after a reconnect.
+func (w *GraphiteWriter) flush(conn net.Conn) error {
+	w.mutex.Lock()
+	lines := w.buffer
+	w.mutex.Unlock()
+
+	payload := strings.Join(lines, "\n") + "\n"
+	conn.SetWriteDeadline(time.Now().Add(w.config.Timeout))
+	if _, err := conn.Write([]byte(payload)); err != nil {
+		return err
+	}
+
+	w.mutex.Lock()
+	// Lines may have been dropped from the front, or appended, meanwhile.
+	sent := len(lines)
+	if sent > len(w.buffer) {
+		sent = len(w.buffer)
+	}
+	w.buffer = w.buffer[sent:]
+	w.mutex.Unlock()
+	w.sentLines.Add(float64(len(lines)))
+	return nil
+}
+
+// Describe implements prometheus.Collector.
+func (w *GraphiteWriter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- w.sentLines.Desc()
+	ch <- w.droppedLines.Desc()
+}
+
+// Collect implements prometheus.Collector.
+func (w *GraphiteWriter) Collect(ch chan<- prometheus.Metric) {
+	ch <- w.sentLines
+	ch <- w.droppedLines
+}
+
+// formatGraphiteLines formats r as plaintext protocol lines, using the
+// device's measurement timestamp.
+func formatGraphiteLines(prefix string, r Reading) []string {
+	path := graphitePathSegment(r.DeviceName())
+	if prefix = strings.Trim(prefix, "."); prefix != "" {
+		path = prefix + "." + path
+	}
+	ts := strconv.FormatInt(r.Timestamp.Unix(), 10)
+
+	fields := r.Fields()
+	lines := make([]string, 0, len(fields))
+	for _, f := range fields {
+		lines = append(lines, path+"."+graphitePathSegment(f.Name)+" "+strconv.FormatFloat(f.Value, 'f', -1, 64)+" "+ts)
+	}
+	return lines
+}
+
+// graphitePathSegment makes s safe to use as one node of a Graphite metric
+// path. Dots would add hierarchy levels and whitespace would end the path,
+// so anything but letters, digits, '-' and '_' is replaced with '_'.
+func graphitePathSegment(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, s)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// fakeCarbon returns the address of a fake Carbon plaintext listener and
+// the channel the lines it receives are sent to.
+func fakeCarbon(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	lines := make(chan string, 100)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				s := bufio.NewScanner(conn)
+				for s.Scan() {
+					lines <- s.Text()
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), lines
+}
+
+// receiveLines returns the next n lines from lines, failing t if they do
+// not arrive in time.
+func receiveLines(t *testing.T, lines <-chan string, n int) []string {
+	t.Helper()
+	var got []string
+	for len(got) < n {
+		select {
+		case line := <-lines:
+			got = append(got, line)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %q, want %d lines", got, n)
+		}
+	}
+	return got
+}
+
+var wantGraphiteLines = []string{
+	"home.living_room.pm25 3 1600000000",
+	"home.living_room.pm10 4 1600000000",
+	"home.living_room.co2 612 1600000000",
+	"home.living_room.temperature 21.5 1600000000",
+	"home.living_room.humidity 40 1600000000",
+}
+
+func checkLines(t *testing.T, got, want []string) {
+	t.Helper()
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("line %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestGraphiteWriter(t *testing.T) {
+	addr, lines := fakeCarbon(t)
+	w := NewGraphiteWriter(GraphiteConfig{Address: addr, Prefix: "home.", Timeout: time.Second, MaxBuffer: 100}, log.NewNopLogger())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+
+	w.OnReading(testReading("living.room", time.Unix(1600000000, 0)))
+	checkLines(t, receiveLines(t, lines, len(wantGraphiteLines)), wantGraphiteLines)
+}
+
+func TestGraphiteWriterFlushesOnShutdown(t *testing.T) {
+	addr, lines := fakeCarbon(t)
+	w := NewGraphiteWriter(GraphiteConfig{Address: addr, Prefix: "home", Timeout: time.Second, MaxBuffer: 100}, log.NewNopLogger())
+	w.OnReading(testReading("living.room", time.Unix(1600000000, 0)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w.Run(ctx)
+
+	checkLines(t, receiveLines(t, lines, len(wantGraphiteLines)), wantGraphiteLines)
+	if w.pending() {
+		t.Error("lines still buffered after Run returned")
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"math"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var iqAirGroupDevicesReporting = prometheus.NewDesc(prometheus.BuildFQName(namespace, "group", "devices_reporting"), "Number of devices in the group whose latest scrape returned a reading, i.e. that the group aggregates are computed from.", []string{"group"}, nil)
+
+// groupAggregates are the readings aggregated per group, by the name of
+// their metric.
+var groupAggregates = []struct {
+	name, help string
+	value      func(d APIData, humidityFraction bool) float64
+}{
+	{"co2", "CO2 reading", func(d APIData, _ bool) float64 { return float64(d.CO2) }},
+	{"p25", "p2.5 particulate reading", func(d APIData, _ bool) float64 { return float64(d.P25) }},
+	{"p10", "p10 particulate reading", func(d APIData, _ bool) float64 { return float64(d.P10) }},
+	{"temperature", "Temperature reading in Celsius", func(d APIData, _ bool) float64 { return d.Temperature }},
+	{"humidity", "Humidity reading", func(d APIData, fraction bool) float64 {
+		if fraction {
+			return float64(d.Humidity) / 100
+		}
+		return float64(d.Humidity)
+	}},
+}
+
+// groupAggregateDesc holds the descriptors of a reading's aggregates.
+type groupAggregateDesc struct {
+	avg, min, max *prometheus.Desc
+}
+
+var groupAggregateDescs = func() []groupAggregateDesc {
+	descs := make([]groupAggregateDesc, len(groupAggregates))
+	for i, a := range groupAggregates {
+		descs[i] = groupAggregateDesc{
+			avg: prometheus.NewDesc(prometheus.BuildFQName(namespace, "group", a.name+"_avg"), "Average "+a.help+" of the devices in the group.", []string{"group"}, nil),
+			min: prometheus.NewDesc(prometheus.BuildFQName(namespace, "group", a.name+"_min"), "Lowest "+a.help+" of the devices in the group.", []string{"group"}, nil),
+			max: prometheus.NewDesc(prometheus.BuildFQName(namespace, "group", a.name+"_max"), "Highest "+a.help+" of the devices in the group.", []string{"group"}, nil),
+		}
+	}
+	return descs
+}()
+
+// deviceGroup is a group of devices, as set with group in the config file.
+type deviceGroup struct {
+	name      string
+	exporters []*Exporter
+}
+
+// GroupCollector exports aggregates of the latest readings of the devices
+// in each group, e.g. the average PM2.5 across a floor. It reads the
+// exporters' cached state and never scrapes a device itself.
+type GroupCollector struct {
+	groups           []deviceGroup
+	humidityFraction bool
+}
+
+// NewGroupCollector returns a GroupCollector for the groups of devices,
+// where exporters[i] scrapes devices[i]. Devices without a group are left
+// out.
+func NewGroupCollector(devices []DeviceConfig, exporters []*Exporter, humidityFraction bool) *GroupCollector {
+	byName := map[string]*deviceGroup{}
+	c := &GroupCollector{humidityFraction: humidityFraction}
+	for i, device := range devices {
+		if device.Group == "" {
+			continue
+		}
+		g, ok := byName[device.Group]
+		if !ok {
+			g = &deviceGroup{name: device.Group}
+			byName[device.Group] = g
+		}
+		g.exporters = append(g.exporters, exporters[i])
+	}
+	for _, g := range byName {
+		c.groups = append(c.groups, *g)
+	}
+	sort.Slice(c.groups, func(i, j int) bool { return c.groups[i].name < c.groups[j].name })
+	return c
+}
+
+// Describe implements prometheus.Collector.
+func (c *GroupCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- iqAirGroupDevicesReporting
+	for _, d := range groupAggregateDescs {
+		ch <- d.avg
+		ch <- d.min
+		ch <- d.max
+	}
+}
+
+// Collect implements prometheus.Collector. A group none of whose devices
+// has a reading only reports iqair_group_devices_reporting.
+func (c *GroupCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, g := range c.groups {
+		var readings []APIData
+		for _, e := range g.exporters {
+			if s := e.Snapshot(); s.Response != nil {
+				readings = append(readings, s.Response.Current)
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(iqAirGroupDevicesReporting, prometheus.GaugeValue, float64(len(readings)), g.name)
+		if len(readings) == 0 {
+			continue
+		}
+		for i, a := range groupAggregates {
+			sum, min, max := 0.0, math.Inf(1), math.Inf(-1)
+			for _, r := range readings {
+				v := a.value(r, c.humidityFraction)
+				sum += v
+				min = math.Min(min, v)
+				max = math.Max(max, v)
+			}
+			ch <- prometheus.MustNewConstMetric(groupAggregateDescs[i].avg, prometheus.GaugeValue, sum/float64(len(readings)), g.name)
+			ch <- prometheus.MustNewConstMetric(groupAggregateDescs[i].min, prometheus.GaugeValue, min, g.name)
+			ch <- prometheus.MustNewConstMetric(groupAggregateDescs[i].max, prometheus.GaugeValue, max, g.name)
+		}
+	}
+}
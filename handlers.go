@@ -0,0 +1,648 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+// newMetricsHandler returns the handler serving the metrics from gatherer.
+// Like node_exporter, it accepts collect[] parameters restricting the output
+// to the named metric families, e.g. ?collect[]=iqair_p25&collect[]=iqair_up,
+// which keeps the exposition small on metered links. Each parameter may
+// also hold a comma-separated list of names.
+//
+// The MaxRequestsInFlight and Timeout of opts apply to the endpoint as a
+// whole, see limitEndpoint.
+func newMetricsHandler(gatherer prometheus.Gatherer, reg prometheus.Registerer, opts promhttp.HandlerOpts) http.Handler {
+	return limitEndpoint("metrics", collectHandler(gatherer, opts), reg, opts)
+}
+
+// collectHandler returns the handler serving the metrics from gatherer,
+// restricted by the request's collect[] parameters, without the limits of
+// opts.
+func collectHandler(gatherer prometheus.Gatherer, opts promhttp.HandlerOpts) http.Handler {
+	opts.MaxRequestsInFlight, opts.Timeout = 0, 0
+	unfiltered := promhttp.HandlerFor(gatherer, opts)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var names []string
+		for _, param := range r.URL.Query()["collect[]"] {
+			for _, name := range strings.Split(param, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					names = append(names, name)
+				}
+			}
+		}
+		if len(names) == 0 {
+			unfiltered.ServeHTTP(w, r)
+			return
+		}
+		promhttp.HandlerFor(filteredGatherer(gatherer, names), opts).ServeHTTP(w, r)
+	})
+}
+
+// limitEndpoint applies the MaxRequestsInFlight and Timeout of opts to the
+// endpoint served by handler, and instruments it with the promhttp metric
+// handler metrics labeled handler=name, so that each endpoint has its own
+// limit and in-flight gauge. As collect[] needs a promhttp handler per
+// request, the limits are enforced here rather than by promhttp, with the
+// same responses.
+func limitEndpoint(name string, handler http.Handler, reg prometheus.Registerer, opts promhttp.HandlerOpts) http.Handler {
+	if opts.Timeout > 0 {
+		handler = http.TimeoutHandler(handler, opts.Timeout, fmt.Sprintf("Exceeded configured timeout of %v.\n", opts.Timeout))
+	}
+	if opts.MaxRequestsInFlight > 0 {
+		handler = limitInFlight(handler, opts.MaxRequestsInFlight)
+	}
+	return promhttp.InstrumentMetricHandler(prometheus.WrapRegistererWith(prometheus.Labels{"handler": name}, reg), handler)
+}
+
+// limitInFlight answers requests beyond max concurrent ones with 503
+// Service Unavailable instead of passing them to next.
+func limitInFlight(next http.Handler, max int) http.Handler {
+	inFlight := make(chan struct{}, max)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case inFlight <- struct{}{}:
+			defer func() { <-inFlight }()
+		default:
+			http.Error(w, fmt.Sprintf("Limit of concurrent requests reached (%d), try again later.", max), http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// newDeviceMetricsHandler returns the handler of the per-device metrics
+// paths under prefix, serving the metrics gathered for the device named by
+// the rest of the path, escaped as usual in URLs. Like /metrics, it accepts
+// collect[] parameters. The limits of opts apply to all the device paths
+// together, separately from /metrics.
+func newDeviceMetricsHandler(prefix string, gatherers map[string]prometheus.Gatherer, reg prometheus.Registerer, opts promhttp.HandlerOpts) http.Handler {
+	handlers := make(map[string]http.Handler, len(gatherers))
+	for name, gatherer := range gatherers {
+		handlers[name] = collectHandler(gatherer, opts)
+	}
+	return limitEndpoint("device_metrics", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler, ok := handlers[strings.TrimPrefix(r.URL.Path, prefix)]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}), reg, opts)
+}
+
+// filteredGatherer returns a Gatherer only returning the metric families of
+// gatherer with the given names.
+func filteredGatherer(gatherer prometheus.Gatherer, names []string) prometheus.Gatherer {
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[name] = true
+	}
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := gatherer.Gather()
+		filtered := mfs[:0]
+		for _, mf := range mfs {
+			if wanted[mf.GetName()] {
+				filtered = append(filtered, mf)
+			}
+		}
+		return filtered, err
+	})
+}
+
+// readingUnits are the units of the reading fields in API responses.
+var readingUnits = map[string]string{
+	"pm25":        "µg/m³",
+	"pm10":        "µg/m³",
+	"co2":         "ppm",
+	"temperature": "°C",
+	"humidity":    "%",
+}
+
+// apiValue is a reading field in API responses.
+type apiValue struct {
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit"`
+}
+
+// apiDevice is the state of a device in /api/v1/current responses.
+type apiDevice struct {
+	Device string            `json:"device"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Serial string            `json:"serial,omitempty"`
+	Model  string            `json:"model,omitempty"`
+	// Up reports whether the most recent scrape succeeded.
+	Up bool `json:"up"`
+	// Stale is true if there is no current reading: the last scrape
+	// failed, or the measurement is older than the staleness threshold.
+	Stale bool `json:"stale"`
+	// Timestamp is the measurement time, null if the device did not report
+	// one or there is no reading.
+	Timestamp *time.Time `json:"timestamp"`
+	// Readings is null if there is no reading.
+	Readings map[string]apiValue `json:"readings"`
+}
+
+type apiCurrentResponse struct {
+	Devices []apiDevice `json:"devices"`
+}
+
+// newCurrentHandler returns the handler of /api/v1/current, serving the
+// latest reading of each device as JSON. It only reads the exporters' cached
+// state and never scrapes a device. A device query parameter, which may be
+// repeated, restricts the response to the named devices.
+func newCurrentHandler(exporters []*Exporter, staleAfter time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		wanted := map[string]bool{}
+		for _, name := range r.URL.Query()["device"] {
+			wanted[name] = true
+		}
+
+		resp := apiCurrentResponse{Devices: []apiDevice{}}
+		found := map[string]bool{}
+		for _, exporter := range exporters {
+			snapshot := exporter.Snapshot()
+			if len(wanted) > 0 && !wanted[snapshot.Device] {
+				continue
+			}
+			found[snapshot.Device] = true
+			resp.Devices = append(resp.Devices, newAPIDevice(snapshot, exporter.nowFunc(), staleAfter))
+		}
+		var missing []string
+		for name := range wanted {
+			if !found[name] {
+				missing = append(missing, name)
+			}
+		}
+		if len(missing) > 0 {
+			sort.Strings(missing)
+			writeAPIError(w, http.StatusNotFound, "unknown device "+strings.Join(missing, ", "))
+			return
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+}
+
+func newAPIDevice(s Snapshot, now time.Time, staleAfter time.Duration) apiDevice {
+	d := apiDevice{
+		Device: s.Device,
+		Labels: s.Labels,
+		Serial: s.Status.SerialNumber,
+		Model:  s.Status.Model,
+		Up:     s.Up,
+		Stale:  true,
+	}
+	if s.Response != nil {
+		d.setReadings(s.Response.Current, now, staleAfter)
+	}
+	return d
+}
+
+// newAPIDeviceFromReading returns the device state carried by a new
+// reading, which implies the scrape succeeded.
+func newAPIDeviceFromReading(r Reading, now time.Time, staleAfter time.Duration) apiDevice {
+	d := apiDevice{
+		Device: r.Device,
+		Labels: r.Labels,
+		Serial: r.Status.SerialNumber,
+		Model:  r.Status.Model,
+		Up:     true,
+	}
+	d.setReadings(r.Data, now, staleAfter)
+	return d
+}
+
+func (d *apiDevice) setReadings(current APIData, now time.Time, staleAfter time.Duration) {
+	d.Readings = map[string]apiValue{}
+	for _, f := range (Reading{Data: current}).Fields() {
+		d.Readings[f.Name] = apiValue{Value: f.Value, Unit: readingUnits[f.Name]}
+	}
+	d.Stale = false
+	if !current.Timestamp.IsZero() {
+		ts := current.Timestamp.UTC()
+		d.Timestamp = &ts
+		d.Stale = now.Sub(ts) > staleAfter
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// historyResponse is the response of /api/v1/history.
+type historyResponse struct {
+	Device  string            `json:"device"`
+	Step    string            `json:"step,omitempty"`
+	Units   map[string]string `json:"units"`
+	Samples []historySample   `json:"samples"`
+}
+
+// newHistoryHandler returns the handler of /api/v1/history, serving the
+// readings of the device given with the device parameter from history.
+// since limits the readings to those taken after a time, given as RFC 3339,
+// Unix seconds or a duration relative to now such as -6h. step averages the
+// readings over intervals of that length. devices are the names of the
+// configured devices, and nowFunc tells the time relative durations start
+// from.
+func newHistoryHandler(history *ReadingHistory, devices []string, nowFunc func() time.Time) http.Handler {
+	known := make(map[string]bool, len(devices))
+	for _, d := range devices {
+		known[d] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		query := r.URL.Query()
+		device := query.Get("device")
+		if device == "" {
+			writeAPIError(w, http.StatusBadRequest, "missing device parameter")
+			return
+		}
+		if !known[device] {
+			writeAPIError(w, http.StatusNotFound, "unknown device "+device)
+			return
+		}
+		since, err := parseSince(query.Get("since"), nowFunc())
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid since parameter: "+err.Error())
+			return
+		}
+		var step time.Duration
+		if s := query.Get("step"); s != "" {
+			d, err := model.ParseDuration(s)
+			if err != nil || d <= 0 {
+				writeAPIError(w, http.StatusBadRequest, "invalid step parameter: must be a positive duration such as 5m")
+				return
+			}
+			step = time.Duration(d)
+		}
+
+		resp := historyResponse{
+			Device:  device,
+			Units:   readingUnits,
+			Samples: downsample(history.Query(device, since), step),
+		}
+		if step > 0 {
+			resp.Step = model.Duration(step).String()
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+}
+
+// parseSince parses the start of a time range: a duration before now such
+// as -6h, an RFC 3339 timestamp, or Unix seconds. An empty string means the
+// zero time.
+func parseSince(s string, now time.Time) (time.Time, error) {
+	switch {
+	case s == "":
+		return time.Time{}, nil
+	case strings.HasPrefix(s, "-"):
+		d, err := model.ParseDuration(s[1:])
+		if err != nil {
+			return time.Time{}, err
+		}
+		return now.Add(-time.Duration(d)), nil
+	}
+	if ts, err := time.Parse(time.RFC3339, s); err == nil {
+		return ts, nil
+	}
+	secs, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither a duration like -6h, an RFC 3339 timestamp nor Unix seconds", s)
+	}
+	return time.Unix(secs, 0), nil
+}
+
+// scrapeResult is the outcome of scraping a device in /-/scrape responses.
+type scrapeResult struct {
+	Device          string  `json:"device"`
+	Success         bool    `json:"success"`
+	Error           string  `json:"error,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	// ReadingAgeSeconds is how old the device's measurement is, null if the
+	// scrape failed or the device reports no timestamp.
+	ReadingAgeSeconds *float64 `json:"reading_age_seconds"`
+}
+
+// targetAddress returns the scheme and host of a device URI, which unlike
+// the whole URI can be shown publicly: the path of AirVisual API links is
+// the API key. File URIs are returned whole, as the file is the target.
+func targetAddress(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "<invalid uri>"
+	}
+	if strings.HasPrefix(uri, fileURIPrefix) {
+		return fileURIPrefix + u.Path
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// redactedScrapeError returns the error of the snapshot's last scrape with
+// every URI the device is scraped from, included in errors of failed
+// requests, redacted by redactURIs.
+func redactedScrapeError(s Snapshot) string {
+	return redactURIs(s.Error, s.URIs)
+}
+
+// apiTarget is a device in /api/v1/targets responses.
+type apiTarget struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	// Source is where the device was configured: "config" for the
+	// configuration file, "flags" for the command line.
+	Source string            `json:"source"`
+	Labels map[string]string `json:"labels"`
+	// Health is "up" or "down" after the last scrape, "unknown" if no
+	// scrape has finished yet.
+	Health    string `json:"health"`
+	LastError string `json:"last_error,omitempty"`
+	// LastSuccess is null if no scrape has succeeded yet.
+	LastSuccess *time.Time `json:"last_success"`
+	// CircuitOpen is true while the device's circuit breaker skips
+	// scrapes.
+	CircuitOpen bool `json:"circuit_open"`
+}
+
+// newTargetsHandler returns the handler of /api/v1/targets, describing the
+// devices the exporter scrapes, sorted by name. It only reads the
+// exporters' cached state and never scrapes a device.
+func newTargetsHandler(exporters []*Exporter, source string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		targets := []apiTarget{}
+		for _, e := range exporters {
+			s := e.Snapshot()
+			t := apiTarget{
+				Name:        Reading{Device: s.Device}.DeviceName(),
+				Address:     targetAddress(s.URI),
+				Source:      source,
+				Labels:      s.Labels,
+				Health:      "unknown",
+				LastError:   redactedScrapeError(s),
+				CircuitOpen: s.CircuitOpen,
+			}
+			switch {
+			case s.Up:
+				t.Health = "up"
+			case s.Error != "":
+				t.Health = "down"
+			}
+			if !s.LastSuccess.IsZero() {
+				ts := s.LastSuccess.UTC()
+				t.LastSuccess = &ts
+			}
+			targets = append(targets, t)
+		}
+		sort.Slice(targets, func(i, j int) bool { return targets[i].Name < targets[j].Name })
+		writeJSON(w, http.StatusOK, map[string][]apiTarget{"targets": targets})
+	})
+}
+
+// newHealthyHandler returns the handler of /-/healthy, which succeeds as
+// long as the process serves requests, the configuration having been
+// loaded before the server starts.
+func newHealthyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("iqAir Exporter is Healthy.\n"))
+	})
+}
+
+// readyDevice is a device in /-/ready responses.
+type readyDevice struct {
+	Device string `json:"device"`
+	// Fresh is true if the device was scraped successfully within the
+	// staleness window.
+	Fresh       bool       `json:"fresh"`
+	LastSuccess *time.Time `json:"last_success"`
+	Error       string     `json:"error,omitempty"`
+}
+
+type readyResponse struct {
+	Ready   bool          `json:"ready"`
+	Devices []readyDevice `json:"devices"`
+}
+
+// newReadyHandler returns the handler of /-/ready, which succeeds once at
+// least one device has been scraped successfully within maxStaleness, and
+// otherwise answers 503 listing why each device is not. Polled devices are
+// only judged by the poller's results; devices scraped on demand are
+// scraped once their last success is stale, see Exporter.RefreshStale.
+func newReadyHandler(exporters []*Exporter, maxStaleness time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp := readyResponse{Devices: []readyDevice{}}
+		for _, e := range exporters {
+			e.RefreshStale(maxStaleness)
+			s := e.Snapshot()
+			d := readyDevice{
+				Device: Reading{Device: s.Device}.DeviceName(),
+				Fresh:  !s.LastSuccess.IsZero() && e.nowFunc().Sub(s.LastSuccess) <= maxStaleness,
+				Error:  redactedScrapeError(s),
+			}
+			if !s.LastSuccess.IsZero() {
+				ts := s.LastSuccess.UTC()
+				d.LastSuccess = &ts
+			}
+			if !d.Fresh && d.Error == "" {
+				d.Error = "no successful scrape within " + model.Duration(maxStaleness).String()
+			}
+			resp.Ready = resp.Ready || d.Fresh
+			resp.Devices = append(resp.Devices, d)
+		}
+		status := http.StatusOK
+		if !resp.Ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, resp)
+	})
+}
+
+// selectExporters returns the exporters of the named devices, or all of
+// them if names is empty. It also returns the first name matching no
+// device, if any.
+func selectExporters(exporters []*Exporter, names []string) (selected []*Exporter, unknown string) {
+	wanted := map[string]bool{}
+	for _, name := range names {
+		wanted[name] = true
+	}
+	found := map[string]bool{}
+	for _, exporter := range exporters {
+		if name := exporter.Snapshot().Device; len(wanted) == 0 || wanted[name] {
+			selected = append(selected, exporter)
+			found[name] = true
+		}
+	}
+	for _, name := range names {
+		if !found[name] {
+			return nil, name
+		}
+	}
+	return selected, ""
+}
+
+// newScrapeHandler returns the handler of POST /-/scrape, which scrapes the
+// devices immediately, updating the cached results the metrics are served
+// from, and reports how it went. A device query parameter, which may be
+// repeated, restricts the scrape to the named devices.
+func newScrapeHandler(exporters []*Exporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		selected, unknown := selectExporters(exporters, r.URL.Query()["device"])
+		if unknown != "" {
+			writeAPIError(w, http.StatusNotFound, "unknown device "+unknown)
+			return
+		}
+
+		results := []scrapeResult{}
+		for _, exporter := range selected {
+			reading, ok := exporter.ScrapeReading()
+			snapshot := exporter.Snapshot()
+			result := scrapeResult{
+				Device:          snapshot.Device,
+				Success:         ok,
+				Error:           redactedScrapeError(snapshot),
+				DurationSeconds: snapshot.ScrapeDuration.Seconds(),
+			}
+			if ok && !reading.Data.Timestamp.IsZero() {
+				age := exporter.nowFunc().Sub(reading.Data.Timestamp).Seconds()
+				result.ReadingAgeSeconds = &age
+			}
+			results = append(results, result)
+		}
+		writeJSON(w, http.StatusOK, map[string][]scrapeResult{"devices": results})
+	})
+}
+
+// readingQuery calls fn for each recorded reading of device taken in
+// [from, to], oldest first, stopping at the first error fn returns.
+type readingQuery func(device string, from, to time.Time, fn func(Reading) error) error
+
+// historyQuery returns a readingQuery over the readings held in history.
+func historyQuery(history *ReadingHistory) readingQuery {
+	return func(device string, from, to time.Time, fn func(Reading) error) error {
+		for _, r := range history.Query(device, from) {
+			if r.Timestamp.After(to) {
+				break
+			}
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// csvFilenameReplacer makes device names safe for use in file names.
+var csvFilenameReplacer = strings.NewReplacer("/", "_", `\`, "_", `"`, "_", " ", "_", ",", "_")
+
+// newExportHandler returns the handler of /export.csv, streaming recorded
+// readings as CSV with the columns of the CSV log. The device parameter,
+// which may be repeated, selects devices; all are exported if it is absent.
+// since is parsed like for the history API, relative to nowFunc, and
+// defaults to -24h. Ranges longer than maxRange are rejected.
+func newExportHandler(query readingQuery, devices []string, maxRange time.Duration, nowFunc func() time.Time, logger log.Logger) http.Handler {
+	known := make(map[string]bool, len(devices))
+	for _, d := range devices {
+		known[d] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		params := r.URL.Query()
+		selected := params["device"]
+		for _, d := range selected {
+			if !known[d] {
+				http.Error(w, "unknown device "+d, http.StatusNotFound)
+				return
+			}
+		}
+		if len(selected) == 0 {
+			selected = devices
+		}
+
+		now := nowFunc()
+		sinceParam := params.Get("since")
+		if sinceParam == "" {
+			sinceParam = "-24h"
+		}
+		since, err := parseSince(sinceParam, now)
+		if err != nil {
+			http.Error(w, "invalid since parameter: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if maxRange > 0 && now.Sub(since) > maxRange {
+			http.Error(w, fmt.Sprintf("range exceeds the maximum of %s", model.Duration(maxRange)), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		filename := "iqair"
+		if len(params["device"]) == 1 {
+			filename += "-" + csvFilenameReplacer.Replace(selected[0])
+		}
+		filename += "-" + now.UTC().Format("20060102T150405Z") + ".csv"
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+		if r.Method == http.MethodHead {
+			return
+		}
+
+		// Rows go out whenever the writer's buffer fills, so a long export
+		// never has to be held in memory.
+		cw := csv.NewWriter(w)
+		cw.Write(csvHeader)
+		for _, device := range selected {
+			err := query(device, since, now, func(reading Reading) error {
+				cw.Write(csvRow(reading))
+				return cw.Error()
+			})
+			if err != nil {
+				// The status has been sent already; all that can be done is
+				// to cut the response short.
+				level.Error(logger).Log("msg", "Error exporting readings", "device", device, "err", err)
+				break
+			}
+		}
+		cw.Flush()
+	})
+}
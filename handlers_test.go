@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// families requests target from handler and returns the sorted names of
+// the metric families in the response.
+func families(t *testing.T, handler http.Handler, target string) []string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s: status %d: %s", target, w.Code, w.Body)
+	}
+	var parser expfmt.TextParser
+	mfs, err := parser.TextToMetricFamilies(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(mfs))
+	for name := range mfs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestMetricsHandlerCollectParams(t *testing.T) {
+	e := newTestExporter(t, writeResponse(t, `{"current":{"co":500,"p2":3,"p1":4,"tp":21.5,"hm":40}}`), ExporterOptions{})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(e)
+	handler := newMetricsHandler(reg, prometheus.NewRegistry(), promhttp.HandlerOpts{})
+
+	for target, want := range map[string][]string{
+		"/metrics?collect[]=iqair_p25&collect[]=iqair_up": {"iqair_p25", "iqair_up"},
+		"/metrics?collect[]=iqair_co2,%20iqair_humidity":  {"iqair_co2", "iqair_humidity"},
+		"/metrics?collect[]=iqair_no_such_metric":         {},
+	} {
+		got := families(t, handler, target)
+		if len(got) != len(want) {
+			t.Errorf("GET %s returned %v, want %v", target, got, want)
+			continue
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("GET %s returned %v, want %v", target, got, want)
+				break
+			}
+		}
+	}
+
+	if all := families(t, handler, "/metrics"); len(all) < 5 {
+		t.Errorf("GET /metrics without collect[] returned only %v", all)
+	}
+}
+
+func TestMetricsEndpointLimits(t *testing.T) {
+	for _, tc := range []struct {
+		// full is the endpoint whose only request slot is taken, other the
+		// one that must keep serving.
+		full, other string
+	}{
+		{"metrics", "device_metrics"},
+		{"device_metrics", "metrics"},
+	} {
+		t.Run(tc.full, func(t *testing.T) {
+			entered, release := make(chan struct{}), make(chan struct{})
+			slow := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+				entered <- struct{}{}
+				<-release
+				return nil, nil
+			})
+			gatherers := map[string]prometheus.Gatherer{"metrics": prometheus.NewRegistry(), "device_metrics": prometheus.NewRegistry()}
+			gatherers[tc.full] = slow
+			reg := prometheus.NewRegistry()
+			opts := promhttp.HandlerOpts{MaxRequestsInFlight: 1}
+			handlers := map[string]http.Handler{
+				"metrics":        newMetricsHandler(gatherers["metrics"], reg, opts),
+				"device_metrics": newDeviceMetricsHandler("/metrics/devices/", map[string]prometheus.Gatherer{"bedroom": gatherers["device_metrics"]}, reg, opts),
+			}
+			targets := map[string]string{"metrics": "/metrics", "device_metrics": "/metrics/devices/bedroom"}
+			get := func(endpoint string) int {
+				w := httptest.NewRecorder()
+				handlers[endpoint].ServeHTTP(w, httptest.NewRequest(http.MethodGet, targets[endpoint], nil))
+				return w.Code
+			}
+
+			done := make(chan int)
+			go func() { done <- get(tc.full) }()
+			<-entered
+			if got := get(tc.full); got != http.StatusServiceUnavailable {
+				t.Errorf("second request to %s answered %d, want 503", tc.full, got)
+			}
+			if got := get(tc.other); got != http.StatusOK {
+				t.Errorf("%s answered %d while %s was full, want 200", tc.other, got, tc.full)
+			}
+			mfs, err := reg.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			inFlight := map[string]float64{}
+			for _, mf := range mfs {
+				if mf.GetName() != "promhttp_metric_handler_requests_in_flight" {
+					continue
+				}
+				for _, m := range mf.GetMetric() {
+					for _, l := range m.GetLabel() {
+						if l.GetName() == "handler" {
+							inFlight[l.GetValue()] = m.GetGauge().GetValue()
+						}
+					}
+				}
+			}
+			if inFlight[tc.full] != 1 || inFlight[tc.other] != 0 {
+				t.Errorf("requests in flight by handler = %v, want 1 for %s and 0 for %s", inFlight, tc.full, tc.other)
+			}
+			close(release)
+			if got := <-done; got != http.StatusOK {
+				t.Errorf("first request to %s answered %d, want 200", tc.full, got)
+			}
+		})
+	}
+}
+
+// unreachableURI returns an AirVisual API link with credentials to an
+// address nothing listens on, so that scrapes fail with an error quoting it.
+func unreachableURI(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return "http://user:hunter2@" + addr + airVisualKeyPrefix + "s3cr3tk3y"
+}
+
+// checkRedacted fails t if body leaks any secret of unreachableURI.
+func checkRedacted(t *testing.T, body string) {
+	t.Helper()
+	for _, secret := range []string{"s3cr3tk3y", "hunter2"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("response leaks %s: %s", secret, body)
+		}
+	}
+}
+
+func TestScrapeHandlerRedactsErrors(t *testing.T) {
+	handler := newScrapeHandler([]*Exporter{newTestExporter(t, unreachableURI(t), ExporterOptions{})})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/-/scrape", nil))
+	body := w.Body.String()
+	if !strings.Contains(body, `"success":false`) {
+		t.Fatalf("scraping an unreachable device reported %s", body)
+	}
+	checkRedacted(t, body)
+}
+
+func TestRedactedScrapeErrorCoversAllURIs(t *testing.T) {
+	first := unreachableURI(t)
+	second := strings.Replace(unreachableURI(t), "s3cr3tk3y", "0th3rk3y", 1)
+	e, err := NewExporter(DeviceConfig{URI: first, URIs: []string{first, second}}, ExporterOptions{Timeout: time.Second}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, uri := range []string{first, second} {
+		e.ScrapeReading()
+		s := e.Snapshot()
+		msg := redactedScrapeError(s)
+		if msg == "" || !strings.Contains(msg, fingerprintURI(uri)) {
+			t.Errorf("error %q does not name the scraped target %s", msg, fingerprintURI(uri))
+		}
+		for _, secret := range []string{"s3cr3tk3y", "0th3rk3y", "hunter2"} {
+			if strings.Contains(msg, secret) {
+				t.Errorf("error %q leaks %s", msg, secret)
+			}
+		}
+	}
+}
+
+func TestReadyHandler(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		poll    time.Duration
+		failing bool
+		// polled is whether the poller scraped the device before the probes.
+		polled bool
+		code   int
+		// requests is how many requests the device got in all.
+		requests int32
+	}{
+		{name: "direct, device up", code: http.StatusOK, requests: 1},
+		{name: "direct, device down", failing: true, code: http.StatusServiceUnavailable, requests: 1},
+		{name: "polling, not polled yet", poll: time.Minute, code: http.StatusServiceUnavailable, requests: 0},
+		{name: "polling, device up", poll: time.Minute, polled: true, code: http.StatusOK, requests: 1},
+		{name: "polling, device down", poll: time.Minute, failing: true, polled: true, code: http.StatusServiceUnavailable, requests: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var requests int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				if tc.failing {
+					http.Error(w, "rebooting", http.StatusInternalServerError)
+					return
+				}
+				w.Write([]byte(`{"current":{"co":500,"p2":3,"p1":4,"tp":21.5,"hm":40}}`))
+			}))
+			defer server.Close()
+			e := newTestExporter(t, server.URL, ExporterOptions{PollInterval: tc.poll})
+			if tc.polled {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				e.Poll(ctx)
+			}
+			handler := newReadyHandler([]*Exporter{e}, time.Minute)
+
+			// The second probe finds the result of the first one: a
+			// success is fresh, and a failure is not retried within the
+			// scrape timeout.
+			for i := 0; i < 2; i++ {
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/-/ready", nil))
+				if w.Code != tc.code {
+					t.Errorf("probe %d: /-/ready answered %d, want %d: %s", i+1, w.Code, tc.code, w.Body.String())
+				}
+			}
+			if got := atomic.LoadInt32(&requests); got != tc.requests {
+				t.Errorf("device got %d requests, want %d", got, tc.requests)
+			}
+		})
+	}
+}
+
+func TestFreshnessFollowsExporterClock(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	now := start
+	e := newTestExporter(t, writeResponse(t, `{"current":{"ts":1600000000000,"co":500,"p2":3,"p1":4,"tp":21.5,"hm":40}}`), ExporterOptions{PollInterval: time.Minute})
+	e.nowFunc = func() time.Time { return now }
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// With ctx already cancelled, Poll scrapes once and returns.
+	e.Poll(ctx)
+
+	exporters := []*Exporter{e}
+	ready := newReadyHandler(exporters, 2*time.Minute)
+	current := newCurrentHandler(exporters, 2*time.Minute)
+	statusPage := newStatusPageHandler(exporters, 2*time.Minute, log.NewNopLogger())
+	landing := newLandingPageHandler(exporters, nil, log.NewNopLogger())
+	watchdog := pollerCheck(e)
+	get := func(handler http.Handler, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+	stale := func() bool {
+		var resp apiCurrentResponse
+		if err := json.Unmarshal(get(current, "/api/v1/current").Body.Bytes(), &resp); err != nil || len(resp.Devices) != 1 {
+			t.Fatalf("/api/v1/current: %v, %+v", err, resp)
+		}
+		return resp.Devices[0].Stale
+	}
+
+	for _, tc := range []struct {
+		elapsed     time.Duration
+		ready       int
+		stale       bool
+		age         string
+		stalled     bool
+		staleMarkup bool
+	}{
+		{0, http.StatusOK, false, "just now", false, false},
+		{90 * time.Second, http.StatusOK, false, "1 min ago", false, false},
+		{3 * time.Minute, http.StatusServiceUnavailable, true, "3 min ago", true, true},
+	} {
+		now = start.Add(tc.elapsed)
+		if got := get(ready, "/-/ready").Code; got != tc.ready {
+			t.Errorf("after %v: /-/ready answered %d, want %d", tc.elapsed, got, tc.ready)
+		}
+		if got := stale(); got != tc.stale {
+			t.Errorf("after %v: /api/v1/current stale = %v, want %v", tc.elapsed, got, tc.stale)
+		}
+		page := get(statusPage, "/dashboard").Body.String()
+		if !strings.Contains(page, "Measured "+tc.age) {
+			t.Errorf("after %v: status page does not say the reading was measured %s", tc.elapsed, tc.age)
+		}
+		if got := strings.Contains(page, `class="age stale"`); got != tc.staleMarkup {
+			t.Errorf("after %v: status page marks the reading stale = %v, want %v", tc.elapsed, got, tc.staleMarkup)
+		}
+		if body := get(landing, "/").Body.String(); !strings.Contains(body, "("+tc.age+")") {
+			t.Errorf("after %v: landing page does not give the last success as %s", tc.elapsed, tc.age)
+		}
+		if err := watchdog(); (err != nil) != tc.stalled {
+			t.Errorf("after %v: poller check = %v, want stalled %v", tc.elapsed, err, tc.stalled)
+		}
+	}
+}
+
+func TestStreamEventsFollowBroadcasterClock(t *testing.T) {
+	b := NewReadingBroadcaster(time.Minute, log.NewNopLogger())
+	s := b.subscribe()
+	defer b.unsubscribe(s)
+	reading := testReading("bedroom", time.Unix(1600000000, 0))
+	reading.Data.Timestamp = reading.Timestamp
+	for _, tc := range []struct {
+		elapsed time.Duration
+		stale   bool
+	}{
+		{30 * time.Second, false},
+		{2 * time.Minute, true},
+	} {
+		b.nowFunc = func() time.Time { return reading.Timestamp.Add(tc.elapsed) }
+		b.OnReading(reading)
+		if event := <-s.events; event.Stale != tc.stale {
+			t.Errorf("event %v after the reading: stale = %v, want %v", tc.elapsed, event.Stale, tc.stale)
+		}
+	}
+}
+
+func TestExportHandler(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	history := NewReadingHistory(10)
+	for _, r := range []Reading{
+		testReading("bedroom", now.Add(-48*time.Hour)),
+		testReading("bedroom", now.Add(-2*time.Hour)),
+		testReading("bedroom", now.Add(-time.Hour)),
+		testReading("office", now.Add(-30*time.Minute)),
+	} {
+		history.OnReading(r)
+	}
+	handler := newExportHandler(historyQuery(history), []string{"bedroom", "office"}, 7*24*time.Hour, func() time.Time { return now }, log.NewNopLogger())
+
+	for _, tc := range []struct {
+		method, target string
+		code           int
+		filename       string
+		// rows are the device and timestamp of each exported reading.
+		rows []string
+	}{
+		{
+			method: http.MethodGet, target: "/export.csv", code: http.StatusOK, filename: "iqair-20210601T120000Z.csv",
+			rows: []string{"bedroom 2021-06-01T10:00:00Z", "bedroom 2021-06-01T11:00:00Z", "office 2021-06-01T11:30:00Z"},
+		},
+		{
+			method: http.MethodGet, target: "/export.csv?device=office", code: http.StatusOK, filename: "iqair-office-20210601T120000Z.csv",
+			rows: []string{"office 2021-06-01T11:30:00Z"},
+		},
+		{
+			method: http.MethodGet, target: "/export.csv?device=bedroom&since=-72h", code: http.StatusOK, filename: "iqair-bedroom-20210601T120000Z.csv",
+			rows: []string{"bedroom 2021-05-30T12:00:00Z", "bedroom 2021-06-01T10:00:00Z", "bedroom 2021-06-01T11:00:00Z"},
+		},
+		{method: http.MethodHead, target: "/export.csv", code: http.StatusOK, filename: "iqair-20210601T120000Z.csv"},
+		{method: http.MethodGet, target: "/export.csv?device=kitchen", code: http.StatusNotFound},
+		{method: http.MethodGet, target: "/export.csv?since=yesterday", code: http.StatusBadRequest},
+		{method: http.MethodGet, target: "/export.csv?since=-30d", code: http.StatusRequestEntityTooLarge},
+		{method: http.MethodPost, target: "/export.csv", code: http.StatusMethodNotAllowed},
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(tc.method, tc.target, nil))
+		if w.Code != tc.code {
+			t.Errorf("%s %s answered %d, want %d: %s", tc.method, tc.target, w.Code, tc.code, w.Body.String())
+			continue
+		}
+		if tc.filename == "" {
+			continue
+		}
+		if got, want := w.Header().Get("Content-Disposition"), `attachment; filename="`+tc.filename+`"`; got != want {
+			t.Errorf("%s %s: Content-Disposition %q, want %q", tc.method, tc.target, got, want)
+		}
+		if tc.method == http.MethodHead {
+			if w.Body.Len() != 0 {
+				t.Errorf("HEAD %s returned a body", tc.target)
+			}
+			continue
+		}
+		records, err := csv.NewReader(w.Body).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) == 0 || strings.Join(records[0], ",") != strings.Join(csvHeader, ",") {
+			t.Fatalf("%s %s: export does not start with the header: %v", tc.method, tc.target, records)
+		}
+		var rows []string
+		for _, record := range records[1:] {
+			rows = append(rows, record[1]+" "+record[0])
+		}
+		if strings.Join(rows, "\n") != strings.Join(tc.rows, "\n") {
+			t.Errorf("%s %s exported %q, want %q", tc.method, tc.target, rows, tc.rows)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ReadingHistory keeps the last readings of each device in memory, for
+// the history API. Each device's readings are kept in a ring of fixed size,
+// so memory use does not depend on how often devices are polled.
+type ReadingHistory struct {
+	size int
+
+	mutex   sync.RWMutex
+	devices map[string]*readingRing
+
+	readings prometheus.GaugeFunc
+}
+
+// readingRing holds the last len(readings) readings of a device.
+type readingRing struct {
+	readings []Reading
+	// next is the index the next reading is stored at; once the ring is
+	// full, it is also the index of the oldest reading.
+	next int
+	full bool
+}
+
+// NewReadingHistory returns a ReadingHistory keeping up to size readings
+// per device.
+func NewReadingHistory(size int) *ReadingHistory {
+	h := &ReadingHistory{
+		size:    size,
+		devices: map[string]*readingRing{},
+	}
+	h.readings = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "exporter_history_readings",
+		Help:      "Number of readings held in the in-memory history.",
+	}, func() float64 {
+		h.mutex.RLock()
+		defer h.mutex.RUnlock()
+		n := 0
+		for _, ring := range h.devices {
+			if ring.full {
+				n += len(ring.readings)
+			} else {
+				n += ring.next
+			}
+		}
+		return float64(n)
+	})
+	return h
+}
+
+// OnReading adds r to the history, replacing the device's oldest reading if
+// its ring is full. It implements ReadingListener.
+func (h *ReadingHistory) OnReading(r Reading) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	ring, ok := h.devices[r.DeviceName()]
+	if !ok {
+		ring = &readingRing{readings: make([]Reading, h.size)}
+		h.devices[r.DeviceName()] = ring
+	}
+	ring.readings[ring.next] = r
+	ring.next++
+	if ring.next == len(ring.readings) {
+		ring.next, ring.full = 0, true
+	}
+}
+
+// Query returns the readings of device taken at or after since, oldest
+// first. device is the name returned by Reading.DeviceName.
+func (h *ReadingHistory) Query(device string, since time.Time) []Reading {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	ring, ok := h.devices[device]
+	if !ok {
+		return nil
+	}
+	ordered := ring.readings[:ring.next]
+	if ring.full {
+		ordered = append(append([]Reading{}, ring.readings[ring.next:]...), ring.readings[:ring.next]...)
+	}
+	var readings []Reading
+	for _, r := range ordered {
+		if !r.Timestamp.Before(since) {
+			readings = append(readings, r)
+		}
+	}
+	return readings
+}
+
+// Describe implements prometheus.Collector.
+func (h *ReadingHistory) Describe(ch chan<- *prometheus.Desc) {
+	ch <- h.readings.Desc()
+}
+
+// Collect implements prometheus.Collector.
+func (h *ReadingHistory) Collect(ch chan<- prometheus.Metric) {
+	ch <- h.readings
+}
+
+// historySample is a reading, or the average of the readings within a step,
+// in history API responses.
+type historySample struct {
+	Timestamp time.Time          `json:"timestamp"`
+	Values    map[string]float64 `json:"values"`
+}
+
+// downsample averages readings, which must be sorted by time, over
+// intervals of step aligned to the Unix epoch. Each sample is timestamped
+// with the start of its interval. A step of zero returns every reading.
+func downsample(readings []Reading, step time.Duration) []historySample {
+	samples := []historySample{}
+	var counts []int
+	for _, r := range readings {
+		ts := r.Timestamp.UTC()
+		if step > 0 {
+			ns := ts.UnixNano()
+			ts = time.Unix(0, ns-ns%int64(step)).UTC()
+		}
+		last := len(samples) - 1
+		if step <= 0 || last < 0 || !samples[last].Timestamp.Equal(ts) {
+			samples = append(samples, historySample{Timestamp: ts, Values: map[string]float64{}})
+			counts = append(counts, 0)
+			last++
+		}
+		n := float64(counts[last])
+		for _, f := range r.Fields() {
+			samples[last].Values[f.Name] = (samples[last].Values[f.Name]*n + f.Value) / (n + 1)
+		}
+		counts[last]++
+	}
+	return samples
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-kit/kit/log/level"
+)
+
+// homeAssistantSensor describes how a reading field maps to a Home Assistant
+// sensor.
+type homeAssistantSensor struct {
+	name        string
+	deviceClass string
+	unit        string
+}
+
+// homeAssistantSensors is keyed by ReadingField name.
+var homeAssistantSensors = map[string]homeAssistantSensor{
+	"pm25":        {"PM2.5", "pm25", "µg/m³"},
+	"pm10":        {"PM10", "pm10", "µg/m³"},
+	"co2":         {"CO2", "carbon_dioxide", "ppm"},
+	"temperature": {"Temperature", "temperature", "°C"},
+	"humidity":    {"Humidity", "humidity", "%"},
+}
+
+// homeAssistantNodePrefix marks the discovery topics owned by the exporter.
+const homeAssistantNodePrefix = "iqair_"
+
+var homeAssistantInvalidID = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+type homeAssistantDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model,omitempty"`
+}
+
+type homeAssistantConfig struct {
+	Name                string              `json:"name"`
+	UniqueID            string              `json:"unique_id"`
+	StateTopic          string              `json:"state_topic"`
+	ValueTemplate       string              `json:"value_template,omitempty"`
+	DeviceClass         string              `json:"device_class"`
+	UnitOfMeasurement   string              `json:"unit_of_measurement"`
+	StateClass          string              `json:"state_class"`
+	AvailabilityTopic   string              `json:"availability_topic"`
+	PayloadAvailable    string              `json:"payload_available"`
+	PayloadNotAvailable string              `json:"payload_not_available"`
+	Device              homeAssistantDevice `json:"device"`
+}
+
+// homeAssistantNodeID returns the discovery node ID of device.
+func homeAssistantNodeID(device string) string {
+	return homeAssistantNodePrefix + homeAssistantInvalidID.ReplaceAllString(Reading{Device: device}.DeviceName(), "_")
+}
+
+// discoveryMessages returns the retained Home Assistant discovery configs
+// for the sensors of r's device.
+func (p *MQTTPublisher) discoveryMessages(r Reading) []mqttMessage {
+	// Key the device by serial number if known, so that renaming it in the
+	// exporter config keeps its history in Home Assistant.
+	deviceID := homeAssistantNodeID(r.Device)
+	if r.Status.SerialNumber != "" {
+		deviceID = homeAssistantNodePrefix + homeAssistantInvalidID.ReplaceAllString(r.Status.SerialNumber, "_")
+	}
+	device := homeAssistantDevice{
+		Identifiers:  []string{deviceID},
+		Name:         r.DeviceName(),
+		Manufacturer: "IQAir",
+		Model:        r.Status.Model,
+	}
+
+	var msgs []mqttMessage
+	for _, f := range r.Fields() {
+		sensor := homeAssistantSensors[f.Name]
+		cfg := homeAssistantConfig{
+			Name:                r.DeviceName() + " " + sensor.name,
+			UniqueID:            deviceID + "_" + f.Name,
+			StateTopic:          p.deviceTopic(r.Device) + "/" + f.Name,
+			DeviceClass:         sensor.deviceClass,
+			UnitOfMeasurement:   sensor.unit,
+			StateClass:          "measurement",
+			AvailabilityTopic:   p.availabilityTopic(r.Device),
+			PayloadAvailable:    "online",
+			PayloadNotAvailable: "offline",
+			Device:              device,
+		}
+		if p.config.Format == mqttFormatJSON {
+			cfg.StateTopic = p.deviceTopic(r.Device)
+			cfg.ValueTemplate = "{{ value_json." + f.Name + " }}"
+		}
+
+		payload, err := json.Marshal(cfg)
+		if err != nil {
+			level.Error(p.logger).Log("msg", "Error encoding Home Assistant discovery config", "err", err)
+			continue
+		}
+		msgs = append(msgs, mqttMessage{
+			topic:   p.discoveryTopic(homeAssistantNodeID(r.Device), f.Name),
+			payload: payload,
+			retain:  true,
+		})
+	}
+	return msgs
+}
+
+func (p *MQTTPublisher) discoveryTopic(nodeID, objectID string) string {
+	return p.config.HomeAssistantPrefix + "/sensor/" + nodeID + "/" + objectID + "/config"
+}
+
+// removeStaleDiscovery clears the retained discovery configs of devices that
+// are no longer configured, so that they disappear from Home Assistant. The
+// broker delivers the retained configs right after subscribing; the
+// subscription is dropped again once they have had time to arrive.
+func (p *MQTTPublisher) removeStaleDiscovery(c mqtt.Client) {
+	configured := make(map[string]bool, len(p.config.Devices))
+	for _, device := range p.config.Devices {
+		configured[homeAssistantNodeID(device)] = true
+	}
+
+	filter := p.config.HomeAssistantPrefix + "/sensor/+/+/config"
+	c.Subscribe(filter, 1, func(c mqtt.Client, msg mqtt.Message) {
+		// <prefix>/sensor/<node_id>/<object_id>/config
+		parts := strings.Split(strings.TrimPrefix(msg.Topic(), p.config.HomeAssistantPrefix+"/"), "/")
+		if len(parts) != 4 || len(msg.Payload()) == 0 {
+			return
+		}
+		nodeID := parts[1]
+		if !strings.HasPrefix(nodeID, homeAssistantNodePrefix) || configured[nodeID] {
+			return
+		}
+		level.Info(p.logger).Log("msg", "Removing Home Assistant discovery config of unconfigured device", "topic", msg.Topic())
+		c.Publish(msg.Topic(), 1, true, []byte{})
+	})
+	time.AfterFunc(10*time.Second, func() {
+		c.Unsubscribe(filter)
+	})
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/version"
+)
+
+// influxMeasurement is the InfluxDB measurement readings are written to.
+const influxMeasurement = "iqair"
+
+// Output formats of --once --format.
+const (
+	onceFormatInflux = "influx"
+	onceFormatJSON   = "json"
+)
+
+// InfluxConfig configures writing readings to InfluxDB.
+type InfluxConfig struct {
+	// URL is the base URL of the InfluxDB server, e.g. http://influx:8086.
+	URL string
+	// APIVersion selects the 1.x /write API or the 2.x /api/v2/write API.
+	APIVersion int
+
+	// Database, RetentionPolicy, Username and Password are used with the
+	// 1.x API.
+	Database        string
+	RetentionPolicy string
+	Username        string
+	Password        string
+
+	// Token, Org and Bucket are used with the 2.x API.
+	Token  string
+	Org    string
+	Bucket string
+
+	// BatchSize is the maximum number of points per write. Points are also
+	// written at least every FlushInterval.
+	BatchSize     int
+	FlushInterval time.Duration
+	MaxRetries    int
+	Timeout       time.Duration
+}
+
+// InfluxWriter writes new readings to InfluxDB in line protocol. Points are
+// batched and written from a separate goroutine, so InfluxDB being slow or
+// down never delays a scrape.
+type InfluxWriter struct {
+	config InfluxConfig
+	client *http.Client
+	points chan string
+	logger log.Logger
+
+	written, dropped, writeErrors prometheus.Counter
+}
+
+// NewInfluxWriter returns an InfluxWriter. Call Run to start writing.
+func NewInfluxWriter(config InfluxConfig, logger log.Logger) *InfluxWriter {
+	return &InfluxWriter{
+		config: config,
+		client: &http.Client{Timeout: config.Timeout},
+		points: make(chan string, config.BatchSize*10),
+		logger: logger,
+		written: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_influx_points_written_total",
+			Help:      "Number of points successfully written to InfluxDB.",
+		}),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_influx_points_dropped_total",
+			Help:      "Number of points dropped because the queue was full, InfluxDB rejected them, or all retries failed.",
+		}),
+		writeErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_influx_write_errors_total",
+			Help:      "Number of failed write requests to InfluxDB, including retried ones.",
+		}),
+	}
+}
+
+// OnReading queues r for writing. It implements ReadingListener.
+func (w *InfluxWriter) OnReading(r Reading) {
+	select {
+	case w.points <- formatLineProtocol(r):
+	default:
+		w.dropped.Inc()
+	}
+}
+
+// Run writes queued points until ctx is cancelled, flushing whenever a
+// batch is full or the flush interval has passed. Pending points are
+// written before it returns, for at most the write timeout.
+func (w *InfluxWriter) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.config.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]string, 0, w.config.BatchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			w.write(ctx, batch)
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			for len(w.points) > 0 {
+				batch = append(batch, <-w.points)
+			}
+			if len(batch) > 0 {
+				// ctx is done, so give the final write a fresh deadline.
+				flushCtx, cancel := context.WithTimeout(context.Background(), w.config.Timeout)
+				w.write(flushCtx, batch)
+				cancel()
+			}
+			return
+		case point := <-w.points:
+			batch = append(batch, point)
+			if len(batch) >= w.config.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// write sends a batch of points, retrying server errors with exponential
+// backoff. Client errors are not retried as they would fail again.
+func (w *InfluxWriter) write(ctx context.Context, batch []string) {
+	body := []byte(strings.Join(batch, "\n") + "\n")
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		retry, err := w.send(ctx, body)
+		if err == nil {
+			w.written.Add(float64(len(batch)))
+			return
+		}
+		w.writeErrors.Inc()
+		if !retry || attempt >= w.config.MaxRetries {
+			level.Error(w.logger).Log("msg", "Dropping points that could not be written to InfluxDB", "points", len(batch), "err", err)
+			w.dropped.Add(float64(len(batch)))
+			return
+		}
+		level.Debug(w.logger).Log("msg", "Retrying InfluxDB write", "attempt", attempt+1, "backoff", backoff, "err", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// send writes body to InfluxDB, reporting whether a failure is worth
+// retrying.
+func (w *InfluxWriter) send(ctx context.Context, body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, w.writeURL(), bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("User-Agent", "iqair_exporter/"+version.Version)
+	if w.config.APIVersion == 2 {
+		req.Header.Set("Authorization", "Token "+w.config.Token)
+	} else if w.config.Username != "" {
+		req.SetBasicAuth(w.config.Username, w.config.Password)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+	return resp.StatusCode/100 == 5, fmt.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(msg))
+}
+
+func (w *InfluxWriter) writeURL() string {
+	params := url.Values{}
+	path := "/write"
+	if w.config.APIVersion == 2 {
+		path = "/api/v2/write"
+		params.Set("org", w.config.Org)
+		params.Set("bucket", w.config.Bucket)
+	} else {
+		params.Set("db", w.config.Database)
+		if w.config.RetentionPolicy != "" {
+			params.Set("rp", w.config.RetentionPolicy)
+		}
+	}
+	params.Set("precision", "s")
+	return strings.TrimSuffix(w.config.URL, "/") + path + "?" + params.Encode()
+}
+
+// Describe implements prometheus.Collector.
+func (w *InfluxWriter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- w.written.Desc()
+	ch <- w.dropped.Desc()
+	ch <- w.writeErrors.Desc()
+}
+
+// Collect implements prometheus.Collector.
+func (w *InfluxWriter) Collect(ch chan<- prometheus.Metric) {
+	ch <- w.written
+	ch <- w.dropped
+	ch <- w.writeErrors
+}
+
+// validateInfluxConfig checks that the settings required by the selected
+// API version are present.
+func validateInfluxConfig(config InfluxConfig) error {
+	switch config.APIVersion {
+	case 1:
+		if config.Database == "" {
+			return fmt.Errorf("a database is required for the InfluxDB 1.x API")
+		}
+	case 2:
+		if config.Token == "" || config.Org == "" || config.Bucket == "" {
+			return fmt.Errorf("a token, org and bucket are required for the InfluxDB 2.x API")
+		}
+	default:
+		return fmt.Errorf("unsupported InfluxDB API version %d", config.APIVersion)
+	}
+	if config.BatchSize < 1 {
+		return fmt.Errorf("InfluxDB batch size must be at least 1")
+	}
+	return nil
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+)
+
+// influxTags returns the tags of r's point: the device name, serial number
+// and static labels. Empty values are left out.
+func influxTags(r Reading) map[string]string {
+	tags := map[string]string{}
+	for name, value := range r.Labels {
+		if value != "" {
+			tags[name] = value
+		}
+	}
+	tags["device"] = r.DeviceName()
+	if r.Status.SerialNumber != "" {
+		tags["serial"] = r.Status.SerialNumber
+	}
+	return tags
+}
+
+// formatLineProtocol formats r as an InfluxDB line protocol point with
+// second precision. The device name, serial number and static labels become
+// tags; the sensor values become float fields.
+func formatLineProtocol(r Reading) string {
+	tags := influxTags(r)
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(influxMeasurementEscaper.Replace(influxMeasurement))
+	for _, name := range names {
+		b.WriteString("," + influxTagEscaper.Replace(name) + "=" + influxTagEscaper.Replace(tags[name]))
+	}
+	for i, f := range r.Fields() {
+		sep := ","
+		if i == 0 {
+			sep = " "
+		}
+		b.WriteString(sep + influxTagEscaper.Replace(f.Name) + "=" + strconv.FormatFloat(f.Value, 'f', -1, 64))
+	}
+	b.WriteString(" " + strconv.FormatInt(r.Timestamp.Unix(), 10))
+	return b.String()
+}
+
+// telegrafMetric is a metric in the JSON format of Telegraf's json
+// serializer.
+type telegrafMetric struct {
+	Name      string             `json:"name"`
+	Tags      map[string]string  `json:"tags"`
+	Fields    map[string]float64 `json:"fields"`
+	Timestamp int64              `json:"timestamp"`
+}
+
+// formatTelegrafJSON formats r as a Telegraf JSON metric with the same
+// measurement, tags and fields as formatLineProtocol.
+func formatTelegrafJSON(r Reading) (string, error) {
+	m := telegrafMetric{
+		Name:      influxMeasurement,
+		Tags:      influxTags(r),
+		Fields:    map[string]float64{},
+		Timestamp: r.Timestamp.Unix(),
+	}
+	for _, f := range r.Fields() {
+		m.Fields[f.Name] = f.Value
+	}
+	b, err := json.Marshal(m)
+	return string(b), err
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// testReading returns a reading of the device named device, with a label
+// needing escaping in line protocol.
+func testReading(device string, ts time.Time) Reading {
+	return Reading{
+		Device:    device,
+		Labels:    map[string]string{"room": "living room"},
+		Timestamp: ts,
+		Data:      APIData{CO2: 612, P25: 3, P10: 4, Temperature: 21.5, Humidity: 40},
+		Status:    Status{Model: "AirVisual Pro", SerialNumber: "ABC123"},
+	}
+}
+
+// influxRequest is a write request received by a fake InfluxDB.
+type influxRequest struct {
+	path, query, auth, body string
+}
+
+// fakeInflux returns a fake InfluxDB server and the channel its write
+// requests are sent to.
+func fakeInflux(t *testing.T) (*httptest.Server, <-chan influxRequest) {
+	t.Helper()
+	requests := make(chan influxRequest, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- influxRequest{path: r.URL.Path, query: r.URL.RawQuery, auth: r.Header.Get("Authorization"), body: string(body)}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func TestInfluxWriterV1(t *testing.T) {
+	server, requests := fakeInflux(t)
+	w := NewInfluxWriter(InfluxConfig{
+		URL:           server.URL,
+		APIVersion:    1,
+		Database:      "iqair",
+		BatchSize:     2,
+		FlushInterval: time.Hour,
+		Timeout:       time.Second,
+	}, log.NewNopLogger())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+
+	w.OnReading(testReading("bedroom", time.Unix(1600000000, 0)))
+	w.OnReading(testReading("office", time.Unix(1600000060, 0)))
+
+	select {
+	case r := <-requests:
+		if r.path != "/write" || r.query != "db=iqair&precision=s" {
+			t.Errorf("wrote to %s?%s, want /write?db=iqair&precision=s", r.path, r.query)
+		}
+		want := `iqair,device=bedroom,room=living\ room,serial=ABC123 pm25=3,pm10=4,co2=612,temperature=21.5,humidity=40 1600000000` + "\n" +
+			`iqair,device=office,room=living\ room,serial=ABC123 pm25=3,pm10=4,co2=612,temperature=21.5,humidity=40 1600000060` + "\n"
+		if r.body != want {
+			t.Errorf("wrote\n%s\nwant\n%s", r.body, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a full batch was not written")
+	}
+}
+
+func TestInfluxWriterV2FlushesOnShutdown(t *testing.T) {
+	server, requests := fakeInflux(t)
+	w := NewInfluxWriter(InfluxConfig{
+		URL:           server.URL,
+		APIVersion:    2,
+		Token:         "t0ken",
+		Org:           "home",
+		Bucket:        "air",
+		BatchSize:     100,
+		FlushInterval: time.Hour,
+		Timeout:       time.Second,
+	}, log.NewNopLogger())
+	w.OnReading(testReading("", time.Unix(1600000000, 0)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w.Run(ctx)
+
+	select {
+	case r := <-requests:
+		if r.path != "/api/v2/write" || r.query != "bucket=air&org=home&precision=s" {
+			t.Errorf("wrote to %s?%s, want /api/v2/write?bucket=air&org=home&precision=s", r.path, r.query)
+		}
+		if r.auth != "Token t0ken" {
+			t.Errorf("Authorization = %q, want Token t0ken", r.auth)
+		}
+		want := `iqair,device=default,room=living\ room,serial=ABC123 pm25=3,pm10=4,co2=612,temperature=21.5,humidity=40 1600000000` + "\n"
+		if r.body != want {
+			t.Errorf("wrote\n%s\nwant\n%s", r.body, want)
+		}
+	default:
+		t.Fatal("pending points were not written on shutdown")
+	}
+}
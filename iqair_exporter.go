@@ -7,53 +7,339 @@ package main
 // Based on code from the HAproxy exporter (https://github.com/prometheus/haproxy_exporter)
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
+	"math"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/promlog"
 	"github.com/prometheus/common/promlog/flag"
 	"github.com/prometheus/common/version"
-	"github.com/prometheus/exporter-toolkit/web"
 	webflag "github.com/prometheus/exporter-toolkit/web/kingpinflag"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
 const (
 	namespace = "iqair" // For Prometheus metrics.
+	// defaultListenAddress is used unless listen addresses or systemd
+	// socket activation are configured.
+	defaultListenAddress = ":9861"
 )
 
 var (
-	iqAirUp       = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "up"), "Was the last scrape of iqAir successful.", nil, nil)
 	iqAirCO2      = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "co2"), "CO2 reading.", nil, nil)
 	iqAirP25      = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "p25"), "p2.5 particulate reading.", nil, nil)
 	iqAirP10      = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "p10"), "p10 particulate reading.", nil, nil)
 	iqAirTemp     = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "temperature"), "Temperature reading in Celsius.", nil, nil)
-	iqAirHumidity = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "humidity"), "Humidity reading.", nil, nil)
+	iqAirHumidity = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "humidity"), "Humidity reading in percent.", nil, nil)
+
+	iqAirHumidityFraction = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "humidity"), "Humidity reading as a fraction between 0 and 1.", nil, nil)
+
+	iqAirFirmwareUpdateAvailable = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "firmware_update_available"), "Whether the device reports a pending firmware update (1) or not (0).", nil, nil)
+
+	iqAirLocationInfo = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "location_info"), "Location reported in the device settings.", []string{"city", "lat", "lon"}, nil)
+
+	iqAirTargetInfo = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "target_info"), "Always 1, identifying each URI the device is scraped from without its credentials. The API key of AirVisual API links is replaced by a hash.", []string{"scheme", "host", "path"}, nil)
+
+	iqAirReadingWithinTolerance = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "reading_within_tolerance"), "Whether the device's measurement timestamp lags the current time by at most the given tolerance (1) or not (0).", []string{"tolerance"}, nil)
+
+	iqAirCO2ThresholdWarning  = prometheus.NewDesc(prometheus.BuildFQName(namespace, "device", "co2_threshold_warning"), "CO2 warning threshold configured on the device, in ppm.", nil, nil)
+	iqAirCO2ThresholdCritical = prometheus.NewDesc(prometheus.BuildFQName(namespace, "device", "co2_threshold_critical"), "CO2 critical threshold configured on the device, in ppm.", nil, nil)
+
+	iqAirTemperatureDelta = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "temperature_indoor_outdoor_delta_celsius"), "Indoor minus outdoor temperature in Celsius, if the device reports both.", nil, nil)
+
+	iqAirClockSkew = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "device_clock_skew_seconds"), "Device measurement timestamp minus the exporter's clock at the last scrape. Positive if the device is ahead.", nil, nil)
+
+	iqAirLastScrapeError = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "last_scrape_error"), "Always 1, with the error of the most recent scrape of the device as the error label. The label is empty if the scrape succeeded.", []string{"error"}, nil)
+	iqAirAQIUnchanged    = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "aqi_unchanged_scrapes"), "Number of consecutive successful scrapes returning the same US AQI as the one before. A value that keeps growing suggests a frozen sensor.", nil, nil)
+	iqAirAQIColorIndex   = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "aqi_color_index"), "Index of the US AQI category's color: 0 green, 1 yellow, 2 orange, 3 red, 4 purple, 5 maroon.", nil, nil)
+	iqAirNoData          = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "no_data"), "1 if the device answered the last scrape with an empty body, as it does while booting.", nil, nil)
+
+	iqAirScrapeDuration  = prometheus.NewDesc(prometheus.BuildFQName(namespace, "exporter", "scrape_duration_seconds"), "Duration of the last scrape of the device.", nil, nil)
+	iqAirTimeToFirstByte = prometheus.NewDesc(prometheus.BuildFQName(namespace, "exporter", "time_to_first_byte_seconds"), "Time from the start of the last scrape until the response headers arrived, including connecting.", nil, nil)
+	iqAirBodyRead        = prometheus.NewDesc(prometheus.BuildFQName(namespace, "exporter", "body_read_seconds"), "Time spent reading the response body during the last scrape.", nil, nil)
+
+	// targetInfo follows the OpenTelemetry convention for conveying resource
+	// attributes, so it deliberately has no namespace.
+	targetInfo = prometheus.NewDesc("target_info", "Target metadata.", []string{"serial", "model"}, nil)
 )
 
+// defaultUpMetricName is the name of the metric reporting scrape success
+// unless overridden with --iqair.up-metric-name.
+var defaultUpMetricName = prometheus.BuildFQName(namespace, "", "up")
+
+// NewUpDesc returns the descriptor of the metric reporting whether the last
+// scrape was successful.
+func NewUpDesc(name string, labels prometheus.Labels) (*prometheus.Desc, error) {
+	if !model.IsValidMetricName(model.LabelValue(name)) {
+		return nil, fmt.Errorf("invalid metric name %q", name)
+	}
+	for label := range labels {
+		if err := validateLabelName(label); err != nil {
+			return nil, err
+		}
+	}
+	return prometheus.NewDesc(name, "Was the last scrape of iqAir successful.", nil, labels), nil
+}
+
+// ExporterOptions holds the settings shared by the exporters of all devices.
+type ExporterOptions struct {
+	Timeout time.Duration
+	// Resolve maps device host names to IP addresses, bypassing DNS.
+	Resolve map[string]string
+	// MinTLSVersion is the minimum TLS version accepted from HTTPS devices.
+	// Defaults to TLS 1.2.
+	MinTLSVersion uint16
+	// TLSServerName, if set, is sent as SNI and expected in the device's
+	// certificate instead of the URI's host, e.g. when scraping through a
+	// tunnel by IP address.
+	TLSServerName string
+	// Headers replace the default headers of scrape requests, see
+	// scrapeHeaders.
+	Headers map[string]string
+	// CandidatePaths, if set, are tried in turn on the device's host until
+	// one returns a parseable response, for devices with unknown firmware.
+	// Devices in the configuration file can override them with paths.
+	CandidatePaths []string
+	// Credentials, if set, authenticate scrape requests.
+	Credentials *ScrapeCredentials
+	// PM25Buckets, if non-empty, enables a histogram of PM2.5 readings with
+	// these buckets, observed once per device measurement.
+	PM25Buckets []float64
+	// HumidityFraction exports relative humidity as a 0–1 fraction instead
+	// of a percentage.
+	HumidityFraction bool
+	// AQIColorIndex enables iqair_aqi_color_index, the index of the US AQI
+	// category's color, for panels mapping it to the official palette.
+	AQIColorIndex bool
+	// TargetInfo exports the device's identity as an OpenTelemetry-style
+	// target_info metric.
+	TargetInfo bool
+	// UpDesc describes the metric reporting scrape success. Defaults to
+	// iqair_up.
+	UpDesc *prometheus.Desc
+	// PollInterval, if positive, makes Collect report the result of the most
+	// recent background poll (see Exporter.Poll) instead of scraping the
+	// device on every collect.
+	PollInterval time.Duration
+	// ReadingTolerance, if positive, enables iqair_reading_within_tolerance,
+	// reporting whether the measurement timestamp lags by at most this much.
+	ReadingTolerance time.Duration
+	// MaxLabelLength, if positive, truncates label values taken from device
+	// responses to this many characters, keeping a misbehaving device from
+	// bloating the exposition.
+	MaxLabelLength int
+	// LastScrapeError enables iqair_last_scrape_error, carrying the error of
+	// the most recent scrape as a label.
+	LastScrapeError bool
+	// CircuitFailures, if positive, is the number of consecutive
+	// failed scrapes after which the device is left alone for
+	// CircuitCooldown.
+	CircuitFailures int
+	CircuitCooldown time.Duration
+	// SuccessWindow, if positive, is the number of recent scrapes
+	// iqair_exporter_scrape_success_ratio is computed over.
+	SuccessWindow int
+	// ResponseHistory is the number of parsed responses kept for /history.
+	// Zero disables the history.
+	ResponseHistory int
+	// AutoLabels are device settings, as listed in autoLabelFields, added
+	// as labels to all of the device's metrics once it has been scraped.
+	AutoLabels []string
+	// EmptyBodyOK treats an empty response body as a successful scrape
+	// without data, reported by iqair_no_data, instead of a parse failure.
+	EmptyBodyOK bool
+	// NaNOnFailure exports the readings as NaN after a failed scrape
+	// instead of leaving them out, so graphs show a gap rather than
+	// carrying the last value forward.
+	NaNOnFailure bool
+	// ReadingListeners are notified of every new device measurement.
+	ReadingListeners []ReadingListener
+}
+
 // Exporter collects iqAir stats from the given URI and exports them using
 // the prometheus metrics package.
 type Exporter struct {
-	URI   string
-	mutex sync.RWMutex
+	// lastPoll is when Poll last completed a scrape, in Unix nanoseconds.
+	// It is accessed atomically and so comes first for 64-bit alignment.
+	lastPoll int64
+
+	URI    string
+	name   string
+	client *http.Client
+	labels map[string]string
+	mutex  sync.RWMutex
+
+	// headers and credentials are sent with every scrape request.
+	headers     http.Header
+	credentials *ScrapeCredentials
+
+	// uris are scraped in turn, starting with uris[nextURI].
+	uris        []string
+	nextURI     int
+	apiRequests *prometheus.CounterVec
+	// fingerprints are the label values of iqair_target_info, one per
+	// distinct fingerprint of uris.
+	fingerprints [][3]string
+	// candidatePaths replace the path of uris if set. workingPath is the
+	// one that last returned a parseable response.
+	candidatePaths []string
+	workingPath    string
 
 	totalScrapes, jsonParseFailures prometheus.Counter
+	readingsTotal, responseBytes    prometheus.Counter
+	cacheHits, cacheMisses          prometheus.Counter
+	openConnections                 prometheus.Gauge
+	pm25Distribution                prometheus.Histogram
+	lastReadingTime                 time.Time
+	humidityFraction                bool
+	aqiColor                        bool
+	targetInfo                      bool
+	upDesc                          *prometheus.Desc
+	pollInterval                    time.Duration
+	readingTolerance                time.Duration
+	maxLabelLength                  int
+	lastScrapeError                 bool
+	emptyBodyOK                     bool
+	nanOnFailure                    bool
+	autoLabels                      []string
+	circuit                         circuitBreaker
+	outcomes                        scrapeOutcomes
+	responses                       responseHistory
+	listeners                       []ReadingListener
 	logger                          log.Logger
+	// nowFunc is read instead of time.Now, so that tests can control the
+	// clock.
+	nowFunc func() time.Time
+	// waitBackoff is how long WaitForDevice first waits between attempts,
+	// doubling up to maxWaitBackoff.
+	waitBackoff time.Duration
+
+	// Result of the most recent scrape.
+	// updatedAt is when update last ran. With polling, Collect serves its
+	// result without scraping the device until it is older than
+	// resultFreshness.
+	updatedAt  time.Time
+	up         float64
+	lastTiming scrapeTiming
+	// clockSkew is the device timestamp minus the local time at the last
+	// scrape. Only meaningful if the last response had a timestamp.
+	clockSkew    time.Duration
+	lastResponse *APIResponse
+	// lastError is why the most recent scrape failed, nil if it succeeded.
+	lastError error
+	// lastSuccess is when the most recent successful scrape finished.
+	lastSuccess time.Time
+	// lastStatus is the status block of the most recent successful scrape.
+	lastStatus Status
+	// lastAQI is the US AQI of the most recent successful scrape, and
+	// aqiUnchanged the number of scrapes before it returned the same.
+	lastAQI      *int
+	aqiUnchanged int
+	// trace, if set, records the raw exchange of the next scrape.
+	trace *scrapeTrace
+	// derived caches the values derived from the last reading collected.
+	derived *derivedValues
+	// autoLabelSettings are the settings the auto labels are taken from,
+	// read on the first successful scrape and again whenever the device
+	// recovers from a failure.
+	autoLabelSettings *Settings
 }
 
-// NewExporter returns an initialized Exporter.
-func NewExporter(uri string, timeout time.Duration, logger log.Logger) (*Exporter, error) {
+// NewExporter returns an initialized Exporter for device.
+func NewExporter(device DeviceConfig, opts ExporterOptions, logger log.Logger) (*Exporter, error) {
+	for _, name := range opts.AutoLabels {
+		if _, ok := device.Labels[name]; ok || (name == "device" && device.Name != "") {
+			return nil, fmt.Errorf("auto label %q clashes with a configured label", name)
+		}
+	}
+	upDesc := opts.UpDesc
+	if upDesc == nil {
+		var err error
+		if upDesc, err = NewUpDesc(defaultUpMetricName, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	var pm25Distribution prometheus.Histogram
+	if len(opts.PM25Buckets) > 0 {
+		pm25Distribution = prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "pm2_5_ugm3_distribution",
+			Help:      "Distribution of PM2.5 readings in µg/m³, observed once per device measurement.",
+			Buckets:   opts.PM25Buckets,
+		})
+	}
+
+	openConnections := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "exporter_open_connections",
+		Help:      "Number of connections to the device currently held open, including idle keep-alive connections.",
+	})
+
+	// Only devices rotating through several API links need to tell the
+	// requests per link apart.
+	var apiRequests *prometheus.CounterVec
+	if len(device.URIs) > 1 {
+		apiRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cloud_api_requests_total",
+			Help:      "Number of requests per API link of the device, by index in its uris list.",
+		}, []string{"key_index"})
+	}
+
 	return &Exporter{
-		URI: uri,
+		URI:              device.URI,
+		uris:             device.scrapeURIs(),
+		fingerprints:     uriFingerprints(device.scrapeURIs()),
+		candidatePaths:   device.candidatePaths(opts),
+		apiRequests:      apiRequests,
+		name:             device.Name,
+		client:           newHTTPClient(device.clientOptions(opts), openConnections),
+		headers:          scrapeHeaders(opts.Headers),
+		credentials:      opts.Credentials,
+		openConnections:  openConnections,
+		labels:           device.Labels,
+		pollInterval:     opts.PollInterval,
+		readingTolerance: opts.ReadingTolerance,
+		maxLabelLength:   opts.MaxLabelLength,
+		lastScrapeError:  opts.LastScrapeError,
+		emptyBodyOK:      opts.EmptyBodyOK,
+		nanOnFailure:     opts.NaNOnFailure,
+		autoLabels:       opts.AutoLabels,
+		circuit:          circuitBreaker{failures: opts.CircuitFailures, cooldown: opts.CircuitCooldown},
+		outcomes:         newScrapeOutcomes(opts.SuccessWindow),
+		responses:        newResponseHistory(opts.ResponseHistory),
+		listeners:        opts.ReadingListeners,
+		pm25Distribution: pm25Distribution,
+		humidityFraction: opts.HumidityFraction,
+		aqiColor:         opts.AQIColorIndex,
+		targetInfo:       opts.TargetInfo,
+		upDesc:           upDesc,
+		nowFunc:          time.Now,
+		waitBackoff:      time.Second,
 		totalScrapes: prometheus.NewCounter(prometheus.CounterOpts{
 			Namespace: namespace,
 			Name:      "exporter_scrapes_total",
@@ -64,6 +350,26 @@ func NewExporter(uri string, timeout time.Duration, logger log.Logger) (*Exporte
 			Name:      "exporter_json_parse_failures_total",
 			Help:      "Number of errors while parsing JSON.",
 		}),
+		readingsTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_readings_total",
+			Help:      "Number of distinct device measurements ingested, after deduplication by measurement timestamp.",
+		}),
+		responseBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_response_bytes_total",
+			Help:      "Total size of the response bodies received from the device.",
+		}),
+		cacheHits: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_cache_hits_total",
+			Help:      "Number of collects served from the still fresh result of the background poll, without scraping the device.",
+		}),
+		cacheMisses: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_cache_misses_total",
+			Help:      "Number of collects that scraped the device, because it is not polled or the poll result was older than the poll interval plus the scrape timeout.",
+		}),
 		logger: logger,
 	}, nil
 }
@@ -71,9 +377,57 @@ func NewExporter(uri string, timeout time.Duration, logger log.Logger) (*Exporte
 // Describe describes all the metrics ever exported by the iqAir exporter. It
 // implements prometheus.Collector.
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
-	ch <- iqAirUp
+	// Auto labels are unknown until the device has been scraped, so the
+	// exporter is an unchecked collector then.
+	if len(e.autoLabels) > 0 {
+		return
+	}
+	ch <- e.upDesc
+	ch <- iqAirCO2
+	ch <- iqAirP25
+	ch <- iqAirP10
+	ch <- iqAirTemp
+	ch <- iqAirTemperatureDelta
+	ch <- e.humidityDesc()
+	ch <- iqAirDewPoint
+	ch <- iqAirHeatIndex
+	ch <- iqAirFirmwareUpdateAvailable
+	ch <- iqAirLocationInfo
+	ch <- iqAirCO2ThresholdWarning
+	ch <- iqAirCO2ThresholdCritical
+	ch <- iqAirReadingWithinTolerance
+	ch <- iqAirClockSkew
+	ch <- iqAirLastScrapeError
+	ch <- iqAirNoData
+	ch <- iqAirCircuitState
+	ch <- iqAirAQIUnchanged
+	if e.aqiColor {
+		ch <- iqAirAQIColorIndex
+	}
+	ch <- iqAirScrapeDuration
+	ch <- iqAirScrapeSuccessRatio
+	ch <- iqAirTimeToFirstByte
+	ch <- iqAirBodyRead
 	ch <- e.totalScrapes.Desc()
 	ch <- e.jsonParseFailures.Desc()
+	ch <- e.readingsTotal.Desc()
+	ch <- e.responseBytes.Desc()
+	ch <- e.cacheHits.Desc()
+	ch <- e.cacheMisses.Desc()
+	ch <- e.openConnections.Desc()
+	if e.apiRequests != nil {
+		e.apiRequests.Describe(ch)
+	}
+	if e.pm25Distribution != nil {
+		ch <- e.pm25Distribution.Desc()
+	}
+	if e.targetInfo {
+		ch <- targetInfo
+	}
+	ch <- iqAirTargetInfo
+	if len(e.candidatePaths) > 0 {
+		ch <- iqAirWorkingPath
+	}
 }
 
 // Collect fetches the stats from configured iqAir location and delivers them
@@ -82,102 +436,1978 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 	e.mutex.Lock() // To protect metrics from concurrent collects.
 	defer e.mutex.Unlock()
 
-	up, result := e.scrape(ch)
+	if e.resultFresh() {
+		e.cacheHits.Inc()
+	} else {
+		e.cacheMisses.Inc()
+		e.update()
+	}
+	if len(e.autoLabels) == 0 || e.autoLabelSettings == nil {
+		e.collect(ch)
+		return
+	}
+
+	labels := autoLabelPairs(e.autoLabels, *e.autoLabelSettings, e.maxLabelLength)
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		e.collect(metrics)
+		close(metrics)
+	}()
+	for m := range metrics {
+		ch <- autoLabeledMetric{Metric: m, labels: labels}
+	}
+}
+
+// resultFresh reports whether Collect can serve the result of the most
+// recent scrape without scraping the device. Without polling it never can.
+// With polling, it can until the result is older than the poll interval
+// plus the scrape timeout, by when the poller should have replaced it; if
+// it has not, because it stalled or has yet to complete its first scrape,
+// Collect scrapes the device itself. Must be called with e.mutex held.
+func (e *Exporter) resultFresh() bool {
+	if e.pollInterval <= 0 || e.updatedAt.IsZero() {
+		return false
+	}
+	return e.nowFunc().Sub(e.updatedAt) <= e.pollInterval+e.client.Timeout
+}
+
+// collect sends the metrics of the most recent scrape. Must be called with
+// e.mutex held.
+func (e *Exporter) collect(ch chan<- prometheus.Metric) {
+	parsed := e.lastResponse
 
 	ch <- e.totalScrapes
 	ch <- e.jsonParseFailures
-	ch <- prometheus.MustNewConstMetric(iqAirUp, prometheus.GaugeValue, up)
+	ch <- e.readingsTotal
+	ch <- e.responseBytes
+	ch <- e.cacheHits
+	ch <- e.cacheMisses
+	ch <- e.openConnections
+	if e.apiRequests != nil {
+		e.apiRequests.Collect(ch)
+	}
+	ch <- prometheus.MustNewConstMetric(e.upDesc, prometheus.GaugeValue, e.up)
+	if e.pm25Distribution != nil {
+		ch <- e.pm25Distribution
+	}
+	e.lastTiming.collect(ch)
+	e.outcomes.collect(ch)
+	e.circuit.collect(ch)
+	if e.lastScrapeError {
+		ch <- prometheus.MustNewConstMetric(iqAirLastScrapeError, prometheus.GaugeValue, 1, e.labelValues(scrapeErrorLabel(e.lastError, e.uris))...)
+	}
+	if e.emptyBodyOK {
+		ch <- prometheus.MustNewConstMetric(iqAirNoData, prometheus.GaugeValue, boolToFloat(e.up == 1 && parsed == nil))
+	}
+	// Keep reporting the last known identity while the device is down.
+	if e.targetInfo && (e.lastStatus.SerialNumber != "" || e.lastStatus.Model != "") {
+		ch <- prometheus.MustNewConstMetric(targetInfo, prometheus.GaugeValue, 1, e.labelValues(e.lastStatus.SerialNumber, e.lastStatus.Model)...)
+	}
+
+	for _, f := range e.fingerprints {
+		ch <- prometheus.MustNewConstMetric(iqAirTargetInfo, prometheus.GaugeValue, 1, f[:]...)
+	}
+	if e.workingPath != "" {
+		ch <- prometheus.MustNewConstMetric(iqAirWorkingPath, prometheus.GaugeValue, 1, e.workingPath)
+	}
+
+	// A failed scrape has no reading to report; skip the gauges rather than
+	// exporting zeroes that look like real measurements, or export NaN if
+	// asked to.
+	if parsed == nil {
+		if e.nanOnFailure && e.up != 1 {
+			for _, desc := range []*prometheus.Desc{iqAirCO2, iqAirP25, iqAirP10, iqAirTemp, e.humidityDesc()} {
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, math.NaN())
+			}
+		}
+		return
+	}
+	result := &parsed.Current
 	ch <- prometheus.MustNewConstMetric(iqAirCO2, prometheus.GaugeValue, float64(result.CO2))
 	ch <- prometheus.MustNewConstMetric(iqAirP25, prometheus.GaugeValue, float64(result.P25))
 	ch <- prometheus.MustNewConstMetric(iqAirP10, prometheus.GaugeValue, float64(result.P10))
 	ch <- prometheus.MustNewConstMetric(iqAirTemp, prometheus.GaugeValue, float64(result.Temperature))
-	ch <- prometheus.MustNewConstMetric(iqAirHumidity, prometheus.GaugeValue, float64(result.Humidity))
+	if delta, ok := parsed.temperatureDelta(); ok {
+		ch <- prometheus.MustNewConstMetric(iqAirTemperatureDelta, prometheus.GaugeValue, delta)
+	}
+	humidity := float64(result.Humidity)
+	if e.humidityFraction {
+		humidity /= 100
+	}
+	ch <- prometheus.MustNewConstMetric(e.humidityDesc(), prometheus.GaugeValue, humidity)
+	if d := e.derivedFor(result); d.ok {
+		ch <- prometheus.MustNewConstMetric(iqAirDewPoint, prometheus.GaugeValue, d.dewPoint)
+		ch <- prometheus.MustNewConstMetric(iqAirHeatIndex, prometheus.GaugeValue, d.heatIndex)
+	}
+	ch <- prometheus.MustNewConstMetric(iqAirAQIUnchanged, prometheus.GaugeValue, float64(e.aqiUnchanged))
+	if e.aqiColor {
+		ch <- prometheus.MustNewConstMetric(iqAirAQIColorIndex, prometheus.GaugeValue, float64(aqiColorIndex(result.usAQI())))
+	}
+
+	if !result.Timestamp.IsZero() {
+		ch <- prometheus.MustNewConstMetric(iqAirClockSkew, prometheus.GaugeValue, e.clockSkew.Seconds())
+	}
+	// Readings without a timestamp have no lag to compare.
+	if e.readingTolerance > 0 && !result.Timestamp.IsZero() {
+		within := e.nowFunc().Sub(result.Timestamp) <= e.readingTolerance
+		ch <- prometheus.MustNewConstMetric(iqAirReadingWithinTolerance, prometheus.GaugeValue, boolToFloat(within), e.labelValues(toleranceLabel(e.readingTolerance))...)
+	}
+
+	if parsed.Status.UpdateAvailable != nil {
+		ch <- prometheus.MustNewConstMetric(iqAirFirmwareUpdateAvailable, prometheus.GaugeValue, boolToFloat(*parsed.Status.UpdateAvailable))
+	}
+
+	if t := parsed.Settings.CO2Warning; t != nil {
+		ch <- prometheus.MustNewConstMetric(iqAirCO2ThresholdWarning, prometheus.GaugeValue, *t)
+	}
+	if t := parsed.Settings.CO2Critical; t != nil {
+		ch <- prometheus.MustNewConstMetric(iqAirCO2ThresholdCritical, prometheus.GaugeValue, *t)
+	}
+
+	if loc := parsed.Settings.Location; loc.City != "" || loc.Latitude != nil || loc.Longitude != nil {
+		ch <- prometheus.MustNewConstMetric(iqAirLocationInfo, prometheus.GaugeValue, 1, e.labelValues(loc.City, formatCoordinate(loc.Latitude), formatCoordinate(loc.Longitude))...)
+	}
+}
+
+// Poll scrapes the device every poll interval until ctx is cancelled. The
+// first scrape happens immediately.
+func (e *Exporter) Poll(ctx context.Context) {
+	ticker := time.NewTicker(e.pollInterval)
+	defer ticker.Stop()
+	atomic.StoreInt64(&e.lastPoll, e.nowFunc().UnixNano())
+	for {
+		e.mutex.Lock()
+		e.update()
+		e.mutex.Unlock()
+		atomic.StoreInt64(&e.lastPoll, e.nowFunc().UnixNano())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// maxWaitBackoff caps the wait between WaitForDevice's attempts.
+const maxWaitBackoff = 30 * time.Second
+
+// WaitForDevice scrapes the device until a scrape succeeds, backing off
+// exponentially between attempts. It gives up and returns an error when ctx
+// is done.
+func (e *Exporter) WaitForDevice(ctx context.Context) error {
+	backoff := e.waitBackoff
+	for attempt := 1; ; attempt++ {
+		e.mutex.Lock()
+		e.update()
+		up, lastErr := e.up, e.lastError
+		e.mutex.Unlock()
+		if up == 1 {
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return fmt.Errorf("device not reachable after %d attempts: %v", attempt, lastErr)
+		}
+		level.Info(e.logger).Log("msg", "Device not reachable yet, retrying", "attempt", attempt, "backoff", backoff, "err", lastErr)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("device not reachable after %d attempts: %v", attempt, lastErr)
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxWaitBackoff {
+			backoff = maxWaitBackoff
+		}
+	}
+}
+
+// update scrapes the device, records the result and notifies listeners if
+// it is a new reading. Must be called with e.mutex held.
+func (e *Exporter) update() {
+	e.updatedAt = e.nowFunc()
+	if !e.circuit.allow(e.nowFunc()) {
+		e.updateSkipped(e.nowFunc())
+		return
+	}
+	wasUp := e.up == 1
+	e.up, e.lastResponse, e.lastError = e.scrape()
+	if e.lastError != nil {
+		level.Error(e.logger).Log("msg", "Error scraping device", "err", e.lastError)
+	}
+	e.outcomes.record(e.up == 1)
+	if e.circuit.record(e.up == 1, e.nowFunc()) {
+		level.Warn(e.logger).Log("msg", "Opening circuit breaker, skipping scrapes", "consecutive_failures", e.circuit.failed, "cooldown", model.Duration(e.circuit.cooldown))
+	}
+	if e.up == 1 {
+		e.lastSuccess = e.nowFunc()
+	}
+	for _, l := range e.listeners {
+		if sl, ok := l.(ScrapeResultListener); ok {
+			sl.OnScrapeResult(e.name, e.up == 1)
+		}
+	}
+	if e.lastResponse == nil {
+		return
+	}
+	e.lastStatus = e.lastResponse.Status
+	e.responses.add(recentResponse{Time: e.nowFunc(), Response: e.lastResponse})
+	if e.autoLabelSettings == nil || !wasUp {
+		settings := e.lastResponse.Settings
+		e.autoLabelSettings = &settings
+	}
+
+	current := e.lastResponse.Current
+	aqi := current.usAQI()
+	if e.lastAQI != nil && *e.lastAQI == aqi {
+		e.aqiUnchanged++
+	} else {
+		e.aqiUnchanged = 0
+	}
+	e.lastAQI = &aqi
+	if !current.Timestamp.IsZero() {
+		e.clockSkew = current.Timestamp.Sub(e.nowFunc())
+	}
+	if !e.isNewReading(&current) {
+		return
+	}
+	e.readingsTotal.Inc()
+	if e.pm25Distribution != nil {
+		e.pm25Distribution.Observe(float64(current.P25))
+	}
+
+	reading := e.newReading(current)
+	for _, l := range e.listeners {
+		l.OnReading(reading)
+	}
+}
+
+// newReading returns the Reading for data from the device. Must be called
+// with e.mutex held.
+func (e *Exporter) newReading(data APIData) Reading {
+	reading := Reading{
+		Device:    e.name,
+		Labels:    e.labels,
+		Timestamp: data.Timestamp,
+		Data:      data,
+		Status:    e.lastStatus,
+	}
+	if reading.Timestamp.IsZero() {
+		reading.Timestamp = e.nowFunc()
+	}
+	return reading
+}
+
+// ScrapeReading scrapes the device and returns its current reading, whether
+// or not it is new. It reports false if the scrape failed.
+func (e *Exporter) ScrapeReading() (Reading, bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.update()
+	if e.lastResponse == nil {
+		return Reading{}, false
+	}
+	return e.newReading(e.lastResponse.Current), true
+}
+
+// RefreshStale scrapes a device that is not polled when it has not been
+// scraped successfully within maxAge, so that its freshness does not only
+// depend on Prometheus scraping the exporter. A failed attempt is not
+// retried until the scrape timeout has passed, which bounds the load that
+// frequent callers put on a device that is down. Polled devices are left to
+// their poller.
+func (e *Exporter) RefreshStale(maxAge time.Duration) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.pollInterval > 0 {
+		return
+	}
+	now := e.nowFunc()
+	if !e.lastSuccess.IsZero() && now.Sub(e.lastSuccess) <= maxAge {
+		return
+	}
+	if !e.updatedAt.IsZero() && now.Sub(e.updatedAt) < e.client.Timeout {
+		return
+	}
+	e.update()
+}
+
+// Snapshot is a copy of an exporter's cached state, safe to use without
+// holding the exporter's lock.
+type Snapshot struct {
+	Device string
+	URI    string
+	// URIs are all the URIs the device is scraped from in turn, starting
+	// with URI.
+	URIs   []string
+	Labels map[string]string
+	// Up reports whether the most recent scrape succeeded.
+	Up bool
+	// Error is why the most recent scrape failed, empty if it succeeded.
+	Error string
+	// LastSuccess is when the most recent successful scrape finished, zero
+	// if none has.
+	LastSuccess time.Time
+	// CircuitOpen is true while the circuit breaker skips scrapes.
+	CircuitOpen bool
+	// Response is the result of the most recent scrape, or nil if it
+	// failed.
+	Response *APIResponse
+	// Status is the status block of the most recent successful scrape.
+	Status Status
+	// LastReadingTime is the measurement timestamp of the latest distinct
+	// reading, zero if the device reports none.
+	LastReadingTime time.Time
+	ScrapeDuration  time.Duration
+}
+
+// Snapshot returns a copy of the exporter's cached state. Readers other than
+// Collect should use it instead of touching the exporter's fields.
+func (e *Exporter) Snapshot() Snapshot {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	s := Snapshot{
+		Device:          e.name,
+		URI:             e.URI,
+		URIs:            append([]string(nil), e.uris...),
+		Labels:          make(map[string]string, len(e.labels)),
+		Up:              e.up == 1,
+		LastSuccess:     e.lastSuccess,
+		CircuitOpen:     e.circuit.state == circuitOpen,
+		Status:          e.lastStatus,
+		LastReadingTime: e.lastReadingTime,
+		ScrapeDuration:  e.lastTiming.total,
+	}
+	for k, v := range e.labels {
+		s.Labels[k] = v
+	}
+	if e.lastError != nil {
+		s.Error = e.lastError.Error()
+	}
+	if e.lastResponse != nil {
+		// Responses are never modified once parsed, so a shallow copy is
+		// enough.
+		response := *e.lastResponse
+		s.Response = &response
+	}
+	return s
+}
+
+// LastScrapeSuccessful reports whether the most recent scrape of the device
+// succeeded.
+func (e *Exporter) LastScrapeSuccessful() bool {
+	return e.Snapshot().Up
+}
+
+// humidityDesc returns the descriptor matching the configured humidity unit.
+func (e *Exporter) humidityDesc() *prometheus.Desc {
+	if e.humidityFraction {
+		return iqAirHumidityFraction
+	}
+	return iqAirHumidity
 }
 
 type APIData struct {
-	CO2         int     `json:"co"`
-	P25         int     `json:"p2"`
-	P10         int     `json:"p1"`
-	Temperature float64 `json:"tp"`
-	Humidity    int     `json:"hm"`
+	Timestamp   time.Time `json:"ts"`
+	CO2         int       `json:"co"`
+	P25         int       `json:"p2"`
+	P10         int       `json:"p1"`
+	Temperature float64   `json:"tp"`
+	Humidity    int       `json:"hm"`
+	// AQIUS is the US AQI as computed by the device, nil if it does not
+	// report one.
+	AQIUS *int `json:"aqius"`
+
+	// hasTemperature is whether the device reported tp at all, as a
+	// missing reading decodes to 0 °C.
+	hasTemperature bool
+}
+
+// usAQI returns the US AQI reported by the device, or computed from the
+// PM2.5 reading if it reports none.
+func (d APIData) usAQI() int {
+	if d.AQIUS != nil {
+		return *d.AQIUS
+	}
+	return usAQI(float64(d.P25))
+}
+
+// UnmarshalJSON decodes the current block, accepting ts as either an
+// RFC 3339 string or a Unix epoch in seconds or milliseconds, as some
+// firmware versions report it.
+func (d *APIData) UnmarshalJSON(b []byte) error {
+	type plain APIData
+	aux := struct {
+		*plain
+		Timestamp   json.RawMessage `json:"ts"`
+		Temperature *float64        `json:"tp"`
+	}{plain: (*plain)(d)}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	if aux.Temperature != nil {
+		d.Temperature, d.hasTemperature = *aux.Temperature, true
+	}
+	ts, err := parseDeviceTimestamp(aux.Timestamp)
+	if err != nil {
+		return fmt.Errorf("invalid ts: %v", err)
+	}
+	d.Timestamp = ts
+	return nil
+}
+
+// epochMillisThreshold separates epoch seconds from epoch milliseconds. As
+// seconds it is far in the future, as milliseconds it is in 2001.
+const epochMillisThreshold = 1e12
+
+// parseDeviceTimestamp parses a JSON timestamp given as an RFC 3339 string
+// or a Unix epoch, possibly quoted, in seconds or milliseconds. A missing or
+// null timestamp yields the zero time.
+func parseDeviceTimestamp(raw json.RawMessage) (time.Time, error) {
+	s := string(raw)
+	if s == "" || s == "null" {
+		return time.Time{}, nil
+	}
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+		if s == "" {
+			return time.Time{}, nil
+		}
+	}
+
+	// Integer epochs are parsed exactly; float64 cannot hold every
+	// millisecond epoch with its sub-second digits.
+	if epoch, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if epoch >= epochMillisThreshold {
+			return time.Unix(epoch/1000, (epoch%1000)*int64(time.Millisecond)).UTC(), nil
+		}
+		return time.Unix(epoch, 0).UTC(), nil
+	}
+	epoch, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Parse(time.RFC3339Nano, s)
+	}
+	if epoch >= epochMillisThreshold {
+		epoch /= 1000
+	}
+	sec, frac := math.Modf(epoch)
+	return time.Unix(int64(sec), int64(frac*1e9)).UTC(), nil
+}
+
+// Status holds the device status block. Fields the firmware does not report
+// are left nil.
+type Status struct {
+	Model           string `json:"model"`
+	SerialNumber    string `json:"serial_number"`
+	UpdateAvailable *bool  `json:"update_available"`
+}
+
+// Location is the device location as configured in its settings.
+type Location struct {
+	City      string   `json:"city"`
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+}
+
+// Settings holds the device settings block.
+type Settings struct {
+	NodeName string `json:"node_name"`
+	Location
+	// CO2 alert thresholds configured on the device, in ppm. Nil if the
+	// device does not report them.
+	CO2Warning  *float64 `json:"co2_warning"`
+	CO2Critical *float64 `json:"co2_critical"`
+}
+
+// OutdoorData holds the outdoor block some devices report alongside their
+// own readings. Fields the device does not report are left nil.
+type OutdoorData struct {
+	Temperature *float64 `json:"tp"`
+	// TemperatureUnit is C or F. Celsius is assumed if it is empty.
+	TemperatureUnit string `json:"tp_unit"`
+}
+
+// celsius returns the outdoor temperature in Celsius. It reports false if
+// there is none or its unit is unknown.
+func (o OutdoorData) celsius() (float64, bool) {
+	if o.Temperature == nil {
+		return 0, false
+	}
+	switch strings.ToUpper(o.TemperatureUnit) {
+	case "", "C":
+		return *o.Temperature, true
+	case "F":
+		return (*o.Temperature - 32) * 5 / 9, true
+	default:
+		return 0, false
+	}
 }
 
 type APIResponse struct {
-	Current APIData `json:"current"`
+	Current  APIData  `json:"current"`
+	Status   Status   `json:"status"`
+	Settings Settings `json:"settings"`
+	// Outdoor is nil unless the device reports outdoor conditions.
+	Outdoor *OutdoorData `json:"outdoor"`
+}
+
+// temperatureDelta returns the indoor minus the outdoor temperature in
+// Celsius. It reports false unless both are known.
+func (r APIResponse) temperatureDelta() (float64, bool) {
+	if r.Outdoor == nil || !r.Current.hasTemperature {
+		return 0, false
+	}
+	outdoor, ok := r.Outdoor.celsius()
+	if !ok {
+		return 0, false
+	}
+	return r.Current.Temperature - outdoor, true
 }
 
-func (e *Exporter) scrape(ch chan<- prometheus.Metric) (up float64, result *APIData) {
+// scrapeTiming records how long the phases of a scrape took. Phases that
+// were not reached are zero.
+type scrapeTiming struct {
+	total, timeToFirstByte, bodyRead time.Duration
+}
+
+// collect sends the durations of the phases that were reached.
+func (t scrapeTiming) collect(ch chan<- prometheus.Metric) {
+	if t.total > 0 {
+		ch <- prometheus.MustNewConstMetric(iqAirScrapeDuration, prometheus.GaugeValue, t.total.Seconds())
+	}
+	if t.timeToFirstByte > 0 {
+		ch <- prometheus.MustNewConstMetric(iqAirTimeToFirstByte, prometheus.GaugeValue, t.timeToFirstByte.Seconds())
+	}
+	if t.bodyRead > 0 {
+		ch <- prometheus.MustNewConstMetric(iqAirBodyRead, prometheus.GaugeValue, t.bodyRead.Seconds())
+	}
+}
+
+// scrape fetches and parses the device's JSON. Must be called with e.mutex
+// held.
+func (e *Exporter) scrape() (up float64, result *APIResponse, err error) {
 	e.totalScrapes.Inc()
 
-	resp, err := http.Get(e.URI)
+	start := e.nowFunc()
+	e.lastTiming = scrapeTiming{}
+	defer func() { e.lastTiming.total = e.nowFunc().Sub(start) }()
+
+	uri := e.uris[e.nextURI]
+	if e.apiRequests != nil {
+		e.apiRequests.WithLabelValues(strconv.Itoa(e.nextURI)).Inc()
+	}
+	e.nextURI = (e.nextURI + 1) % len(e.uris)
+	if e.trace != nil {
+		e.trace.uri = uri
+	}
+
+	fetch := e.fetch
+	if strings.HasPrefix(uri, fileURIPrefix) {
+		fetch = e.readFile
+	} else if len(e.candidatePaths) > 0 {
+		return e.scrapeCandidates(uri, start)
+	}
+	body, err := fetch(uri, start)
+	if err != nil {
+		return 0, nil, err
+	}
+	e.responseBytes.Add(float64(len(body)))
+
+	// Some devices answer with an empty body while booting.
+	if e.emptyBodyOK && len(bytes.TrimSpace(body)) == 0 {
+		return 1, nil, nil
+	}
+
+	var parsed APIResponse
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		e.jsonParseFailures.Inc()
+		return 0, nil, parseError{fmt.Errorf("parsing response body: %v", err)}
+	}
+	return 1, &parsed, nil
+}
+
+// fetch requests uri from the device and returns the response body. start
+// is when the scrape started. Must be called with e.mutex held.
+func (e *Exporter) fetch(uri string, start time.Time) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, redactURLError(err)
+	}
+	req.Header = e.headers.Clone()
+	if e.credentials != nil {
+		e.credentials.apply(req)
+	}
+	resp, err := e.client.Do(req)
 	if err != nil {
-		e.logger.Log("failed to scrape: %v", err)
-		return 0, nil
+		return nil, redactURLError(err)
 	}
 	defer resp.Body.Close()
+	e.lastTiming.timeToFirstByte = e.nowFunc().Sub(start)
+	if e.trace != nil {
+		e.trace.status, e.trace.header = resp.StatusCode, resp.Header
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if e.trace != nil {
+			// The error page may tell why the device failed.
+			e.trace.body, _ = io.ReadAll(resp.Body)
+		}
+		return nil, statusError{status: resp.Status}
+	}
 
+	// Timing the body read separately tells a device that is slow to
+	// produce its JSON apart from a slow network.
+	bodyStart := e.nowFunc()
 	body, err := io.ReadAll(resp.Body)
+	e.lastTiming.bodyRead = e.nowFunc().Sub(bodyStart)
+	if e.trace != nil {
+		e.trace.body = body
+	}
 	if err != nil {
-		e.logger.Log("failed to read body: %v", err)
-		return 0, nil
+		return nil, fmt.Errorf("reading response body: %v", err)
 	}
+	return body, nil
+}
 
-	var parsed APIResponse
-	e.logger.Log("parsed: %v", parsed)
+// redactURLError redacts the URI included in err, which may hold a
+// password.
+func redactURLError(err error) error {
+	if urlErr, ok := err.(*url.Error); ok {
+		urlErr.URL = redactURI(urlErr.URL)
+	}
+	return err
+}
 
-	if err := json.Unmarshal(body, &parsed); err != nil {
-		e.logger.Log("failed to parse body: %v", err)
-		return 0, nil
+// statusError is the error of a request the device answered with a
+// status other than 2xx, e.g. while it is booting. Like an unreachable
+// device, it fails the scrape rather than the parse.
+type statusError struct {
+	status string
+}
+
+func (e statusError) Error() string {
+	return "device answered with HTTP status " + e.status
+}
+
+// parseError is the error of a scrape that received a response that did
+// not parse, as opposed to one that received no response.
+type parseError struct {
+	error
+}
+
+// fileURIPrefix marks scrape URIs naming a local file holding a device
+// response, e.g. one saved by a cron job.
+const fileURIPrefix = "file://"
+
+// readFile reads the device response saved in the file uri names. A
+// missing or unreadable file fails the scrape like an unreachable device.
+// Must be called with e.mutex held.
+func (e *Exporter) readFile(uri string, _ time.Time) ([]byte, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	bodyStart := e.nowFunc()
+	body, err := os.ReadFile(u.Path)
+	e.lastTiming.bodyRead = e.nowFunc().Sub(bodyStart)
+	if err != nil {
+		return nil, fmt.Errorf("reading file: %v", err)
+	}
+	if e.trace != nil {
+		// There are no headers, but there is a body to parse.
+		e.trace.header, e.trace.body = http.Header{}, body
+	}
+	return body, nil
+}
+
+// isNewReading reports whether result is a measurement that has not been seen
+// before, based on the device's measurement timestamp. Readings without a
+// timestamp are always treated as new. Must be called with e.mutex held.
+func (e *Exporter) isNewReading(result *APIData) bool {
+	if result.Timestamp.IsZero() {
+		return true
+	}
+	if result.Timestamp.Equal(e.lastReadingTime) {
+		return false
+	}
+	e.lastReadingTime = result.Timestamp
+	return true
+}
+
+// formatCoordinate formats a coordinate for use as a label value. The
+// shortest exact representation keeps the value stable across scrapes.
+func formatCoordinate(c *float64) string {
+	if c == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*c, 'f', -1, 64)
+}
+
+// maxScrapeErrorLength is the maximum length of the error label of
+// iqair_last_scrape_error.
+const maxScrapeErrorLength = 200
+
+// scrapeErrorLabel returns err as a single line of at most
+// maxScrapeErrorLength characters with uris redacted, or "" if err is nil.
+func scrapeErrorLabel(err error, uris []string) string {
+	if err == nil {
+		return ""
 	}
+	msg := strings.Join(strings.FieldsFunc(redactURIs(err.Error(), uris), func(r rune) bool {
+		return unicode.IsSpace(r) || !unicode.IsPrint(r)
+	}), " ")
+	return truncateLabelValue(msg, maxScrapeErrorLength)
+}
+
+// labelValues returns values for use as the values of dynamic labels, each
+// truncated to the configured maximum length.
+func (e *Exporter) labelValues(values ...string) []string {
+	for i, v := range values {
+		values[i] = truncateLabelValue(v, e.maxLabelLength)
+	}
+	return values
+}
 
-	return 1, &parsed.Current
+// truncateLabelValue shortens v to at most max characters, replacing the
+// last one with an ellipsis. It never splits a UTF-8 sequence. A max of zero
+// or less means no limit.
+func truncateLabelValue(v string, max int) string {
+	if max <= 0 || utf8.RuneCountInString(v) <= max {
+		return v
+	}
+	runes := []rune(v)
+	return string(runes[:max-1]) + "…"
+}
+
+// toleranceLabel formats d in seconds, e.g. "60s" or "1.5s", so that the
+// label value does not change with how the flag was written.
+func toleranceLabel(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "s"
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// warnWithoutPolling warns that the output what, which acts on new
+// readings, is enabled without --iqair.poll-interval, so that readings are
+// only verb, e.g. "published", when Prometheus scrapes the exporter.
+func warnWithoutPolling(logger log.Logger, what, verb string) {
+	level.Warn(logger).Log("msg", "Enabled without --iqair.poll-interval; readings are only "+verb+" when Prometheus scrapes the exporter", "output", what)
 }
 
 func main() {
 	var (
-		webConfig      = webflag.AddFlags(kingpin.CommandLine)
-		listenAddress  = kingpin.Flag("web.listen-address", "Address to listen on for web interface and telemetry.").Default(":9861").String()
-		metricsPath    = kingpin.Flag("web.telemetry-path", "Path under which to expose metrics.").Default("/metrics").String()
-		iqairScrapeURI = kingpin.Flag("iqair.scrape-uri", "URI on which to scrape iqAir.").String()
+		webConfig        = webflag.AddFlags(kingpin.CommandLine)
+		listenAddress    = kingpin.Flag("web.listen-address", "Address to listen on for web interface and telemetry, "+defaultListenAddress+" unless --web.systemd-socket is set. Repeat to listen on several addresses. unix:///path/to/socket listens on a Unix domain socket. Set to an empty string to only push metrics.").Strings()
+		headerTimeout    = kingpin.Flag("web.read-header-timeout", "Maximum time to read the headers of a request. Disabled if zero.").Default("5s").Duration()
+		readTimeout      = kingpin.Flag("web.read-timeout", "Maximum time to read a whole request. Disabled if zero.").Default("30s").Duration()
+		writeTimeout     = kingpin.Flag("web.write-timeout", "Maximum time from the end of the request headers to the end of the response, which must cover scraping the devices. Does not apply to /api/v1/stream and /api/v1/ws. Disabled if zero.").Default("2m").Duration()
+		idleTimeout      = kingpin.Flag("web.idle-timeout", "Maximum time to wait for the next request on a keep-alive connection. Disabled if zero.").Default("2m").Duration()
+		maxHeaderBytes   = kingpin.Flag("web.max-header-bytes", "Maximum size of the headers of a request, e.g. 64KiB.").Default("64KiB").Bytes()
+		socketMode       = kingpin.Flag("web.socket-mode", "File mode, in octal, of the Unix domain sockets listened on.").Default("0660").String()
+		socketOwner      = kingpin.Flag("web.socket-owner", "Owner of the Unix domain sockets listened on, as user[:group] by name or ID. Unchanged if empty.").Default("").String()
+		systemdSocket    = kingpin.Flag("web.systemd-socket", "Serve on the sockets passed by systemd socket activation, in addition to any --web.listen-address.").Default("false").Bool()
+		metricsPath      = kingpin.Flag("web.telemetry-path", "Path under which to expose metrics.").Default("/metrics").String()
+		logRequests      = kingpin.Flag("web.log-requests", "Log every HTTP request with its method, path, status, response size, duration and remote address.").Default("false").Bool()
+		logRequestLevel  = kingpin.Flag("web.log-requests-level", "Level at which --web.log-requests logs requests.").Default(requestLogDebug).Enum(requestLogDebug, requestLogInfo)
+		logRequestSkip   = kingpin.Flag("web.log-requests-exclude", "Path, including any route prefix, whose requests --web.log-requests does not log, e.g. /metrics to leave out Prometheus scrapes. Can be repeated.").Strings()
+		allowedCIDRs     = kingpin.Flag("web.allowed-cidrs", "Comma-separated networks, e.g. 192.168.1.0/24,10.0.0.5/32, whose clients may use the HTTP endpoints. Other clients get 403 Forbidden. Everyone is allowed if empty.").Default("").String()
+		trustedProxies   = kingpin.Flag("web.trusted-proxies", "Comma-separated networks of reverse proxies whose X-Forwarded-For header names the client for --web.allowed-cidrs.").Default("").String()
+		rawExternalURL   = kingpin.Flag("web.external-url", "The URL under which the exporter is externally reachable, e.g. behind a reverse proxy. Used to build redirects, and its path is the default --web.route-prefix.").Default("").String()
+		rawRoutePrefix   = kingpin.Flag("web.route-prefix", "Prefix for all HTTP endpoints. Defaults to the path of --web.external-url.").Default("").String()
+		redirectUnprefix = kingpin.Flag("web.redirect-unprefixed", "Redirect requests to paths outside --web.route-prefix to the same path below the external URL instead of answering 404.").Default("false").Bool()
+		maxRequests      = kingpin.Flag("web.max-requests", "Maximum number of concurrent requests to the metrics path, and separately to the device metrics paths together, answered with 503 beyond it. 0 means no limit.").Default("40").Int()
+		handlerTimeout   = kingpin.Flag("web.handler-timeout", "Time after which a request to a metrics path is answered with 503, e.g. when a device is slow to scrape. Disabled if zero.").Default("0s").Duration()
+		noExporterStats  = kingpin.Flag("web.disable-exporter-metrics", "Exclude metrics about the exporter process itself (promhttp_*, process_*, go_*).").Default("false").Bool()
+		perDevicePaths   = kingpin.Flag("web.device-metrics-paths", "Also expose each device's metrics on its own path, <telemetry-path>/devices/<name>.").Default("false").Bool()
+		enableDebug      = kingpin.Flag("web.enable-debug", "Enable debugging endpoints: POST /-/scrape to scrape the devices immediately, GET /debug/scrape to diagnose scrapes, which exposes raw device responses, and GET /history listing recent parsed responses.").Default("false").Bool()
+		readyStaleness   = kingpin.Flag("web.ready-max-staleness", "Maximum age of the last successful scrape of at least one device for /-/ready to report the exporter as ready.").Default("5m").Duration()
+		apiStaleAfter    = kingpin.Flag("web.api-stale-after", "Age after which a reading served by /api/v1/current is flagged as stale.").Default("5m").Duration()
+		wsMaxConns       = kingpin.Flag("web.websocket-max-connections", "Maximum number of concurrent clients of /api/v1/ws. 0 disables the WebSocket endpoint.").Default("100").Int()
+		shutdownGrace    = kingpin.Flag("web.shutdown-grace-period", "Time allowed on SIGINT or SIGTERM for in-flight requests and scrapes to finish and for outputs to flush before the exporter exits.").Default("30s").Duration()
+		configFile       = kingpin.Flag("config.file", "Path to a configuration file listing the devices to scrape. Mutually exclusive with --iqair.scrape-uri.").Default("").String()
+		configCheck      = kingpin.Flag("config.check", "Validate --config.file, the --iqair.* flags choosing and authenticating to the devices, and the secret files they name, print the effective devices and notifications with secrets redacted, and exit without contacting the devices. Output, push and web flags are not checked.").Default("false").Bool()
+		iqairScrapeURI   = kingpin.Flag("iqair.scrape-uri", "URI on which to scrape iqAir.").String()
+		iqairTimeout     = kingpin.Flag("iqair.timeout", "Timeout for scraping a device. Devices in --config.file can override it with timeout.").Default("10s").Duration()
+		minTLSVersion    = kingpin.Flag("iqair.min-tls-version", "Minimum TLS version to accept when scraping devices over HTTPS (1.2 or 1.3).").Default("1.2").Enum("1.2", "1.3")
+		tlsServerName    = kingpin.Flag("iqair.tls-server-name", "Server name to send as SNI and verify the device's certificate against, instead of the host of the scrape URI.").Default("").String()
+		iqairHeaders     = kingpin.Flag("iqair.header", "Header to send with scrape requests, as name=value, replacing the default Accept: application/json. An empty value removes the header. Can be repeated.").Strings()
+		candidatePaths   = kingpin.Flag("iqair.candidate-path", "Path to try on the device's host instead of the path of the scrape URI, e.g. /measurements. Repeat to try several paths in order until one returns a parseable response, for devices with unknown firmware.").Strings()
+		iqairUsername    = kingpin.Flag("iqair.username", "Username for basic authentication to the devices, with --iqair.password-file.").Default("").String()
+		passwordFile     = kingpin.Flag("iqair.password-file", "File holding the password for basic authentication to the devices, e.g. a Docker or Kubernetes secret. Re-read on SIGHUP.").Default("").String()
+		bearerTokenFile  = kingpin.Flag("iqair.bearer-token-file", "File holding a bearer token to authenticate to the devices with. Re-read on SIGHUP.").Default("").String()
+		apiKeyFile       = kingpin.Flag("iqair.api-key-file", "File holding the key of the device's AirVisual API link, to scrape "+airVisualAPIBase+"<key> instead of --iqair.scrape-uri.").Default("").String()
+		iqairResolve     = kingpin.Flag("iqair.resolve", "Static host:ip resolution for device host names, e.g. airvisual.local:192.168.1.20. Can be repeated.").Strings()
+		humidityFraction = kingpin.Flag("iqair.humidity-fraction", "Export relative humidity as a fraction between 0 and 1 instead of a percentage.").Default("false").Bool()
+		thresholds       = kingpin.Flag("iqair.threshold", "Alert threshold to export as iqair_configured_threshold, as metric=value (e.g. co2=1000). Repeat for multiple metrics. The thresholds of --config.file replace these for the same metric.").Strings()
+		aqiColorMetric   = kingpin.Flag("iqair.aqi-color-index", "Export iqair_aqi_color_index, the index from 0 (green) to 5 (maroon) of the color of the US AQI category, for panels mapping it to the official palette.").Default("false").Bool()
+		targetInfo       = kingpin.Flag("iqair.target-info", "Export an OpenTelemetry-style target_info metric per device carrying its serial, model, and configured labels.").Default("false").Bool()
+		upMetricName     = kingpin.Flag("iqair.up-metric-name", "Name of the metric reporting whether the last scrape was successful.").Default(defaultUpMetricName).String()
+		upMetricLabels   = kingpin.Flag("iqair.up-metric-label", "Constant label to add to the up metric, as name=value. Repeat for multiple labels.").Strings()
+		deviceName       = kingpin.Flag("iqair.device-name", "Name of the device, added as a device label to all of its metrics. No label is added if empty.").Default("").String()
+		pm25Histogram    = kingpin.Flag("iqair.pm25-histogram", "Export a histogram of PM2.5 readings, observed once per device measurement.").Default("false").Bool()
+		dashboardPath    = kingpin.Flag("dashboard.generate", "Write a Grafana dashboard for the configured devices, metrics and thresholds to this path (- for stdout) and exit.").Default("").String()
+		pm25Buckets      = kingpin.Flag("iqair.pm25-histogram-buckets", "Bucket upper bounds in µg/m³ for the PM2.5 histogram. Repeat for multiple buckets.").Default("5", "12", "35.5", "55.5", "150.5", "250.5", "350.5", "500").Float64List()
+
+		remoteWriteURL      = kingpin.Flag("push.remote-write-url", "Prometheus remote-write endpoint to push metrics to. Disabled if empty.").Default("").String()
+		remoteWriteInterval = kingpin.Flag("push.interval", "Interval at which devices are scraped and the results pushed.").Default("1m").Duration()
+		remoteWriteTimeout  = kingpin.Flag("push.timeout", "Timeout for each push request.").Default("30s").Duration()
+		remoteWriteLabels   = kingpin.Flag("push.label", "Extra label to add to all pushed series, as name=value. Repeat for multiple labels.").Strings()
+		remoteWriteUser     = kingpin.Flag("push.basic-auth-username", "Username for basic authentication to the remote-write endpoint.").Default("").String()
+		remoteWritePassword = kingpin.Flag("push.basic-auth-password", "Password for basic authentication to the remote-write endpoint.").Default("").String()
+		remoteWriteToken    = kingpin.Flag("push.bearer-token", "Bearer token for authentication to the remote-write endpoint.").Default("").String()
+		remoteWriteRetries  = kingpin.Flag("push.max-retries", "Maximum number of retries for a failed push before the batch is dropped.").Default("5").Int()
+		remoteWriteQueue    = kingpin.Flag("push.queue-size", "Maximum number of batches held in memory while the push endpoint is unavailable.").Default("60").Int()
+
+		gatewayURL              = kingpin.Flag("push.gateway-url", "Pushgateway to push each device's metrics to. Disabled if empty.").Default("").String()
+		gatewayJob              = kingpin.Flag("push.gateway-job", "Job name to push metrics under.").Default("iqair_exporter").String()
+		gatewayGrouping         = kingpin.Flag("push.gateway-grouping", "Extra grouping label, as name=value, added to the device name. Repeat for multiple labels.").Strings()
+		gatewayDeleteOnShutdown = kingpin.Flag("push.gateway-delete-on-shutdown", "Delete the pushed metrics from the Pushgateway when the exporter shuts down.").Default("false").Bool()
+		gatewayUser             = kingpin.Flag("push.gateway-basic-auth-username", "Username for basic authentication to the Pushgateway.").Default("").String()
+		gatewayPassword         = kingpin.Flag("push.gateway-basic-auth-password", "Password for basic authentication to the Pushgateway.").Default("").String()
+		gatewayCAFile           = kingpin.Flag("push.gateway-tls-ca-file", "CA certificate to verify the Pushgateway with.").Default("").String()
+		gatewayCertFile         = kingpin.Flag("push.gateway-tls-cert-file", "Client certificate for TLS authentication to the Pushgateway.").Default("").String()
+		gatewayKeyFile          = kingpin.Flag("push.gateway-tls-key-file", "Client key for TLS authentication to the Pushgateway.").Default("").String()
+		gatewayInsecure         = kingpin.Flag("push.gateway-tls-insecure-skip-verify", "Disable verification of the Pushgateway's certificate.").Default("false").Bool()
+		pushCAFile              = kingpin.Flag("push.tls-ca-file", "CA certificate to verify the remote-write endpoint with.").Default("").String()
+		pushCertFile            = kingpin.Flag("push.tls-cert-file", "Client certificate for TLS authentication to the remote-write endpoint.").Default("").String()
+		pushKeyFile             = kingpin.Flag("push.tls-key-file", "Client key for TLS authentication to the remote-write endpoint.").Default("").String()
+		pushInsecure            = kingpin.Flag("push.tls-insecure-skip-verify", "Disable verification of the remote-write endpoint's certificate.").Default("false").Bool()
+		failOnStartup           = kingpin.Flag("iqair.fail-on-startup-error", "Exit with an error instead of serving metrics if a device not marked optional in --config.file cannot be scraped at startup, within --iqair.startup-wait if set.").Default("false").Bool()
+		requireInitialScrape    = kingpin.Flag("iqair.require-initial-scrape", "Alias of --iqair.fail-on-startup-error.").Default("false").Bool()
+		startupWait             = kingpin.Flag("iqair.startup-wait", "Maximum time to wait at startup for all devices to become reachable before serving metrics. Disabled if zero.").Default("0s").Duration()
+		readingTolerance        = kingpin.Flag("iqair.reading-tolerance", "Export iqair_reading_within_tolerance, reporting whether the device's measurement timestamp lags by at most this much. Disabled if zero.").Default("0s").Duration()
+		exitAfterFailures       = kingpin.Flag("iqair.exit-after-consecutive-failures", "Exit with code 3, for the supervisor to restart the exporter, once every device has failed this many consecutive scrapes. Disabled if zero.").Default("0").Int()
+		selfWatchdog            = kingpin.Flag("iqair.self-watchdog", "Periodically request /-/healthy from each listen address, and exit with an error for the supervisor to restart the exporter if the HTTP server stops answering.").Default("false").Bool()
+		selfWatchdogInterval    = kingpin.Flag("iqair.self-watchdog-interval", "Interval between the requests of --iqair.self-watchdog, each of which times out after half of it.").Default("30s").Duration()
+		selfWatchdogFailures    = kingpin.Flag("iqair.self-watchdog-failures", "Number of consecutive failed requests after which --iqair.self-watchdog exits.").Default("3").Int()
+		circuitFailures         = kingpin.Flag("iqair.circuit-breaker-failures", "Number of consecutive failed scrapes after which a device is not scraped for --iqair.circuit-breaker-cooldown. Disabled if zero.").Default("0").Int()
+		rawHistorySize          = kingpin.Flag("iqair.history-size", "Number of parsed responses per device served by /history with --web.enable-debug.").Default("10").Int()
+		successWindow           = kingpin.Flag("iqair.success-ratio-window", "Number of recent scrapes of each device iqair_exporter_scrape_success_ratio is computed over. Disabled if zero.").Default("100").Int()
+		circuitCooldown         = kingpin.Flag("iqair.circuit-breaker-cooldown", "Time to leave a failing device alone once its circuit breaker opens.").Default("5m").Duration()
+		autoLabelsSpec          = kingpin.Flag("iqair.auto-labels", "Comma-separated device settings to add as labels to all of the device's metrics, read on the first successful scrape: node_name, city, latitude, longitude.").Default("").String()
+		nanOnFailure            = kingpin.Flag("iqair.nan-on-failure", "Export the CO2, particulate, temperature and humidity readings as NaN after a failed scrape instead of leaving them out, so that graphs show a gap instead of the last value.").Default("false").Bool()
+		emptyBodyOK             = kingpin.Flag("iqair.empty-body-ok", "Treat an empty response body as a successful scrape without data, reported by iqair_no_data, instead of a failed one.").Default("false").Bool()
+		lastScrapeError         = kingpin.Flag("iqair.last-scrape-error", "Export iqair_last_scrape_error, carrying the error of each device's most recent scrape as a label.").Default("false").Bool()
+		maxLabelLength          = kingpin.Flag("iqair.max-label-length", "Truncate label values taken from device responses, such as the city or serial number, to this many characters. Disabled if zero.").Default("0").Int()
+		pollInterval            = kingpin.Flag("iqair.poll-interval", "Scrape devices in the background at this interval and serve the latest result, instead of scraping on every Prometheus scrape. Needed for push outputs that publish new readings, such as MQTT. Disabled if zero.").Default("0s").Duration()
+
+		mqttBroker      = kingpin.Flag("mqtt.broker", "MQTT broker to publish new readings to, e.g. tcp://broker:1883 or ssl://broker:8883. Disabled if empty.").Default("").String()
+		mqttTopicPrefix = kingpin.Flag("mqtt.topic-prefix", "Prefix of the topics readings are published to.").Default("iqair").String()
+		mqttClientID    = kingpin.Flag("mqtt.client-id", "MQTT client ID.").Default("iqair_exporter").String()
+		mqttUsername    = kingpin.Flag("mqtt.username", "Username for authentication to the MQTT broker.").Default("").String()
+		mqttPassword    = kingpin.Flag("mqtt.password", "Password for authentication to the MQTT broker.").Default("").String()
+		mqttCAFile      = kingpin.Flag("mqtt.tls-ca-file", "CA certificate to verify the MQTT broker with.").Default("").String()
+		mqttCertFile    = kingpin.Flag("mqtt.tls-cert-file", "Client certificate for TLS authentication to the MQTT broker.").Default("").String()
+		mqttKeyFile     = kingpin.Flag("mqtt.tls-key-file", "Client key for TLS authentication to the MQTT broker.").Default("").String()
+		mqttInsecure    = kingpin.Flag("mqtt.tls-insecure-skip-verify", "Disable verification of the MQTT broker's certificate.").Default("false").Bool()
+		mqttQoS         = kingpin.Flag("mqtt.qos", "QoS level to publish with (0, 1 or 2).").Default("0").Uint8()
+		mqttRetain      = kingpin.Flag("mqtt.retain", "Publish readings as retained messages.").Default("false").Bool()
+		mqttFormat      = kingpin.Flag("mqtt.format", "Publish each value to its own topic (<prefix>/<device>/<metric>) or one JSON document per reading (<prefix>/<device>).").Default(mqttFormatValues).Enum(mqttFormatValues, mqttFormatJSON)
+		mqttQueueSize   = kingpin.Flag("mqtt.queue-size", "Maximum number of readings waiting to be published.").Default("100").Int()
+		mqttHADiscovery = kingpin.Flag("mqtt.homeassistant-discovery", "Publish Home Assistant MQTT discovery configs so the sensors appear in Home Assistant automatically.").Default("false").Bool()
+		mqttHAPrefix    = kingpin.Flag("mqtt.homeassistant-prefix", "Home Assistant MQTT discovery prefix.").Default("homeassistant").String()
+
+		influxURL           = kingpin.Flag("influx.url", "Base URL of an InfluxDB server to write new readings to, e.g. http://influx:8086. Disabled if empty.").Default("").String()
+		influxAPIVersion    = kingpin.Flag("influx.api-version", "InfluxDB write API to use: 1 for /write, 2 for /api/v2/write.").Default("2").Enum("1", "2")
+		influxDatabase      = kingpin.Flag("influx.database", "Database to write to (1.x API).").Default("").String()
+		influxRetention     = kingpin.Flag("influx.retention-policy", "Retention policy to write to (1.x API). Uses the database default if empty.").Default("").String()
+		influxUsername      = kingpin.Flag("influx.username", "Username for authentication (1.x API).").Default("").String()
+		influxPassword      = kingpin.Flag("influx.password", "Password for authentication (1.x API).").Default("").String()
+		influxToken         = kingpin.Flag("influx.token", "API token (2.x API).").Default("").String()
+		influxOrg           = kingpin.Flag("influx.org", "Organization to write to (2.x API).").Default("").String()
+		influxBucket        = kingpin.Flag("influx.bucket", "Bucket to write to (2.x API).").Default("").String()
+		influxBatchSize     = kingpin.Flag("influx.batch-size", "Maximum number of points per write request.").Default("100").Int()
+		influxFlushInterval = kingpin.Flag("influx.flush-interval", "Maximum time points are held before being written.").Default("10s").Duration()
+		influxMaxRetries    = kingpin.Flag("influx.max-retries", "Maximum number of retries for a write that failed with a server error.").Default("5").Int()
+
+		graphiteAddress   = kingpin.Flag("graphite.address", "host:port of a Graphite plaintext listener to send new readings to. Disabled if empty.").Default("").String()
+		graphitePrefix    = kingpin.Flag("graphite.prefix", "Prefix of the Graphite metric paths.").Default("iqair").String()
+		graphiteMaxBuffer = kingpin.Flag("graphite.max-buffer", "Maximum number of lines buffered while Graphite is unreachable.").Default("10000").Int()
+
+		statsdAddress   = kingpin.Flag("statsd.address", "StatsD address to send new readings to: host:port for UDP, or unix:///path/to/socket for a unix datagram socket. Disabled if empty.").Default("").String()
+		statsdPrefix    = kingpin.Flag("statsd.prefix", "Prefix of the StatsD metric names.").Default("iqair").String()
+		statsdFormat    = kingpin.Flag("statsd.format", "Put the device name into the metric name (plain) or send it as a DogStatsD tag (dogstatsd).").Default(statsdFormatPlain).Enum(statsdFormatPlain, statsdFormatDogStatsD)
+		statsdQueueSize = kingpin.Flag("statsd.queue-size", "Maximum number of readings waiting to be sent.").Default("100").Int()
+
+		sqlitePath          = kingpin.Flag("storage.sqlite.path", "Path of an SQLite database to keep a local history of readings in. Disabled if empty.").Default("").String()
+		sqliteRetention     = kingpin.Flag("storage.sqlite.retention", "How long to keep readings in the SQLite database. Zero keeps them forever.").Default("0s").Duration()
+		sqliteBatchSize     = kingpin.Flag("storage.sqlite.batch-size", "Maximum number of readings written to the SQLite database at once.").Default("100").Int()
+		sqliteFlushInterval = kingpin.Flag("storage.sqlite.flush-interval", "Maximum time readings are held before being written to the SQLite database.").Default("5m").Duration()
+
+		exportMaxRange = kingpin.Flag("web.export-max-range", "Longest time range /export.csv serves. Unlimited if zero.").Default("744h").Duration()
+		historySize    = kingpin.Flag("history.size", "Number of readings per device to keep in memory for /api/v1/history. Disabled if zero.").Default("0").Int()
+
+		csvPath     = kingpin.Flag("log.readings-csv", "Append one CSV row per new reading to this file. Disabled if empty.").Default("").String()
+		csvMaxSize  = kingpin.Flag("log.readings-csv-max-size", "Rotate the CSV log once it reaches this size, e.g. 10MB. Disabled if zero.").Default("0").Bytes()
+		csvMaxAge   = kingpin.Flag("log.readings-csv-max-age", "Rotate the CSV log once it has been open this long. Disabled if zero.").Default("0s").Duration()
+		csvMaxFiles = kingpin.Flag("log.readings-csv-max-files", "Number of rotated CSV logs to keep.").Default("5").Int()
+
+		kafkaBrokers      = kingpin.Flag("kafka.brokers", "Comma-separated host:port list of Kafka brokers to publish new readings to. Disabled if empty.").Default("").String()
+		kafkaTopic        = kingpin.Flag("kafka.topic", "Kafka topic to publish readings to.").Default("iqair").String()
+		kafkaClientID     = kingpin.Flag("kafka.client-id", "Kafka client ID.").Default("iqair_exporter").String()
+		kafkaSASLUsername = kingpin.Flag("kafka.sasl-username", "Username for SASL/PLAIN authentication to Kafka.").Default("").String()
+		kafkaSASLPassword = kingpin.Flag("kafka.sasl-password", "Password for SASL/PLAIN authentication to Kafka.").Default("").String()
+		kafkaTLS          = kingpin.Flag("kafka.tls", "Connect to the Kafka brokers over TLS.").Default("false").Bool()
+		kafkaCAFile       = kingpin.Flag("kafka.tls-ca-file", "CA certificate to verify the Kafka brokers with. Implies --kafka.tls.").Default("").String()
+		kafkaCertFile     = kingpin.Flag("kafka.tls-cert-file", "Client certificate for TLS authentication to Kafka. Implies --kafka.tls.").Default("").String()
+		kafkaKeyFile      = kingpin.Flag("kafka.tls-key-file", "Client key for TLS authentication to Kafka.").Default("").String()
+		kafkaInsecure     = kingpin.Flag("kafka.tls-insecure-skip-verify", "Disable verification of the Kafka brokers' certificates.").Default("false").Bool()
+		kafkaQueueSize    = kingpin.Flag("kafka.queue-size", "Maximum number of readings waiting to be published.").Default("1000").Int()
+
+		cloudWatchNamespace   = kingpin.Flag("cloudwatch.namespace", "CloudWatch namespace to push new readings to. Credentials are resolved like the AWS SDKs do. Disabled if empty.").Default("").String()
+		cloudWatchRegion      = kingpin.Flag("cloudwatch.region", "AWS region to push to. Defaults to AWS_REGION or AWS_DEFAULT_REGION.").Default("").String()
+		cloudWatchEndpoint    = kingpin.Flag("cloudwatch.endpoint", "URL of the CloudWatch API, overriding the regional endpoint.").Default("").String()
+		cloudWatchMetrics     = kingpin.Flag("cloudwatch.metric", "Reading to push (pm25, pm10, co2, temperature or humidity). Repeat for multiple readings. Defaults to all of them.").Strings()
+		cloudWatchSiteLabel   = kingpin.Flag("cloudwatch.site-label", "Configured device label whose value is pushed as the Site dimension.").Default("site").String()
+		cloudWatchMinInterval = kingpin.Flag("cloudwatch.min-interval", "Minimum time between two pushes to CloudWatch; readings in between are batched.").Default("1m").Duration()
+		cloudWatchMaxRetries  = kingpin.Flag("cloudwatch.max-retries", "Maximum number of retries for a push that was throttled or failed with a server error.").Default("5").Int()
+		cloudWatchQueueSize   = kingpin.Flag("cloudwatch.queue-size", "Maximum number of readings waiting to be pushed.").Default("1000").Int()
+
+		otlpEnabled  = kingpin.Flag("otlp.enabled", "Export metrics over OTLP/HTTP. Also enabled by setting --otlp.endpoint or the OTEL_EXPORTER_OTLP_ENDPOINT environment variable; the other OTEL_EXPORTER_OTLP_* variables are honored too.").Default("false").Bool()
+		otlpProtocol = kingpin.Flag("otlp.protocol", "OTLP transport, http/protobuf or grpc. Overrides OTEL_EXPORTER_OTLP_PROTOCOL.").Default("").String()
+		otlpEndpoint = kingpin.Flag("otlp.endpoint", "URL to export OTLP metrics to, e.g. http://collector:4318/v1/metrics, or with grpc the collector's address, e.g. http://collector:4317. Overrides OTEL_EXPORTER_OTLP_ENDPOINT.").Default("").String()
+		otlpHeaders  = kingpin.Flag("otlp.header", "Header to send with OTLP requests, as name=value. Can be repeated.").Strings()
+		otlpInterval = kingpin.Flag("otlp.interval", "Interval between OTLP exports. Overrides OTEL_METRIC_EXPORT_INTERVAL.").Default("0s").Duration()
+		otlpTimeout  = kingpin.Flag("otlp.timeout", "Timeout of each OTLP export. Overrides OTEL_EXPORTER_OTLP_TIMEOUT.").Default("0s").Duration()
+
+		textfileDirectory = kingpin.Flag("textfile.directory", "Write metrics to "+textfileName+" in this directory for node_exporter's textfile collector. Disabled if empty.").Default("").String()
+		textfileInterval  = kingpin.Flag("textfile.interval", "Interval at which the textfile is rewritten.").Default("1m").Duration()
+		textfileOnFailure = kingpin.Flag("textfile.on-failure", "What to do with the textfile once device scrapes keep failing: keep writing it, skip updating it so its mtime goes stale, or remove it.").Default(textfileOnFailureWrite).Enum(textfileOnFailureWrite, textfileOnFailureSkip, textfileOnFailureRemove)
+		textfileThreshold = kingpin.Flag("textfile.failure-threshold", "Number of consecutive writes with a failed device scrape before --textfile.on-failure applies.").Default("3").Int()
+
+		once       = kingpin.Flag("once", "Scrape each device once, push the results to the Pushgateway, write the textfile and/or print the metrics, and exit without listening. Exits with 4 if a device could not be scraped, 5 if its response did not parse, and 1 if a push or write failed.").Default("false").Bool()
+		onceFormat = kingpin.Flag("format", "With --once, print the metrics to stdout in the Prometheus text format (prometheus), the default without --push.gateway-url or --textfile.directory, or each device's reading as InfluxDB line protocol (influx) or Telegraf JSON (json), e.g. for Telegraf's exec input.").Enum(onceFormatPrometheus, onceFormatInflux, onceFormatJSON)
+
+		metricsLint = kingpin.Flag("metrics.lint", "Check the exported metrics against the Prometheus naming conventions at startup, and warn about violations or refuse to start. Gathering them scrapes the devices unless --iqair.poll-interval is set.").Default(metricsLintOff).Enum(metricsLintOff, metricsLintWarn, metricsLintFail)
 	)
 
+	kingpin.Command("serve", "Serve the metrics of the devices. This is the default.").Default()
+	checkCommand := kingpin.Command("check", "Scrape each device once, print a report of what it returned, and exit with an error if any device failed.")
+	checkOutput := checkCommand.Flag("output", "Format of the report.").Default(checkOutputText).Enum(checkOutputText, checkOutputJSON)
+	discoverCommand := kingpin.Command("discover", "Find devices on the local network by mDNS and, with --cidr, by probing every address, print them and exit.")
+	discoverOutput := discoverCommand.Flag("output", "Format of the list of devices.").Default(checkOutputText).Enum(checkOutputText, checkOutputJSON)
+	discoverTimeout := discoverCommand.Flag("timeout", "Time to wait for mDNS answers, and for each address probed to answer.").Default("5s").Duration()
+	discoverMDNS := discoverCommand.Flag("mdns", "Browse mDNS for devices. Disable with --no-mdns to only scan --cidr.").Default("true").Bool()
+	discoverService := discoverCommand.Flag("mdns.service", "mDNS service to browse for.").Default("_http._tcp").String()
+	discoverCIDRs := discoverCommand.Flag("cidr", "Comma-separated networks, e.g. 192.168.1.0/24, whose addresses are all probed, at most 4096.").Default("").String()
+	mockCommand := kingpin.Command("mock-device", "Serve synthetic readings like an AirVisual monitor, for demos and developing dashboards without a device. It serves the local device API on /, /measurements and /api/v1/status and the AirVisual cloud API on "+airVisualKeyPrefix+"<any key>.")
+	mockListen := mockCommand.Flag("listen", "Address to serve the mock device on.").Default(":8080").String()
+	mockModel := mockCommand.Flag("model", "Model to pretend to be. Outdoor monitors have no CO2 sensor.").Default(mockModelPro).Enum(mockModelPro, mockModelOutdoor)
+	mockFirmware := mockCommand.Flag("firmware", "Firmware version to report.").Default("1.17").String()
+	mockSerial := mockCommand.Flag("serial", "Serial number to report.").Default("MOCK0001").String()
+	mockUpdate := mockCommand.Flag("update-available", "Report a pending firmware update.").Default("false").Bool()
+	mockWarmUp := mockCommand.Flag("warm-up", "Answer with an empty body for this long after starting, as devices do while booting.").Default("0s").Duration()
+	mockFailureRate := mockCommand.Flag("failure-rate", "Fraction of requests to answer with HTTP 500, between 0 and 1.").Default("0").Float64()
+	mockScenario := mockCommand.Flag("scenario", "YAML file scripting readings, failures and empty answers over time.").Default("").String()
+
 	promlogConfig := &promlog.Config{}
 	flag.AddFlags(kingpin.CommandLine, promlogConfig)
 
 	kingpin.Version(version.Print("iqair_exporter"))
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+	kingpin.CommandLine.Help = envarHelp
+	setFlagEnvars(kingpin.CommandLine)
+	command := kingpin.Parse()
 
 	logger := promlog.New(promlogConfig)
 
+	secretFlags := map[string]*string{
+		"push.basic-auth-password":         remoteWritePassword,
+		"push.bearer-token":                remoteWriteToken,
+		"push.gateway-basic-auth-password": gatewayPassword,
+		"mqtt.password":                    mqttPassword,
+		"influx.password":                  influxPassword,
+		"influx.token":                     influxToken,
+		"kafka.sasl-password":              kafkaSASLPassword,
+	}
+	if err := resolveSecretFlags(secretFlags); err != nil {
+		level.Error(logger).Log("msg", "Error reading a secret flag", "err", err)
+		os.Exit(1)
+	}
+
+	if command == discoverCommand.FullCommand() {
+		os.Exit(runDiscover(os.Stdout, *discoverCIDRs, *discoverMDNS, *discoverService, *discoverTimeout, *candidatePaths, *discoverOutput))
+	}
+	if command == mockCommand.FullCommand() {
+		os.Exit(runMockDevice(*mockListen, *mockScenario, MockDeviceOptions{
+			Model:           *mockModel,
+			Firmware:        *mockFirmware,
+			Serial:          *mockSerial,
+			UpdateAvailable: *mockUpdate,
+			WarmUp:          *mockWarmUp,
+			FailureRate:     *mockFailureRate,
+		}, logger))
+	}
+
+	targetOpts := targetFlags{
+		ConfigFile:      *configFile,
+		ScrapeURI:       *iqairScrapeURI,
+		DeviceName:      *deviceName,
+		APIKeyFile:      *apiKeyFile,
+		Username:        *iqairUsername,
+		PasswordFile:    *passwordFile,
+		BearerTokenFile: *bearerTokenFile,
+		CandidatePaths:  *candidatePaths,
+		Timeout:         *iqairTimeout,
+		PollInterval:    *pollInterval,
+	}
+	if *configCheck {
+		t, err := loadTargets(targetOpts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Configuration is invalid: %v\n", err)
+			os.Exit(1)
+		}
+		printTargets(os.Stdout, t, targetOpts)
+		os.Exit(0)
+	}
+
+	if ok, err := serviceCommand(); ok {
+		if err != nil {
+			level.Error(logger).Log("msg", "Error managing the Windows service", "err", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	// A service's stop requests arrive as SIGTERM.
+	sigs := make(chan os.Signal, 1)
+	logger, exit, err := startService(sigs, logger, promlogConfig)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error starting the Windows service", "err", err)
+		os.Exit(1)
+	}
+
 	level.Info(logger).Log("msg", "Starting iqair", "version", version.Info())
 	level.Info(logger).Log("msg", "Build context", "context", version.BuildContext())
 
-	exporter, err := NewExporter(*iqairScrapeURI, 10*time.Second, logger)
+	// reg holds all collectors and is what every output gathers. Leaving out
+	// the Go and process collectors leaves them out of all outputs; the
+	// promhttp_* metrics of the metrics handlers then go to a registry that
+	// is never gathered.
+	reg := prometheus.NewRegistry()
+	metricsRegisterer := prometheus.Registerer(reg)
+	if *noExporterStats {
+		metricsRegisterer = prometheus.NewRegistry()
+	} else {
+		reg.MustRegister(prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	}
+
+	upLabels, err := parseLabels(*upMetricLabels)
 	if err != nil {
-		level.Error(logger).Log("msg", "Error creating an exporter", "err", err)
+		level.Error(logger).Log("msg", "Error parsing up metric labels", "err", err)
+		os.Exit(1)
+	}
+	upDesc, err := NewUpDesc(*upMetricName, upLabels)
+	if err != nil {
+		level.Error(logger).Log("msg", "Invalid up metric", "err", err)
+		os.Exit(1)
+	}
+
+	autoLabels, err := parseAutoLabels(*autoLabelsSpec)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error parsing --iqair.auto-labels", "err", err)
+		os.Exit(1)
+	}
+
+	headers, err := parseHeaders(*iqairHeaders)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error parsing --iqair.header", "err", err)
+		os.Exit(1)
+	}
+	resolve, err := parseResolve(*iqairResolve)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error parsing --iqair.resolve", "err", err)
 		os.Exit(1)
 	}
 
-	prometheus.MustRegister(exporter)
-	prometheus.MustRegister(version.NewCollector("iqair_exporter"))
+	exporterOpts := ExporterOptions{
+		Timeout:          *iqairTimeout,
+		Resolve:          resolve,
+		MinTLSVersion:    tlsVersions[*minTLSVersion],
+		TLSServerName:    *tlsServerName,
+		Headers:          headers,
+		CandidatePaths:   *candidatePaths,
+		HumidityFraction: *humidityFraction,
+		AQIColorIndex:    *aqiColorMetric,
+		TargetInfo:       *targetInfo,
+		UpDesc:           upDesc,
+		PollInterval:     *pollInterval,
+		ReadingTolerance: *readingTolerance,
+		MaxLabelLength:   *maxLabelLength,
+		LastScrapeError:  *lastScrapeError,
+		EmptyBodyOK:      *emptyBodyOK,
+		NaNOnFailure:     *nanOnFailure,
+		AutoLabels:       autoLabels,
+		CircuitFailures:  *circuitFailures,
+		CircuitCooldown:  *circuitCooldown,
+		SuccessWindow:    *successWindow,
+	}
+	if *enableDebug {
+		exporterOpts.ResponseHistory = *rawHistorySize
+	}
+	if *once {
+		// Every output of --once scrapes the devices as it needs them.
+		exporterOpts.PollInterval = 0
+	}
+	if *pm25Histogram {
+		exporterOpts.PM25Buckets = *pm25Buckets
+	}
+
+	scrapeTargets, err := loadTargets(targetOpts)
+	if err != nil {
+		level.Error(logger).Log("msg", "Invalid configuration", "err", err)
+		os.Exit(1)
+	}
+	if scrapeTargets.Credentials != nil {
+		exporterOpts.Credentials = scrapeTargets.Credentials
+	}
+	devices, notifications := scrapeTargets.Devices, scrapeTargets.Notifications
+	if *configFile != "" {
+		devices = dedupeDevices(devices, lookupHostWithOverrides(resolve), logger)
+	}
 
-	http.Handle(*metricsPath, promhttp.Handler())
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`<html>
-             <head><title>iqAir Exporter</title></head>
-             <body>
-             <h1>iqAir Exporter</h1>
-             <p><a href='` + *metricsPath + `'>Metrics</a></p>
-             </body>
-             </html>`))
+	flagThresholds, err := parseThresholds(*thresholds)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error parsing thresholds", "err", err)
+		os.Exit(1)
+	}
+	configuredThresholds := mergeThresholds(flagThresholds, scrapeTargets.Thresholds)
+
+	if *dashboardPath != "" {
+		dashboard, err := GenerateDashboard(DashboardOptions{
+			Devices:          devices,
+			Thresholds:       configuredThresholds,
+			HumidityFraction: *humidityFraction,
+			PM25Histogram:    *pm25Histogram,
+			UpMetricName:     *upMetricName,
+		})
+		if err == nil {
+			if *dashboardPath == "-" {
+				_, err = os.Stdout.Write(dashboard)
+			} else {
+				err = os.WriteFile(*dashboardPath, dashboard, 0o644)
+			}
+		}
+		if err != nil {
+			level.Error(logger).Log("msg", "Error generating dashboard", "err", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if command == checkCommand.FullCommand() {
+		os.Exit(runCheck(os.Stdout, devices, exporterOpts, *checkOutput, logger))
+	}
+
+	// On SIGINT or SIGTERM, the pollers are stopped, then the outputs, which
+	// flush what they hold, and finally the hooks run.
+	var shutdownHooks []func()
+	outputs := newBackgroundTasks()
+
+	var store *SQLiteStore
+	if *sqlitePath != "" {
+		if *sqliteBatchSize < 1 {
+			level.Error(logger).Log("msg", "--storage.sqlite.batch-size must be at least 1")
+			os.Exit(1)
+		}
+		store, err = OpenSQLiteStore(SQLiteStoreConfig{
+			Path:          *sqlitePath,
+			Retention:     *sqliteRetention,
+			BatchSize:     *sqliteBatchSize,
+			FlushInterval: *sqliteFlushInterval,
+		}, log.With(logger, "component", "store"))
+		if err != nil {
+			level.Error(logger).Log("msg", "Error opening store", "err", err)
+			os.Exit(1)
+		}
+		reg.MustRegister(store)
+		exporterOpts.ReadingListeners = append(exporterOpts.ReadingListeners, store)
+		outputs.Go(store.Run)
+		shutdownHooks = append(shutdownHooks, func() { store.Close() })
+	}
+
+	if *csvPath != "" {
+		if *pollInterval <= 0 {
+			warnWithoutPolling(logger, "CSV log", "logged")
+		}
+		csvLogger := NewCSVLogger(CSVLogConfig{
+			Path:     *csvPath,
+			MaxSize:  int64(*csvMaxSize),
+			MaxAge:   *csvMaxAge,
+			MaxFiles: *csvMaxFiles,
+		}, log.With(logger, "component", "csv"))
+		reg.MustRegister(csvLogger)
+		exporterOpts.ReadingListeners = append(exporterOpts.ReadingListeners, csvLogger)
+		outputs.Go(csvLogger.Run)
+	}
+
+	var history *ReadingHistory
+	if *historySize > 0 {
+		if *pollInterval <= 0 {
+			warnWithoutPolling(logger, "history", "recorded")
+		}
+		history = NewReadingHistory(*historySize)
+		reg.MustRegister(history)
+		exporterOpts.ReadingListeners = append(exporterOpts.ReadingListeners, history)
+	}
+
+	var allowlist *IPAllowlist
+	if *allowedCIDRs != "" {
+		allowed, err := parseCIDRs(*allowedCIDRs)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error parsing --web.allowed-cidrs", "err", err)
+			os.Exit(1)
+		}
+		trusted, err := parseCIDRs(*trustedProxies)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error parsing --web.trusted-proxies", "err", err)
+			os.Exit(1)
+		}
+		allowlist = NewIPAllowlist(allowed, trusted)
+		reg.MustRegister(allowlist)
+	} else if *trustedProxies != "" {
+		level.Warn(logger).Log("msg", "--web.trusted-proxies has no effect without --web.allowed-cidrs")
+	}
+
+	broadcaster := NewReadingBroadcaster(*apiStaleAfter, log.With(logger, "component", "stream"))
+	reg.MustRegister(broadcaster)
+	exporterOpts.ReadingListeners = append(exporterOpts.ReadingListeners, broadcaster)
+
+	if len(notifications) > 0 {
+		if *pollInterval <= 0 {
+			warnWithoutPolling(logger, "notifications", "checked")
+		}
+		notifier, err := NewNotifier(notifications, 10*time.Second, log.With(logger, "component", "notify"))
+		if err != nil {
+			level.Error(logger).Log("msg", "Error creating notifier", "err", err)
+			os.Exit(1)
+		}
+		reg.MustRegister(notifier)
+		exporterOpts.ReadingListeners = append(exporterOpts.ReadingListeners, notifier)
+		outputs.Go(notifier.Run)
+	}
+
+	if *mqttBroker != "" {
+		if *pollInterval <= 0 {
+			warnWithoutPolling(logger, "MQTT", "published")
+		}
+		tlsConfig, err := newTLSConfig(*mqttCAFile, *mqttCertFile, *mqttKeyFile, *mqttInsecure)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error loading MQTT TLS configuration", "err", err)
+			os.Exit(1)
+		}
+		mqttConfig := MQTTConfig{
+			Broker:         *mqttBroker,
+			TopicPrefix:    *mqttTopicPrefix,
+			ClientID:       *mqttClientID,
+			Username:       *mqttUsername,
+			Password:       *mqttPassword,
+			TLSConfig:      tlsConfig,
+			QoS:            *mqttQoS,
+			Retain:         *mqttRetain,
+			Format:         *mqttFormat,
+			QueueSize:      *mqttQueueSize,
+			PublishTimeout: 10 * time.Second,
+		}
+		if *mqttHADiscovery {
+			mqttConfig.HomeAssistantPrefix = *mqttHAPrefix
+			for _, device := range devices {
+				mqttConfig.Devices = append(mqttConfig.Devices, device.Name)
+			}
+		}
+		if err := validateMQTTConfig(mqttConfig); err != nil {
+			level.Error(logger).Log("msg", "Invalid MQTT configuration", "err", err)
+			os.Exit(1)
+		}
+		publisher := NewMQTTPublisher(mqttConfig, log.With(logger, "component", "mqtt"))
+		reg.MustRegister(publisher)
+		exporterOpts.ReadingListeners = append(exporterOpts.ReadingListeners, publisher)
+		outputs.Go(publisher.Run)
+	}
+
+	if *influxURL != "" {
+		if *pollInterval <= 0 {
+			warnWithoutPolling(logger, "InfluxDB", "written")
+		}
+		apiVersion, _ := strconv.Atoi(*influxAPIVersion)
+		influxConfig := InfluxConfig{
+			URL:             *influxURL,
+			APIVersion:      apiVersion,
+			Database:        *influxDatabase,
+			RetentionPolicy: *influxRetention,
+			Username:        *influxUsername,
+			Password:        *influxPassword,
+			Token:           *influxToken,
+			Org:             *influxOrg,
+			Bucket:          *influxBucket,
+			BatchSize:       *influxBatchSize,
+			FlushInterval:   *influxFlushInterval,
+			MaxRetries:      *influxMaxRetries,
+			Timeout:         10 * time.Second,
+		}
+		if err := validateInfluxConfig(influxConfig); err != nil {
+			level.Error(logger).Log("msg", "Invalid InfluxDB configuration", "err", err)
+			os.Exit(1)
+		}
+		writer := NewInfluxWriter(influxConfig, log.With(logger, "component", "influx"))
+		reg.MustRegister(writer)
+		exporterOpts.ReadingListeners = append(exporterOpts.ReadingListeners, writer)
+		outputs.Go(writer.Run)
+	}
+
+	if *graphiteAddress != "" {
+		if *pollInterval <= 0 {
+			warnWithoutPolling(logger, "Graphite", "sent")
+		}
+		writer := NewGraphiteWriter(GraphiteConfig{
+			Address:   *graphiteAddress,
+			Prefix:    *graphitePrefix,
+			Timeout:   10 * time.Second,
+			MaxBuffer: *graphiteMaxBuffer,
+		}, log.With(logger, "component", "graphite"))
+		reg.MustRegister(writer)
+		exporterOpts.ReadingListeners = append(exporterOpts.ReadingListeners, writer)
+		outputs.Go(writer.Run)
+	}
+
+	if *statsdAddress != "" {
+		if *pollInterval <= 0 {
+			warnWithoutPolling(logger, "StatsD", "sent")
+		}
+		statsdConfig := StatsDConfig{
+			Address:   *statsdAddress,
+			Prefix:    *statsdPrefix,
+			Format:    *statsdFormat,
+			QueueSize: *statsdQueueSize,
+		}
+		if err := validateStatsDConfig(statsdConfig); err != nil {
+			level.Error(logger).Log("msg", "Invalid StatsD configuration", "err", err)
+			os.Exit(1)
+		}
+		writer := NewStatsDWriter(statsdConfig, log.With(logger, "component", "statsd"))
+		reg.MustRegister(writer)
+		exporterOpts.ReadingListeners = append(exporterOpts.ReadingListeners, writer)
+		outputs.Go(writer.Run)
+	}
+
+	if *kafkaBrokers != "" {
+		if *pollInterval <= 0 {
+			warnWithoutPolling(logger, "Kafka", "published")
+		}
+		if *kafkaQueueSize < 1 {
+			level.Error(logger).Log("msg", "--kafka.queue-size must be at least 1")
+			os.Exit(1)
+		}
+		kafkaConfig := KafkaConfig{
+			Brokers:      strings.Split(*kafkaBrokers, ","),
+			Topic:        *kafkaTopic,
+			ClientID:     *kafkaClientID,
+			SASLUsername: *kafkaSASLUsername,
+			SASLPassword: *kafkaSASLPassword,
+			Timeout:      10 * time.Second,
+			QueueSize:    *kafkaQueueSize,
+		}
+		if *kafkaTLS || *kafkaCAFile != "" || *kafkaCertFile != "" {
+			tlsConfig, err := newTLSConfig(*kafkaCAFile, *kafkaCertFile, *kafkaKeyFile, *kafkaInsecure)
+			if err != nil {
+				level.Error(logger).Log("msg", "Error loading Kafka TLS configuration", "err", err)
+				os.Exit(1)
+			}
+			kafkaConfig.TLSConfig = tlsConfig
+		}
+		producer := NewKafkaProducer(kafkaConfig, log.With(logger, "component", "kafka"))
+		reg.MustRegister(producer)
+		exporterOpts.ReadingListeners = append(exporterOpts.ReadingListeners, producer)
+		outputs.Go(producer.Run)
+	}
+
+	if *cloudWatchNamespace != "" {
+		if *pollInterval <= 0 {
+			warnWithoutPolling(logger, "CloudWatch", "pushed")
+		}
+		cloudWatchConfig := CloudWatchConfig{
+			Namespace:   *cloudWatchNamespace,
+			Region:      *cloudWatchRegion,
+			Endpoint:    *cloudWatchEndpoint,
+			Metrics:     *cloudWatchMetrics,
+			SiteLabel:   *cloudWatchSiteLabel,
+			MinInterval: *cloudWatchMinInterval,
+			MaxRetries:  *cloudWatchMaxRetries,
+			QueueSize:   *cloudWatchQueueSize,
+			Timeout:     10 * time.Second,
+		}
+		if err := validateCloudWatchConfig(&cloudWatchConfig); err != nil {
+			level.Error(logger).Log("msg", "Invalid CloudWatch configuration", "err", err)
+			os.Exit(1)
+		}
+		writer := NewCloudWatchWriter(cloudWatchConfig, log.With(logger, "component", "cloudwatch"))
+		reg.MustRegister(writer)
+		exporterOpts.ReadingListeners = append(exporterOpts.ReadingListeners, writer)
+		outputs.Go(writer.Run)
+	}
+
+	// A nil channel never trips the shutdown below.
+	var failuresTripped <-chan struct{}
+	var failureWatch *FailureWatch
+	if *exitAfterFailures > 0 {
+		names := make([]string, len(devices))
+		for i, device := range devices {
+			names[i] = device.Name
+		}
+		failureWatch = NewFailureWatch(names, *exitAfterFailures)
+		failuresTripped = failureWatch.Tripped()
+		exporterOpts.ReadingListeners = append(exporterOpts.ReadingListeners, failureWatch)
+	}
+
+	exporters := make([]*Exporter, 0, len(devices))
+	// deviceGatherers serve the per-device metrics paths.
+	deviceGatherers := map[string]prometheus.Gatherer{}
+	for _, device := range devices {
+		exporter, err := NewExporter(device, exporterOpts, log.With(logger, "device", device.Name))
+		if err != nil {
+			level.Error(logger).Log("msg", "Error creating an exporter", "device", device.Name, "err", err)
+			os.Exit(1)
+		}
+
+		prometheus.WrapRegistererWith(device.labels(), reg).MustRegister(exporter)
+		if *perDevicePaths {
+			deviceReg := prometheus.NewRegistry()
+			prometheus.WrapRegistererWith(device.labels(), deviceReg).MustRegister(exporter)
+			deviceGatherers[Reading{Device: device.Name}.DeviceName()] = deviceReg
+		}
+		exporters = append(exporters, exporter)
+	}
+	failOnStartupErr := *failOnStartup || *requireInitialScrape
+	if *startupWait > 0 || failOnStartupErr {
+		// Without a startup wait, each device gets a single attempt.
+		ctx, cancel := context.WithTimeout(context.Background(), *startupWait)
+		var unreachable []string
+		for i, exporter := range exporters {
+			if err := exporter.WaitForDevice(ctx); err != nil {
+				if failOnStartupErr && !devices[i].Optional {
+					level.Error(logger).Log("msg", "Device unreachable at startup", "device", devices[i].Name, "err", err)
+					unreachable = append(unreachable, Reading{Device: devices[i].Name}.DeviceName())
+				} else {
+					level.Warn(logger).Log("msg", "Device still unreachable, starting anyway", "device", devices[i].Name, "err", err)
+				}
+			}
+		}
+		cancel()
+		if len(unreachable) > 0 {
+			level.Error(logger).Log("msg", "Exiting as --iqair.fail-on-startup-error is set", "unreachable_devices", strings.Join(unreachable, ", "))
+			os.Exit(1)
+		}
+	}
+
+	pollers := newBackgroundTasks()
+	if exporterOpts.PollInterval > 0 {
+		for _, exporter := range exporters {
+			pollers.Go(exporter.Poll)
+		}
+	}
+
+	for _, device := range devices {
+		if device.Group != "" {
+			reg.MustRegister(NewGroupCollector(devices, exporters, *humidityFraction))
+			break
+		}
+	}
+
+	registeredDevices := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "exporter_registered_devices",
+		Help:      "Number of devices the exporter is configured to scrape.",
 	})
+	registeredDevices.Set(float64(len(exporters)))
+	reg.MustRegister(registeredDevices)
+	thresholdCollector := NewThresholdCollector(configuredThresholds)
+	reg.MustRegister(thresholdCollector)
+	if scrapeTargets.Credentials != nil || *configFile != "" {
+		// Rotated secrets and changed thresholds are picked up without a
+		// restart.
+		reloader := &configReloader{
+			configFile:     *configFile,
+			credentials:    scrapeTargets.Credentials,
+			flagThresholds: flagThresholds,
+			thresholds:     thresholdCollector,
+			devices:        scrapeTargets.Devices,
+			logger:         logger,
+		}
+		hups := make(chan os.Signal, 1)
+		signal.Notify(hups, syscall.SIGHUP)
+		go reloader.run(hups)
+	}
+	reg.MustRegister(version.NewCollector("iqair_exporter"))
+
+	if *remoteWriteURL != "" {
+		externalLabels, err := parseLabels(*remoteWriteLabels)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error parsing push labels", "err", err)
+			os.Exit(1)
+		}
+		if *remoteWriteQueue < 1 {
+			level.Error(logger).Log("msg", "--push.queue-size must be at least 1")
+			os.Exit(1)
+		}
+		tlsConfig, err := newTLSConfig(*pushCAFile, *pushCertFile, *pushKeyFile, *pushInsecure)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error loading remote-write TLS configuration", "err", err)
+			os.Exit(1)
+		}
+		writer := NewRemoteWriter(RemoteWriteConfig{
+			URL:               *remoteWriteURL,
+			Interval:          *remoteWriteInterval,
+			Timeout:           *remoteWriteTimeout,
+			ExternalLabels:    externalLabels,
+			BasicAuthUsername: *remoteWriteUser,
+			BasicAuthPassword: *remoteWritePassword,
+			BearerToken:       *remoteWriteToken,
+			TLSConfig:         tlsConfig,
+			MaxRetries:        *remoteWriteRetries,
+			MinBackoff:        time.Second,
+			MaxBackoff:        time.Minute,
+			QueueSize:         *remoteWriteQueue,
+		}, reg, log.With(logger, "component", "remote_write"))
+		reg.MustRegister(writer)
+		outputs.Go(writer.Run)
+		level.Info(logger).Log("msg", "Pushing metrics via remote write", "url", redactURI(*remoteWriteURL), "interval", *remoteWriteInterval)
+	}
+
+	if *otlpEnabled || *otlpEndpoint != "" || os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT") != "" {
+		otlpConfig, err := newOTLPConfig(*otlpProtocol, *otlpEndpoint, *otlpHeaders, *otlpInterval, *otlpTimeout)
+		if err != nil {
+			level.Error(logger).Log("msg", "Invalid OTLP configuration", "err", err)
+			os.Exit(1)
+		}
+		if otlpConfig.Endpoint == "" {
+			level.Error(logger).Log("msg", "OTLP export requires --otlp.endpoint or OTEL_EXPORTER_OTLP_ENDPOINT")
+			os.Exit(1)
+		}
+		byName := make(map[string]*Exporter, len(exporters))
+		for i, exporter := range exporters {
+			byName[devices[i].Name] = exporter
+		}
+		otlpConfig.DeviceStatus = func(device string) (Status, bool) {
+			exporter, ok := byName[device]
+			if !ok {
+				return Status{}, false
+			}
+			return exporter.Snapshot().Status, true
+		}
+
+		otlpExporter := NewOTLPExporter(otlpConfig, reg, log.With(logger, "component", "otlp"))
+		reg.MustRegister(otlpExporter)
+		outputs.Go(otlpExporter.Run)
+		level.Info(logger).Log("msg", "Exporting metrics over OTLP", "protocol", otlpConfig.Protocol, "endpoint", redactURI(otlpConfig.Endpoint), "interval", otlpConfig.Interval)
+	}
+
+	if *metricsLint != metricsLintOff {
+		problems, err := lintMetrics(reg)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error gathering metrics to lint", "err", err)
+			os.Exit(1)
+		}
+		for _, p := range problems {
+			if *metricsLint == metricsLintFail {
+				level.Error(logger).Log("msg", "Metric violates naming conventions", "metric", p.Metric, "problem", p.Text)
+			} else {
+				level.Warn(logger).Log("msg", "Metric violates naming conventions", "metric", p.Metric, "problem", p.Text)
+			}
+		}
+		if len(problems) > 0 && *metricsLint == metricsLintFail {
+			level.Error(logger).Log("msg", "Exiting as --metrics.lint=fail is set", "problems", len(problems))
+			os.Exit(1)
+		}
+	}
+
+	if *once && *gatewayURL == "" && *textfileDirectory == "" && *onceFormat == "" {
+		*onceFormat = onceFormatPrometheus
+	}
+	if *onceFormat != "" && !*once {
+		level.Error(logger).Log("msg", "--format requires --once")
+		os.Exit(1)
+	}
+	// onceOK records whether everything done for --once succeeded.
+	onceOK := true
 
-	level.Info(logger).Log("msg", "Listening on address", "address", *listenAddress)
-	srv := &http.Server{Addr: *listenAddress}
+	if *onceFormat == onceFormatPrometheus {
+		if err := writeExposition(os.Stdout, reg); err != nil {
+			level.Error(logger).Log("msg", "Error gathering metrics", "err", err)
+			onceOK = false
+		}
+	} else if *onceFormat != "" {
+		// Telegraf's exec input runs the exporter with --once --format and
+		// parses the readings from stdout.
+		for i, exporter := range exporters {
+			reading, ok := exporter.ScrapeReading()
+			if !ok {
+				level.Error(logger).Log("msg", "Error scraping device", "device", devices[i].Name)
+				onceOK = false
+				continue
+			}
+			line := formatLineProtocol(reading)
+			if *onceFormat == onceFormatJSON {
+				if line, err = formatTelegrafJSON(reading); err != nil {
+					level.Error(logger).Log("msg", "Error formatting reading", "device", devices[i].Name, "err", err)
+					onceOK = false
+					continue
+				}
+			}
+			fmt.Println(line)
+		}
+	}
+
+	if *textfileDirectory != "" {
+		if *textfileThreshold < 1 {
+			level.Error(logger).Log("msg", "--textfile.failure-threshold must be at least 1")
+			os.Exit(1)
+		}
+		devicesUp := func() bool {
+			for _, exporter := range exporters {
+				if !exporter.LastScrapeSuccessful() {
+					return false
+				}
+			}
+			return true
+		}
+		writer := NewTextfileWriter(TextfileConfig{
+			Directory:        *textfileDirectory,
+			OnFailure:        *textfileOnFailure,
+			FailureThreshold: *textfileThreshold,
+		}, reg, devicesUp, log.With(logger, "component", "textfile"))
+		writeTextfile := func() bool {
+			if err := writer.Write(); err != nil {
+				level.Error(logger).Log("msg", "Error writing textfile", "err", err)
+				return false
+			}
+			return true
+		}
+
+		if *once {
+			onceOK = writeTextfile() && devicesUp()
+		} else {
+			outputs.Go(func(ctx context.Context) {
+				ticker := time.NewTicker(*textfileInterval)
+				defer ticker.Stop()
+				for {
+					writeTextfile()
+					select {
+					case <-ctx.Done():
+						// Leave the latest metrics behind.
+						writeTextfile()
+						return
+					case <-ticker.C:
+					}
+				}
+			})
+			level.Info(logger).Log("msg", "Writing metrics to textfile", "path", writer.Path(), "interval", *textfileInterval)
+		}
+	}
+
+	if *gatewayURL != "" {
+		grouping, err := parseLabels(*gatewayGrouping)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error parsing Pushgateway grouping labels", "err", err)
+			os.Exit(1)
+		}
+		tlsConfig, err := newTLSConfig(*gatewayCAFile, *gatewayCertFile, *gatewayKeyFile, *gatewayInsecure)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error loading Pushgateway TLS configuration", "err", err)
+			os.Exit(1)
+		}
+		gatewayConfig := PushgatewayConfig{
+			URL:               *gatewayURL,
+			Job:               *gatewayJob,
+			Grouping:          grouping,
+			BasicAuthUsername: *gatewayUser,
+			BasicAuthPassword: *gatewayPassword,
+			TLSConfig:         tlsConfig,
+			Timeout:           *remoteWriteTimeout,
+		}
+		pushers := make([]*push.Pusher, len(devices))
+		for i, device := range devices {
+			pushers[i] = newDevicePusher(gatewayConfig, device, exporters[i])
+		}
+
+		pushAll := func() bool {
+			ok := true
+			for i, pusher := range pushers {
+				if err := pusher.Push(); err != nil {
+					level.Error(logger).Log("msg", "Error pushing to Pushgateway", "device", devices[i].Name, "err", err)
+					ok = false
+				}
+				if !exporters[i].LastScrapeSuccessful() {
+					level.Error(logger).Log("msg", "Error scraping device", "device", devices[i].Name)
+					ok = false
+				}
+			}
+			return ok
+		}
+
+		if *once {
+			onceOK = pushAll() && onceOK
+		} else {
+			outputs.Go(func(ctx context.Context) {
+				ticker := time.NewTicker(*remoteWriteInterval)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ctx.Done():
+						// The metrics are about to be deleted otherwise.
+						if !*gatewayDeleteOnShutdown {
+							pushAll()
+						}
+						return
+					case <-ticker.C:
+						pushAll()
+					}
+				}
+			})
+			if *gatewayDeleteOnShutdown {
+				shutdownHooks = append(shutdownHooks, func() {
+					for i, pusher := range pushers {
+						if err := pusher.Delete(); err != nil {
+							level.Error(logger).Log("msg", "Error deleting metrics from Pushgateway", "device", devices[i].Name, "err", err)
+						}
+					}
+				})
+			}
+			level.Info(logger).Log("msg", "Pushing metrics to Pushgateway", "url", redactURI(*gatewayURL), "interval", *remoteWriteInterval)
+		}
+	}
+
+	if *once {
+		if code := onceExitCode(exporters); code != 0 {
+			os.Exit(code)
+		}
+		if !onceOK {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 
-	if err := web.ListenAndServe(srv, *webConfig, logger); err != nil {
+	externalURL, err := parseExternalURL(*rawExternalURL)
+	if err != nil {
+		level.Error(logger).Log("msg", "Invalid --web.external-url", "err", err)
+		os.Exit(1)
+	}
+	prefix := routePrefix(*rawRoutePrefix, externalURL)
+	mux := prefixedMux{ServeMux: http.DefaultServeMux, prefix: prefix}
+	if prefix != "" {
+		http.Handle("/", newUnprefixedHandler(externalBase(externalURL, prefix), *redirectUnprefix))
+	}
+	metricsOpts := promhttp.HandlerOpts{MaxRequestsInFlight: *maxRequests, Timeout: *handlerTimeout}
+	mux.Handle(*metricsPath, newMetricsHandler(reg, metricsRegisterer, metricsOpts))
+	if *perDevicePaths {
+		devicesPath := strings.TrimSuffix(*metricsPath, "/") + "/devices/"
+		mux.Handle(devicesPath, newDeviceMetricsHandler(devicesPath, deviceGatherers, metricsRegisterer, metricsOpts))
+	}
+	mux.Handle("/-/healthy", newHealthyHandler())
+	mux.Handle("/-/ready", newReadyHandler(exporters, *readyStaleness))
+	mux.Handle("/api/v1/current", newCurrentHandler(exporters, *apiStaleAfter))
+	targetSource := "flags"
+	if *configFile != "" {
+		targetSource = "config"
+	}
+	mux.Handle("/api/v1/targets", newTargetsHandler(exporters, targetSource))
+	mux.Handle("/dashboard", newStatusPageHandler(exporters, *apiStaleAfter, log.With(logger, "component", "dashboard")))
+	links := []landingLink{
+		newLandingLink(*metricsPath, "Metrics"),
+		newLandingLink("/dashboard", "Dashboard"),
+		newLandingLink("/-/healthy", "Health"),
+		newLandingLink("/-/ready", "Readiness"),
+		newLandingLink("/api/v1/current", "Current readings (JSON)"),
+		newLandingLink("/api/v1/targets", "Devices (JSON)"),
+	}
+	if *enableDebug {
+		mux.Handle("/-/scrape", newScrapeHandler(exporters))
+		mux.Handle("/debug/scrape", newDebugScrapeHandler(exporters))
+		mux.Handle("/history", newResponseHistoryHandler(exporters))
+		links = append(links,
+			landingLink{Path: "-/scrape", Description: "Scrape the devices now", Post: true},
+			newLandingLink("/debug/scrape", "Diagnose device scrapes"),
+			newLandingLink("/history", "Recent device responses (JSON)"),
+		)
+	}
+	deviceNames := make([]string, len(devices))
+	configuredNames := make([]string, len(devices))
+	for i, device := range devices {
+		deviceNames[i] = Reading{Device: device.Name}.DeviceName()
+		configuredNames[i] = device.Name
+	}
+	mux.Handle("/api/v1/stream", newSSEHandler(broadcaster, configuredNames))
+	links = append(links, newLandingLink("/api/v1/stream", "Live readings (Server-Sent Events)"))
+	if *wsMaxConns > 0 {
+		mux.Handle("/api/v1/ws", newWebSocketHandler(broadcaster, configuredNames, *wsMaxConns, log.With(logger, "component", "websocket")))
+	}
+	if history != nil {
+		mux.Handle("/api/v1/history", newHistoryHandler(history, deviceNames, time.Now))
+	}
+	// The store usually reaches further back than the in-memory history.
+	if store != nil {
+		mux.Handle("/export.csv", newExportHandler(store.QueryFunc, deviceNames, *exportMaxRange, time.Now, log.With(logger, "component", "export")))
+		links = append(links, newLandingLink("/export.csv", "Readings as CSV"))
+	} else if history != nil {
+		mux.Handle("/export.csv", newExportHandler(historyQuery(history), deviceNames, *exportMaxRange, time.Now, log.With(logger, "component", "export")))
+		links = append(links, newLandingLink("/export.csv", "Readings as CSV"))
+	}
+	mux.Handle("/", newLandingPageHandler(exporters, links, log.With(logger, "component", "landing")))
+
+	var listeners []net.Listener
+	if *systemdSocket {
+		if listeners, err = activationListeners(); err != nil {
+			level.Error(logger).Log("msg", "Error using systemd socket activation", "err", err)
+			os.Exit(1)
+		}
+	}
+	addrs := *listenAddress
+	if len(addrs) == 0 && !*systemdSocket {
+		addrs = []string{defaultListenAddress}
+	}
+	var nonEmpty []string
+	for _, addr := range addrs {
+		if addr != "" {
+			nonEmpty = append(nonEmpty, addr)
+		}
+	}
+	socket := socketOptions{}
+	mode, err := strconv.ParseUint(*socketMode, 8, 32)
+	if err != nil {
+		level.Error(logger).Log("msg", "Invalid --web.socket-mode", "err", err)
+		os.Exit(1)
+	}
+	socket.Mode = os.FileMode(mode)
+	if socket.UID, socket.GID, err = parseSocketOwner(*socketOwner); err != nil {
+		level.Error(logger).Log("msg", "Invalid --web.socket-owner", "err", err)
+		os.Exit(1)
+	}
+	opened, err := openListeners(nonEmpty, socket)
+	if err != nil {
+		closeListeners(listeners)
 		level.Error(logger).Log("msg", "Error starting HTTP server", "err", err)
 		os.Exit(1)
 	}
+	listeners = append(listeners, opened...)
+	var handler http.Handler = http.DefaultServeMux
+	if allowlist != nil {
+		handler = allowlist.Wrap(handler)
+	}
+	if *logRequests {
+		handler = withRequestLog(handler, *logRequestLevel, *logRequestSkip, log.With(logger, "component", "http"))
+	}
+	servers := newServers(listeners, handler, serverLimits{
+		ReadHeaderTimeout: *headerTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+		MaxHeaderBytes:    int(*maxHeaderBytes),
+		StreamPaths:       []string{prefix + "/api/v1/stream", prefix + "/api/v1/ws"},
+	})
+	for _, srv := range servers {
+		// Streams last until the broadcaster closes them, so close it
+		// first for Shutdown not to wait for them.
+		srv.RegisterOnShutdown(broadcaster.Close)
+	}
+
+	watchdogCtx, stopWatchdog := context.WithCancel(context.Background())
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		code := 0
+		select {
+		case sig := <-sigs:
+			level.Info(logger).Log("msg", "Shutting down", "signal", sig, "grace_period", *shutdownGrace)
+		case <-failuresTripped:
+			code = exitConsecutiveFailures
+			level.Error(logger).Log("msg", "Shutting down as all devices failed --iqair.exit-after-consecutive-failures consecutive scrapes", "consecutive_failures", failureWatch.Summary(), "exit_code", code, "grace_period", *shutdownGrace)
+		}
+		stopWatchdog()
+		if _, err := sdNotify("STOPPING=1"); err != nil {
+			level.Warn(logger).Log("msg", "Error notifying systemd", "err", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownGrace)
+		defer cancel()
+		steps := append([]func(){pollers.Stop, outputs.Stop}, shutdownHooks...)
+		if err := gracefulShutdown(ctx, servers, steps...); err != nil {
+			level.Error(logger).Log("msg", "Error shutting down gracefully", "err", err)
+			if code == 0 {
+				code = 1
+			}
+			exit(code)
+		}
+		level.Info(logger).Log("msg", "Shutdown complete")
+		exit(code)
+	}()
+
+	// With a systemd watchdog, keep-alives are only sent while the pollers
+	// and the HTTP server make progress.
+	var watchdogChecks []watchdogCheck
+	if *pollInterval > 0 {
+		for _, exporter := range exporters {
+			watchdogChecks = append(watchdogChecks, pollerCheck(exporter))
+		}
+	}
+	// notifyReady tells systemd that startup is complete, the devices
+	// having been waited for already.
+	notifyReady := func() {
+		if ok, err := sdNotify("READY=1"); !ok {
+			if err != nil {
+				level.Warn(logger).Log("msg", "Error notifying systemd", "err", err)
+			}
+			return
+		}
+		if interval, ok := watchdogInterval(); ok {
+			level.Info(logger).Log("msg", "Sending systemd watchdog keep-alives", "interval", interval)
+			go runWatchdog(watchdogCtx, interval, watchdogChecks, log.With(logger, "component", "watchdog"))
+		}
+	}
+
+	// Push-only setups, e.g. exporting over OTLP, can do without the
+	// Prometheus endpoint.
+	if len(listeners) == 0 {
+		level.Info(logger).Log("msg", "No listen address, not serving metrics over HTTP")
+		notifyReady()
+		select {}
+	}
+
+	var selfChecks []watchdogCheck
+	for _, l := range listeners {
+		level.Info(logger).Log("msg", "Listening on address", "address", l.Addr())
+		if interval, ok := watchdogInterval(); ok {
+			watchdogChecks = append(watchdogChecks, httpCheck(l.Addr(), prefix+"/-/healthy", interval/4))
+		}
+		if *selfWatchdog {
+			selfChecks = append(selfChecks, httpCheck(l.Addr(), prefix+"/-/healthy", *selfWatchdogInterval/2))
+		}
+	}
+	if *selfWatchdog {
+		if *selfWatchdogInterval <= 0 || *selfWatchdogFailures < 1 {
+			level.Error(logger).Log("msg", "--iqair.self-watchdog-interval must be positive and --iqair.self-watchdog-failures at least 1")
+			os.Exit(1)
+		}
+		// Stopped with the systemd watchdog, as the server stops answering
+		// during a shutdown.
+		go func() {
+			err := runSelfWatchdog(watchdogCtx, *selfWatchdogInterval, *selfWatchdogFailures, selfChecks, log.With(logger, "component", "self-watchdog"))
+			if err != nil {
+				level.Error(logger).Log("msg", "HTTP server stopped answering, exiting", "consecutive_failures", *selfWatchdogFailures, "err", err)
+				exit(1)
+			}
+		}()
+	}
+	notifyReady()
+	errs := serve(listeners, servers, *webConfig, logger)
+	for range servers {
+		if err := <-errs; err != http.ErrServerClosed {
+			level.Error(logger).Log("msg", "Error starting HTTP server", "err", err)
+			os.Exit(1)
+		}
+	}
+	// The shutdown exits once it completes.
+	select {}
 }
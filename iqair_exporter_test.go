@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+var updateGolden = flag.Bool("update", false, "Rewrite the golden exposition files in testdata.")
+
+// writeResponse writes a device response to a file and returns the
+// file:// URI scraping it.
+func writeResponse(t testing.TB, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "response.json")
+	if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return fileURIPrefix + path
+}
+
+// fixtureURI returns the file:// URI of the fixture response name in
+// testdata.
+func fixtureURI(t testing.TB, name string) string {
+	t.Helper()
+	path, err := filepath.Abs(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fileURIPrefix + path
+}
+
+// rewriteResponse replaces the response served by uri, as returned by
+// writeResponse.
+func rewriteResponse(t testing.TB, uri, body string) {
+	t.Helper()
+	if err := os.WriteFile(uri[len(fileURIPrefix):], []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestExporter returns an exporter for the device at uri, with a short
+// timeout unless opts sets one.
+func newTestExporter(t testing.TB, uri string, opts ExporterOptions) *Exporter {
+	t.Helper()
+	if opts.Timeout == 0 {
+		opts.Timeout = time.Second
+	}
+	e, err := NewExporter(DeviceConfig{URI: uri}, opts, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// gather collects c through a registry and returns its metrics by name.
+func gather(t testing.TB, c prometheus.Collector) map[string]*dto.MetricFamily {
+	t.Helper()
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(c); err != nil {
+		t.Fatal(err)
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	families := make(map[string]*dto.MetricFamily, len(mfs))
+	for _, mf := range mfs {
+		families[mf.GetName()] = mf
+	}
+	return families
+}
+
+// metricValue returns the value of the first metric named name in
+// families, and false if there is none.
+func metricValue(families map[string]*dto.MetricFamily, name string) (float64, bool) {
+	mf, ok := families[name]
+	if !ok || len(mf.Metric) == 0 {
+		return 0, false
+	}
+	m := mf.Metric[0]
+	switch {
+	case m.Gauge != nil:
+		return m.Gauge.GetValue(), true
+	case m.Counter != nil:
+		return m.Counter.GetValue(), true
+	}
+	return 0, false
+}
+
+func TestFirmwareUpdateAvailable(t *testing.T) {
+	for fixture, want := range map[string]float64{
+		"update_available.json": 1,
+		"up_to_date.json":       0,
+	} {
+		e := newTestExporter(t, fixtureURI(t, fixture), ExporterOptions{})
+		if got, ok := metricValue(gather(t, e), "iqair_firmware_update_available"); !ok || got != want {
+			t.Errorf("%s: iqair_firmware_update_available = %v, %v, want %v", fixture, got, ok, want)
+		}
+	}
+
+	e := newTestExporter(t, writeResponse(t, `{"current":{"co":500},"status":{"model":"AirVisual Pro"}}`), ExporterOptions{})
+	if _, ok := gather(t, e)["iqair_firmware_update_available"]; ok {
+		t.Error("iqair_firmware_update_available exported without update_available in the status")
+	}
+}
+
+func TestHumidityFraction(t *testing.T) {
+	uri := writeResponse(t, `{"current":{"co":500,"p2":3,"p1":4,"tp":21.5,"hm":45}}`)
+	for fraction, want := range map[bool]float64{false: 45, true: 0.45} {
+		e := newTestExporter(t, uri, ExporterOptions{HumidityFraction: fraction})
+		if got, _ := metricValue(gather(t, e), "iqair_humidity"); got != want {
+			t.Errorf("with HumidityFraction %v, iqair_humidity = %v, want %v", fraction, got, want)
+		}
+	}
+}
+
+func TestEmptyBody(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		status      int
+		emptyBodyOK bool
+		up, noData  float64
+		// exitCode tells scrape failures from parse failures.
+		exitCode int
+	}{
+		{"empty 200 accepted", http.StatusOK, true, 1, 1, 0},
+		{"empty 200 without the flag", http.StatusOK, false, 0, 0, exitOnceParseFailed},
+		{"empty 503 with the flag", http.StatusServiceUnavailable, true, 0, 0, exitOnceScrapeFailed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+			}))
+			defer server.Close()
+			e := newTestExporter(t, server.URL, ExporterOptions{EmptyBodyOK: tc.emptyBodyOK})
+			families := gather(t, e)
+			if got, _ := metricValue(families, "iqair_up"); got != tc.up {
+				t.Errorf("iqair_up = %v, want %v", got, tc.up)
+			}
+			if got, _ := metricValue(families, "iqair_no_data"); got != tc.noData {
+				t.Errorf("iqair_no_data = %v, want %v", got, tc.noData)
+			}
+			if got := onceExitCode([]*Exporter{e}); got != tc.exitCode {
+				t.Errorf("--once exit code = %d, want %d", got, tc.exitCode)
+			}
+		})
+	}
+}
+
+func TestWaitForDevice(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			http.Error(w, "booting", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"current":{"co":500,"p2":3,"p1":4,"tp":21.5,"hm":40}}`))
+	}))
+	defer server.Close()
+
+	e := newTestExporter(t, server.URL, ExporterOptions{})
+	e.waitBackoff = time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := e.WaitForDevice(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&requests); got != 3 {
+		t.Errorf("WaitForDevice made %d requests, want 3", got)
+	}
+	if snapshot := e.Snapshot(); snapshot.Response == nil || snapshot.Response.Current.CO2 != 500 {
+		t.Errorf("WaitForDevice did not keep the reading: %+v", snapshot.Response)
+	}
+}
+
+func TestWaitForDeviceGivesUp(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "booting", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	e := newTestExporter(t, server.URL, ExporterOptions{})
+	e.waitBackoff = time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := e.WaitForDevice(ctx); err == nil {
+		t.Fatal("WaitForDevice succeeded against a device that never comes up")
+	}
+}
+
+func TestReadingWithinTolerance(t *testing.T) {
+	uri := writeResponse(t, `{"current":{"ts":1600000000,"co":500,"p2":3,"p1":4,"tp":21.5,"hm":40}}`)
+	e := newTestExporter(t, uri, ExporterOptions{ReadingTolerance: time.Minute})
+	for lag, want := range map[time.Duration]float64{
+		30 * time.Second: 1,
+		90 * time.Second: 0,
+	} {
+		now := time.Unix(1600000000, 0).Add(lag)
+		e.nowFunc = func() time.Time { return now }
+		mf, ok := gather(t, e)["iqair_reading_within_tolerance"]
+		if !ok {
+			t.Fatal("iqair_reading_within_tolerance not exported")
+		}
+		m := mf.Metric[0]
+		if got := m.GetGauge().GetValue(); got != want {
+			t.Errorf("lagging by %v, iqair_reading_within_tolerance = %v, want %v", lag, got, want)
+		}
+		if label := m.Label[0]; label.GetName() != "tolerance" || label.GetValue() != "60s" {
+			t.Errorf("label %s=%q, want tolerance=\"60s\"", label.GetName(), label.GetValue())
+		}
+	}
+}
+
+func TestToleranceLabel(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		time.Minute:             "60s",
+		90 * time.Minute:        "5400s",
+		1500 * time.Millisecond: "1.5s",
+	} {
+		if got := toleranceLabel(d); got != want {
+			t.Errorf("toleranceLabel(%v) = %q, want %q", d, got, want)
+		}
+	}
+}
+
+func TestCacheHitsAndMisses(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte(`{"current":{"co":500,"p2":3,"p1":4,"tp":21.5,"hm":40}}`))
+	}))
+	defer server.Close()
+	collect := func(e *Exporter, times int) {
+		ch := make(chan prometheus.Metric, 100)
+		for i := 0; i < times; i++ {
+			e.Collect(ch)
+			for len(ch) > 0 {
+				<-ch
+			}
+		}
+	}
+	check := func(e *Exporter, hits, misses float64, scrapes int32) {
+		t.Helper()
+		if got := testutil.ToFloat64(e.cacheHits); got != hits {
+			t.Errorf("cache hits = %v, want %v", got, hits)
+		}
+		if got := testutil.ToFloat64(e.cacheMisses); got != misses {
+			t.Errorf("cache misses = %v, want %v", got, misses)
+		}
+		if got := atomic.SwapInt32(&requests, 0); got != scrapes {
+			t.Errorf("device got %d requests, want %d", got, scrapes)
+		}
+	}
+
+	// Without polling, every collect scrapes the device.
+	e := newTestExporter(t, server.URL, ExporterOptions{})
+	collect(e, 3)
+	check(e, 0, 3, 3)
+
+	start := time.Unix(1600000000, 0)
+	now := start
+	e = newTestExporter(t, server.URL, ExporterOptions{PollInterval: time.Minute})
+	e.nowFunc = func() time.Time { return now }
+	// Before the first poll completes, collects scrape the device.
+	collect(e, 1)
+	check(e, 0, 1, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// With ctx already cancelled, Poll scrapes once and returns.
+	e.Poll(ctx)
+	check(e, 0, 1, 1)
+
+	collect(e, 5)
+	check(e, 5, 1, 0)
+	// The poll result is fresh for the poll interval plus the 1s timeout.
+	now = start.Add(61 * time.Second)
+	collect(e, 1)
+	check(e, 6, 1, 0)
+	// Once the poller fails to replace it, collects scrape the device, and
+	// the result of that is fresh again.
+	now = start.Add(62 * time.Second)
+	collect(e, 3)
+	check(e, 8, 2, 1)
+}
+
+// TestSnapshotDuringCollect is meant to be run with -race.
+func TestSnapshotDuringCollect(t *testing.T) {
+	uri := writeResponse(t, `{"current":{"co":500,"p2":3,"p1":4,"tp":21.5,"hm":40},"status":{"model":"AirVisual Pro"}}`)
+	e := newTestExporter(t, uri, ExporterOptions{})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(e)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				reg.Gather()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				s := e.Snapshot()
+				if s.Response != nil {
+					s.Labels["mutated"] = "yes"
+					s.Response.Current.CO2 = -1
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if s := e.Snapshot(); s.Response == nil || s.Response.Current.CO2 != 500 || len(s.Labels) != 0 {
+		t.Errorf("changing snapshots changed the exporter's state: %+v", s)
+	}
+}
+
+func TestDeviceTimestampFixtures(t *testing.T) {
+	for fixture, want := range map[string]time.Time{
+		"ts_seconds.json": time.Unix(1600000000, 0),
+		"ts_millis.json":  time.Unix(1600000000, 123*int64(time.Millisecond)),
+		"ts_rfc3339.json": time.Unix(1600000000, 123*int64(time.Millisecond)),
+	} {
+		body, err := os.ReadFile(filepath.Join("testdata", fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var response APIResponse
+		if err := json.Unmarshal(body, &response); err != nil {
+			t.Fatalf("%s: %v", fixture, err)
+		}
+		if got := response.Current.Timestamp; !got.Equal(want) {
+			t.Errorf("%s: timestamp = %v, want %v", fixture, got, want)
+		}
+	}
+}
+
+func TestParseDeviceTimestamp(t *testing.T) {
+	for raw, want := range map[string]time.Time{
+		`null`:                        {},
+		`""`:                          {},
+		`1600000000`:                  time.Unix(1600000000, 0),
+		`"1600000000"`:                time.Unix(1600000000, 0),
+		`1600000000999`:               time.Unix(1600000000, 999*int64(time.Millisecond)),
+		`"1600000000001"`:             time.Unix(1600000000, int64(time.Millisecond)),
+		`1600000000.5`:                time.Unix(1600000000, 500*int64(time.Millisecond)),
+		`"2020-09-13T12:26:40+02:00"`: time.Unix(1600000000-2*3600, 0),
+	} {
+		got, err := parseDeviceTimestamp(json.RawMessage(raw))
+		if err != nil {
+			t.Errorf("parseDeviceTimestamp(%s): %v", raw, err)
+			continue
+		}
+		if !got.Equal(want) {
+			t.Errorf("parseDeviceTimestamp(%s) = %v, want %v", raw, got, want)
+		}
+	}
+	if _, err := parseDeviceTimestamp(json.RawMessage(`"yesterday"`)); err == nil {
+		t.Error("parseDeviceTimestamp accepted \"yesterday\"")
+	}
+}
+
+// unstableMetrics vary between machines, so they are left out of the
+// golden exposition files: iqair_target_info holds the fixture's absolute
+// path.
+var unstableMetrics = map[string]bool{
+	"iqair_target_info": true,
+}
+
+// newGoldenExporter returns an exporter of the fixture payload, with a
+// clock 30s after its measurement for a stable clock skew. Every collect
+// scrapes again, so each golden comparison needs a new one.
+func newGoldenExporter(t *testing.T, fixture string) *Exporter {
+	e := newTestExporter(t, fixtureURI(t, fixture+".json"), ExporterOptions{})
+	e.nowFunc = func() time.Time { return time.Unix(1600000030, 0) }
+	return e
+}
+
+// TestGoldenExposition compares the metrics exported for each fixture
+// payload with testdata/<fixture>.txt. Run with -update after an intended
+// change to rewrite them.
+func TestGoldenExposition(t *testing.T) {
+	for _, fixture := range []string{"base", "outdoor"} {
+		t.Run(fixture, func(t *testing.T) {
+			var names []string
+			for name := range gather(t, newGoldenExporter(t, fixture)) {
+				if !unstableMetrics[name] {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+
+			golden := filepath.Join("testdata", fixture+".txt")
+			if *updateGolden {
+				writeGolden(t, golden, gather(t, newGoldenExporter(t, fixture)), names)
+			}
+			f, err := os.Open(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if err := testutil.CollectAndCompare(newGoldenExporter(t, fixture), f, names...); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// writeGolden writes the named metric families to path.
+func writeGolden(t *testing.T, path string, families map[string]*dto.MetricFamily, names []string) {
+	t.Helper()
+	var b strings.Builder
+	for _, name := range names {
+		if _, err := expfmt.MetricFamilyToText(&b, families[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLastScrapeErrorRedactsURI(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			// Fail the request with an error that quotes the URL.
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Write([]byte(`{"current":{"co":500,"p2":3,"p1":4,"tp":21.5,"hm":40}}`))
+	}))
+	defer server.Close()
+
+	uri := strings.Replace(server.URL, "http://", "http://user:hunter2@", 1) + airVisualKeyPrefix + "s3cr3tk3y"
+	e := newTestExporter(t, uri, ExporterOptions{LastScrapeError: true})
+	label := func() string {
+		mf, ok := gather(t, e)["iqair_last_scrape_error"]
+		if !ok {
+			t.Fatal("iqair_last_scrape_error not exported")
+		}
+		return mf.Metric[0].Label[0].GetValue()
+	}
+
+	failed := label()
+	if failed == "" {
+		t.Fatal("no error label after a failed scrape")
+	}
+	for _, secret := range []string{"s3cr3tk3y", "hunter2"} {
+		if strings.Contains(failed, secret) {
+			t.Errorf("error label %q leaks %s", failed, secret)
+		}
+	}
+	if want := fingerprintURI(uri); !strings.Contains(failed, want) {
+		t.Errorf("error label %q does not name the target as %s", failed, want)
+	}
+	if got := label(); got != "" {
+		t.Errorf("error label after a successful scrape = %q, want empty", got)
+	}
+}
@@ -0,0 +1,634 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Kafka API keys and the versions used. Produce v3 with v2 record batches
+// works with Kafka 0.11 and later.
+const (
+	kafkaAPIProduce          = 0
+	kafkaAPIMetadata         = 3
+	kafkaAPISaslHandshake    = 17
+	kafkaAPISaslAuthenticate = 36
+
+	kafkaProduceVersion          = 3
+	kafkaMetadataVersion         = 1
+	kafkaSaslHandshakeVersion    = 1
+	kafkaSaslAuthenticateVersion = 0
+)
+
+// kafkaMaxBatch bounds the number of messages sent in one produce request.
+const kafkaMaxBatch = 100
+
+// kafkaErrorLogInterval is the minimum time between logged produce errors.
+const kafkaErrorLogInterval = time.Minute
+
+var kafkaCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// KafkaConfig configures publishing readings to Kafka.
+type KafkaConfig struct {
+	// Brokers are the host:port addresses used to discover the cluster.
+	Brokers  []string
+	Topic    string
+	ClientID string
+	// TLSConfig enables TLS if not nil.
+	TLSConfig *tls.Config
+	// SASLUsername enables SASL/PLAIN authentication if not empty.
+	SASLUsername string
+	SASLPassword string
+	Timeout      time.Duration
+	// QueueSize bounds the number of readings waiting to be published.
+	QueueSize int
+}
+
+type kafkaMessage struct {
+	key, value []byte
+	timestamp  time.Time
+}
+
+// KafkaProducer publishes one JSON message per new reading to a Kafka topic,
+// keyed by the device's serial number so each device's readings stay in
+// order on one partition. Messages are queued and produced from a separate
+// goroutine, so an unavailable cluster never delays a scrape.
+//
+// Only the small subset of the Kafka protocol needed to produce is
+// implemented: metadata discovery, SASL/PLAIN and uncompressed produce
+// requests with acks from all in-sync replicas.
+type KafkaProducer struct {
+	config   KafkaConfig
+	messages chan kafkaMessage
+	logger   log.Logger
+
+	// Cluster state, only used by the Run goroutine.
+	conns         map[int32]*kafkaConn
+	brokers       map[int32]string
+	leaders       []int32
+	correlationID int32
+	lastErrorLog  time.Time
+	suppressed    int
+
+	produced, failed, dropped prometheus.Counter
+}
+
+// NewKafkaProducer returns a KafkaProducer. Call Run to start producing.
+func NewKafkaProducer(config KafkaConfig, logger log.Logger) *KafkaProducer {
+	return &KafkaProducer{
+		config:   config,
+		messages: make(chan kafkaMessage, config.QueueSize),
+		logger:   logger,
+		conns:    map[int32]*kafkaConn{},
+		produced: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_kafka_produced_messages_total",
+			Help:      "Number of messages acknowledged by Kafka.",
+		}),
+		failed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_kafka_failed_messages_total",
+			Help:      "Number of messages that could not be produced to Kafka.",
+		}),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_kafka_dropped_readings_total",
+			Help:      "Number of readings dropped because the produce queue was full.",
+		}),
+	}
+}
+
+// OnReading queues r for producing. It implements ReadingListener.
+func (p *KafkaProducer) OnReading(r Reading) {
+	value, err := json.Marshal(newReadingDocument(r))
+	if err != nil {
+		level.Error(p.logger).Log("msg", "Error encoding reading", "err", err)
+		return
+	}
+	key := r.Status.SerialNumber
+	if key == "" {
+		key = r.DeviceName()
+	}
+	select {
+	case p.messages <- kafkaMessage{key: []byte(key), value: value, timestamp: r.Timestamp}:
+	default:
+		p.dropped.Inc()
+	}
+}
+
+// Run produces queued messages until ctx is cancelled. Messages still
+// queued are produced before it returns, unless the cluster cannot be
+// reached, in which case they are counted as failed.
+func (p *KafkaProducer) Run(ctx context.Context) {
+	defer p.reset()
+	for {
+		select {
+		case <-ctx.Done():
+			for len(p.messages) > 0 {
+				if !p.send(p.nextBatch(nil)) {
+					// Do not time out once more for every remaining batch.
+					for len(p.messages) > 0 {
+						<-p.messages
+						p.failed.Inc()
+					}
+				}
+			}
+			return
+		case m := <-p.messages:
+			p.send(p.nextBatch([]kafkaMessage{m}))
+		}
+	}
+}
+
+// nextBatch appends whatever else is already queued to batch, up to
+// kafkaMaxBatch messages.
+func (p *KafkaProducer) nextBatch(batch []kafkaMessage) []kafkaMessage {
+	for len(batch) < kafkaMaxBatch {
+		select {
+		case m := <-p.messages:
+			batch = append(batch, m)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// send produces batch, counting the outcome, and reports whether it
+// succeeded.
+func (p *KafkaProducer) send(batch []kafkaMessage) bool {
+	err := p.produce(batch)
+	if err != nil {
+		// Leadership may have moved; retry once with fresh metadata.
+		p.reset()
+		err = p.produce(batch)
+	}
+	if err != nil {
+		p.reset()
+		p.failed.Add(float64(len(batch)))
+		p.logError(err)
+		return false
+	}
+	p.produced.Add(float64(len(batch)))
+	return true
+}
+
+// logError logs err unless another error was logged recently, so an
+// unavailable cluster does not flood the log.
+func (p *KafkaProducer) logError(err error) {
+	if time.Since(p.lastErrorLog) < kafkaErrorLogInterval {
+		p.suppressed++
+		return
+	}
+	level.Error(p.logger).Log("msg", "Error producing to Kafka", "suppressed_errors", p.suppressed, "err", err)
+	p.lastErrorLog = time.Now()
+	p.suppressed = 0
+}
+
+// reset closes all connections and forgets the cluster metadata.
+func (p *KafkaProducer) reset() {
+	for id, conn := range p.conns {
+		conn.Close()
+		delete(p.conns, id)
+	}
+	p.leaders = nil
+}
+
+// produce sends batch to the partition leaders and waits for their
+// acknowledgements.
+func (p *KafkaProducer) produce(batch []kafkaMessage) error {
+	if p.leaders == nil {
+		if err := p.refreshMetadata(); err != nil {
+			return err
+		}
+	}
+
+	byPartition := map[int32][]kafkaMessage{}
+	for _, m := range batch {
+		partition := kafkaPartition(m.key, int32(len(p.leaders)))
+		byPartition[partition] = append(byPartition[partition], m)
+	}
+	for partition, messages := range byPartition {
+		conn, err := p.conn(p.leaders[partition])
+		if err != nil {
+			return err
+		}
+		resp, err := p.roundTrip(conn, kafkaAPIProduce, kafkaProduceVersion, encodeKafkaProduce(p.config.Topic, partition, messages, p.config.Timeout))
+		if err != nil {
+			return err
+		}
+		if err := checkKafkaProduceResponse(resp); err != nil {
+			return fmt.Errorf("partition %d: %v", partition, err)
+		}
+	}
+	return nil
+}
+
+// refreshMetadata looks up the brokers and partition leaders of the topic
+// from the first reachable bootstrap broker.
+func (p *KafkaProducer) refreshMetadata() error {
+	var lastErr error
+	for _, addr := range p.config.Brokers {
+		conn, err := p.dial(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		var req kafkaEncoder
+		req.int32(1)
+		req.string(p.config.Topic)
+		resp, err := p.roundTrip(conn, kafkaAPIMetadata, kafkaMetadataVersion, req.buf)
+		conn.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		brokers, leaders, err := decodeKafkaMetadata(resp, p.config.Topic)
+		if err != nil {
+			return err
+		}
+		p.brokers, p.leaders = brokers, leaders
+		return nil
+	}
+	return fmt.Errorf("no bootstrap broker reachable: %v", lastErr)
+}
+
+// conn returns the connection to a broker, connecting if needed.
+func (p *KafkaProducer) conn(id int32) (*kafkaConn, error) {
+	if conn, ok := p.conns[id]; ok {
+		return conn, nil
+	}
+	addr, ok := p.brokers[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown broker %d", id)
+	}
+	conn, err := p.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	p.conns[id] = conn
+	return conn, nil
+}
+
+func (p *KafkaProducer) dial(addr string) (*kafkaConn, error) {
+	dialer := &net.Dialer{Timeout: p.config.Timeout}
+	var c net.Conn
+	var err error
+	if p.config.TLSConfig != nil {
+		c, err = tls.DialWithDialer(dialer, "tcp", addr, p.config.TLSConfig)
+	} else {
+		c, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn := &kafkaConn{Conn: c, reader: bufio.NewReader(c)}
+
+	if p.config.SASLUsername != "" {
+		if err := p.authenticate(conn); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("SASL authentication with %s failed: %v", addr, err)
+		}
+	}
+	return conn, nil
+}
+
+// authenticate performs a SASL/PLAIN exchange on conn.
+func (p *KafkaProducer) authenticate(conn *kafkaConn) error {
+	var req kafkaEncoder
+	req.string("PLAIN")
+	resp, err := p.roundTrip(conn, kafkaAPISaslHandshake, kafkaSaslHandshakeVersion, req.buf)
+	if err != nil {
+		return err
+	}
+	d := kafkaDecoder{buf: resp}
+	if code := d.int16(); code != 0 {
+		return kafkaError(code)
+	}
+
+	req = kafkaEncoder{}
+	req.bytes([]byte("\x00" + p.config.SASLUsername + "\x00" + p.config.SASLPassword))
+	resp, err = p.roundTrip(conn, kafkaAPISaslAuthenticate, kafkaSaslAuthenticateVersion, req.buf)
+	if err != nil {
+		return err
+	}
+	d = kafkaDecoder{buf: resp}
+	if code := d.int16(); code != 0 {
+		if msg := d.nullableString(); msg != "" {
+			return fmt.Errorf("%v: %s", kafkaError(code), msg)
+		}
+		return kafkaError(code)
+	}
+	return d.err
+}
+
+// roundTrip sends a request and returns the body of its response.
+func (p *KafkaProducer) roundTrip(conn *kafkaConn, apiKey, apiVersion int16, body []byte) ([]byte, error) {
+	p.correlationID++
+	var req kafkaEncoder
+	req.int32(0) // Size, filled in below.
+	req.int16(apiKey)
+	req.int16(apiVersion)
+	req.int32(p.correlationID)
+	req.string(p.config.ClientID)
+	req.buf = append(req.buf, body...)
+	binary.BigEndian.PutUint32(req.buf, uint32(len(req.buf)-4))
+
+	conn.SetDeadline(time.Now().Add(p.config.Timeout))
+	if _, err := conn.Write(req.buf); err != nil {
+		return nil, err
+	}
+	var size int32
+	if err := binary.Read(conn.reader, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if size < 4 {
+		return nil, fmt.Errorf("invalid response size %d", size)
+	}
+	resp := make([]byte, size)
+	if _, err := io.ReadFull(conn.reader, resp); err != nil {
+		return nil, err
+	}
+	if id := int32(binary.BigEndian.Uint32(resp)); id != p.correlationID {
+		return nil, fmt.Errorf("response correlation ID %d does not match request %d", id, p.correlationID)
+	}
+	return resp[4:], nil
+}
+
+// Describe implements prometheus.Collector.
+func (p *KafkaProducer) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.produced.Desc()
+	ch <- p.failed.Desc()
+	ch <- p.dropped.Desc()
+}
+
+// Collect implements prometheus.Collector.
+func (p *KafkaProducer) Collect(ch chan<- prometheus.Metric) {
+	ch <- p.produced
+	ch <- p.failed
+	ch <- p.dropped
+}
+
+type kafkaConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// kafkaPartition picks the partition for key the same way as sarama's
+// default hash partitioner, so other producers keyed by serial agree.
+func kafkaPartition(key []byte, partitions int32) int32 {
+	h := fnv.New32a()
+	h.Write(key)
+	partition := int32(h.Sum32()) % partitions
+	if partition < 0 {
+		partition = -partition
+	}
+	return partition
+}
+
+// encodeKafkaProduce encodes a produce request for one partition, requiring
+// acknowledgement from all in-sync replicas.
+func encodeKafkaProduce(topic string, partition int32, messages []kafkaMessage, timeout time.Duration) []byte {
+	var req kafkaEncoder
+	req.int16(-1) // Null transactional ID.
+	req.int16(-1) // acks=all
+	req.int32(int32(timeout / time.Millisecond))
+	req.int32(1)
+	req.string(topic)
+	req.int32(1)
+	req.int32(partition)
+	req.bytes(encodeKafkaRecordBatch(messages))
+	return req.buf
+}
+
+// encodeKafkaRecordBatch encodes messages as an uncompressed v2 record
+// batch.
+func encodeKafkaRecordBatch(messages []kafkaMessage) []byte {
+	first := messages[0].timestamp.UnixNano() / int64(time.Millisecond)
+	max := first
+	var records []byte
+	for i, m := range messages {
+		ts := m.timestamp.UnixNano() / int64(time.Millisecond)
+		if ts > max {
+			max = ts
+		}
+		var record []byte
+		record = append(record, 0) // Attributes.
+		record = protowire.AppendVarint(record, protowire.EncodeZigZag(ts-first))
+		record = protowire.AppendVarint(record, protowire.EncodeZigZag(int64(i)))
+		record = protowire.AppendVarint(record, protowire.EncodeZigZag(int64(len(m.key))))
+		record = append(record, m.key...)
+		record = protowire.AppendVarint(record, protowire.EncodeZigZag(int64(len(m.value))))
+		record = append(record, m.value...)
+		record = protowire.AppendVarint(record, 0) // No headers.
+
+		records = protowire.AppendVarint(records, protowire.EncodeZigZag(int64(len(record))))
+		records = append(records, record...)
+	}
+
+	// The CRC covers everything from the attributes onwards.
+	var crcd kafkaEncoder
+	crcd.int16(0) // Attributes: no compression, create time.
+	crcd.int32(int32(len(messages) - 1))
+	crcd.int64(first)
+	crcd.int64(max)
+	crcd.int64(-1) // Producer ID.
+	crcd.int16(-1) // Producer epoch.
+	crcd.int32(-1) // Base sequence.
+	crcd.int32(int32(len(messages)))
+	crcd.buf = append(crcd.buf, records...)
+
+	var batch kafkaEncoder
+	batch.int64(0)                                // Base offset.
+	batch.int32(int32(4 + 1 + 4 + len(crcd.buf))) // Length after this field.
+	batch.int32(-1)                               // Partition leader epoch.
+	batch.buf = append(batch.buf, 2)              // Magic.
+	batch.int32(int32(crc32.Checksum(crcd.buf, kafkaCRCTable)))
+	batch.buf = append(batch.buf, crcd.buf...)
+	return batch.buf
+}
+
+// decodeKafkaMetadata returns the broker addresses by node ID and the
+// leader of each partition of topic from a v1 metadata response.
+func decodeKafkaMetadata(resp []byte, topic string) (map[int32]string, []int32, error) {
+	d := kafkaDecoder{buf: resp}
+	brokers := map[int32]string{}
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		id := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.nullableString() // Rack.
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.int32() // Controller ID.
+
+	var leaders []int32
+	found := false
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		code := d.int16()
+		name := d.string()
+		d.int8() // Internal.
+		partitions := d.int32()
+		if name == topic {
+			if code != 0 {
+				return nil, nil, fmt.Errorf("topic %s: %v", topic, kafkaError(code))
+			}
+			found = true
+			leaders = make([]int32, partitions)
+		}
+		for i := int32(0); i < partitions && d.err == nil; i++ {
+			d.int16() // Partition error.
+			index := d.int32()
+			leader := d.int32()
+			for r := d.int32(); r > 0; r-- {
+				d.int32() // Replicas.
+			}
+			for r := d.int32(); r > 0; r-- {
+				d.int32() // In-sync replicas.
+			}
+			if name == topic && index >= 0 && index < partitions {
+				leaders[index] = leader
+			}
+		}
+	}
+	if d.err != nil {
+		return nil, nil, fmt.Errorf("invalid metadata response: %v", d.err)
+	}
+	if !found || len(leaders) == 0 {
+		return nil, nil, fmt.Errorf("topic %s not found", topic)
+	}
+	for i, leader := range leaders {
+		if leader < 0 {
+			return nil, nil, fmt.Errorf("partition %d of topic %s has no leader", i, topic)
+		}
+	}
+	return brokers, leaders, nil
+}
+
+// checkKafkaProduceResponse returns the first partition error in a v3
+// produce response.
+func checkKafkaProduceResponse(resp []byte) error {
+	d := kafkaDecoder{buf: resp}
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		d.string() // Topic.
+		for p := d.int32(); p > 0 && d.err == nil; p-- {
+			d.int32() // Partition.
+			code := d.int16()
+			d.int64() // Base offset.
+			d.int64() // Log append time.
+			if code != 0 {
+				return kafkaError(code)
+			}
+		}
+	}
+	return d.err
+}
+
+// kafkaError is a Kafka protocol error code.
+type kafkaError int16
+
+func (e kafkaError) Error() string {
+	return fmt.Sprintf("kafka error code %d", int16(e))
+}
+
+// kafkaEncoder appends Kafka protocol primitives to buf.
+type kafkaEncoder struct {
+	buf []byte
+}
+
+func (e *kafkaEncoder) int16(v int16) {
+	e.buf = append(e.buf, byte(v>>8), byte(v))
+}
+
+func (e *kafkaEncoder) int32(v int32) {
+	e.buf = append(e.buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (e *kafkaEncoder) int64(v int64) {
+	e.int32(int32(v >> 32))
+	e.int32(int32(v))
+}
+
+func (e *kafkaEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *kafkaEncoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// kafkaDecoder reads Kafka protocol primitives from buf, recording the first
+// error and returning zero values after it.
+type kafkaDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *kafkaDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.buf) < n {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *kafkaDecoder) int8() int8 {
+	if b := d.next(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if b := d.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if b := d.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) string() string {
+	return string(d.next(int(d.int16())))
+}
+
+func (d *kafkaDecoder) nullableString() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// fakeKafka is a single Kafka broker answering metadata and produce
+// requests for one topic with one partition.
+type fakeKafka struct {
+	t        *testing.T
+	addr     string
+	topic    string
+	messages chan kafkaMessage
+}
+
+// newFakeKafka starts a fake broker for topic.
+func newFakeKafka(t *testing.T, topic string) *fakeKafka {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	k := &fakeKafka{t: t, addr: l.Addr().String(), topic: topic, messages: make(chan kafkaMessage, 100)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go k.serve(conn)
+		}
+	}()
+	return k
+}
+
+func (k *fakeKafka) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		var size int32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return
+		}
+		req := make([]byte, size)
+		if _, err := io.ReadFull(r, req); err != nil {
+			return
+		}
+		d := kafkaDecoder{buf: req}
+		apiKey := d.int16()
+		d.int16() // API version.
+		correlationID := d.int32()
+		d.string() // Client ID.
+
+		var resp kafkaEncoder
+		resp.int32(0) // Size, filled in below.
+		resp.int32(correlationID)
+		switch apiKey {
+		case kafkaAPIMetadata:
+			k.metadata(&resp)
+		case kafkaAPIProduce:
+			k.produce(&d, &resp)
+		default:
+			k.t.Errorf("fake broker got API key %d", apiKey)
+			return
+		}
+		binary.BigEndian.PutUint32(resp.buf, uint32(len(resp.buf)-4))
+		if _, err := conn.Write(resp.buf); err != nil {
+			return
+		}
+	}
+}
+
+// metadata answers with the broker itself leading the only partition.
+func (k *fakeKafka) metadata(resp *kafkaEncoder) {
+	host, port, _ := net.SplitHostPort(k.addr)
+	portNum, _ := strconv.Atoi(port)
+	resp.int32(1)
+	resp.int32(0) // Node ID.
+	resp.string(host)
+	resp.int32(int32(portNum))
+	resp.int16(-1) // No rack.
+	resp.int32(0)  // Controller ID.
+	resp.int32(1)
+	resp.int16(0)
+	resp.string(k.topic)
+	resp.buf = append(resp.buf, 0) // Not internal.
+	resp.int32(1)
+	resp.int16(0)
+	resp.int32(0) // Partition.
+	resp.int32(0) // Leader.
+	resp.int32(1) // Replicas.
+	resp.int32(0)
+	resp.int32(1) // In-sync replicas.
+	resp.int32(0)
+}
+
+// produce decodes the record batch of a produce request and acknowledges
+// it.
+func (k *fakeKafka) produce(d *kafkaDecoder, resp *kafkaEncoder) {
+	d.int16() // Transactional ID.
+	if acks := d.int16(); acks != -1 {
+		k.t.Errorf("produce request with acks=%d, want -1", acks)
+	}
+	d.int32() // Timeout.
+	d.int32() // Topics.
+	if topic := d.string(); topic != k.topic {
+		k.t.Errorf("produce request for topic %s, want %s", topic, k.topic)
+	}
+	d.int32() // Partitions.
+	d.int32() // Partition.
+	batch := d.next(int(d.int32()))
+	if d.err != nil {
+		k.t.Errorf("invalid produce request: %v", d.err)
+		return
+	}
+	k.decodeRecordBatch(batch)
+
+	resp.int32(1)
+	resp.string(k.topic)
+	resp.int32(1)
+	resp.int32(0) // Partition.
+	resp.int16(0) // No error.
+	resp.int64(0) // Base offset.
+	resp.int64(-1)
+	resp.int32(0) // Throttle time.
+}
+
+func (k *fakeKafka) decodeRecordBatch(batch []byte) {
+	const headerSize = 61
+	if len(batch) < headerSize || batch[16] != 2 {
+		k.t.Errorf("invalid record batch %x", batch)
+		return
+	}
+	if crc := binary.BigEndian.Uint32(batch[17:]); crc != crc32.Checksum(batch[21:], kafkaCRCTable) {
+		k.t.Error("record batch CRC does not match")
+	}
+	first := int64(binary.BigEndian.Uint64(batch[27:]))
+	records := batch[headerSize:]
+	varint := func() int64 {
+		v, n := protowire.ConsumeVarint(records)
+		if n < 0 {
+			// t.Fatal must not be called outside the test's goroutine.
+			panic("invalid varint in record batch")
+		}
+		records = records[n:]
+		return protowire.DecodeZigZag(v)
+	}
+	for count := binary.BigEndian.Uint32(batch[57:]); count > 0; count-- {
+		varint()              // Length.
+		records = records[1:] // Attributes.
+		ts := first + varint()
+		varint() // Offset delta.
+		key := records[:varint()]
+		records = records[len(key):]
+		value := records[:varint()]
+		records = records[len(value):]
+		varint() // Headers.
+		k.messages <- kafkaMessage{key: key, value: value, timestamp: time.Unix(0, ts*int64(time.Millisecond))}
+	}
+}
+
+func (k *fakeKafka) receive(t *testing.T) kafkaMessage {
+	t.Helper()
+	select {
+	case m := <-k.messages:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message produced")
+	}
+	return kafkaMessage{}
+}
+
+func newTestKafkaProducer(k *fakeKafka) *KafkaProducer {
+	return NewKafkaProducer(KafkaConfig{
+		Brokers:   []string{k.addr},
+		Topic:     k.topic,
+		ClientID:  "iqair_exporter",
+		Timeout:   time.Second,
+		QueueSize: 10,
+	}, log.NewNopLogger())
+}
+
+func TestKafkaMessageSchema(t *testing.T) {
+	k := newFakeKafka(t, "readings")
+	p := newTestKafkaProducer(k)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(ctx)
+
+	ts := time.Unix(1600000000, 0)
+	p.OnReading(testReading("living.room", ts))
+	m := k.receive(t)
+	if string(m.key) != "ABC123" {
+		t.Errorf("message key = %q, want the serial number ABC123", m.key)
+	}
+	if !m.timestamp.Equal(ts) {
+		t.Errorf("message timestamp = %v, want %v", m.timestamp, ts)
+	}
+	golden, err := os.ReadFile(filepath.Join("testdata", "kafka_message.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want bytes.Buffer
+	if err := json.Compact(&want, golden); err != nil {
+		t.Fatal(err)
+	}
+	if string(m.value) != want.String() {
+		t.Errorf("message value\n%s\nwant\n%s", m.value, want.String())
+	}
+}
+
+func TestKafkaProducerFlushesOnShutdown(t *testing.T) {
+	k := newFakeKafka(t, "readings")
+	p := newTestKafkaProducer(k)
+	p.OnReading(testReading("bedroom", time.Unix(1600000000, 0)))
+	p.OnReading(testReading("office", time.Unix(1600000060, 0)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p.Run(ctx)
+
+	if got := testutil.ToFloat64(p.produced); got != 2 {
+		t.Errorf("produced %v messages on shutdown, want 2", got)
+	}
+	for _, want := range []string{"bedroom", "office"} {
+		var doc readingDocument
+		if err := json.Unmarshal(k.receive(t).value, &doc); err != nil {
+			t.Fatal(err)
+		}
+		if doc.Device != want {
+			t.Errorf("produced a reading of %s, want %s", doc.Device, want)
+		}
+	}
+}
+
+func TestKafkaProducerFailsQueueOnShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	p := NewKafkaProducer(KafkaConfig{Brokers: []string{addr}, Topic: "readings", Timeout: time.Second, QueueSize: 10}, log.NewNopLogger())
+	p.OnReading(testReading("bedroom", time.Unix(1600000000, 0)))
+	p.OnReading(testReading("office", time.Unix(1600000060, 0)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p.Run(ctx)
+	if got := testutil.ToFloat64(p.failed); got != 2 {
+		t.Errorf("failed %v messages with no broker, want 2", got)
+	}
+}
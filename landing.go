@@ -0,0 +1,97 @@
+package main
+
+import (
+	_ "embed"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/version"
+)
+
+//go:embed landing.html
+var landingPageHTML string
+
+var landingPageTemplate = template.Must(template.New("landing").Parse(landingPageHTML))
+
+// landingLink is an endpoint listed on the landing page.
+type landingLink struct {
+	// Path is relative to the landing page, so links keep working behind
+	// a path prefix.
+	Path        string
+	Description string
+	// Post marks endpoints that only accept POST, shown without a link.
+	Post bool
+}
+
+// newLandingLink returns the link to the endpoint at path, which may be
+// absolute.
+func newLandingLink(path, description string) landingLink {
+	return landingLink{Path: strings.TrimPrefix(path, "/"), Description: description}
+}
+
+// landingDevice is a device listed on the landing page.
+type landingDevice struct {
+	Name string
+	// Target is the device's address as returned by targetAddress.
+	Target  string
+	Scraped bool
+	Up      bool
+	Error   string
+	// LastSuccess is empty if no scrape has succeeded yet.
+	LastSuccess string
+	HasAQI      bool
+	AQI         int
+	Category    aqiCategory
+}
+
+type landingPageData struct {
+	Version string
+	Devices []landingDevice
+	Links   []landingLink
+}
+
+// newLandingPageHandler returns the handler of /, listing the devices with
+// the outcome of their last scrape and the enabled endpoints. It only reads
+// the exporters' cached state, so it never waits for a device.
+func newLandingPageHandler(exporters []*Exporter, links []landingLink, logger log.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		data := landingPageData{
+			Version: version.Info(),
+			Links:   links,
+		}
+		for _, e := range exporters {
+			data.Devices = append(data.Devices, newLandingDevice(e.Snapshot(), e.nowFunc()))
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := landingPageTemplate.Execute(w, data); err != nil {
+			level.Error(logger).Log("msg", "Error rendering landing page", "err", err)
+		}
+	})
+}
+
+func newLandingDevice(s Snapshot, now time.Time) landingDevice {
+	d := landingDevice{
+		Name:    Reading{Device: s.Device}.DeviceName(),
+		Target:  targetAddress(s.URI),
+		Scraped: s.Up || s.Error != "",
+		Up:      s.Up,
+		Error:   redactedScrapeError(s),
+	}
+	if !s.LastSuccess.IsZero() {
+		d.LastSuccess = s.LastSuccess.UTC().Format(time.RFC3339) + " (" + formatAge(now.Sub(s.LastSuccess)) + ")"
+	}
+	if s.Response != nil {
+		d.HasAQI = true
+		d.AQI = s.Response.Current.usAQI()
+		d.Category = categorizeAQI(d.AQI)
+	}
+	return d
+}
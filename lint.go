@@ -0,0 +1,24 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil/promlint"
+)
+
+// Values of --metrics.lint.
+const (
+	metricsLintOff  = "off"
+	metricsLintWarn = "warn"
+	metricsLintFail = "fail"
+)
+
+// lintMetrics gathers the metrics of g and checks them against the
+// Prometheus naming conventions, as promtool check metrics does. This
+// catches names and labels broken by flags such as --iqair.up-metric-name.
+func lintMetrics(g prometheus.Gatherer) ([]promlint.Problem, error) {
+	mfs, err := g.Gather()
+	if err != nil {
+		return nil, err
+	}
+	return promlint.NewWithMetricFamilies(mfs).Lint()
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/exporter-toolkit/web"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket
+// activation.
+const listenFDsStart = 3
+
+// activationListeners returns the sockets passed by systemd socket
+// activation, as announced by LISTEN_PID and LISTEN_FDS.
+func activationListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, fmt.Errorf("no sockets passed by systemd, is the exporter started by a socket unit?")
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("no sockets passed by systemd, is the exporter started by a socket unit?")
+	}
+	// Keep child processes from believing the sockets are theirs.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, 0, count)
+	for fd := listenFDsStart; fd < listenFDsStart+count; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		// FileListener duplicates the descriptor.
+		f.Close()
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("socket passed by systemd as file descriptor %d: %v", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// unixSocketPrefix marks listen addresses that are Unix domain socket paths.
+const unixSocketPrefix = "unix://"
+
+// socketOptions are applied to the Unix domain sockets the exporter
+// creates.
+type socketOptions struct {
+	Mode os.FileMode
+	// UID and GID own the socket. -1 leaves them unchanged.
+	UID, GID int
+}
+
+// openListeners listens on each of addrs, which are TCP addresses or
+// unix:// followed by a socket path. If any of them fails, those already
+// opened are closed again.
+func openListeners(addrs []string, socket socketOptions) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		var l net.Listener
+		var err error
+		if strings.HasPrefix(addr, unixSocketPrefix) {
+			l, err = listenUnix(strings.TrimPrefix(addr, unixSocketPrefix), socket)
+		} else {
+			l, err = net.Listen("tcp", addr)
+		}
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("listening on %s: %v", addr, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// listenUnix creates a Unix domain socket at path, replacing a stale one
+// left behind by an exporter that did not shut down cleanly. The socket is
+// removed again when the listener is closed.
+func listenUnix(path string, opts socketOptions) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, opts.Mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if opts.UID != -1 || opts.GID != -1 {
+		if err := os.Chown(path, opts.UID, opts.GID); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// removeStaleSocket removes the socket at path unless a server still
+// accepts connections on it. Other files are never removed.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	return os.Remove(path)
+}
+
+// parseSocketOwner parses the value of --web.socket-owner, a user and an
+// optional group, by name or ID, separated by a colon. An empty value
+// leaves the owner unchanged.
+func parseSocketOwner(spec string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if spec == "" {
+		return uid, gid, nil
+	}
+	name, group := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		name, group = spec[:i], spec[i+1:]
+	}
+	if name != "" {
+		if uid, err = strconv.Atoi(name); err != nil {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return 0, 0, err
+			}
+			if uid, err = strconv.Atoi(u.Uid); err != nil {
+				return 0, 0, fmt.Errorf("user %s has no numeric ID", name)
+			}
+		}
+	}
+	if group != "" {
+		if gid, err = strconv.Atoi(group); err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return 0, 0, err
+			}
+			if gid, err = strconv.Atoi(g.Gid); err != nil {
+				return 0, 0, fmt.Errorf("group %s has no numeric ID", group)
+			}
+		}
+	}
+	return uid, gid, nil
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+// serverLimits bound how long clients may take and how much they may send,
+// so that stalled or malicious clients cannot exhaust connections.
+type serverLimits struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	// StreamPaths are long-lived streaming endpoints, exempt from the read
+	// and write timeouts once their request headers have been read.
+	StreamPaths []string
+}
+
+// newServers returns a server for each listener, all serving handler.
+// Each listener needs its own server, as web.Serve wraps the server's
+// handler for authentication.
+func newServers(listeners []net.Listener, handler http.Handler, limits serverLimits) []*http.Server {
+	if len(limits.StreamPaths) > 0 {
+		handler = withoutStreamDeadlines(handler, limits.StreamPaths)
+	}
+	servers := make([]*http.Server, len(listeners))
+	for i := range listeners {
+		servers[i] = &http.Server{
+			Handler:           handler,
+			ReadHeaderTimeout: limits.ReadHeaderTimeout,
+			ReadTimeout:       limits.ReadTimeout,
+			WriteTimeout:      limits.WriteTimeout,
+			IdleTimeout:       limits.IdleTimeout,
+			MaxHeaderBytes:    limits.MaxHeaderBytes,
+			ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+				return context.WithValue(ctx, connContextKey{}, c)
+			},
+		}
+	}
+	return servers
+}
+
+// connContextKey is the request context key of the request's connection.
+type connContextKey struct{}
+
+// withoutStreamDeadlines clears the read and write deadlines the server set
+// on the connection for requests to paths, so that streams outlive the
+// server timeouts. The next request on the connection gets fresh deadlines.
+func withoutStreamDeadlines(next http.Handler, paths []string) http.Handler {
+	streams := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		streams[p] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conn, ok := r.Context().Value(connContextKey{}).(net.Conn); ok && streams[r.URL.Path] {
+			conn.SetDeadline(time.Time{})
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serve serves each listener with the matching server, with TLS and
+// authentication according to the web configuration file. The returned
+// channel receives the error each server stopped with, which is
+// http.ErrServerClosed after a shutdown.
+func serve(listeners []net.Listener, servers []*http.Server, webConfig string, logger log.Logger) <-chan error {
+	errs := make(chan error, len(listeners))
+	for i, l := range listeners {
+		go func(l net.Listener, srv *http.Server) {
+			errs <- web.Serve(l, srv, webConfig, log.With(logger, "address", l.Addr()))
+		}(l, servers[i])
+	}
+	return errs
+}
@@ -0,0 +1,142 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestListenUnixSocket(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// setup prepares what is at path before the exporter listens, and
+		// returns a func undoing it, if any.
+		setup func(t *testing.T, path string) func()
+		// err is part of the expected error, empty if listening succeeds.
+		err string
+	}{
+		{name: "new socket"},
+		{
+			name: "stale socket",
+			setup: func(t *testing.T, path string) func() {
+				l, err := net.Listen("unix", path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// Leave the socket file behind, as a crashed exporter would.
+				l.(*net.UnixListener).SetUnlinkOnClose(false)
+				l.Close()
+				return nil
+			},
+		},
+		{
+			name: "socket in use",
+			setup: func(t *testing.T, path string) func() {
+				l, err := net.Listen("unix", path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return func() { l.Close() }
+			},
+			err: "in use by another process",
+		},
+		{
+			name: "regular file",
+			setup: func(t *testing.T, path string) func() {
+				if err := os.WriteFile(path, []byte("keep me"), 0600); err != nil {
+					t.Fatal(err)
+				}
+				return nil
+			},
+			err: "is not a socket",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "iqair.sock")
+			if tc.setup != nil {
+				if undo := tc.setup(t, path); undo != nil {
+					defer undo()
+				}
+			}
+			listeners, err := openListeners([]string{"unix://" + path}, socketOptions{Mode: 0660, UID: -1, GID: -1})
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					closeListeners(listeners)
+					t.Fatalf("openListeners() = %v, want an error mentioning %q", err, tc.err)
+				}
+				if _, err := os.Lstat(path); err != nil {
+					t.Errorf("the existing %s was removed: %v", path, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fi, err := os.Lstat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0660 {
+				t.Errorf("socket has mode %v, want a socket with 0660", fi.Mode())
+			}
+			go http.Serve(listeners[0], http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "ok")
+			}))
+			client := &http.Client{Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", path)
+				},
+			}}
+			resp, err := client.Get("http://iqair/-/healthy")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != "ok" {
+				t.Errorf("request over the socket returned %q, want ok", body)
+			}
+
+			closeListeners(listeners)
+			if _, err := os.Lstat(path); !os.IsNotExist(err) {
+				t.Errorf("socket left behind after closing the listener: %v", err)
+			}
+		})
+	}
+}
+
+func TestParseSocketOwner(t *testing.T) {
+	for _, tc := range []struct {
+		spec     string
+		uid, gid int
+		err      bool
+	}{
+		{spec: "", uid: -1, gid: -1},
+		{spec: "1000", uid: 1000, gid: -1},
+		{spec: "1000:100", uid: 1000, gid: 100},
+		{spec: ":100", uid: -1, gid: 100},
+		{spec: "root:0", uid: 0, gid: 0},
+		{spec: "no-such-user-iqair", err: true},
+		{spec: "1000:no-such-group-iqair", err: true},
+	} {
+		uid, gid, err := parseSocketOwner(tc.spec)
+		if tc.err {
+			if err == nil {
+				t.Errorf("parseSocketOwner(%q) succeeded, want an error", tc.spec)
+			}
+			continue
+		}
+		if err != nil || uid != tc.uid || gid != tc.gid {
+			t.Errorf("parseSocketOwner(%q) = %d, %d, %v, want %d, %d", tc.spec, uid, gid, err, tc.uid, tc.gid)
+		}
+	}
+}
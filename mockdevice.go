@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// Models the mock device can pretend to be, as given with --model.
+const (
+	mockModelPro     = "pro"
+	mockModelOutdoor = "outdoor"
+)
+
+// mockModelNames are the model names mock devices report in their status
+// block.
+var mockModelNames = map[string]string{
+	mockModelPro:     "AirVisual Pro",
+	mockModelOutdoor: "AirVisual Outdoor",
+}
+
+// mockV1Paths are the paths the mock device answers on with the local
+// device API. AirVisual API links, under airVisualKeyPrefix, get the cloud
+// API's response.
+var mockV1Paths = map[string]bool{"/": true, "/measurements": true, "/api/v1/status": true}
+
+// MockDeviceOptions configure a MockDevice.
+type MockDeviceOptions struct {
+	// Model is mockModelPro or mockModelOutdoor. Outdoor monitors have no
+	// CO2 sensor.
+	Model           string
+	Firmware        string
+	Serial          string
+	UpdateAvailable bool
+	// WarmUp is how long the device answers with an empty body after it
+	// starts, as devices do while booting.
+	WarmUp time.Duration
+	// FailureRate is the fraction of requests answered with HTTP 500.
+	FailureRate float64
+	// Scenario, if not nil, scripts the readings over time.
+	Scenario *MockScenario
+}
+
+// MockScenario scripts a mock device's behavior over time, as read from the
+// file given with --scenario.
+type MockScenario struct {
+	// Loop, if positive, restarts the scenario after this long.
+	Loop  model.Duration `yaml:"loop"`
+	Steps []MockStep     `yaml:"steps"`
+}
+
+// MockStep applies from At after the device started until the next step.
+type MockStep struct {
+	At model.Duration `yaml:"at"`
+	// Values override the synthetic readings, by the names used by
+	// --iqair.threshold, e.g. co2 or p25.
+	Values map[string]float64 `yaml:"values"`
+	// Status, if set, makes the device answer every request with this HTTP
+	// status instead of a reading.
+	Status int `yaml:"status"`
+	// Empty makes the device answer with an empty body, as while booting.
+	Empty bool `yaml:"empty"`
+}
+
+// LoadMockScenario reads and validates the scenario file at filename.
+func LoadMockScenario(filename string) (*MockScenario, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	s := &MockScenario{}
+	if err := yaml.UnmarshalStrict(content, s); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", filename, err)
+	}
+	for i, step := range s.Steps {
+		if i > 0 && step.At <= s.Steps[i-1].At {
+			return nil, fmt.Errorf("step %d: at must be later than the step before", i)
+		}
+		for name := range step.Values {
+			if !thresholdMetrics[name] {
+				return nil, fmt.Errorf("step %d: unknown value %q (valid: %s)", i, name, strings.Join(knownThresholdMetrics(), ", "))
+			}
+		}
+		if step.Status != 0 && (step.Status < 100 || step.Status > 599) {
+			return nil, fmt.Errorf("step %d: invalid status %d", i, step.Status)
+		}
+	}
+	if s.Loop > 0 && len(s.Steps) > 0 && s.Loop <= s.Steps[len(s.Steps)-1].At {
+		return nil, fmt.Errorf("loop must be longer than the last step's at")
+	}
+	return s, nil
+}
+
+// stepAt returns the step applying elapsed after the device started, or
+// the zero step before the first one.
+func (s *MockScenario) stepAt(elapsed time.Duration) MockStep {
+	if s.Loop > 0 {
+		elapsed %= time.Duration(s.Loop)
+	}
+	i := sort.Search(len(s.Steps), func(i int) bool { return time.Duration(s.Steps[i].At) > elapsed })
+	if i == 0 {
+		return MockStep{}
+	}
+	return s.Steps[i-1]
+}
+
+// MockDevice serves synthetic readings like an AirVisual monitor, for
+// demos and for developing dashboards without a device. It implements
+// http.Handler.
+type MockDevice struct {
+	opts   MockDeviceOptions
+	start  time.Time
+	logger log.Logger
+
+	// nowFunc is read instead of time.Now, so that tests can control the
+	// clock.
+	nowFunc func() time.Time
+
+	mutex sync.Mutex
+	rand  *rand.Rand
+}
+
+// NewMockDevice returns a MockDevice started now.
+func NewMockDevice(opts MockDeviceOptions, logger log.Logger) *MockDevice {
+	return &MockDevice{
+		opts:    opts,
+		start:   time.Now(),
+		logger:  logger,
+		nowFunc: time.Now,
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (m *MockDevice) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	now := m.nowFunc()
+	elapsed := now.Sub(m.start)
+	cloudAPI := strings.HasPrefix(r.URL.Path, airVisualKeyPrefix)
+	if !cloudAPI && !mockV1Paths[r.URL.Path] {
+		http.NotFound(w, r)
+		return
+	}
+
+	var step MockStep
+	if m.opts.Scenario != nil {
+		step = m.opts.Scenario.stepAt(elapsed)
+	}
+	switch {
+	case elapsed < m.opts.WarmUp || step.Empty:
+		level.Debug(m.logger).Log("msg", "Answering with an empty body", "path", r.URL.Path)
+		return
+	case step.Status != 0:
+		level.Debug(m.logger).Log("msg", "Answering with the scenario's status", "path", r.URL.Path, "status", step.Status)
+		http.Error(w, http.StatusText(step.Status), step.Status)
+		return
+	case m.fail():
+		level.Debug(m.logger).Log("msg", "Injecting a failure", "path", r.URL.Path)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	values := m.values(elapsed)
+	for name, value := range step.Values {
+		values[name] = value
+	}
+	response := m.v1Response(now, values)
+	if cloudAPI {
+		response = m.v2Response(now, values)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// fail reports whether to inject a failure into the current request.
+func (m *MockDevice) fail() bool {
+	if m.opts.FailureRate <= 0 {
+		return false
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.rand.Float64() < m.opts.FailureRate
+}
+
+// values returns synthetic readings elapsed after the device started. They
+// drift slowly along waves of different periods, plus a little noise.
+func (m *MockDevice) values(elapsed time.Duration) map[string]float64 {
+	wave := func(period time.Duration, phase float64) float64 {
+		return math.Sin(2*math.Pi*elapsed.Seconds()/period.Seconds() + phase)
+	}
+	m.mutex.Lock()
+	noise := func(amplitude float64) float64 { return amplitude * (2*m.rand.Float64() - 1) }
+	p25 := 9 + 6*wave(45*time.Minute, 1) + noise(0.5)
+	values := map[string]float64{
+		"co2":         650 + 150*wave(time.Hour, 0) + noise(10),
+		"p25":         p25,
+		"p10":         1.4*p25 + 2 + noise(0.5),
+		"temperature": 21.5 + 1.5*wave(2*time.Hour, 2) + noise(0.1),
+		"humidity":    45 + 8*wave(90*time.Minute, 3) + noise(0.5),
+	}
+	m.mutex.Unlock()
+	return values
+}
+
+// current returns the current block for values, with ts as given.
+func (m *MockDevice) current(ts interface{}, values map[string]float64) map[string]interface{} {
+	current := map[string]interface{}{
+		"ts": ts,
+		"p2": math.Round(values["p25"]),
+		"p1": math.Round(values["p10"]),
+		"tp": math.Round(values["temperature"]*10) / 10,
+		"hm": math.Round(values["humidity"]),
+	}
+	if m.opts.Model != mockModelOutdoor {
+		current["co"] = math.Round(values["co2"])
+	}
+	return current
+}
+
+// v1Response returns a response of the local device API, which reports ts
+// as a Unix epoch in milliseconds.
+func (m *MockDevice) v1Response(now time.Time, values map[string]float64) interface{} {
+	return map[string]interface{}{
+		"current": m.current(now.UnixNano()/int64(time.Millisecond), values),
+		"status": map[string]interface{}{
+			"model":            mockModelNames[m.opts.Model],
+			"serial_number":    m.opts.Serial,
+			"firmware_version": m.opts.Firmware,
+		},
+	}
+}
+
+// v2Response returns a response of the AirVisual cloud API, v2, which
+// reports ts in RFC 3339 and adds the settings and outdoor blocks.
+func (m *MockDevice) v2Response(now time.Time, values map[string]float64) interface{} {
+	current := m.current(now.UTC().Format(time.RFC3339), values)
+	current["aqius"] = usAQI(math.Round(values["p25"]))
+	settings := map[string]interface{}{
+		"node_name": "Mock " + mockModelNames[m.opts.Model],
+		"city":      "Mockville",
+		"latitude":  47.3769,
+		"longitude": 8.5417,
+	}
+	if m.opts.Model != mockModelOutdoor {
+		settings["co2_warning"] = 1000
+		settings["co2_critical"] = 2000
+	}
+	response := map[string]interface{}{
+		"current": current,
+		"status": map[string]interface{}{
+			"model":            mockModelNames[m.opts.Model],
+			"serial_number":    m.opts.Serial,
+			"firmware_version": m.opts.Firmware,
+			"update_available": m.opts.UpdateAvailable,
+		},
+		"settings": settings,
+	}
+	if m.opts.Model != mockModelOutdoor {
+		response["outdoor"] = map[string]interface{}{
+			"tp":      math.Round((values["temperature"]-8)*10) / 10,
+			"tp_unit": "C",
+		}
+	}
+	return response
+}
+
+// runMockDevice runs the mock-device command until it fails, and returns
+// its exit code.
+func runMockDevice(listen, scenarioFile string, opts MockDeviceOptions, logger log.Logger) int {
+	if opts.FailureRate < 0 || opts.FailureRate > 1 {
+		level.Error(logger).Log("msg", "--failure-rate must be between 0 and 1")
+		return 1
+	}
+	if scenarioFile != "" {
+		scenario, err := LoadMockScenario(scenarioFile)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error loading scenario", "file", scenarioFile, "err", err)
+			return 1
+		}
+		opts.Scenario = scenario
+	}
+	level.Info(logger).Log("msg", "Serving a mock device", "address", listen, "model", mockModelNames[opts.Model], "firmware", opts.Firmware)
+	if err := http.ListenAndServe(listen, NewMockDevice(opts, logger)); err != nil {
+		level.Error(logger).Log("msg", "Error serving the mock device", "err", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MQTT payload formats.
+const (
+	mqttFormatValues = "values"
+	mqttFormatJSON   = "json"
+)
+
+// MQTTConfig configures publishing readings to an MQTT broker.
+type MQTTConfig struct {
+	// Broker is the broker URL, e.g. tcp://broker:1883 or ssl://broker:8883.
+	Broker      string
+	TopicPrefix string
+	ClientID    string
+	Username    string
+	Password    string
+	TLSConfig   *tls.Config
+	QoS         byte
+	Retain      bool
+	// Format is mqttFormatValues to publish each value to its own topic, or
+	// mqttFormatJSON to publish one JSON document per reading.
+	Format string
+	// QueueSize bounds the number of readings waiting to be published.
+	QueueSize      int
+	PublishTimeout time.Duration
+	// HomeAssistantPrefix, if not empty, enables Home Assistant MQTT
+	// discovery under this topic prefix.
+	HomeAssistantPrefix string
+	// Devices are the names of all configured devices. Home Assistant
+	// discovery entries of other devices are removed.
+	Devices []string
+}
+
+// MQTTPublisher publishes device readings to an MQTT broker. Readings are
+// queued and published from a separate goroutine, so a slow or unavailable
+// broker never delays a scrape.
+type MQTTPublisher struct {
+	config MQTTConfig
+	client mqtt.Client
+	queue  chan []mqttMessage
+	logger log.Logger
+
+	mutex sync.Mutex
+	// discovered holds the devices whose Home Assistant discovery config
+	// has been published.
+	discovered map[string]bool
+	// available holds the last published availability of each device.
+	available map[string]bool
+
+	published, failed, dropped prometheus.Counter
+}
+
+// NewMQTTPublisher returns an MQTTPublisher. Call Run to connect and start
+// publishing.
+func NewMQTTPublisher(config MQTTConfig, logger log.Logger) *MQTTPublisher {
+	opts := mqtt.NewClientOptions().
+		AddBroker(config.Broker).
+		SetClientID(config.ClientID).
+		SetUsername(config.Username).
+		SetPassword(config.Password).
+		SetTLSConfig(config.TLSConfig).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(5 * time.Second).
+		SetMaxReconnectInterval(2 * time.Minute).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			level.Warn(logger).Log("msg", "Lost connection to MQTT broker", "err", err)
+		})
+
+	p := &MQTTPublisher{
+		config:     config,
+		queue:      make(chan []mqttMessage, config.QueueSize),
+		logger:     logger,
+		discovered: map[string]bool{},
+		available:  map[string]bool{},
+		published: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_mqtt_messages_published_total",
+			Help:      "Number of messages successfully published to the MQTT broker.",
+		}),
+		failed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_mqtt_publish_failures_total",
+			Help:      "Number of messages that could not be published to the MQTT broker.",
+		}),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_mqtt_dropped_readings_total",
+			Help:      "Number of readings dropped because the publish queue was full.",
+		}),
+	}
+
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		level.Info(logger).Log("msg", "Connected to MQTT broker", "broker", config.Broker)
+		if config.HomeAssistantPrefix != "" {
+			p.removeStaleDiscovery(c)
+		}
+	})
+	p.client = mqtt.NewClient(opts)
+	return p
+}
+
+// OnReading queues r for publishing. It implements ReadingListener.
+func (p *MQTTPublisher) OnReading(r Reading) {
+	var msgs []mqttMessage
+	if p.config.HomeAssistantPrefix != "" {
+		p.mutex.Lock()
+		if !p.discovered[r.Device] {
+			p.discovered[r.Device] = true
+			msgs = append(msgs, p.discoveryMessages(r)...)
+		}
+		p.mutex.Unlock()
+	}
+	p.enqueue(append(msgs, p.messages(r)...))
+}
+
+// OnScrapeResult publishes the device's availability when it changes. It
+// implements ScrapeResultListener.
+func (p *MQTTPublisher) OnScrapeResult(device string, up bool) {
+	p.mutex.Lock()
+	available, known := p.available[device]
+	p.available[device] = up
+	p.mutex.Unlock()
+	if known && available == up {
+		return
+	}
+
+	payload := "offline"
+	if up {
+		payload = "online"
+	}
+	p.enqueue([]mqttMessage{{topic: p.availabilityTopic(device), payload: []byte(payload), retain: true}})
+}
+
+func (p *MQTTPublisher) enqueue(msgs []mqttMessage) {
+	select {
+	case p.queue <- msgs:
+	default:
+		p.dropped.Inc()
+	}
+}
+
+// Run connects to the broker and publishes queued readings until ctx is
+// cancelled. Connection failures are retried in the background. Pending
+// readings are published before it returns.
+func (p *MQTTPublisher) Run(ctx context.Context) {
+	p.client.Connect()
+	defer p.client.Disconnect(250)
+
+	for {
+		select {
+		case <-ctx.Done():
+			for len(p.queue) > 0 {
+				for _, msg := range <-p.queue {
+					p.publish(msg)
+				}
+			}
+			return
+		case msgs := <-p.queue:
+			for _, msg := range msgs {
+				p.publish(msg)
+			}
+		}
+	}
+}
+
+func (p *MQTTPublisher) publish(msg mqttMessage) {
+	topic := msg.topic
+	token := p.client.Publish(topic, p.config.QoS, msg.retain, msg.payload)
+	if !token.WaitTimeout(p.config.PublishTimeout) {
+		p.failed.Inc()
+		level.Debug(p.logger).Log("msg", "Timed out publishing to MQTT", "topic", topic)
+		return
+	}
+	if err := token.Error(); err != nil {
+		p.failed.Inc()
+		level.Debug(p.logger).Log("msg", "Error publishing to MQTT", "topic", topic, "err", err)
+		return
+	}
+	p.published.Inc()
+}
+
+type mqttMessage struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+// deviceTopic returns the topic under which the readings of device are
+// published.
+func (p *MQTTPublisher) deviceTopic(device string) string {
+	return p.config.TopicPrefix + "/" + mqttTopicSegment(Reading{Device: device}.DeviceName())
+}
+
+func (p *MQTTPublisher) availabilityTopic(device string) string {
+	return p.deviceTopic(device) + "/availability"
+}
+
+// messages returns the messages to publish for r in the configured format.
+func (p *MQTTPublisher) messages(r Reading) []mqttMessage {
+	deviceTopic := p.deviceTopic(r.Device)
+
+	if p.config.Format == mqttFormatJSON {
+		payload, err := json.Marshal(newReadingDocument(r))
+		if err != nil {
+			level.Error(p.logger).Log("msg", "Error encoding reading", "err", err)
+			return nil
+		}
+		return []mqttMessage{{topic: deviceTopic, payload: payload, retain: p.config.Retain}}
+	}
+
+	fields := r.Fields()
+	msgs := make([]mqttMessage, 0, len(fields))
+	for _, f := range fields {
+		msgs = append(msgs, mqttMessage{
+			topic:   deviceTopic + "/" + f.Name,
+			payload: []byte(strconv.FormatFloat(f.Value, 'f', -1, 64)),
+			retain:  p.config.Retain,
+		})
+	}
+	return msgs
+}
+
+// Describe implements prometheus.Collector.
+func (p *MQTTPublisher) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.published.Desc()
+	ch <- p.failed.Desc()
+	ch <- p.dropped.Desc()
+}
+
+// Collect implements prometheus.Collector.
+func (p *MQTTPublisher) Collect(ch chan<- prometheus.Metric) {
+	ch <- p.published
+	ch <- p.failed
+	ch <- p.dropped
+}
+
+// mqttTopicSegment replaces the characters that have a special meaning in
+// MQTT topics.
+var mqttTopicSegment = strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace
+
+// validateMQTTConfig checks the settings that cannot be validated by flag
+// parsing alone.
+func validateMQTTConfig(config MQTTConfig) error {
+	if config.QoS > 2 {
+		return fmt.Errorf("invalid MQTT QoS %d, must be 0, 1 or 2", config.QoS)
+	}
+	if config.Format != mqttFormatValues && config.Format != mqttFormatJSON {
+		return fmt.Errorf("invalid MQTT format %q", config.Format)
+	}
+	if config.QueueSize < 1 {
+		return fmt.Errorf("MQTT queue size must be at least 1")
+	}
+	return nil
+}
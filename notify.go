@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/common/version"
+)
+
+// Notification states.
+const (
+	notificationFiring   = "firing"
+	notificationResolved = "resolved"
+)
+
+// NotificationConfig configures a webhook sent when a reading stays above or
+// below a threshold, and again when it recovers.
+type NotificationConfig struct {
+	// Metric is one of the metrics accepted by --iqair.threshold.
+	Metric string   `yaml:"metric"`
+	Above  *float64 `yaml:"above"`
+	Below  *float64 `yaml:"below"`
+	// For is how long the condition must hold before notifying.
+	For model.Duration `yaml:"for"`
+	// MinInterval is the minimum time between two firing notifications of
+	// the rule for the same device, to limit noise from flapping readings.
+	MinInterval model.Duration `yaml:"min_interval"`
+	URL         string         `yaml:"url"`
+	// Method defaults to POST.
+	Method  string            `yaml:"method"`
+	Headers map[string]string `yaml:"headers"`
+	// Body is a text/template rendered with the notification's fields. It
+	// defaults to a JSON document holding all of them.
+	Body string `yaml:"body"`
+}
+
+func (n *NotificationConfig) validate() error {
+	if !thresholdMetrics[n.Metric] {
+		return fmt.Errorf("unknown metric %q (valid: %s)", n.Metric, strings.Join(knownThresholdMetrics(), ", "))
+	}
+	if (n.Above == nil) == (n.Below == nil) {
+		return fmt.Errorf("exactly one of above and below is required")
+	}
+	u, err := url.Parse(n.URL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid url %q: scheme must be http or https", n.URL)
+	}
+	if n.Method == "" {
+		n.Method = http.MethodPost
+	}
+	if _, err := newNotificationTemplate(n.Body); err != nil {
+		return fmt.Errorf("invalid body template: %v", err)
+	}
+	return nil
+}
+
+// notificationData is the data a notification body is rendered from.
+type notificationData struct {
+	Device    string            `json:"device"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Metric    string            `json:"metric"`
+	Value     float64           `json:"value"`
+	Condition string            `json:"condition"`
+	Threshold float64           `json:"threshold"`
+	State     string            `json:"state"`
+	Timestamp time.Time         `json:"timestamp"`
+}
+
+func newNotificationTemplate(body string) (*template.Template, error) {
+	if body == "" {
+		return nil, nil
+	}
+	return template.New("body").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(body)
+}
+
+type notificationRule struct {
+	NotificationConfig
+	body *template.Template
+}
+
+// condition returns the rule's comparison and threshold, and whether value
+// meets it.
+func (r notificationRule) condition(value float64) (string, float64, bool) {
+	if r.Above != nil {
+		return "above", *r.Above, value > *r.Above
+	}
+	return "below", *r.Below, value < *r.Below
+}
+
+type notificationKey struct {
+	rule   int
+	device string
+}
+
+type notificationState struct {
+	// pendingSince is when the condition started holding, zero if it does
+	// not.
+	pendingSince time.Time
+	firing       bool
+	lastFired    time.Time
+}
+
+type notification struct {
+	rule notificationRule
+	data notificationData
+}
+
+// Notifier sends webhook notifications when readings breach the configured
+// thresholds for long enough, and when they recover. A rule fires at most
+// once while its condition holds. Webhooks are sent from a separate
+// goroutine, so a slow receiver never delays a scrape.
+type Notifier struct {
+	rules  []notificationRule
+	client *http.Client
+	queue  chan notification
+	logger log.Logger
+
+	mutex  sync.Mutex
+	states map[notificationKey]*notificationState
+
+	sent, failed prometheus.Counter
+}
+
+// NewNotifier returns a Notifier for rules, which must have been validated.
+// Call Run to start sending.
+func NewNotifier(rules []NotificationConfig, timeout time.Duration, logger log.Logger) (*Notifier, error) {
+	n := &Notifier{
+		client: &http.Client{Timeout: timeout},
+		queue:  make(chan notification, 100),
+		logger: logger,
+		states: map[notificationKey]*notificationState{},
+		sent: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_notifications_sent_total",
+			Help:      "Number of webhook notifications sent successfully.",
+		}),
+		failed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_notifications_failed_total",
+			Help:      "Number of webhook notifications that failed or were dropped.",
+		}),
+	}
+	for _, rule := range rules {
+		body, err := newNotificationTemplate(rule.Body)
+		if err != nil {
+			return nil, err
+		}
+		n.rules = append(n.rules, notificationRule{NotificationConfig: rule, body: body})
+	}
+	return n, nil
+}
+
+// OnReading evaluates the rules against r. It implements ReadingListener.
+func (n *Notifier) OnReading(r Reading) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	now := time.Now()
+	for i, rule := range n.rules {
+		key := notificationKey{rule: i, device: r.DeviceName()}
+		state, ok := n.states[key]
+		if !ok {
+			state = &notificationState{}
+			n.states[key] = state
+		}
+
+		value := thresholdValue(rule.Metric, r.Data)
+		cond, threshold, holds := rule.condition(value)
+		data := notificationData{
+			Device:    r.DeviceName(),
+			Labels:    r.Labels,
+			Metric:    rule.Metric,
+			Value:     value,
+			Condition: cond,
+			Threshold: threshold,
+			Timestamp: r.Timestamp,
+		}
+
+		if !holds {
+			state.pendingSince = time.Time{}
+			if state.firing {
+				state.firing = false
+				data.State = notificationResolved
+				n.enqueue(rule, data)
+			}
+			continue
+		}
+		if state.pendingSince.IsZero() {
+			state.pendingSince = now
+		}
+		if state.firing || now.Sub(state.pendingSince) < time.Duration(rule.For) {
+			continue
+		}
+		if !state.lastFired.IsZero() && now.Sub(state.lastFired) < time.Duration(rule.MinInterval) {
+			continue
+		}
+		state.firing = true
+		state.lastFired = now
+		data.State = notificationFiring
+		n.enqueue(rule, data)
+	}
+}
+
+func (n *Notifier) enqueue(rule notificationRule, data notificationData) {
+	select {
+	case n.queue <- notification{rule: rule, data: data}:
+	default:
+		level.Warn(n.logger).Log("msg", "Notification queue full, dropping notification", "device", data.Device, "metric", data.Metric, "state", data.State)
+		n.failed.Inc()
+	}
+}
+
+// Run sends queued notifications until ctx is cancelled.
+func (n *Notifier) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case notif := <-n.queue:
+			if err := n.send(ctx, notif); err != nil {
+				level.Error(n.logger).Log("msg", "Error sending notification", "device", notif.data.Device, "metric", notif.data.Metric, "state", notif.data.State, "url", redactURI(notif.rule.URL), "err", err)
+				n.failed.Inc()
+				continue
+			}
+			level.Info(n.logger).Log("msg", "Sent notification", "device", notif.data.Device, "metric", notif.data.Metric, "state", notif.data.State, "value", notif.data.Value)
+			n.sent.Inc()
+		}
+	}
+}
+
+func (n *Notifier) send(ctx context.Context, notif notification) error {
+	var body []byte
+	contentType := "application/json"
+	if notif.rule.body == nil {
+		var err error
+		if body, err = json.Marshal(notif.data); err != nil {
+			return err
+		}
+	} else {
+		var buf bytes.Buffer
+		if err := notif.rule.body.Execute(&buf, notif.data); err != nil {
+			return fmt.Errorf("error rendering body: %v", err)
+		}
+		body = buf.Bytes()
+		contentType = "text/plain; charset=utf-8"
+	}
+
+	req, err := http.NewRequest(notif.rule.Method, notif.rule.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "iqair_exporter/"+version.Version)
+	for k, v := range notif.rule.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// Describe implements prometheus.Collector.
+func (n *Notifier) Describe(ch chan<- *prometheus.Desc) {
+	ch <- n.sent.Desc()
+	ch <- n.failed.Desc()
+}
+
+// Collect implements prometheus.Collector.
+func (n *Notifier) Collect(ch chan<- prometheus.Metric) {
+	ch <- n.sent
+	ch <- n.failed
+}
+
+// thresholdValue returns the value of one of the thresholdMetrics.
+func thresholdValue(metric string, data APIData) float64 {
+	switch metric {
+	case "co2":
+		return float64(data.CO2)
+	case "p25":
+		return float64(data.P25)
+	case "p10":
+		return float64(data.P10)
+	case "temperature":
+		return data.Temperature
+	case "humidity":
+		return float64(data.Humidity)
+	}
+	return 0
+}
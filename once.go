@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// onceFormatPrometheus prints the metrics with --once, as /metrics serves
+// them.
+const onceFormatPrometheus = "prometheus"
+
+// Exit codes of --once telling failed device scrapes apart from other
+// failures, which exit with 1.
+const (
+	// exitOnceScrapeFailed means a device could not be scraped, e.g.
+	// because it was unreachable.
+	exitOnceScrapeFailed = 4
+	// exitOnceParseFailed means a device answered, but its response did
+	// not parse.
+	exitOnceParseFailed = 5
+)
+
+// writeExposition writes the metrics of g to w in the Prometheus text
+// format. If gathering fails, the metrics gathered anyway are still
+// written.
+func writeExposition(w io.Writer, g prometheus.Gatherer) error {
+	mfs, gatherErr := g.Gather()
+	enc := expfmt.NewEncoder(w, expfmt.FmtText)
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			return err
+		}
+	}
+	return gatherErr
+}
+
+// onceExitCode returns the exit code reporting the most recent scrapes of
+// exporters for --once: 0 if all succeeded, exitOnceScrapeFailed if a
+// device could not be scraped, or else exitOnceParseFailed if a response
+// did not parse.
+func onceExitCode(exporters []*Exporter) int {
+	code := 0
+	for _, e := range exporters {
+		e.mutex.RLock()
+		err := e.lastError
+		e.mutex.RUnlock()
+		switch err.(type) {
+		case nil:
+		case parseError:
+			if code == 0 {
+				code = exitOnceParseFailed
+			}
+		default:
+			code = exitOnceScrapeFailed
+		}
+	}
+	return code
+}
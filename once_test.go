@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+// runMainEnvar makes the test binary run the exporter's main with the
+// arguments following "--" instead of the tests, so that tests can run the
+// exporter end to end.
+const runMainEnvar = "RUN_IQAIR_EXPORTER_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnvar) != "" {
+		for i, arg := range os.Args {
+			if arg == "--" {
+				os.Args = append([]string{"iqair_exporter"}, os.Args[i+1:]...)
+				break
+			}
+		}
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// exporterCommand returns the command running the exporter with args.
+func exporterCommand(args ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], append([]string{"-test.run=^$", "--"}, args...)...)
+	cmd.Env = append(os.Environ(), runMainEnvar+"=1")
+	return cmd
+}
+
+// runExporter runs the exporter with args and returns its stdout and exit
+// code.
+func runExporter(t *testing.T, args ...string) (string, int) {
+	t.Helper()
+	cmd := exporterCommand(args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return stdout.String(), exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatalf("running the exporter: %v\n%s", err, stderr.String())
+	}
+	return stdout.String(), 0
+}
+
+func TestOnce(t *testing.T) {
+	reading, err := os.ReadFile("testdata/base.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/reading":
+			w.Write(reading)
+		case "/garbage":
+			w.Write([]byte("<html>Rebooting</html>"))
+		}
+	}))
+	defer device.Close()
+	// The mock device answers every request with HTTP 500 at a failure
+	// rate of 1.
+	failing := httptest.NewServer(NewMockDevice(MockDeviceOptions{Model: mockModelPro, FailureRate: 1}, log.NewNopLogger()))
+	defer failing.Close()
+
+	for _, tc := range []struct {
+		name   string
+		uri    string
+		code   int
+		output []string
+	}{
+		{"success", device.URL + "/reading", 0, []string{"iqair_up 1", "iqair_co2 612"}},
+		{"scrape failure", failing.URL + "/", exitOnceScrapeFailed, []string{"iqair_up 0"}},
+		{"parse failure", device.URL + "/garbage", exitOnceParseFailed, []string{"iqair_up 0", "iqair_exporter_json_parse_failures_total 1"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			stdout, code := runExporter(t, "--once", "--iqair.scrape-uri="+tc.uri, "--log.level=error")
+			if code != tc.code {
+				t.Errorf("exit code = %d, want %d", code, tc.code)
+			}
+			for _, want := range tc.output {
+				if !strings.Contains(stdout, want+"\n") {
+					t.Errorf("stdout lacks %q:\n%s", want, stdout)
+				}
+			}
+		})
+	}
+}
+
+func TestRegisteredDevices(t *testing.T) {
+	reading, err := os.ReadFile("testdata/base.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	var uris []string
+	for _, name := range []string{"bedroom", "office", "kitchen"} {
+		path := filepath.Join(dir, name+".json")
+		if err := os.WriteFile(path, reading, 0600); err != nil {
+			t.Fatal(err)
+		}
+		uris = append(uris, "file://"+path)
+	}
+
+	for _, tc := range []struct {
+		name string
+		uris []string
+		want int
+	}{
+		{"three devices", uris, 3},
+		{"one device removed", uris[:2], 2},
+		{"duplicate target", []string{uris[0], uris[1], uris[0]}, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := "devices:\n"
+			for i, uri := range tc.uris {
+				config += fmt.Sprintf("  - name: device%d\n    uri: %s\n", i, uri)
+			}
+			configFile := filepath.Join(t.TempDir(), "iqair.yml")
+			if err := os.WriteFile(configFile, []byte(config), 0600); err != nil {
+				t.Fatal(err)
+			}
+			stdout, code := runExporter(t, "--once", "--config.file="+configFile, "--log.level=error")
+			if code != 0 {
+				t.Fatalf("exit code = %d, want 0:\n%s", code, stdout)
+			}
+			want := fmt.Sprintf("iqair_exporter_registered_devices %d\n", tc.want)
+			if !strings.Contains(stdout, want) {
+				t.Errorf("stdout lacks %q:\n%s", want, stdout)
+			}
+		})
+	}
+}
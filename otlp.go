@@ -0,0 +1,605 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/version"
+	"golang.org/x/net/http2"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// OTLP transports, as named by OTEL_EXPORTER_OTLP_PROTOCOL. OTLP/gRPC is
+// spoken directly over HTTP/2 rather than through the gRPC library, as the
+// export is a single unary call whose request is encoded here anyway.
+const (
+	otlpProtocolHTTPProtobuf = "http/protobuf"
+	otlpProtocolGRPC         = "grpc"
+)
+
+// otlpGRPCExportPath is the path of the OTLP/gRPC metrics Export method.
+const otlpGRPCExportPath = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+
+// OTLPConfig configures exporting metrics over OTLP.
+type OTLPConfig struct {
+	// Protocol is the transport, otlpProtocolHTTPProtobuf or
+	// otlpProtocolGRPC.
+	Protocol string
+	// Endpoint is, over OTLP/HTTP, the full URL metrics are POSTed to,
+	// usually ending in /v1/metrics. Over OTLP/gRPC, only its scheme and
+	// host are used: http for plaintext (h2c), https for TLS.
+	Endpoint string
+	Headers  map[string]string
+	Interval time.Duration
+	Timeout  time.Duration
+	// ResourceAttributes are added to the resource of every device.
+	ResourceAttributes map[string]string
+	// DeviceStatus returns the identity last reported by the named device,
+	// used for its resource attributes.
+	DeviceStatus func(device string) (Status, bool)
+}
+
+// otlpConfigFromEnv returns the configuration given by the standard
+// OTEL_EXPORTER_OTLP_* and related environment variables. Flags set on top
+// of it take precedence.
+func otlpConfigFromEnv(getenv func(string) string) (OTLPConfig, error) {
+	config := OTLPConfig{
+		Protocol:           otlpProtocolHTTPProtobuf,
+		Headers:            map[string]string{},
+		Interval:           time.Minute,
+		Timeout:            10 * time.Second,
+		ResourceAttributes: map[string]string{"service.name": "iqair_exporter"},
+	}
+
+	// Signal-specific variables override the generic ones.
+	lookup := func(name string) string {
+		if v := getenv("OTEL_EXPORTER_OTLP_METRICS_" + name); v != "" {
+			return v
+		}
+		return getenv("OTEL_EXPORTER_OTLP_" + name)
+	}
+
+	if v := getenv("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT"); v != "" {
+		config.Endpoint = v
+	} else if v := getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); v != "" {
+		config.Endpoint = strings.TrimSuffix(v, "/") + "/v1/metrics"
+	}
+	if v := lookup("PROTOCOL"); v != "" {
+		config.Protocol = v
+	}
+	if v := lookup("HEADERS"); v != "" {
+		headers, err := parseOTLPKeyValues(v)
+		if err != nil {
+			return config, fmt.Errorf("invalid OTLP headers: %v", err)
+		}
+		config.Headers = headers
+	}
+	if v := lookup("TIMEOUT"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil {
+			return config, fmt.Errorf("invalid OTLP timeout %q: %v", v, err)
+		}
+		config.Timeout = time.Duration(ms) * time.Millisecond
+	}
+	if v := getenv("OTEL_METRIC_EXPORT_INTERVAL"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil {
+			return config, fmt.Errorf("invalid OTEL_METRIC_EXPORT_INTERVAL %q: %v", v, err)
+		}
+		config.Interval = time.Duration(ms) * time.Millisecond
+	}
+	if v := getenv("OTEL_RESOURCE_ATTRIBUTES"); v != "" {
+		attrs, err := parseOTLPKeyValues(v)
+		if err != nil {
+			return config, fmt.Errorf("invalid OTEL_RESOURCE_ATTRIBUTES: %v", err)
+		}
+		for k, v := range attrs {
+			config.ResourceAttributes[k] = v
+		}
+	}
+	if v := getenv("OTEL_SERVICE_NAME"); v != "" {
+		config.ResourceAttributes["service.name"] = v
+	}
+	return config, nil
+}
+
+// parseOTLPKeyValues parses the comma-separated key=value lists used by the
+// OpenTelemetry environment variables. Values are URL-decoded.
+func parseOTLPKeyValues(s string) (map[string]string, error) {
+	kvs := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid key=value pair %q", pair)
+		}
+		value, err := url.QueryUnescape(strings.TrimSpace(pair[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid value in %q: %v", pair, err)
+		}
+		kvs[strings.TrimSpace(pair[:i])] = value
+	}
+	return kvs, nil
+}
+
+// OTLPExporter periodically gathers the metrics exposed on /metrics and
+// exports them over OTLP/HTTP or OTLP/gRPC. Each device's metrics are grouped under a
+// resource describing the device.
+type OTLPExporter struct {
+	config    OTLPConfig
+	gatherer  prometheus.Gatherer
+	client    *http.Client
+	logger    log.Logger
+	startTime time.Time
+
+	exports, failedExports prometheus.Counter
+}
+
+// NewOTLPExporter returns an OTLPExporter exporting the metrics from
+// gatherer.
+func NewOTLPExporter(config OTLPConfig, gatherer prometheus.Gatherer, logger log.Logger) *OTLPExporter {
+	client := &http.Client{Timeout: config.Timeout}
+	if config.Protocol == otlpProtocolGRPC {
+		client.Transport = newGRPCTransport(strings.HasPrefix(config.Endpoint, "http://"), config.Timeout)
+	}
+	return &OTLPExporter{
+		config:    config,
+		gatherer:  gatherer,
+		client:    client,
+		logger:    logger,
+		startTime: time.Now(),
+		exports: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_otlp_exports_total",
+			Help:      "Number of OTLP export requests sent.",
+		}),
+		failedExports: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_otlp_failed_exports_total",
+			Help:      "Number of OTLP export requests that failed.",
+		}),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (o *OTLPExporter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- o.exports.Desc()
+	ch <- o.failedExports.Desc()
+}
+
+// Collect implements prometheus.Collector.
+func (o *OTLPExporter) Collect(ch chan<- prometheus.Metric) {
+	ch <- o.exports
+	ch <- o.failedExports
+}
+
+// Run exports metrics every interval until ctx is cancelled, then exports
+// once more so the final values are not lost.
+func (o *OTLPExporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(o.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), o.config.Timeout)
+			o.export(flushCtx)
+			cancel()
+			return
+		case <-ticker.C:
+			o.export(ctx)
+		}
+	}
+}
+
+func (o *OTLPExporter) export(ctx context.Context) {
+	mfs, err := o.gatherer.Gather()
+	if err != nil {
+		// Gather returns whatever it could collect alongside the error.
+		level.Warn(o.logger).Log("msg", "Error gathering metrics for OTLP export", "err", err)
+	}
+	if len(mfs) == 0 {
+		return
+	}
+
+	o.exports.Inc()
+	if err := o.send(ctx, o.encode(mfs, time.Now())); err != nil {
+		level.Error(o.logger).Log("msg", "Error exporting metrics over OTLP", "err", err)
+		o.failedExports.Inc()
+	}
+}
+
+func (o *OTLPExporter) send(ctx context.Context, body []byte) error {
+	if o.config.Protocol == otlpProtocolGRPC {
+		return o.sendGRPC(ctx, body)
+	}
+	req, err := http.NewRequest(http.MethodPost, o.config.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "iqair_exporter/"+version.Version)
+	for k, v := range o.config.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+	return fmt.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(msg))
+}
+
+// newGRPCTransport returns an HTTP/2-only transport, as gRPC needs. If
+// plaintext, it speaks HTTP/2 without TLS (h2c), as collectors do on
+// http:// endpoints.
+func newGRPCTransport(plaintext bool, timeout time.Duration) http.RoundTripper {
+	dialer := &net.Dialer{Timeout: timeout}
+	return &http2.Transport{
+		AllowHTTP: plaintext,
+		DialTLS: func(network, addr string, config *tls.Config) (net.Conn, error) {
+			if plaintext {
+				return dialer.Dial(network, addr)
+			}
+			return tls.DialWithDialer(dialer, network, addr, config)
+		},
+	}
+}
+
+// sendGRPC makes the OTLP/gRPC Export call with body, the encoded request,
+// and returns an error unless the collector answered with gRPC status OK.
+func (o *OTLPExporter) sendGRPC(ctx context.Context, body []byte) error {
+	endpoint, err := url.Parse(o.config.Endpoint)
+	if err != nil {
+		return err
+	}
+	target := url.URL{Scheme: endpoint.Scheme, Host: endpoint.Host, Path: otlpGRPCExportPath}
+
+	// A gRPC message is prefixed with an uncompressed flag and its length.
+	frame := make([]byte, 5, 5+len(body))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(body)))
+	req, err := http.NewRequest(http.MethodPost, target.String(), bytes.NewReader(append(frame, body...)))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	req.Header.Set("User-Agent", "iqair_exporter/"+version.Version)
+	for k, v := range o.config.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// The status is in the trailers, which are only read with the body.
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned HTTP status %s", resp.Status)
+	}
+
+	status, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		// Responses without a message carry the status in the headers.
+		status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	switch status {
+	case "0":
+		return nil
+	case "":
+		return fmt.Errorf("server returned no gRPC status")
+	}
+	if decoded, err := url.PathUnescape(message); err == nil {
+		message = decoded
+	}
+	return fmt.Errorf("server returned gRPC status %s: %s", status, message)
+}
+
+// encode converts mfs into an ExportMetricsServiceRequest protobuf. Series
+// are grouped into one resource per value of the device label, which is
+// dropped from the data point attributes.
+func (o *OTLPExporter) encode(mfs []*dto.MetricFamily, now time.Time) []byte {
+	// Metrics, in gathering order, of each resource.
+	resources := map[string][][]byte{}
+	var devices []string
+
+	for _, mf := range mfs {
+		byDevice := map[string][]*dto.Metric{}
+		for _, m := range mf.GetMetric() {
+			device := ""
+			for _, lp := range m.GetLabel() {
+				if lp.GetName() == "device" {
+					device = lp.GetValue()
+				}
+			}
+			if _, ok := resources[device]; !ok {
+				resources[device] = nil
+				devices = append(devices, device)
+			}
+			byDevice[device] = append(byDevice[device], m)
+		}
+		for device, metrics := range byDevice {
+			resources[device] = append(resources[device], o.encodeMetric(mf, metrics, now))
+		}
+	}
+
+	sort.Strings(devices)
+	var req []byte
+	for _, device := range devices {
+		var scope []byte
+		scope = protowire.AppendTag(scope, 1, protowire.BytesType)
+		scope = protowire.AppendBytes(scope, encodeOTLPScope())
+		for _, metric := range resources[device] {
+			scope = protowire.AppendTag(scope, 2, protowire.BytesType)
+			scope = protowire.AppendBytes(scope, metric)
+		}
+
+		var rm []byte
+		rm = protowire.AppendTag(rm, 1, protowire.BytesType)
+		rm = protowire.AppendBytes(rm, encodeOTLPAttributes(1, o.resourceAttributes(device)))
+		rm = protowire.AppendTag(rm, 2, protowire.BytesType)
+		rm = protowire.AppendBytes(rm, scope)
+
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, rm)
+	}
+	return req
+}
+
+// resourceAttributes returns the attributes describing device. Metrics not
+// belonging to a named device, such as the exporter's own, use device "".
+func (o *OTLPExporter) resourceAttributes(device string) map[string]string {
+	attrs := make(map[string]string, len(o.config.ResourceAttributes)+4)
+	for k, v := range o.config.ResourceAttributes {
+		attrs[k] = v
+	}
+	if device != "" {
+		attrs["iqair.device"] = device
+	}
+	if o.config.DeviceStatus != nil {
+		if status, ok := o.config.DeviceStatus(device); ok {
+			attrs["device.manufacturer"] = "IQAir"
+			if status.SerialNumber != "" {
+				attrs["device.id"] = status.SerialNumber
+			}
+			if status.Model != "" {
+				attrs["device.model.identifier"] = status.Model
+			}
+		}
+	}
+	return attrs
+}
+
+func encodeOTLPScope() []byte {
+	var scope []byte
+	scope = protowire.AppendTag(scope, 1, protowire.BytesType)
+	scope = protowire.AppendString(scope, "iqair_exporter")
+	scope = protowire.AppendTag(scope, 2, protowire.BytesType)
+	return protowire.AppendString(scope, version.Version)
+}
+
+// encodeMetric encodes the series of one metric family as an OTLP Metric.
+// Counters become cumulative monotonic sums, gauges and untyped metrics
+// become gauges.
+func (o *OTLPExporter) encodeMetric(mf *dto.MetricFamily, metrics []*dto.Metric, now time.Time) []byte {
+	const cumulative = 2 // AGGREGATION_TEMPORALITY_CUMULATIVE
+
+	var buf []byte
+	buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+	buf = protowire.AppendString(buf, mf.GetName())
+	buf = protowire.AppendTag(buf, 2, protowire.BytesType)
+	buf = protowire.AppendString(buf, mf.GetHelp())
+
+	var data []byte
+	var field protowire.Number
+	switch mf.GetType() {
+	case dto.MetricType_COUNTER:
+		field = 7
+		for _, m := range metrics {
+			data = appendOTLPMessage(data, 1, o.encodeNumberPoint(m, m.GetCounter().GetValue(), now))
+		}
+		data = protowire.AppendTag(data, 2, protowire.VarintType)
+		data = protowire.AppendVarint(data, cumulative)
+		data = protowire.AppendTag(data, 3, protowire.VarintType)
+		data = protowire.AppendVarint(data, 1)
+	case dto.MetricType_HISTOGRAM:
+		field = 9
+		for _, m := range metrics {
+			data = appendOTLPMessage(data, 1, o.encodeHistogramPoint(m, now))
+		}
+		data = protowire.AppendTag(data, 2, protowire.VarintType)
+		data = protowire.AppendVarint(data, cumulative)
+	case dto.MetricType_SUMMARY:
+		field = 11
+		for _, m := range metrics {
+			data = appendOTLPMessage(data, 1, o.encodeSummaryPoint(m, now))
+		}
+	default:
+		field = 5
+		for _, m := range metrics {
+			value := m.GetGauge().GetValue()
+			if mf.GetType() == dto.MetricType_UNTYPED {
+				value = m.GetUntyped().GetValue()
+			}
+			data = appendOTLPMessage(data, 1, o.encodeNumberPoint(m, value, now))
+		}
+	}
+	return appendOTLPMessage(buf, field, data)
+}
+
+func (o *OTLPExporter) encodeNumberPoint(m *dto.Metric, value float64, now time.Time) []byte {
+	buf := encodeOTLPAttributes(7, otlpPointAttributes(m))
+	buf = o.appendOTLPTimes(buf, m, now)
+	buf = protowire.AppendTag(buf, 4, protowire.Fixed64Type)
+	return protowire.AppendFixed64(buf, math.Float64bits(value))
+}
+
+// encodeHistogramPoint converts Prometheus' cumulative buckets into OTLP's
+// per-bucket counts, with an implicit +Inf bucket at the end.
+func (o *OTLPExporter) encodeHistogramPoint(m *dto.Metric, now time.Time) []byte {
+	h := m.GetHistogram()
+	buf := encodeOTLPAttributes(9, otlpPointAttributes(m))
+	buf = o.appendOTLPTimes(buf, m, now)
+	buf = protowire.AppendTag(buf, 4, protowire.Fixed64Type)
+	buf = protowire.AppendFixed64(buf, h.GetSampleCount())
+	buf = protowire.AppendTag(buf, 5, protowire.Fixed64Type)
+	buf = protowire.AppendFixed64(buf, math.Float64bits(h.GetSampleSum()))
+
+	var counts, bounds []byte
+	var prev uint64
+	for _, b := range h.GetBucket() {
+		if math.IsInf(b.GetUpperBound(), +1) {
+			break
+		}
+		counts = protowire.AppendFixed64(counts, b.GetCumulativeCount()-prev)
+		bounds = protowire.AppendFixed64(bounds, math.Float64bits(b.GetUpperBound()))
+		prev = b.GetCumulativeCount()
+	}
+	counts = protowire.AppendFixed64(counts, h.GetSampleCount()-prev)
+
+	buf = appendOTLPMessage(buf, 6, counts)
+	return appendOTLPMessage(buf, 7, bounds)
+}
+
+func (o *OTLPExporter) encodeSummaryPoint(m *dto.Metric, now time.Time) []byte {
+	s := m.GetSummary()
+	buf := encodeOTLPAttributes(7, otlpPointAttributes(m))
+	buf = o.appendOTLPTimes(buf, m, now)
+	buf = protowire.AppendTag(buf, 4, protowire.Fixed64Type)
+	buf = protowire.AppendFixed64(buf, s.GetSampleCount())
+	buf = protowire.AppendTag(buf, 5, protowire.Fixed64Type)
+	buf = protowire.AppendFixed64(buf, math.Float64bits(s.GetSampleSum()))
+	for _, q := range s.GetQuantile() {
+		var vq []byte
+		vq = protowire.AppendTag(vq, 1, protowire.Fixed64Type)
+		vq = protowire.AppendFixed64(vq, math.Float64bits(q.GetQuantile()))
+		vq = protowire.AppendTag(vq, 2, protowire.Fixed64Type)
+		vq = protowire.AppendFixed64(vq, math.Float64bits(q.GetValue()))
+		buf = appendOTLPMessage(buf, 6, vq)
+	}
+	return buf
+}
+
+// appendOTLPTimes appends the start and sample time of a data point. The
+// start time of cumulative points is when the exporter started.
+func (o *OTLPExporter) appendOTLPTimes(buf []byte, m *dto.Metric, now time.Time) []byte {
+	ts := uint64(now.UnixNano())
+	if m.TimestampMs != nil {
+		ts = uint64(m.GetTimestampMs()) * uint64(time.Millisecond)
+	}
+	buf = protowire.AppendTag(buf, 2, protowire.Fixed64Type)
+	buf = protowire.AppendFixed64(buf, uint64(o.startTime.UnixNano()))
+	buf = protowire.AppendTag(buf, 3, protowire.Fixed64Type)
+	return protowire.AppendFixed64(buf, ts)
+}
+
+// otlpPointAttributes returns the labels of m except device, which is a
+// resource attribute.
+func otlpPointAttributes(m *dto.Metric) map[string]string {
+	attrs := make(map[string]string, len(m.GetLabel()))
+	for _, lp := range m.GetLabel() {
+		if lp.GetName() != "device" {
+			attrs[lp.GetName()] = lp.GetValue()
+		}
+	}
+	return attrs
+}
+
+// encodeOTLPAttributes encodes attrs as repeated KeyValue messages with the
+// given field number, sorted by key.
+func encodeOTLPAttributes(field protowire.Number, attrs map[string]string) []byte {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf []byte
+	for _, k := range keys {
+		var value []byte
+		value = protowire.AppendTag(value, 1, protowire.BytesType)
+		value = protowire.AppendString(value, attrs[k])
+
+		var kv []byte
+		kv = protowire.AppendTag(kv, 1, protowire.BytesType)
+		kv = protowire.AppendString(kv, k)
+		kv = appendOTLPMessage(kv, 2, value)
+
+		buf = appendOTLPMessage(buf, field, kv)
+	}
+	return buf
+}
+
+func appendOTLPMessage(buf []byte, field protowire.Number, msg []byte) []byte {
+	buf = protowire.AppendTag(buf, field, protowire.BytesType)
+	return protowire.AppendBytes(buf, msg)
+}
+
+// checkOTLPProtocol returns an error unless protocol is supported.
+func checkOTLPProtocol(protocol string) error {
+	switch protocol {
+	case otlpProtocolHTTPProtobuf, otlpProtocolGRPC:
+		return nil
+	}
+	return fmt.Errorf("unsupported OTLP protocol %q, only %s and %s are supported", protocol, otlpProtocolHTTPProtobuf, otlpProtocolGRPC)
+}
+
+// newOTLPConfig combines the OpenTelemetry environment variables with the
+// explicitly set flags.
+func newOTLPConfig(protocol, endpoint string, headers []string, interval, timeout time.Duration) (OTLPConfig, error) {
+	config, err := otlpConfigFromEnv(os.Getenv)
+	if err != nil {
+		return config, err
+	}
+	if protocol != "" {
+		config.Protocol = protocol
+	}
+	if err := checkOTLPProtocol(config.Protocol); err != nil {
+		return config, err
+	}
+	if endpoint != "" {
+		config.Endpoint = endpoint
+	}
+	for _, header := range headers {
+		parts := strings.SplitN(header, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return config, fmt.Errorf("invalid OTLP header %q, expected name=value", header)
+		}
+		config.Headers[parts[0]] = parts[1]
+	}
+	if interval > 0 {
+		config.Interval = interval
+	}
+	if timeout > 0 {
+		config.Timeout = timeout
+	}
+	return config, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestOTLPProtocol(t *testing.T) {
+	config, err := otlpConfigFromEnv(func(name string) string {
+		if name == "OTEL_EXPORTER_OTLP_METRICS_PROTOCOL" {
+			return otlpProtocolGRPC
+		}
+		return ""
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Protocol != otlpProtocolGRPC {
+		t.Errorf("protocol from the environment = %q, want grpc", config.Protocol)
+	}
+
+	for _, protocol := range []string{otlpProtocolHTTPProtobuf, otlpProtocolGRPC} {
+		if err := checkOTLPProtocol(protocol); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := checkOTLPProtocol("http/json"); err == nil {
+		t.Error("checkOTLPProtocol(http/json) succeeded")
+	}
+	if _, err := newOTLPConfig(otlpProtocolGRPC, "http://collector:4317", nil, 0, 0); err != nil {
+		t.Errorf("newOTLPConfig rejected --otlp.protocol=grpc: %v", err)
+	}
+}
+
+// fakeGRPCCollector is an OTLP/gRPC receiver answering every Export call
+// with a gRPC status, in the trailers or, if trailersOnly, in the headers
+// of a response without a message.
+type fakeGRPCCollector struct {
+	status, message string
+	trailersOnly    bool
+
+	mutex         sync.Mutex
+	path          string
+	contentType   string
+	authorization string
+	request       []byte
+}
+
+func (c *fakeGRPCCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	c.mutex.Lock()
+	c.path, c.contentType, c.authorization = r.URL.Path, r.Header.Get("Content-Type"), r.Header.Get("Authorization")
+	if len(body) >= 5 && body[0] == 0 && int(binary.BigEndian.Uint32(body[1:5])) == len(body)-5 {
+		c.request = body[5:]
+	}
+	c.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/grpc")
+	if c.trailersOnly {
+		w.Header().Set("Grpc-Status", c.status)
+		w.Header().Set("Grpc-Message", c.message)
+		return
+	}
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	// An empty ExportMetricsServiceResponse.
+	w.Write([]byte{0, 0, 0, 0, 0})
+	w.Header().Set("Grpc-Status", c.status)
+	w.Header().Set("Grpc-Message", c.message)
+}
+
+func TestOTLPExportOverGRPC(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	co2 := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "iqair_co2", Help: "CO2."}, []string{"device"})
+	co2.WithLabelValues("bedroom").Set(612)
+	reg.MustRegister(co2)
+
+	for _, tc := range []struct {
+		name      string
+		collector *fakeGRPCCollector
+		// err is part of the expected error, empty if the export succeeds.
+		err string
+	}{
+		{name: "ok", collector: &fakeGRPCCollector{status: "0"}},
+		{name: "error status", collector: &fakeGRPCCollector{status: "3", message: "invalid%20metric"}, err: "gRPC status 3: invalid metric"},
+		{name: "trailers only", collector: &fakeGRPCCollector{status: "14", message: "unavailable", trailersOnly: true}, err: "gRPC status 14: unavailable"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(h2c.NewHandler(tc.collector, &http2.Server{}))
+			defer server.Close()
+			o := NewOTLPExporter(OTLPConfig{
+				Protocol: otlpProtocolGRPC,
+				Endpoint: server.URL,
+				Headers:  map[string]string{"Authorization": "Bearer t0k3n"},
+				Timeout:  5 * time.Second,
+			}, reg, log.NewNopLogger())
+			mfs, err := reg.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			body := o.encode(mfs, time.Unix(1600000000, 0))
+
+			err = o.send(context.Background(), body)
+			if tc.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+				t.Fatalf("send() = %v, want an error mentioning %q", err, tc.err)
+			}
+			c := tc.collector
+			c.mutex.Lock()
+			defer c.mutex.Unlock()
+			if c.path != otlpGRPCExportPath || c.contentType != "application/grpc" {
+				t.Errorf("call to %s with content type %q, want %s with application/grpc", c.path, c.contentType, otlpGRPCExportPath)
+			}
+			if c.authorization != "Bearer t0k3n" {
+				t.Errorf("call authorized with %q, want the configured header", c.authorization)
+			}
+			if !bytes.Equal(c.request, body) {
+				t.Errorf("collector got request %x, want %x", c.request, body)
+			}
+		})
+	}
+}
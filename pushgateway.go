@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// PushgatewayConfig configures pushing device metrics to a Pushgateway.
+type PushgatewayConfig struct {
+	URL string
+	Job string
+	// Grouping labels are added to every device's grouping key, in addition
+	// to the device name.
+	Grouping          map[string]string
+	BasicAuthUsername string
+	BasicAuthPassword string
+	TLSConfig         *tls.Config
+	Timeout           time.Duration
+}
+
+// newDevicePusher returns a Pusher that pushes the metrics of a single
+// device. The device name becomes part of the grouping key rather than a
+// label on the metrics, as the Pushgateway rejects pushes whose metrics
+// carry grouping labels.
+func newDevicePusher(config PushgatewayConfig, device DeviceConfig, exporter *Exporter) *push.Pusher {
+	registry := prometheus.NewRegistry()
+	labels := device.labels()
+	delete(labels, "device")
+	prometheus.WrapRegistererWith(labels, registry).MustRegister(exporter)
+
+	pusher := push.New(config.URL, config.Job).
+		Gatherer(registry).
+		Client(&http.Client{
+			Timeout:   config.Timeout,
+			Transport: &http.Transport{TLSClientConfig: config.TLSConfig, Proxy: http.ProxyFromEnvironment},
+		})
+	if device.Name != "" {
+		pusher = pusher.Grouping("device", device.Name)
+	}
+	for name, value := range config.Grouping {
+		pusher = pusher.Grouping(name, value)
+	}
+	if config.BasicAuthUsername != "" {
+		pusher = pusher.BasicAuth(config.BasicAuthUsername, config.BasicAuthPassword)
+	}
+	return pusher
+}
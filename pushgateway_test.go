@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// fakeGateway records the requests made to a Pushgateway.
+type fakeGateway struct {
+	mutex   sync.Mutex
+	methods []string
+	paths   []string
+	// credentials are the basic authentication of each request, as
+	// user:password, empty if it had none.
+	credentials []string
+	families    map[string]*dto.MetricFamily
+}
+
+func (g *fakeGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	var credentials string
+	if user, password, ok := r.BasicAuth(); ok {
+		credentials = user + ":" + password
+	}
+	g.methods = append(g.methods, r.Method)
+	g.paths = append(g.paths, r.URL.Path)
+	g.credentials = append(g.credentials, credentials)
+	if r.Method == http.MethodPut {
+		g.families = map[string]*dto.MetricFamily{}
+		dec := expfmt.NewDecoder(r.Body, expfmt.ResponseFormat(r.Header))
+		for {
+			var mf dto.MetricFamily
+			if err := dec.Decode(&mf); err != nil {
+				break
+			}
+			g.families[mf.GetName()] = &mf
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// groupingOf returns the grouping labels of a Pushgateway path for job,
+// and false if path is not one.
+func groupingOf(path, job string) (map[string]string, bool) {
+	prefix := "/metrics/job/" + job + "/"
+	if !strings.HasPrefix(path, prefix) {
+		return nil, false
+	}
+	parts := strings.Split(strings.TrimPrefix(path, prefix), "/")
+	if len(parts)%2 != 0 {
+		return nil, false
+	}
+	grouping := map[string]string{}
+	for i := 0; i < len(parts); i += 2 {
+		grouping[parts[i]] = parts[i+1]
+	}
+	return grouping, true
+}
+
+func TestDevicePusher(t *testing.T) {
+	gateway := &fakeGateway{}
+	server := httptest.NewServer(gateway)
+	defer server.Close()
+
+	device := DeviceConfig{Name: "bedroom", URI: writeResponse(t, `{"current":{"co":612,"p2":3,"p1":4,"tp":21.5,"hm":40}}`), Labels: map[string]string{"room": "upstairs"}}
+	e := newTestExporter(t, device.URI, ExporterOptions{})
+	e.name, e.labels = device.Name, device.Labels
+	pusher := newDevicePusher(PushgatewayConfig{
+		URL:               server.URL,
+		Job:               "iqair",
+		Grouping:          map[string]string{"site": "cabin"},
+		BasicAuthUsername: "pusher",
+		BasicAuthPassword: "secret",
+	}, device, e)
+
+	if err := pusher.Push(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pusher.Delete(); err != nil {
+		t.Fatal(err)
+	}
+
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
+	// The grouping labels may come in any order.
+	wantGrouping := map[string]string{"device": "bedroom", "site": "cabin"}
+	if len(gateway.methods) != 2 || gateway.methods[0] != http.MethodPut || gateway.methods[1] != http.MethodDelete {
+		t.Fatalf("gateway got %v, want a PUT then a DELETE", gateway.methods)
+	}
+	for i, path := range gateway.paths {
+		if grouping, ok := groupingOf(path, "iqair"); !ok || !reflect.DeepEqual(grouping, wantGrouping) {
+			t.Errorf("%s to %s, want job iqair grouped by %v", gateway.methods[i], path, wantGrouping)
+		}
+		if gateway.credentials[i] != "pusher:secret" {
+			t.Errorf("%s authenticated as %q, want pusher:secret", gateway.methods[i], gateway.credentials[i])
+		}
+	}
+
+	co2, ok := gateway.families["iqair_co2"]
+	if !ok {
+		t.Fatal("pushed body has no iqair_co2")
+	}
+	m := co2.Metric[0]
+	if got := m.GetGauge().GetValue(); got != 612 {
+		t.Errorf("pushed iqair_co2 = %v, want 612", got)
+	}
+	labels := map[string]string{}
+	for _, l := range m.Label {
+		labels[l.GetName()] = l.GetValue()
+	}
+	if labels["room"] != "upstairs" {
+		t.Errorf("pushed iqair_co2 labels %v, want room=upstairs", labels)
+	}
+	if _, ok := labels["device"]; ok {
+		t.Errorf("pushed iqair_co2 carries the device label, which is part of the grouping key")
+	}
+}
+
+// TestPushgatewayDeleteOnShutdown runs the exporter against a fake
+// Pushgateway over TLS and checks that it pushes with the gateway's own
+// credentials, not the remote-write ones, and deletes the metrics when it
+// stops.
+func TestPushgatewayDeleteOnShutdown(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stopping the exporter needs SIGINT")
+	}
+	gateway := &fakeGateway{}
+	server := httptest.NewTLSServer(gateway)
+	defer server.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+	fixture, err := filepath.Abs("testdata/base.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exporterCommand(
+		"--iqair.scrape-uri=file://"+fixture,
+		"--iqair.device-name=bedroom",
+		"--push.gateway-url="+server.URL,
+		"--push.gateway-job=iqair",
+		"--push.gateway-basic-auth-username=pusher",
+		"--push.gateway-basic-auth-password=secret",
+		"--push.gateway-tls-ca-file="+caFile,
+		"--push.gateway-delete-on-shutdown",
+		"--push.basic-auth-username=remote",
+		"--push.basic-auth-password=other",
+		"--push.interval=50ms",
+		"--web.listen-address=127.0.0.1:0",
+		"--log.level=error",
+	)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	pushed := func() bool {
+		gateway.mutex.Lock()
+		defer gateway.mutex.Unlock()
+		return len(gateway.methods) > 0
+	}
+	for deadline := time.Now().Add(10 * time.Second); !pushed(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the exporter pushed nothing")
+		}
+	}
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("exporter exited with %v", err)
+	}
+
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
+	last := len(gateway.methods) - 1
+	if gateway.methods[last] != http.MethodDelete {
+		t.Errorf("gateway got %v, want a DELETE last", gateway.methods)
+	}
+	if grouping, ok := groupingOf(gateway.paths[last], "iqair"); !ok || grouping["device"] != "bedroom" {
+		t.Errorf("DELETE of %s, want job iqair and device bedroom", gateway.paths[last])
+	}
+	for i, credentials := range gateway.credentials {
+		if credentials != "pusher:secret" {
+			t.Errorf("%s authenticated as %q, want pusher:secret", gateway.methods[i], credentials)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"time"
+)
+
+// Reading is a new measurement from a device, as passed to ReadingListeners.
+type Reading struct {
+	// Device is the configured device name. It may be empty when a single
+	// device is scraped without --iqair.device-name.
+	Device string
+	// Labels are the static labels configured for the device.
+	Labels map[string]string
+	// Timestamp is the device's measurement time, or the time of the scrape
+	// if the device did not report one.
+	Timestamp time.Time
+	Data      APIData
+	// Status is the device's most recent status block, identifying the
+	// device by serial number and model where the firmware reports them.
+	Status Status
+}
+
+// ReadingListener is notified of every new device measurement. OnReading is
+// called from the scrape path and must not block.
+type ReadingListener interface {
+	OnReading(Reading)
+}
+
+// ScrapeResultListener is an optional interface for ReadingListeners that
+// also want to know whether each scrape of a device succeeded. Like
+// OnReading, OnScrapeResult must not block.
+type ScrapeResultListener interface {
+	OnScrapeResult(device string, up bool)
+}
+
+// ReadingField is a sensor value of a reading under the name used by the
+// push outputs.
+type ReadingField struct {
+	Name  string
+	Value float64
+}
+
+// Fields returns the sensor values of r in a stable order.
+func (r Reading) Fields() []ReadingField {
+	return []ReadingField{
+		{"pm25", float64(r.Data.P25)},
+		{"pm10", float64(r.Data.P10)},
+		{"co2", float64(r.Data.CO2)},
+		{"temperature", r.Data.Temperature},
+		{"humidity", float64(r.Data.Humidity)},
+	}
+}
+
+// DeviceName returns the name to identify r's device by in push outputs,
+// which unlike metric labels cannot be left empty.
+func (r Reading) DeviceName() string {
+	if r.Device == "" {
+		return "default"
+	}
+	return r.Device
+}
+
+// readingDocument is the JSON representation of a reading used by the push
+// outputs.
+type readingDocument struct {
+	Device      string            `json:"device"`
+	Serial      string            `json:"serial,omitempty"`
+	Model       string            `json:"model,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Timestamp   time.Time         `json:"timestamp"`
+	PM25        float64           `json:"pm25"`
+	PM10        float64           `json:"pm10"`
+	CO2         float64           `json:"co2"`
+	Temperature float64           `json:"temperature"`
+	Humidity    float64           `json:"humidity"`
+}
+
+func newReadingDocument(r Reading) readingDocument {
+	return readingDocument{
+		Device:      r.DeviceName(),
+		Serial:      r.Status.SerialNumber,
+		Model:       r.Status.Model,
+		Labels:      r.Labels,
+		Timestamp:   r.Timestamp.UTC(),
+		PM25:        float64(r.Data.P25),
+		PM10:        float64(r.Data.P10),
+		CO2:         float64(r.Data.CO2),
+		Temperature: r.Data.Temperature,
+		Humidity:    float64(r.Data.Humidity),
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// configReloader re-reads on SIGHUP what can change without a restart: the
+// scrape credentials and the thresholds of the config file. Devices and
+// notifications are only read at startup.
+type configReloader struct {
+	// configFile is empty without --config.file.
+	configFile string
+	// credentials is nil unless scrapes are authenticated.
+	credentials    *ScrapeCredentials
+	flagThresholds map[string]float64
+	thresholds     *ThresholdCollector
+	// devices are the devices of the config file at startup, as loaded
+	// before dropping duplicate targets.
+	devices []DeviceConfig
+	logger  log.Logger
+}
+
+// reload re-reads the credentials and the config file. If either fails,
+// the previous configuration stays in effect.
+func (r *configReloader) reload() error {
+	if r.credentials != nil {
+		if err := r.credentials.Load(); err != nil {
+			return fmt.Errorf("re-reading credentials: %v", err)
+		}
+	}
+	if r.configFile == "" {
+		return nil
+	}
+	cfg, err := LoadConfig(r.configFile)
+	if err != nil {
+		return err
+	}
+	r.thresholds.Update(mergeThresholds(r.flagThresholds, cfg.Thresholds))
+	if !reflect.DeepEqual(cfg.Devices, r.devices) {
+		level.Warn(r.logger).Log("msg", "Devices changed in the configuration file, restart the exporter to apply the change")
+	}
+	return nil
+}
+
+// run reloads whenever a signal arrives on hups, until hups is closed. As
+// a Type=notify service, the exporter tells systemd when a reload starts
+// and when it is ready again, whether or not the reload succeeded.
+func (r *configReloader) run(hups <-chan os.Signal) {
+	for range hups {
+		if _, err := sdNotify("RELOADING=1"); err != nil {
+			level.Error(r.logger).Log("msg", "Error notifying systemd", "err", err)
+		}
+		if err := r.reload(); err != nil {
+			level.Error(r.logger).Log("msg", "Error reloading the configuration, keeping the previous one", "err", err)
+		} else {
+			level.Info(r.logger).Log("msg", "Reloaded the configuration")
+		}
+		if _, err := sdNotify("READY=1"); err != nil {
+			level.Error(r.logger).Log("msg", "Error notifying systemd", "err", err)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestReloadThresholds(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "iqair.yml")
+	const devices = "devices:\n  - name: bedroom\n    uri: http://bedroom.local/measurements\n"
+	collector := NewThresholdCollector(nil)
+	r := &configReloader{
+		configFile:     configFile,
+		flagThresholds: map[string]float64{"co2": 800, "humidity": 60},
+		thresholds:     collector,
+		logger:         log.NewNopLogger(),
+	}
+
+	for _, tc := range []struct {
+		name       string
+		thresholds string
+		err        bool
+		// want are the exported thresholds in the exposition format.
+		want string
+	}{
+		{
+			name:       "file replaces flags",
+			thresholds: "thresholds: {co2: 1000, p25: 35}\n",
+			want: `iqair_configured_threshold{metric="co2"} 1000
+iqair_configured_threshold{metric="humidity"} 60
+iqair_configured_threshold{metric="p25"} 35
+`,
+		},
+		{
+			name:       "removed thresholds are retired",
+			thresholds: "thresholds: {co2: 1200}\n",
+			want: `iqair_configured_threshold{metric="co2"} 1200
+iqair_configured_threshold{metric="humidity"} 60
+`,
+		},
+		{
+			name:       "invalid file keeps the previous thresholds",
+			thresholds: "thresholds: {radon: 100}\n",
+			err:        true,
+			want: `iqair_configured_threshold{metric="co2"} 1200
+iqair_configured_threshold{metric="humidity"} 60
+`,
+		},
+		{
+			name: "flags only",
+			want: `iqair_configured_threshold{metric="co2"} 800
+iqair_configured_threshold{metric="humidity"} 60
+`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := os.WriteFile(configFile, []byte(devices+tc.thresholds), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.reload(); (err != nil) != tc.err {
+				t.Fatalf("reload() = %v, want error %v", err, tc.err)
+			}
+			want := "# HELP iqair_configured_threshold Configured alert threshold for a reading.\n# TYPE iqair_configured_threshold gauge\n" + tc.want
+			if err := testutil.CollectAndCompare(collector, strings.NewReader(want)); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/common/version"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// RemoteWriteConfig configures pushing samples to a Prometheus remote-write
+// endpoint.
+type RemoteWriteConfig struct {
+	URL      string
+	Interval time.Duration
+	Timeout  time.Duration
+	// ExternalLabels are added to every pushed series, overriding labels of
+	// the same name.
+	ExternalLabels    map[string]string
+	BasicAuthUsername string
+	BasicAuthPassword string
+	BearerToken       string
+	TLSConfig         *tls.Config
+	MaxRetries        int
+	MinBackoff        time.Duration
+	MaxBackoff        time.Duration
+	// QueueSize bounds the number of batches held while the endpoint is
+	// unavailable. The oldest batch is dropped when the queue is full.
+	QueueSize int
+}
+
+// RemoteWriter periodically gathers the metrics exposed on /metrics and
+// pushes them to a remote-write endpoint.
+type RemoteWriter struct {
+	config   RemoteWriteConfig
+	gatherer prometheus.Gatherer
+	client   *http.Client
+	logger   log.Logger
+
+	mutex sync.Mutex
+	queue [][]byte
+	// queueSamples holds the sample count of each queued batch.
+	queueSamples []int
+	wakeup       chan struct{}
+
+	sentSamples, failedBatches, droppedBatches prometheus.Counter
+	queueLength                                prometheus.GaugeFunc
+}
+
+// NewRemoteWriter returns a RemoteWriter pushing the metrics from gatherer.
+func NewRemoteWriter(config RemoteWriteConfig, gatherer prometheus.Gatherer, logger log.Logger) *RemoteWriter {
+	w := &RemoteWriter{
+		config:   config,
+		gatherer: gatherer,
+		client: &http.Client{
+			Timeout:   config.Timeout,
+			Transport: &http.Transport{TLSClientConfig: config.TLSConfig, Proxy: http.ProxyFromEnvironment},
+		},
+		logger: logger,
+		wakeup: make(chan struct{}, 1),
+		sentSamples: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_remote_write_sent_samples_total",
+			Help:      "Number of samples successfully pushed to the remote-write endpoint.",
+		}),
+		failedBatches: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_remote_write_failed_batches_total",
+			Help:      "Number of batches that could not be pushed after all retries.",
+		}),
+		droppedBatches: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_remote_write_dropped_batches_total",
+			Help:      "Number of batches dropped because the queue was full.",
+		}),
+	}
+	w.queueLength = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "exporter_remote_write_queue_length",
+		Help:      "Number of batches waiting to be pushed.",
+	}, func() float64 {
+		w.mutex.Lock()
+		defer w.mutex.Unlock()
+		return float64(len(w.queue))
+	})
+	return w
+}
+
+// Describe implements prometheus.Collector.
+func (w *RemoteWriter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- w.sentSamples.Desc()
+	ch <- w.failedBatches.Desc()
+	ch <- w.droppedBatches.Desc()
+	ch <- w.queueLength.Desc()
+}
+
+// Collect implements prometheus.Collector.
+func (w *RemoteWriter) Collect(ch chan<- prometheus.Metric) {
+	ch <- w.sentSamples
+	ch <- w.failedBatches
+	ch <- w.droppedBatches
+	ch <- w.queueLength
+}
+
+// Run gathers and pushes metrics every interval until ctx is cancelled.
+// Batches still queued then are pushed before it returns, for at most the
+// push timeout.
+func (w *RemoteWriter) Run(ctx context.Context) {
+	sent := make(chan struct{})
+	go func() {
+		w.send(ctx)
+		close(sent)
+	}()
+
+	ticker := time.NewTicker(w.config.Interval)
+	defer ticker.Stop()
+	for {
+		w.gather()
+		select {
+		case <-ctx.Done():
+			<-sent
+			flushCtx, cancel := context.WithTimeout(context.Background(), w.config.Timeout)
+			defer cancel()
+			w.sendQueued(flushCtx)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// gather collects the current metrics and queues them for sending.
+func (w *RemoteWriter) gather() {
+	mfs, err := w.gatherer.Gather()
+	if err != nil {
+		// Gather returns whatever it could collect alongside the error.
+		level.Warn(w.logger).Log("msg", "Error gathering metrics for remote write", "err", err)
+	}
+	if len(mfs) == 0 {
+		return
+	}
+
+	body, samples := encodeWriteRequest(mfs, w.config.ExternalLabels, time.Now())
+	w.enqueue(snappy.Encode(nil, body), samples)
+}
+
+func (w *RemoteWriter) enqueue(batch []byte, samples int) {
+	w.mutex.Lock()
+	if len(w.queue) >= w.config.QueueSize {
+		w.queue = w.queue[1:]
+		w.queueSamples = w.queueSamples[1:]
+		w.droppedBatches.Inc()
+	}
+	w.queue = append(w.queue, batch)
+	w.queueSamples = append(w.queueSamples, samples)
+	w.mutex.Unlock()
+
+	select {
+	case w.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// send pushes queued batches in order until ctx is cancelled.
+func (w *RemoteWriter) send(ctx context.Context) {
+	for w.sendQueued(ctx) {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.wakeup:
+		}
+	}
+}
+
+// sendQueued pushes queued batches in order until the queue is empty. It
+// returns false if ctx was cancelled first, putting the interrupted batch
+// back at the head of the queue.
+func (w *RemoteWriter) sendQueued(ctx context.Context) bool {
+	for {
+		w.mutex.Lock()
+		if len(w.queue) == 0 {
+			w.mutex.Unlock()
+			return true
+		}
+		batch, samples := w.queue[0], w.queueSamples[0]
+		w.queue = w.queue[1:]
+		w.queueSamples = w.queueSamples[1:]
+		w.mutex.Unlock()
+
+		if err := w.sendWithRetries(ctx, batch); err != nil {
+			if ctx.Err() != nil {
+				w.mutex.Lock()
+				w.queue = append([][]byte{batch}, w.queue...)
+				w.queueSamples = append([]int{samples}, w.queueSamples...)
+				w.mutex.Unlock()
+				return false
+			}
+			level.Error(w.logger).Log("msg", "Error pushing to remote-write endpoint", "err", err)
+			w.failedBatches.Inc()
+			continue
+		}
+		w.sentSamples.Add(float64(samples))
+	}
+}
+
+// recoverableError is returned for failures worth retrying.
+type recoverableError struct {
+	error
+}
+
+func (w *RemoteWriter) sendWithRetries(ctx context.Context, batch []byte) error {
+	backoff := w.config.MinBackoff
+	for attempt := 0; ; attempt++ {
+		err := w.sendBatch(ctx, batch)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(recoverableError); !ok || attempt >= w.config.MaxRetries {
+			return err
+		}
+		level.Debug(w.logger).Log("msg", "Retrying remote write", "attempt", attempt+1, "backoff", backoff, "err", err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > w.config.MaxBackoff {
+			backoff = w.config.MaxBackoff
+		}
+	}
+}
+
+func (w *RemoteWriter) sendBatch(ctx context.Context, batch []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.config.URL, bytes.NewReader(batch))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "iqair_exporter/"+version.Version)
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if w.config.BasicAuthUsername != "" {
+		req.SetBasicAuth(w.config.BasicAuthUsername, w.config.BasicAuthPassword)
+	} else if w.config.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+w.config.BearerToken)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return recoverableError{err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+	err = fmt.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	// Like Prometheus, retry on server errors and rate limiting but not on
+	// other client errors, which will fail again.
+	if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+		return recoverableError{err}
+	}
+	return err
+}
+
+// encodeWriteRequest encodes mfs as a remote-write WriteRequest protobuf,
+// returning the encoded message and the number of samples in it.
+func encodeWriteRequest(mfs []*dto.MetricFamily, externalLabels map[string]string, now time.Time) ([]byte, int) {
+	ts := now.UnixNano() / int64(time.Millisecond)
+
+	var buf []byte
+	samples := 0
+	add := func(name string, m *dto.Metric, extra map[string]string, value float64) {
+		labels := make(map[string]string, len(m.GetLabel())+len(extra)+len(externalLabels)+1)
+		for _, lp := range m.GetLabel() {
+			labels[lp.GetName()] = lp.GetValue()
+		}
+		for k, v := range extra {
+			labels[k] = v
+		}
+		for k, v := range externalLabels {
+			labels[k] = v
+		}
+		labels[model.MetricNameLabel] = name
+
+		sampleTS := ts
+		if m.TimestampMs != nil {
+			sampleTS = m.GetTimestampMs()
+		}
+		buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, encodeTimeSeries(labels, value, sampleTS))
+		samples++
+	}
+
+	for _, mf := range mfs {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, m, nil, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, m, nil, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, m, nil, m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					add(name, m, map[string]string{model.QuantileLabel: formatFloat(q.GetQuantile())}, q.GetValue())
+				}
+				add(name+"_sum", m, nil, s.GetSampleSum())
+				add(name+"_count", m, nil, float64(s.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				infSeen := false
+				for _, b := range h.GetBucket() {
+					if math.IsInf(b.GetUpperBound(), +1) {
+						infSeen = true
+					}
+					add(name+"_bucket", m, map[string]string{model.BucketLabel: formatFloat(b.GetUpperBound())}, float64(b.GetCumulativeCount()))
+				}
+				if !infSeen {
+					add(name+"_bucket", m, map[string]string{model.BucketLabel: "+Inf"}, float64(h.GetSampleCount()))
+				}
+				add(name+"_sum", m, nil, h.GetSampleSum())
+				add(name+"_count", m, nil, float64(h.GetSampleCount()))
+			}
+		}
+	}
+	return buf, samples
+}
+
+// encodeTimeSeries encodes a TimeSeries message with a single sample. Labels
+// are written sorted by name, as the remote-write protocol requires.
+func encodeTimeSeries(labels map[string]string, value float64, ts int64) []byte {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf []byte
+	for _, name := range names {
+		var label []byte
+		label = protowire.AppendTag(label, 1, protowire.BytesType)
+		label = protowire.AppendString(label, name)
+		label = protowire.AppendTag(label, 2, protowire.BytesType)
+		label = protowire.AppendString(label, labels[name])
+
+		buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, label)
+	}
+
+	var sample []byte
+	sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+	sample = protowire.AppendFixed64(sample, math.Float64bits(value))
+	sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+	sample = protowire.AppendVarint(sample, uint64(ts))
+
+	buf = protowire.AppendTag(buf, 2, protowire.BytesType)
+	return protowire.AppendBytes(buf, sample)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// recentResponse is a parsed device response kept for /history.
+type recentResponse struct {
+	// Time is when the scrape that returned the response finished.
+	Time     time.Time    `json:"time"`
+	Response *APIResponse `json:"response"`
+}
+
+// responseHistory keeps the last parsed responses of a device in a ring of
+// fixed size.
+type responseHistory struct {
+	responses []recentResponse
+	// next is the index overwritten by the next response; once the ring is
+	// full, it is also the index of the oldest one.
+	next int
+	full bool
+}
+
+// newResponseHistory returns a history of the last size responses. A size
+// of zero or less disables it.
+func newResponseHistory(size int) responseHistory {
+	if size <= 0 {
+		return responseHistory{}
+	}
+	return responseHistory{responses: make([]recentResponse, size)}
+}
+
+// add records a response, replacing the oldest one if the ring is full.
+func (h *responseHistory) add(r recentResponse) {
+	if len(h.responses) == 0 {
+		return
+	}
+	h.responses[h.next] = r
+	h.next = (h.next + 1) % len(h.responses)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// list returns the responses from the oldest to the newest.
+func (h *responseHistory) list() []recentResponse {
+	if !h.full {
+		return append([]recentResponse{}, h.responses[:h.next]...)
+	}
+	return append(append([]recentResponse{}, h.responses[h.next:]...), h.responses[:h.next]...)
+}
+
+// RecentResponses returns copies of the device's last parsed responses,
+// from the oldest to the newest. Like Snapshot, it is safe to use without
+// holding the exporter's lock: responses are never modified once parsed.
+func (e *Exporter) RecentResponses() []recentResponse {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.responses.list()
+}
+
+// deviceResponses is a device's entry in /history responses.
+type deviceResponses struct {
+	Device    string           `json:"device"`
+	Responses []recentResponse `json:"responses"`
+}
+
+// newResponseHistoryHandler returns the handler of /history, listing the
+// last parsed responses of each device. Like /-/scrape, a device query
+// parameter, which may be repeated, restricts it to the named devices.
+func newResponseHistoryHandler(exporters []*Exporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		selected, unknown := selectExporters(exporters, r.URL.Query()["device"])
+		if unknown != "" {
+			writeAPIError(w, http.StatusNotFound, "unknown device "+unknown)
+			return
+		}
+		devices := []deviceResponses{}
+		for _, e := range selected {
+			devices = append(devices, deviceResponses{
+				Device:    Reading{Device: e.name}.DeviceName(),
+				Responses: e.RecentResponses(),
+			})
+		}
+		writeJSON(w, http.StatusOK, map[string][]deviceResponses{"devices": devices})
+	})
+}
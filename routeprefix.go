@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// parseExternalURL parses the value of --web.external-url, the absolute URL
+// under which users reach the exporter, e.g. through a reverse proxy. An
+// empty value returns nil.
+func parseExternalURL(s string) (*url.URL, error) {
+	if s == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("%q is not an absolute http or https URL", s)
+	}
+	// Only the scheme, host and path are used to build URLs.
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawPath, u.RawQuery, u.Fragment = "", "", ""
+	return u, nil
+}
+
+// routePrefix returns the path prefix of all handlers, as Prometheus does:
+// --web.route-prefix, defaulting to the path of the external URL. The root
+// prefix is returned as the empty string, others without a trailing slash.
+func routePrefix(prefix string, externalURL *url.URL) string {
+	if prefix == "" && externalURL != nil {
+		prefix = externalURL.Path
+	}
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	return "/" + prefix
+}
+
+// externalBase returns the URL that the paths of the exporter's handlers
+// are appended to in redirects: the external URL, or the route prefix
+// without one.
+func externalBase(externalURL *url.URL, prefix string) string {
+	if externalURL == nil {
+		return prefix
+	}
+	return externalURL.String()
+}
+
+// prefixedMux registers handlers under a route prefix. The handlers see the
+// request path without the prefix, so they work unchanged with any prefix.
+type prefixedMux struct {
+	*http.ServeMux
+	prefix string
+}
+
+// Handle registers h for path below the prefix.
+func (m prefixedMux) Handle(path string, h http.Handler) {
+	if m.prefix == "" {
+		m.ServeMux.Handle(path, h)
+		return
+	}
+	m.ServeMux.Handle(m.prefix+path, http.StripPrefix(m.prefix, h))
+}
+
+// newUnprefixedHandler returns the handler of requests outside the route
+// prefix. They are not found, or with redirect, redirected to the same path
+// below base.
+func newUnprefixedHandler(base string, redirect bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !redirect {
+			http.NotFound(w, r)
+			return
+		}
+		target := base + r.URL.Path
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusFound)
+	})
+}
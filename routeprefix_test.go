@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRoutePrefix(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		externalURL string
+		prefix      string
+		redirect    bool
+		target      string
+		// code is the expected status, seen the path the handler got and
+		// location where a redirect points to.
+		code     int
+		seen     string
+		location string
+	}{
+		{name: "no prefix", target: "/metrics", code: http.StatusOK, seen: "/metrics"},
+		{name: "prefix from the external URL", externalURL: "https://example.com/iqair/", target: "/iqair/metrics", code: http.StatusOK, seen: "/metrics"},
+		{name: "path outside the prefix", externalURL: "https://example.com/iqair", target: "/metrics", code: http.StatusNotFound},
+		{name: "redirect into the prefix", externalURL: "https://example.com/iqair", redirect: true, target: "/metrics?collect[]=iqair_up", code: http.StatusFound, location: "https://example.com/iqair/metrics?collect[]=iqair_up"},
+		{name: "redirect without an external URL", prefix: "iqair", redirect: true, target: "/metrics", code: http.StatusFound, location: "/iqair/metrics"},
+		{name: "root prefix overriding the external URL", externalURL: "https://example.com/iqair", prefix: "/", target: "/metrics", code: http.StatusOK, seen: "/metrics"},
+		{name: "explicit prefix", prefix: "/exporters/iqair/", target: "/exporters/iqair/metrics", code: http.StatusOK, seen: "/metrics"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			externalURL, err := parseExternalURL(tc.externalURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Wire the handlers as main does.
+			prefix := routePrefix(tc.prefix, externalURL)
+			serveMux := http.NewServeMux()
+			mux := prefixedMux{ServeMux: serveMux, prefix: prefix}
+			if prefix != "" {
+				serveMux.Handle("/", newUnprefixedHandler(externalBase(externalURL, prefix), tc.redirect))
+			}
+			mux.Handle("/metrics", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, r.URL.Path)
+			}))
+
+			w := httptest.NewRecorder()
+			serveMux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.target, nil))
+			if w.Code != tc.code {
+				t.Fatalf("GET %s answered %d, want %d", tc.target, w.Code, tc.code)
+			}
+			if tc.seen != "" && w.Body.String() != tc.seen {
+				t.Errorf("handler saw path %q, want %q", w.Body.String(), tc.seen)
+			}
+			if got := w.Header().Get("Location"); got != tc.location {
+				t.Errorf("redirected to %q, want %q", got, tc.location)
+			}
+		})
+	}
+}
+
+func TestParseExternalURL(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+		err      bool
+	}{
+		{in: "", want: ""},
+		{in: "https://example.com/iqair/?q=1#top", want: "https://example.com/iqair"},
+		{in: "http://example.com", want: "http://example.com"},
+		{in: "/iqair", err: true},
+		{in: "ftp://example.com/iqair", err: true},
+	} {
+		u, err := parseExternalURL(tc.in)
+		if tc.err {
+			if err == nil {
+				t.Errorf("parseExternalURL(%q) = %v, want an error", tc.in, u)
+			}
+			continue
+		}
+		got := ""
+		if u != nil {
+			got = u.String()
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("parseExternalURL(%q) = %q, %v, want %q", tc.in, got, err, tc.want)
+		}
+	}
+}
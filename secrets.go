@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// airVisualAPIBase is the AirVisual API link of a device without its key.
+const airVisualAPIBase = "https://www.airvisual.com" + airVisualKeyPrefix
+
+// readSecretFile reads a secret such as a password from path, as mounted by
+// Docker or Kubernetes secrets, without the trailing newline editors and
+// echo leave behind.
+func readSecretFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimRight(string(b), "\r\n")
+	if secret == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return secret, nil
+}
+
+// ScrapeCredentials authenticate scrape requests with basic authentication
+// or a bearer token read from files, so that secrets stay off the command
+// line. Load reads the files again, e.g. after a secret was rotated.
+type ScrapeCredentials struct {
+	Username        string
+	PasswordFile    string
+	BearerTokenFile string
+
+	mutex       sync.RWMutex
+	password    string
+	bearerToken string
+}
+
+// Load reads the credential files. If any of them cannot be read, the
+// credentials read before are kept.
+func (c *ScrapeCredentials) Load() error {
+	var password, bearerToken string
+	var err error
+	if c.PasswordFile != "" {
+		if password, err = readSecretFile(c.PasswordFile); err != nil {
+			return err
+		}
+	}
+	if c.BearerTokenFile != "" {
+		if bearerToken, err = readSecretFile(c.BearerTokenFile); err != nil {
+			return err
+		}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.password, c.bearerToken = password, bearerToken
+	return nil
+}
+
+// apply adds the credentials to req, overriding user info in its URL.
+func (c *ScrapeCredentials) apply(req *http.Request) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.PasswordFile != "" {
+		req.SetBasicAuth(c.Username, c.password)
+	}
+	if c.BearerTokenFile != "" {
+		req.Header.Set("Authorization", "Bearer "+c.bearerToken)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/common/promlog"
+)
+
+// serviceCommand does nothing: the --service.* flags only exist on Windows.
+func serviceCommand() (bool, error) {
+	return false, nil
+}
+
+// startService returns logger and os.Exit as is: only on Windows can the
+// exporter run as a service.
+func startService(_ chan<- os.Signal, logger log.Logger, _ *promlog.Config) (log.Logger, func(int), error) {
+	return logger, os.Exit, nil
+}
@@ -0,0 +1,200 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/promlog"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// serviceName is the name the exporter is installed as, both as a service
+// and as an event log source.
+const serviceName = "iqair_exporter"
+
+var (
+	serviceInstall   = kingpin.Flag("service.install", "Install the exporter as a Windows service started with the other flags given, and exit.").Default("false").Bool()
+	serviceUninstall = kingpin.Flag("service.uninstall", "Remove the Windows service installed with --service.install, and exit.").Default("false").Bool()
+)
+
+// serviceCommand installs or removes the Windows service if asked to with
+// --service.install or --service.uninstall, returning whether it did.
+func serviceCommand() (bool, error) {
+	switch {
+	case *serviceInstall && *serviceUninstall:
+		return true, fmt.Errorf("--service.install and --service.uninstall are mutually exclusive")
+	case *serviceInstall:
+		return true, installService()
+	case *serviceUninstall:
+		return true, uninstallService()
+	}
+	return false, nil
+}
+
+// installService registers the exporter as an automatically started
+// service, with the current command line minus --service.install.
+func installService() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	var args []string
+	for _, arg := range os.Args[1:] {
+		if arg != "--service.install" && !strings.HasPrefix(arg, "--service.install=") {
+			args = append(args, arg)
+		}
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s is already installed", serviceName)
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "IQAir exporter",
+		Description: "Prometheus exporter for IQAir AirVisual air quality monitors.",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("registering event log source: %v", err)
+	}
+	return nil
+}
+
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", serviceName)
+	}
+	defer s.Close()
+	if err := s.Delete(); err != nil {
+		return err
+	}
+	return eventlog.Remove(serviceName)
+}
+
+// windowsService answers the control requests of the service control
+// manager. Stop and shutdown requests are turned into a SIGTERM, so the
+// exporter shuts down gracefully as it does on other platforms.
+type windowsService struct {
+	sigs chan<- os.Signal
+	// exitCode receives the exit code once the exporter has shut down.
+	exitCode chan int
+}
+
+// Execute implements svc.Handler.
+func (s *windowsService) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case code := <-s.exitCode:
+			return code != 0, uint32(code)
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				select {
+				case s.sigs <- syscall.SIGTERM:
+				default:
+					// A shutdown is already under way.
+				}
+			}
+		}
+	}
+}
+
+// startService runs the exporter as a Windows service if the service
+// control manager started it. It then returns a logger writing to the event
+// log and a function that reports the exit code to the service control
+// manager before exiting. Otherwise, logger and os.Exit are returned as is.
+func startService(sigs chan<- os.Signal, logger log.Logger, config *promlog.Config) (log.Logger, func(int), error) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return logger, os.Exit, err
+	}
+	elog, err := eventlog.Open(serviceName)
+	if err != nil {
+		return logger, os.Exit, fmt.Errorf("opening event log: %v", err)
+	}
+	logger = level.NewFilter(eventLogLogger{elog: elog}, allowedLevel(config.Level.String()))
+
+	s := &windowsService{sigs: sigs, exitCode: make(chan int, 1)}
+	done := make(chan struct{})
+	go func() {
+		if err := svc.Run(serviceName, s); err != nil {
+			level.Error(logger).Log("msg", "Error running as a Windows service", "err", err)
+		}
+		close(done)
+	}()
+	exit := func(code int) {
+		s.exitCode <- code
+		<-done
+		os.Exit(code)
+	}
+	return logger, exit, nil
+}
+
+// eventLogLogger writes logfmt lines to the Windows event log, as errors,
+// warnings or information according to their level.
+type eventLogLogger struct {
+	elog *eventlog.Log
+}
+
+func (l eventLogLogger) Log(keyvals ...interface{}) error {
+	var buf bytes.Buffer
+	if err := log.NewLogfmtLogger(&buf).Log(keyvals...); err != nil {
+		return err
+	}
+	msg := strings.TrimSuffix(buf.String(), "\n")
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if keyvals[i] != level.Key() {
+			continue
+		}
+		switch keyvals[i+1] {
+		case level.ErrorValue():
+			return l.elog.Error(1, msg)
+		case level.WarnValue():
+			return l.elog.Warning(1, msg)
+		}
+	}
+	return l.elog.Info(1, msg)
+}
+
+// allowedLevel returns the filter option of a --log.level value.
+func allowedLevel(s string) level.Option {
+	switch s {
+	case "debug":
+		return level.AllowDebug()
+	case "warn":
+		return level.AllowWarn()
+	case "error":
+		return level.AllowError()
+	}
+	return level.AllowInfo()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// backgroundTasks runs goroutines that stop together when cancelled.
+type backgroundTasks struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newBackgroundTasks() *backgroundTasks {
+	t := &backgroundTasks{}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	return t
+}
+
+// Go runs run in a goroutine with a context that is cancelled by Stop.
+func (t *backgroundTasks) Go(run func(context.Context)) {
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		run(t.ctx)
+	}()
+}
+
+// Stop cancels the tasks and waits for them to return.
+func (t *backgroundTasks) Stop() {
+	t.cancel()
+	t.wg.Wait()
+}
+
+// gracefulShutdown stops servers from accepting connections and waits for
+// their in-flight requests, then runs steps in order. It gives up when ctx
+// is done, returning ctx's error.
+func gracefulShutdown(ctx context.Context, servers []*http.Server, steps ...func()) error {
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			errs <- srv.Shutdown(ctx)
+		}(srv)
+	}
+	for range servers {
+		if err := <-errs; err != nil {
+			return err
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		for _, step := range steps {
+			step()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// StatsD metric formats.
+const (
+	statsdFormatPlain     = "plain"
+	statsdFormatDogStatsD = "dogstatsd"
+)
+
+// StatsDConfig configures emitting readings to StatsD.
+type StatsDConfig struct {
+	// Address is a UDP host:port, or a unix:// path to a datagram socket
+	// such as the one the Datadog agent listens on.
+	Address string
+	Prefix  string
+	// Format is statsdFormatPlain, which puts the device name into the
+	// metric name, or statsdFormatDogStatsD, which sends it as a tag.
+	Format    string
+	QueueSize int
+}
+
+// StatsDWriter emits every value of a new reading as a StatsD gauge.
+// Failures are counted rather than logged, as a missing StatsD daemon would
+// otherwise log on every reading.
+type StatsDWriter struct {
+	config  StatsDConfig
+	packets chan []byte
+	logger  log.Logger
+
+	sentPackets, writeFailures, droppedReadings prometheus.Counter
+}
+
+// NewStatsDWriter returns a StatsDWriter. Call Run to start sending.
+func NewStatsDWriter(config StatsDConfig, logger log.Logger) *StatsDWriter {
+	return &StatsDWriter{
+		config:  config,
+		packets: make(chan []byte, config.QueueSize),
+		logger:  logger,
+		sentPackets: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_statsd_sent_packets_total",
+			Help:      "Number of packets sent to StatsD.",
+		}),
+		writeFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_statsd_write_failures_total",
+			Help:      "Number of packets that could not be sent to StatsD.",
+		}),
+		droppedReadings: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_statsd_dropped_readings_total",
+			Help:      "Number of readings dropped because the send queue was full.",
+		}),
+	}
+}
+
+// OnReading queues r for sending. It implements ReadingListener.
+func (w *StatsDWriter) OnReading(r Reading) {
+	select {
+	case w.packets <- formatStatsD(w.config, r):
+	default:
+		w.droppedReadings.Inc()
+	}
+}
+
+// Run sends queued packets until ctx is cancelled. Packets still queued
+// are sent before it returns.
+func (w *StatsDWriter) Run(ctx context.Context) {
+	network, addr := statsdNetwork(w.config.Address)
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	send := func(packet []byte) {
+		if conn == nil {
+			var err error
+			if conn, err = net.Dial(network, addr); err != nil {
+				level.Debug(w.logger).Log("msg", "Error connecting to StatsD", "err", err)
+				w.writeFailures.Inc()
+				return
+			}
+		}
+		if _, err := conn.Write(packet); err != nil {
+			level.Debug(w.logger).Log("msg", "Error sending to StatsD", "err", err)
+			w.writeFailures.Inc()
+			// Redial next time; a unix socket may have been recreated.
+			conn.Close()
+			conn = nil
+			return
+		}
+		w.sentPackets.Inc()
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			for len(w.packets) > 0 {
+				send(<-w.packets)
+			}
+			return
+		case packet := <-w.packets:
+			send(packet)
+		}
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (w *StatsDWriter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- w.sentPackets.Desc()
+	ch <- w.writeFailures.Desc()
+	ch <- w.droppedReadings.Desc()
+}
+
+// Collect implements prometheus.Collector.
+func (w *StatsDWriter) Collect(ch chan<- prometheus.Metric) {
+	ch <- w.sentPackets
+	ch <- w.writeFailures
+	ch <- w.droppedReadings
+}
+
+// statsdNetwork returns the network and address to dial for address.
+func statsdNetwork(address string) (network, addr string) {
+	if strings.HasPrefix(address, "unix://") {
+		return "unixgram", strings.TrimPrefix(address, "unix://")
+	}
+	return "udp", strings.TrimPrefix(address, "udp://")
+}
+
+// validateStatsDConfig checks that the StatsD address can be dialed.
+func validateStatsDConfig(config StatsDConfig) error {
+	network, addr := statsdNetwork(config.Address)
+	if network == "udp" {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid StatsD address %q: %v", config.Address, err)
+		}
+	} else if addr == "" {
+		return fmt.Errorf("invalid StatsD address %q: missing socket path", config.Address)
+	}
+	if config.QueueSize < 1 {
+		return fmt.Errorf("StatsD queue size must be at least 1")
+	}
+	return nil
+}
+
+// formatStatsD formats r as a packet of newline-separated gauges.
+func formatStatsD(config StatsDConfig, r Reading) []byte {
+	prefix := strings.Trim(config.Prefix, ".")
+	if prefix != "" {
+		prefix += "."
+	}
+
+	var suffix string
+	if config.Format == statsdFormatDogStatsD {
+		suffix = "|#" + strings.Join(dogStatsDTags(r), ",")
+	} else {
+		prefix += graphitePathSegment(r.DeviceName()) + "."
+	}
+
+	var b strings.Builder
+	for i, f := range r.Fields() {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(prefix + f.Name + ":" + strconv.FormatFloat(f.Value, 'f', -1, 64) + "|g" + suffix)
+	}
+	return []byte(b.String())
+}
+
+// dogStatsDTags returns the device name, serial number and static labels as
+// sorted name:value tags.
+func dogStatsDTags(r Reading) []string {
+	tags := []string{"device:" + dogStatsDTagValue(r.DeviceName())}
+	if r.Status.SerialNumber != "" {
+		tags = append(tags, "serial:"+dogStatsDTagValue(r.Status.SerialNumber))
+	}
+	for name, value := range r.Labels {
+		tags = append(tags, name+":"+dogStatsDTagValue(value))
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// dogStatsDTagValue replaces the characters that delimit tags and packet
+// fields.
+var dogStatsDTagValue = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_").Replace
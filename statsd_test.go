@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// fakeStatsD returns the address of a fake StatsD daemon and the channel
+// the packets it receives are sent to.
+func fakeStatsD(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	packets := make(chan string, 10)
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			packets <- string(buf[:n])
+		}
+	}()
+	return conn.LocalAddr().String(), packets
+}
+
+func TestStatsDWriter(t *testing.T) {
+	for _, tc := range []struct {
+		format, want string
+	}{
+		{statsdFormatPlain, "home.living_room.pm25:3|g\nhome.living_room.pm10:4|g\nhome.living_room.co2:612|g\nhome.living_room.temperature:21.5|g\nhome.living_room.humidity:40|g"},
+		{statsdFormatDogStatsD, "home.pm25:3|g|#device:living.room,room:living room,serial:ABC123\nhome.pm10:4|g|#device:living.room,room:living room,serial:ABC123\nhome.co2:612|g|#device:living.room,room:living room,serial:ABC123\nhome.temperature:21.5|g|#device:living.room,room:living room,serial:ABC123\nhome.humidity:40|g|#device:living.room,room:living room,serial:ABC123"},
+	} {
+		addr, packets := fakeStatsD(t)
+		w := NewStatsDWriter(StatsDConfig{Address: "udp://" + addr, Prefix: "home", Format: tc.format, QueueSize: 10}, log.NewNopLogger())
+		ctx, cancel := context.WithCancel(context.Background())
+		go w.Run(ctx)
+		w.OnReading(testReading("living.room", time.Unix(1600000000, 0)))
+
+		select {
+		case got := <-packets:
+			if got != tc.want {
+				t.Errorf("%s: sent\n%s\nwant\n%s", tc.format, got, tc.want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: no packet sent", tc.format)
+		}
+		cancel()
+	}
+}
+
+func TestStatsDWriterDrainsOnShutdown(t *testing.T) {
+	addr, packets := fakeStatsD(t)
+	w := NewStatsDWriter(StatsDConfig{Address: addr, Format: statsdFormatPlain, QueueSize: 10}, log.NewNopLogger())
+	w.OnReading(testReading("bedroom", time.Unix(1600000000, 0)))
+	w.OnReading(testReading("office", time.Unix(1600000000, 0)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w.Run(ctx)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-packets:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d packets, want 2", i)
+		}
+	}
+}
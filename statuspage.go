@@ -0,0 +1,156 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// statusPageRefresh is how often the status page reloads when it cannot
+// follow the live stream.
+const statusPageRefresh = time.Minute
+
+//go:embed statuspage.html
+var statusPageHTML string
+
+var statusPageTemplate = template.Must(template.New("statuspage").Parse(statusPageHTML))
+
+// aqiCategory is a US EPA AQI category with its official color.
+type aqiCategory struct {
+	Name  string
+	Color string
+	// TextColor keeps text readable on Color.
+	TextColor string
+	max       int
+}
+
+var aqiCategories = []aqiCategory{
+	{"Good", "#00e400", "#000", 50},
+	{"Moderate", "#ffff00", "#000", 100},
+	{"Unhealthy for Sensitive Groups", "#ff7e00", "#000", 150},
+	{"Unhealthy", "#ff0000", "#fff", 200},
+	{"Very Unhealthy", "#8f3f97", "#fff", 300},
+	{"Hazardous", "#7e0023", "#fff", 500},
+}
+
+// categorizeAQI returns the category of an AQI as returned by usAQI.
+func categorizeAQI(aqi int) aqiCategory {
+	return aqiCategories[aqiColorIndex(aqi)]
+}
+
+// aqiColorIndex returns the index of the AQI's category in aqiCategories,
+// from 0 for Good (green) to 5 for Hazardous (maroon).
+func aqiColorIndex(aqi int) int {
+	for i, c := range aqiCategories {
+		if aqi <= c.max {
+			return i
+		}
+	}
+	return len(aqiCategories) - 1
+}
+
+// statusPageValue is a reading field shown on the status page.
+type statusPageValue struct {
+	Name  string
+	Value string
+	Unit  string
+}
+
+// statusPageDevice is a device shown on the status page.
+type statusPageDevice struct {
+	Name string
+	// HasReading is true if the last scrape succeeded.
+	HasReading bool
+	// Failed is true if the last scrape failed, as opposed to no scrape
+	// having finished yet.
+	Failed   bool
+	Stale    bool
+	AQI      int
+	Category aqiCategory
+	// Age is how long ago the reading was measured, empty if the device
+	// does not report measurement times.
+	Age      string
+	Readings []statusPageValue
+}
+
+type statusPageData struct {
+	Devices []statusPageDevice
+	// StreamURL is the URL of the live stream, relative to the page, so
+	// the page keeps working behind a path prefix.
+	StreamURL      string
+	RefreshSeconds int
+}
+
+// newStatusPageHandler returns the handler of /dashboard, a status page
+// showing the latest reading of each device for people rather than
+// machines. Like /api/v1/current it only reads the exporters' cached state.
+// The page reloads whenever /api/v1/stream reports a new reading, and
+// every statusPageRefresh in browsers without JavaScript.
+func newStatusPageHandler(exporters []*Exporter, staleAfter time.Duration, logger log.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		data := statusPageData{
+			StreamURL:      "api/v1/stream",
+			RefreshSeconds: int(statusPageRefresh / time.Second),
+		}
+		for _, e := range exporters {
+			data.Devices = append(data.Devices, newStatusPageDevice(e.Snapshot(), e.nowFunc(), staleAfter))
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := statusPageTemplate.Execute(w, data); err != nil {
+			level.Error(logger).Log("msg", "Error rendering status page", "err", err)
+		}
+	})
+}
+
+func newStatusPageDevice(s Snapshot, now time.Time, staleAfter time.Duration) statusPageDevice {
+	d := statusPageDevice{
+		Name:   Reading{Device: s.Device}.DeviceName(),
+		Failed: s.Error != "",
+	}
+	if s.Response == nil {
+		return d
+	}
+	current := s.Response.Current
+	d.HasReading = true
+	d.AQI = usAQI(float64(current.P25))
+	d.Category = categorizeAQI(d.AQI)
+	if !current.Timestamp.IsZero() {
+		age := now.Sub(current.Timestamp)
+		d.Age = formatAge(age)
+		d.Stale = age > staleAfter
+	}
+	for _, f := range (Reading{Data: current}).Fields() {
+		d.Readings = append(d.Readings, statusPageValue{
+			Name:  f.Name,
+			Value: strconv.FormatFloat(f.Value, 'f', -1, 64),
+			Unit:  readingUnits[f.Name],
+		})
+	}
+	return d
+}
+
+// formatAge returns a short description of how long ago something
+// happened, e.g. "5 min ago".
+func formatAge(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%d min ago", int(d/time.Minute))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%d h ago", int(d/time.Hour))
+	default:
+		return fmt.Sprintf("%d days ago", int(d/(24*time.Hour)))
+	}
+}
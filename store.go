@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sqliteMigrations are applied in order to bring the database schema up to
+// date. The number of applied migrations is kept in PRAGMA user_version, so
+// existing entries must never change; append new ones instead.
+var sqliteMigrations = []string{
+	`CREATE TABLE readings (
+		device      TEXT    NOT NULL,
+		timestamp   INTEGER NOT NULL,
+		serial      TEXT    NOT NULL DEFAULT '',
+		pm25        REAL    NOT NULL,
+		pm10        REAL    NOT NULL,
+		co2         REAL    NOT NULL,
+		temperature REAL    NOT NULL,
+		humidity    REAL    NOT NULL,
+		PRIMARY KEY (device, timestamp)
+	)`,
+	`CREATE INDEX readings_timestamp ON readings (timestamp)`,
+}
+
+// sqlitePruneInterval is how often readings older than the retention period
+// are deleted.
+const sqlitePruneInterval = time.Hour
+
+// SQLiteStoreConfig configures the local reading history.
+type SQLiteStoreConfig struct {
+	Path string
+	// Retention is how long readings are kept. Zero keeps them forever.
+	Retention time.Duration
+	// Readings are written in batches of up to BatchSize, at least every
+	// FlushInterval, to limit writes to SD cards.
+	BatchSize     int
+	FlushInterval time.Duration
+}
+
+// SQLiteStore appends every new reading to an SQLite database, keeping a
+// local history independent of Prometheus' retention.
+type SQLiteStore struct {
+	config SQLiteStoreConfig
+	db     *sql.DB
+	queue  chan Reading
+	logger log.Logger
+
+	written, dropped, writeErrors prometheus.Counter
+	size                          prometheus.GaugeFunc
+}
+
+// OpenSQLiteStore opens or creates the database at config.Path and migrates
+// it to the current schema. Call Run to start writing. It fails with
+// errSQLiteUnavailable in builds without cgo.
+func OpenSQLiteStore(config SQLiteStoreConfig, logger log.Logger) (*SQLiteStore, error) {
+	if errSQLiteUnavailable != nil {
+		return nil, errSQLiteUnavailable
+	}
+	// WAL mode keeps readers from blocking the writer and needs fewer
+	// fsyncs than the default rollback journal.
+	db, err := sql.Open("sqlite3", "file:"+config.Path+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating %s: %v", config.Path, err)
+	}
+
+	s := &SQLiteStore{
+		config: config,
+		db:     db,
+		queue:  make(chan Reading, config.BatchSize*10),
+		logger: logger,
+		written: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_store_written_readings_total",
+			Help:      "Number of readings written to the local store.",
+		}),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_store_dropped_readings_total",
+			Help:      "Number of readings dropped because the write queue was full.",
+		}),
+		writeErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_store_write_errors_total",
+			Help:      "Number of failed writes to the local store.",
+		}),
+	}
+	s.size = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "exporter_store_size_bytes",
+		Help:      "Size of the local store on disk, including its write-ahead log.",
+	}, func() float64 {
+		var size int64
+		for _, path := range []string{config.Path, config.Path + "-wal"} {
+			if fi, err := os.Stat(path); err == nil {
+				size += fi.Size()
+			}
+		}
+		return float64(size)
+	})
+	return s, nil
+}
+
+// migrateSQLite applies the migrations the database has not seen yet.
+func migrateSQLite(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(sqliteMigrations) {
+		return fmt.Errorf("schema version %d is newer than this exporter supports (%d)", version, len(sqliteMigrations))
+	}
+	for ; version < len(sqliteMigrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteMigrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %v", version+1, err)
+		}
+		// PRAGMA does not accept bound parameters.
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OnReading queues r for writing. It implements ReadingListener.
+func (s *SQLiteStore) OnReading(r Reading) {
+	select {
+	case s.queue <- r:
+	default:
+		s.dropped.Inc()
+	}
+}
+
+// Run writes queued readings and prunes old ones until ctx is cancelled.
+// Pending readings are written before it returns.
+func (s *SQLiteStore) Run(ctx context.Context) {
+	flushTicker := time.NewTicker(s.config.FlushInterval)
+	defer flushTicker.Stop()
+	pruneTicker := time.NewTicker(sqlitePruneInterval)
+	defer pruneTicker.Stop()
+
+	s.prune()
+	var batch []Reading
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := s.write(batch); err != nil {
+			level.Error(s.logger).Log("msg", "Error writing readings to store", "readings", len(batch), "err", err)
+			s.writeErrors.Inc()
+		} else {
+			s.written.Add(float64(len(batch)))
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			for len(s.queue) > 0 {
+				batch = append(batch, <-s.queue)
+			}
+			flush()
+			return
+		case r := <-s.queue:
+			batch = append(batch, r)
+			if len(batch) >= s.config.BatchSize {
+				flush()
+			}
+		case <-flushTicker.C:
+			flush()
+		case <-pruneTicker.C:
+			s.prune()
+		}
+	}
+}
+
+// write inserts batch in a single transaction. Readings already stored are
+// ignored.
+func (s *SQLiteStore) write(batch []Reading) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`INSERT OR IGNORE INTO readings
+		(device, timestamp, serial, pm25, pm10, co2, temperature, humidity)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, r := range batch {
+		doc := newReadingDocument(r)
+		if _, err := stmt.Exec(doc.Device, r.Timestamp.Unix(), doc.Serial, doc.PM25, doc.PM10, doc.CO2, doc.Temperature, doc.Humidity); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// prune deletes readings older than the retention period.
+func (s *SQLiteStore) prune() {
+	if s.config.Retention <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-s.config.Retention).Unix()
+	res, err := s.db.Exec("DELETE FROM readings WHERE timestamp < ?", cutoff)
+	if err != nil {
+		level.Error(s.logger).Log("msg", "Error pruning store", "err", err)
+		s.writeErrors.Inc()
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		level.Debug(s.logger).Log("msg", "Pruned old readings from store", "readings", n)
+	}
+}
+
+// Query returns the stored readings of device taken in [from, to], oldest
+// first. Only the fields kept in the store are set.
+func (s *SQLiteStore) Query(device string, from, to time.Time) ([]Reading, error) {
+	var readings []Reading
+	err := s.QueryFunc(device, from, to, func(r Reading) error {
+		readings = append(readings, r)
+		return nil
+	})
+	return readings, err
+}
+
+// QueryFunc calls fn for each stored reading of device taken in [from, to],
+// oldest first, without loading them all into memory. It stops at the first
+// error fn returns.
+func (s *SQLiteStore) QueryFunc(device string, from, to time.Time, fn func(Reading) error) error {
+	rows, err := s.db.Query(`SELECT timestamp, serial, pm25, pm10, co2, temperature, humidity
+		FROM readings WHERE device = ? AND timestamp BETWEEN ? AND ? ORDER BY timestamp`,
+		device, from.Unix(), to.Unix())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ts int64
+		var pm25, pm10, co2, humidity float64
+		r := Reading{Device: device}
+		if err := rows.Scan(&ts, &r.Status.SerialNumber, &pm25, &pm10, &co2, &r.Data.Temperature, &humidity); err != nil {
+			return err
+		}
+		r.Timestamp = time.Unix(ts, 0).UTC()
+		r.Data.Timestamp = r.Timestamp
+		r.Data.P25, r.Data.P10, r.Data.CO2, r.Data.Humidity = int(pm25), int(pm10), int(co2), int(humidity)
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Close closes the database. Run must have returned.
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// Describe implements prometheus.Collector.
+func (s *SQLiteStore) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.written.Desc()
+	ch <- s.dropped.Desc()
+	ch <- s.writeErrors.Desc()
+	ch <- s.size.Desc()
+}
+
+// Collect implements prometheus.Collector.
+func (s *SQLiteStore) Collect(ch chan<- prometheus.Metric) {
+	ch <- s.written
+	ch <- s.dropped
+	ch <- s.writeErrors
+	ch <- s.size
+}
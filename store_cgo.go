@@ -0,0 +1,9 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import _ "github.com/mattn/go-sqlite3" // Registers the sqlite3 driver.
+
+// errSQLiteUnavailable is nil as the SQLite driver is compiled in.
+var errSQLiteUnavailable error
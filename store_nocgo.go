@@ -0,0 +1,10 @@
+//go:build !cgo
+// +build !cgo
+
+package main
+
+import "errors"
+
+// errSQLiteUnavailable is returned by OpenSQLiteStore in builds without
+// cgo, which the SQLite driver needs.
+var errSQLiteUnavailable = errors.New("the SQLite store is not available in this build, as it needs cgo; rebuild with CGO_ENABLED=1 and a C compiler")
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// streamBufferSize is the number of events buffered per client. Events
+	// for a client that falls further behind are dropped.
+	streamBufferSize = 64
+	// streamHeartbeatInterval is how often idle event streams send a
+	// comment, so proxies do not close them.
+	streamHeartbeatInterval = 15 * time.Second
+)
+
+// streamSubscription receives the events of a ReadingBroadcaster.
+type streamSubscription struct {
+	events chan apiDevice
+}
+
+// ReadingBroadcaster fans new readings out to the clients of the live
+// streaming endpoints. OnReading never blocks: each client has a bounded
+// buffer, and events for clients that cannot keep up are dropped.
+type ReadingBroadcaster struct {
+	staleAfter time.Duration
+	logger     log.Logger
+
+	// nowFunc is read instead of time.Now, so that tests can control the
+	// clock.
+	nowFunc func() time.Time
+
+	mutex         sync.Mutex
+	subscriptions map[*streamSubscription]bool
+	// done is closed on shutdown, making all streams end.
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	clients prometheus.GaugeFunc
+	dropped prometheus.Counter
+}
+
+// NewReadingBroadcaster returns a ReadingBroadcaster. staleAfter is used to
+// flag stale readings like /api/v1/current does.
+func NewReadingBroadcaster(staleAfter time.Duration, logger log.Logger) *ReadingBroadcaster {
+	b := &ReadingBroadcaster{
+		staleAfter:    staleAfter,
+		logger:        logger,
+		nowFunc:       time.Now,
+		subscriptions: map[*streamSubscription]bool{},
+		done:          make(chan struct{}),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_stream_dropped_events_total",
+			Help:      "Number of live stream events dropped because a client fell behind.",
+		}),
+	}
+	b.clients = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "exporter_stream_clients",
+		Help:      "Number of clients connected to the live reading streams.",
+	}, func() float64 {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		return float64(len(b.subscriptions))
+	})
+	return b
+}
+
+// OnReading sends r to all subscribed clients. It implements
+// ReadingListener.
+func (b *ReadingBroadcaster) OnReading(r Reading) {
+	event := newAPIDeviceFromReading(r, b.nowFunc(), b.staleAfter)
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for s := range b.subscriptions {
+		select {
+		case s.events <- event:
+		default:
+			b.dropped.Inc()
+		}
+	}
+}
+
+// subscribe registers a new client. It returns nil if the broadcaster is
+// shutting down. Call unsubscribe when the client is gone.
+func (b *ReadingBroadcaster) subscribe() *streamSubscription {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	select {
+	case <-b.done:
+		return nil
+	default:
+	}
+	s := &streamSubscription{events: make(chan apiDevice, streamBufferSize)}
+	b.subscriptions[s] = true
+	b.wg.Add(1)
+	return s
+}
+
+func (b *ReadingBroadcaster) unsubscribe(s *streamSubscription) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.subscriptions, s)
+	b.wg.Done()
+}
+
+// Close ends all streams and waits for their handlers to return. It may be
+// called more than once, e.g. by each HTTP server shutting down.
+func (b *ReadingBroadcaster) Close() {
+	b.mutex.Lock()
+	select {
+	case <-b.done:
+	default:
+		close(b.done)
+	}
+	b.mutex.Unlock()
+	b.wg.Wait()
+}
+
+// Describe implements prometheus.Collector.
+func (b *ReadingBroadcaster) Describe(ch chan<- *prometheus.Desc) {
+	ch <- b.clients.Desc()
+	ch <- b.dropped.Desc()
+}
+
+// Collect implements prometheus.Collector.
+func (b *ReadingBroadcaster) Collect(ch chan<- prometheus.Metric) {
+	ch <- b.clients
+	ch <- b.dropped
+}
+
+// newSSEHandler returns the handler of /api/v1/stream, sending a
+// Server-Sent Event with the device's state, as served by /api/v1/current,
+// for every new reading. A device query parameter, which may be repeated,
+// restricts the stream to the named devices.
+func newSSEHandler(b *ReadingBroadcaster, devices []string) http.Handler {
+	known := make(map[string]bool, len(devices))
+	for _, d := range devices {
+		known[d] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		wanted := map[string]bool{}
+		for _, name := range r.URL.Query()["device"] {
+			if !known[name] {
+				writeAPIError(w, http.StatusNotFound, "unknown device "+name)
+				return
+			}
+			wanted[name] = true
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeAPIError(w, http.StatusInternalServerError, "streaming not supported")
+			return
+		}
+		s := b.subscribe()
+		if s == nil {
+			writeAPIError(w, http.StatusServiceUnavailable, "shutting down")
+			return
+		}
+		defer b.unsubscribe(s)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		// Keeps nginx from buffering the stream.
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(streamHeartbeatInterval)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-b.done:
+				return
+			case <-heartbeat.C:
+				if _, err := w.Write([]byte(": heartbeat\n\n")); err != nil {
+					return
+				}
+			case event := <-s.events:
+				if len(wanted) > 0 && !wanted[event.Device] {
+					continue
+				}
+				data, err := json.Marshal(event)
+				if err != nil {
+					level.Error(b.logger).Log("msg", "Error encoding stream event", "err", err)
+					continue
+				}
+				if _, err := w.Write([]byte("event: reading\ndata: " + string(data) + "\n\n")); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var iqAirScrapeSuccessRatio = prometheus.NewDesc(prometheus.BuildFQName(namespace, "exporter", "scrape_success_ratio"), "Fraction of the device's recent scrapes that succeeded, over the window set by --iqair.success-ratio-window.", nil, nil)
+
+// scrapeOutcomes remembers whether the most recent scrapes succeeded, in a
+// ring buffer of fixed size.
+type scrapeOutcomes struct {
+	results []bool
+	// next is the index overwritten by the next outcome.
+	next  int
+	count int
+}
+
+// newScrapeOutcomes returns a window of the last size outcomes. A size of
+// zero or less disables it.
+func newScrapeOutcomes(size int) scrapeOutcomes {
+	if size <= 0 {
+		return scrapeOutcomes{}
+	}
+	return scrapeOutcomes{results: make([]bool, size)}
+}
+
+// record adds the outcome of a scrape, dropping the oldest one once the
+// window is full.
+func (o *scrapeOutcomes) record(success bool) {
+	if len(o.results) == 0 {
+		return
+	}
+	o.results[o.next] = success
+	o.next = (o.next + 1) % len(o.results)
+	if o.count < len(o.results) {
+		o.count++
+	}
+}
+
+// ratio returns the fraction of successful scrapes in the window. It
+// reports false if no scrape has been recorded.
+func (o *scrapeOutcomes) ratio() (float64, bool) {
+	if o.count == 0 {
+		return 0, false
+	}
+	successes := 0
+	for i := 0; i < o.count; i++ {
+		if o.results[i] {
+			successes++
+		}
+	}
+	return float64(successes) / float64(o.count), true
+}
+
+func (o *scrapeOutcomes) collect(ch chan<- prometheus.Metric) {
+	if ratio, ok := o.ratio(); ok {
+		ch <- prometheus.MustNewConstMetric(iqAirScrapeSuccessRatio, prometheus.GaugeValue, ratio)
+	}
+}
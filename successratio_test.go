@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestScrapeOutcomesRatio(t *testing.T) {
+	o := newScrapeOutcomes(4)
+	if _, ok := o.ratio(); ok {
+		t.Error("ratio reported before any scrape")
+	}
+	for _, tc := range []struct {
+		success bool
+		want    float64
+	}{
+		{true, 1},
+		{false, 0.5},
+		{true, 2.0 / 3},
+		{true, 0.75},
+		// The window is full: the first success drops out.
+		{false, 0.5},
+		// The failure drops out.
+		{true, 0.75},
+		{true, 0.75},
+		{true, 0.75},
+		{true, 1},
+	} {
+		o.record(tc.success)
+		if got, ok := o.ratio(); !ok || got != tc.want {
+			t.Fatalf("after recording %v, ratio = %v, %v, want %v", tc.success, got, ok, tc.want)
+		}
+	}
+
+	disabled := newScrapeOutcomes(0)
+	disabled.record(true)
+	if _, ok := disabled.ratio(); ok {
+		t.Error("a disabled window reported a ratio")
+	}
+}
+
+func TestScrapeSuccessRatioMetric(t *testing.T) {
+	uri := writeResponse(t, `{"current":{"co":500,"p2":3,"p1":4,"tp":21.5,"hm":40}}`)
+	e := newTestExporter(t, uri, ExporterOptions{SuccessWindow: 10})
+	gather(t, e)
+	rewriteResponse(t, uri, `{"current":`)
+	if got, _ := metricValue(gather(t, e), "iqair_exporter_scrape_success_ratio"); got != 0.5 {
+		t.Errorf("iqair_exporter_scrape_success_ratio = %v after a success and a failure, want 0.5", got)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// sdNotify sends state, such as "READY=1", to systemd's notification
+// socket. It does nothing and returns false if NOTIFY_SOCKET is unset, i.e.
+// the exporter does not run as a Type=notify service.
+func sdNotify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	// A leading @ denotes a socket in the abstract namespace.
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// watchdogInterval returns the interval within which systemd expects
+// watchdog keep-alives, or false if WatchdogSec is not set for the
+// exporter's service.
+func watchdogInterval() (time.Duration, bool) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, false
+	}
+	// WATCHDOG_PID is set when the watchdog is meant for another process.
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, false
+	}
+	return time.Duration(usec) * time.Microsecond, true
+}
+
+// watchdogCheck returns an error if part of the exporter is not healthy.
+type watchdogCheck func() error
+
+// runWatchdog sends watchdog keep-alives to systemd at half the given
+// interval until ctx is cancelled, as long as all checks pass. Once a check
+// fails, keep-alives stop so that systemd restarts the exporter unless the
+// check recovers in time.
+func runWatchdog(ctx context.Context, interval time.Duration, checks []watchdogCheck, logger log.Logger) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		if err := checkHealth(checks); err != nil {
+			level.Warn(logger).Log("msg", "Unhealthy, withholding watchdog keep-alive", "err", err)
+		} else if _, err := sdNotify("WATCHDOG=1"); err != nil {
+			level.Error(logger).Log("msg", "Error notifying systemd", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkHealth returns the error of the first failing check.
+func checkHealth(checks []watchdogCheck) error {
+	for _, check := range checks {
+		if err := check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pollerCheck fails once the device's poller has not completed a scrape for
+// twice the poll interval plus the scrape timeout.
+func pollerCheck(e *Exporter) watchdogCheck {
+	return func() error {
+		now := e.nowFunc()
+		lastPoll := time.Unix(0, atomic.LoadInt64(&e.lastPoll))
+		if limit := 2*e.pollInterval + e.client.Timeout; now.Sub(lastPoll) > limit {
+			return fmt.Errorf("poller of device %q stalled, last scrape completed %v ago", e.name, now.Sub(lastPoll).Round(time.Second))
+		}
+		return nil
+	}
+}
+
+// httpCheck fails unless the server at addr, a TCP address or a Unix domain
+// socket, answers an HTTP request for path within timeout. Any response will do:
+// with TLS enabled, the server answers the plain HTTP request with a 400,
+// and with authentication a 401.
+func httpCheck(addr net.Addr, path string, timeout time.Duration) watchdogCheck {
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, addr.Network(), addr.String())
+			},
+		},
+	}
+	return func() error {
+		// The host is ignored by the dialer.
+		resp, err := client.Get("http://exporter" + path)
+		if err != nil {
+			return fmt.Errorf("HTTP server not responding: %v", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return nil
+	}
+}
+
+// runSelfWatchdog runs checks every interval until ctx is cancelled,
+// independently of systemd. Once they have failed the given number of
+// consecutive times, it returns the last error for the exporter to exit and
+// be restarted by its supervisor.
+func runSelfWatchdog(ctx context.Context, interval time.Duration, failures int, checks []watchdogCheck, logger log.Logger) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	failed := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		err := checkHealth(checks)
+		if err == nil {
+			failed = 0
+			continue
+		}
+		failed++
+		if failed >= failures {
+			return err
+		}
+		level.Warn(logger).Log("msg", "Self-check failed", "consecutive_failures", failed, "err", err)
+	}
+}
@@ -0,0 +1,130 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// fakeNotifySocket points NOTIFY_SOCKET at a datagram socket for the
+// duration of the test and returns it, to read the states sent to it.
+func fakeNotifySocket(t *testing.T) *net.UnixConn {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	setenv(t, "NOTIFY_SOCKET", path)
+	return conn
+}
+
+// readStates returns the next n states sent to conn.
+func readStates(t *testing.T, conn *net.UnixConn, n int) []string {
+	t.Helper()
+	var states []string
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(states) < n {
+		size, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("reading states, got %q so far: %v", states, err)
+		}
+		states = append(states, string(buf[:size]))
+	}
+	return states
+}
+
+func TestSDNotifyWithoutSocket(t *testing.T) {
+	setenv(t, "NOTIFY_SOCKET", "")
+	if ok, err := sdNotify("READY=1"); ok || err != nil {
+		t.Errorf("sdNotify without NOTIFY_SOCKET = %v, %v, want false, nil", ok, err)
+	}
+}
+
+func TestReloadNotifiesSystemd(t *testing.T) {
+	conn := fakeNotifySocket(t)
+	configFile := filepath.Join(t.TempDir(), "iqair.yml")
+	r := &configReloader{
+		configFile: configFile,
+		thresholds: NewThresholdCollector(nil),
+		logger:     log.NewNopLogger(),
+	}
+	hups := make(chan os.Signal)
+	done := make(chan struct{})
+	go func() {
+		r.run(hups)
+		close(done)
+	}()
+
+	for _, tc := range []struct {
+		name   string
+		config string
+	}{
+		{"successful reload", "devices:\n  - name: bedroom\n    uri: http://bedroom.local\n"},
+		// systemd waits for READY=1 after a failed reload too.
+		{"failed reload", "devices: []\n"},
+	} {
+		if err := os.WriteFile(configFile, []byte(tc.config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		hups <- os.Interrupt
+		states := readStates(t, conn, 2)
+		if states[0] != "RELOADING=1" || states[1] != "READY=1" {
+			t.Errorf("%s: sent %q, want RELOADING=1 then READY=1", tc.name, states)
+		}
+	}
+	close(hups)
+	<-done
+}
+
+func TestSystemdLifecycle(t *testing.T) {
+	conn := fakeNotifySocket(t)
+	fixture, err := filepath.Abs("testdata/base.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(t.TempDir(), "iqair.yml")
+	if err := os.WriteFile(configFile, []byte("devices:\n  - name: bedroom\n    uri: file://"+fixture+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exporterCommand("--config.file="+configFile, "--web.listen-address=127.0.0.1:0", "--log.level=error")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	for _, step := range []struct {
+		signal os.Signal
+		want   []string
+	}{
+		{nil, []string{"READY=1"}},
+		{syscall.SIGHUP, []string{"RELOADING=1", "READY=1"}},
+		{syscall.SIGTERM, []string{"STOPPING=1"}},
+	} {
+		if step.signal != nil {
+			if err := cmd.Process.Signal(step.signal); err != nil {
+				t.Fatal(err)
+			}
+		}
+		states := readStates(t, conn, len(step.want))
+		for i, want := range step.want {
+			if states[i] != want {
+				t.Errorf("after %v: sent %q, want %q", step.signal, states, step.want)
+				break
+			}
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("exporter exited with %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// textfileName is the file written to the textfile directory.
+const textfileName = "iqair.prom"
+
+// What to do with the textfile while devices keep failing.
+const (
+	textfileOnFailureWrite  = "write"
+	textfileOnFailureSkip   = "skip"
+	textfileOnFailureRemove = "remove"
+)
+
+// TextfileConfig configures writing metrics for node_exporter's textfile
+// collector.
+type TextfileConfig struct {
+	Directory string
+	// OnFailure is what to do once a device scrape has failed
+	// FailureThreshold times in a row: keep writing the file, stop updating
+	// it so its mtime goes stale, or remove it.
+	OnFailure        string
+	FailureThreshold int
+}
+
+// TextfileWriter writes the exporter's metrics in the text exposition format
+// to a file for node_exporter's textfile collector.
+type TextfileWriter struct {
+	config   TextfileConfig
+	gatherer prometheus.Gatherer
+	// healthy reports whether all device scrapes of the last gather
+	// succeeded.
+	healthy func() bool
+	logger  log.Logger
+
+	failures int
+}
+
+// NewTextfileWriter returns a TextfileWriter writing the metrics from
+// gatherer.
+func NewTextfileWriter(config TextfileConfig, gatherer prometheus.Gatherer, healthy func() bool, logger log.Logger) *TextfileWriter {
+	return &TextfileWriter{
+		config:   config,
+		gatherer: gatherer,
+		healthy:  healthy,
+		logger:   logger,
+	}
+}
+
+// Path returns the path of the file written.
+func (w *TextfileWriter) Path() string {
+	return filepath.Join(w.config.Directory, textfileName)
+}
+
+// Write gathers the metrics and writes them to the textfile, unless devices
+// have been failing for too long. The file is written to a temporary file
+// and renamed, so node_exporter never reads a partial file.
+func (w *TextfileWriter) Write() error {
+	// Gathering scrapes the devices unless they are polled, so check their
+	// health afterwards.
+	mfs, err := w.gatherer.Gather()
+	if err != nil {
+		level.Warn(w.logger).Log("msg", "Error gathering metrics for textfile", "err", err)
+	}
+
+	if w.healthy() {
+		w.failures = 0
+	} else {
+		w.failures++
+	}
+	if w.failures >= w.config.FailureThreshold {
+		switch w.config.OnFailure {
+		case textfileOnFailureSkip:
+			level.Warn(w.logger).Log("msg", "Devices failing, not updating textfile", "failures", w.failures)
+			return nil
+		case textfileOnFailureRemove:
+			level.Warn(w.logger).Log("msg", "Devices failing, removing textfile", "failures", w.failures)
+			if err := os.Remove(w.Path()); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			return nil
+		}
+	}
+
+	gathered := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return mfs, nil })
+	if err := prometheus.WriteToTextfile(w.Path(), gathered); err != nil {
+		return fmt.Errorf("error writing %s: %v", w.Path(), err)
+	}
+	return nil
+}
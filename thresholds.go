@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	iqAirConfiguredThreshold = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "configured_threshold"), "Configured alert threshold for a reading.", []string{"metric"}, nil)
+
+	// thresholdMetrics are the readings a threshold may be configured for.
+	thresholdMetrics = map[string]bool{
+		"co2":         true,
+		"p25":         true,
+		"p10":         true,
+		"temperature": true,
+		"humidity":    true,
+	}
+)
+
+// ThresholdCollector exports the configured alert thresholds so dashboards
+// and alerting rules can refer to them instead of repeating the numbers.
+// Update replaces them when the config file is reloaded.
+type ThresholdCollector struct {
+	mutex      sync.Mutex
+	thresholds map[string]float64
+}
+
+// NewThresholdCollector returns a ThresholdCollector exporting thresholds.
+func NewThresholdCollector(thresholds map[string]float64) *ThresholdCollector {
+	return &ThresholdCollector{thresholds: thresholds}
+}
+
+// Describe implements prometheus.Collector.
+func (c *ThresholdCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- iqAirConfiguredThreshold
+}
+
+// Update replaces the exported thresholds. Series of thresholds missing
+// from thresholds are no longer exported.
+func (c *ThresholdCollector) Update(thresholds map[string]float64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.thresholds = thresholds
+}
+
+// Collect implements prometheus.Collector.
+func (c *ThresholdCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for metric, value := range c.thresholds {
+		ch <- prometheus.MustNewConstMetric(iqAirConfiguredThreshold, prometheus.GaugeValue, value, metric)
+	}
+}
+
+// parseThresholds parses metric=value pairs as given on the command line.
+func parseThresholds(specs []string) (map[string]float64, error) {
+	thresholds := make(map[string]float64, len(specs))
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid threshold %q, expected metric=value", spec)
+		}
+		metric := strings.TrimSpace(parts[0])
+		if !thresholdMetrics[metric] {
+			return nil, fmt.Errorf("invalid threshold %q, unknown metric %q (valid: %s)", spec, metric, strings.Join(knownThresholdMetrics(), ", "))
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid threshold %q: %v", spec, err)
+		}
+		thresholds[metric] = value
+	}
+	return thresholds, nil
+}
+
+// mergeThresholds returns the thresholds of flags, replaced by those of file
+// for the same metric.
+func mergeThresholds(flags, file map[string]float64) map[string]float64 {
+	merged := make(map[string]float64, len(flags)+len(file))
+	for metric, value := range flags {
+		merged[metric] = value
+	}
+	for metric, value := range file {
+		merged[metric] = value
+	}
+	return merged
+}
+
+func knownThresholdMetrics() []string {
+	names := make([]string, 0, len(thresholdMetrics))
+	for name := range thresholdMetrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// tlsVersions maps the accepted --iqair.min-tls-version values to their
+// crypto/tls constants.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newHTTPClient returns the client used to scrape devices. Hosts in
+// opts.Resolve are dialed at the given IP address instead of being looked
+// up, which helps with .local names the exporter's host cannot resolve.
+// openConns tracks the number of connections the client holds open.
+func newHTTPClient(opts ExporterOptions, openConns prometheus.Gauge) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   opts.Timeout,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, resolveAddr(addr, opts.Resolve))
+		if err != nil {
+			return nil, err
+		}
+		openConns.Inc()
+		return &countedConn{Conn: conn, gauge: openConns}, nil
+	}
+	minVersion := opts.MinTLSVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+	transport.TLSClientConfig = &tls.Config{
+		MinVersion: minVersion,
+		ServerName: opts.TLSServerName,
+	}
+	return &http.Client{
+		Timeout:   opts.Timeout,
+		Transport: transport,
+	}
+}
+
+// countedConn decrements gauge when the connection is closed, however
+// often Close is called.
+type countedConn struct {
+	net.Conn
+	gauge prometheus.Gauge
+	once  sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(c.gauge.Dec)
+	return c.Conn.Close()
+}
+
+// resolveAddr replaces the host of addr with its override from resolve, if
+// any.
+func resolveAddr(addr string, resolve map[string]string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip, ok := resolve[strings.ToLower(host)]; ok {
+		return net.JoinHostPort(ip, port)
+	}
+	return addr
+}
+
+// lookupHostWithOverrides returns a net.LookupHost that answers from resolve
+// before falling back to DNS.
+func lookupHostWithOverrides(resolve map[string]string) func(string) ([]string, error) {
+	return func(host string) ([]string, error) {
+		if ip, ok := resolve[strings.ToLower(host)]; ok {
+			return []string{ip}, nil
+		}
+		return net.LookupHost(host)
+	}
+}
+
+// scrapeHeaders returns the headers sent with every scrape request: Accept
+// asks devices and proxies that negotiate content for JSON rather than an
+// HTML page, and overrides, such as those of --iqair.header, replace or,
+// with an empty value, remove headers.
+func scrapeHeaders(overrides map[string]string) http.Header {
+	h := http.Header{"Accept": {"application/json"}}
+	for name, value := range overrides {
+		if value == "" {
+			h.Del(name)
+		} else {
+			h.Set(name, value)
+		}
+	}
+	return h
+}
+
+// parseHeaders parses name=value pairs as given on the command line.
+func parseHeaders(specs []string) (map[string]string, error) {
+	headers := make(map[string]string, len(specs))
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || strings.ContainsAny(parts[0], " \t:") {
+			return nil, fmt.Errorf("invalid header %q, expected name=value", spec)
+		}
+		headers[parts[0]] = parts[1]
+	}
+	return headers, nil
+}
+
+// parseResolve parses host:ip pairs into a map of lower-cased host names to
+// IP addresses.
+func parseResolve(entries []string) (map[string]string, error) {
+	resolve := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		// Split on the first colon so IPv6 addresses survive intact.
+		i := strings.Index(entry, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid resolve entry %q, expected host:ip", entry)
+		}
+		host, ip := strings.ToLower(entry[:i]), entry[i+1:]
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("invalid IP address %q for host %q", ip, host)
+		}
+		if _, ok := resolve[host]; ok {
+			return nil, fmt.Errorf("duplicate resolve entry for host %q", host)
+		}
+		resolve[host] = ip
+	}
+	return resolve, nil
+}
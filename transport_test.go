@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newTestGauge() prometheus.Gauge {
+	return prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_open_connections"})
+}
+
+func TestResolveOverride(t *testing.T) {
+	var host string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	// .invalid never resolves, so the request only arrives if it is dialed
+	// at the override.
+	client := newHTTPClient(ExporterOptions{
+		Timeout: time.Second,
+		Resolve: map[string]string{"airvisual.invalid": "127.0.0.1"},
+	}, newTestGauge())
+	resp, err := client.Get("http://AirVisual.invalid:" + port + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if want := "AirVisual.invalid:" + port; host != want {
+		t.Errorf("request arrived for host %q, want %q", host, want)
+	}
+}
+
+func TestParseResolve(t *testing.T) {
+	resolve, err := parseResolve([]string{"AirVisual.local:192.168.1.20", "outdoor:fe80::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolve["airvisual.local"] != "192.168.1.20" || resolve["outdoor"] != "fe80::1" {
+		t.Errorf("parseResolve = %v", resolve)
+	}
+	for _, entries := range [][]string{
+		{"airvisual.local"},
+		{":192.168.1.20"},
+		{"airvisual.local:not-an-ip"},
+		{"a:192.168.1.20", "A:192.168.1.21"},
+	} {
+		if _, err := parseResolve(entries); err == nil {
+			t.Errorf("parseResolve(%q) succeeded", entries)
+		}
+	}
+}
+
+func TestMinTLSVersion(t *testing.T) {
+	for _, tc := range []struct {
+		serverMax, clientMin uint16
+		ok                   bool
+	}{
+		{tls.VersionTLS11, 0, false},
+		{tls.VersionTLS11, tls.VersionTLS12, false},
+		{tls.VersionTLS12, tls.VersionTLS12, true},
+		{tls.VersionTLS12, tls.VersionTLS13, false},
+		{tls.VersionTLS13, tls.VersionTLS13, true},
+	} {
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		server.TLS = &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tc.serverMax}
+		server.Config.ErrorLog = log.New(io.Discard, "", 0)
+		server.StartTLS()
+
+		client := newHTTPClient(ExporterOptions{Timeout: time.Second, MinTLSVersion: tc.clientMin}, newTestGauge())
+		roots := x509.NewCertPool()
+		roots.AddCert(server.Certificate())
+		client.Transport.(*http.Transport).TLSClientConfig.RootCAs = roots
+
+		resp, err := client.Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if ok := err == nil; ok != tc.ok {
+			t.Errorf("server up to %x, client from %x: err = %v, want success %v", tc.serverMax, tc.clientMin, err, tc.ok)
+		}
+		server.Close()
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// wsWriteTimeout bounds every write to a WebSocket client, so a stuck
+	// client is disconnected instead of holding on to its subscription.
+	wsWriteTimeout = 10 * time.Second
+	// wsPingInterval is how often clients are pinged. A client that sends
+	// nothing, not even a pong, for wsPongTimeout is disconnected.
+	wsPingInterval = 30 * time.Second
+	wsPongTimeout  = 2 * wsPingInterval
+	// wsMaxMessageSize limits the size of subscription messages.
+	wsMaxMessageSize = 4096
+)
+
+// wsSubscribe is the message clients send to choose what they receive.
+// Empty lists select everything.
+type wsSubscribe struct {
+	Devices []string `json:"devices"`
+	Metrics []string `json:"metrics"`
+}
+
+// wsMessage is a message sent to WebSocket clients. Type is "reading" for
+// new readings, "subscribed" to acknowledge a subscription message, or
+// "error" for subscription messages that could not be applied.
+type wsMessage struct {
+	Type       string       `json:"type"`
+	Reading    *apiDevice   `json:"reading,omitempty"`
+	Subscribed *wsSubscribe `json:"subscribed,omitempty"`
+	Error      string       `json:"error,omitempty"`
+}
+
+// wsReply is the answer to a subscription message, with the filter to
+// apply from then on unless the message was rejected.
+type wsReply struct {
+	msg    wsMessage
+	filter *wsFilter
+}
+
+// wsFilter selects the devices and metrics sent to a client; nil maps
+// select everything.
+type wsFilter struct {
+	devices, metrics map[string]bool
+}
+
+func newWSFilter(sub wsSubscribe) wsFilter {
+	var f wsFilter
+	if len(sub.Devices) > 0 {
+		f.devices = map[string]bool{}
+		for _, d := range sub.Devices {
+			f.devices[d] = true
+		}
+	}
+	if len(sub.Metrics) > 0 {
+		f.metrics = map[string]bool{}
+		for _, m := range sub.Metrics {
+			f.metrics[m] = true
+		}
+	}
+	return f
+}
+
+// apply returns event restricted to the filter's metrics, and false if the
+// client did not subscribe to the event's device.
+func (f wsFilter) apply(event apiDevice) (apiDevice, bool) {
+	if f.devices != nil && !f.devices[event.Device] {
+		return event, false
+	}
+	if f.metrics != nil && event.Readings != nil {
+		readings := make(map[string]apiValue, len(f.metrics))
+		for name, v := range event.Readings {
+			if f.metrics[name] {
+				readings[name] = v
+			}
+		}
+		event.Readings = readings
+	}
+	return event, true
+}
+
+// newWebSocketHandler returns the handler of /api/v1/ws, which upgrades to a
+// WebSocket and sends a message with the device's state, as served by
+// /api/v1/current, for every new reading. Clients may send a subscription
+// message at any time to restrict the devices and metrics they receive; the
+// device query parameter sets the initial subscription like it does for
+// /api/v1/stream. At most maxConns clients are served at a time.
+func newWebSocketHandler(b *ReadingBroadcaster, devices []string, maxConns int, logger log.Logger) http.Handler {
+	known := make(map[string]bool, len(devices))
+	for _, d := range devices {
+		known[d] = true
+	}
+	metrics := map[string]bool{}
+	for _, f := range (Reading{}).Fields() {
+		metrics[f.Name] = true
+	}
+	upgrader := websocket.Upgrader{
+		HandshakeTimeout: wsWriteTimeout,
+		Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+			writeAPIError(w, status, reason.Error())
+		},
+	}
+
+	var (
+		mutex sync.Mutex
+		conns int
+	)
+	release := func() {
+		mutex.Lock()
+		conns--
+		mutex.Unlock()
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sub := wsSubscribe{Devices: r.URL.Query()["device"]}
+		if err := validateWSSubscribe(sub, known, metrics); err != "" {
+			writeAPIError(w, http.StatusNotFound, err)
+			return
+		}
+
+		mutex.Lock()
+		if conns >= maxConns {
+			mutex.Unlock()
+			writeAPIError(w, http.StatusServiceUnavailable, "too many WebSocket connections")
+			return
+		}
+		conns++
+		mutex.Unlock()
+		defer release()
+
+		s := b.subscribe()
+		if s == nil {
+			writeAPIError(w, http.StatusServiceUnavailable, "shutting down")
+			return
+		}
+		defer b.unsubscribe(s)
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// The upgrader has already answered the request.
+			return
+		}
+		defer conn.Close()
+
+		// The reader goroutine handles pongs and subscription messages,
+		// passing the latter on as replies, as only this goroutine
+		// writes to conn.
+		replies := make(chan wsReply)
+		closed := make(chan struct{})
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			defer close(closed)
+			conn.SetReadLimit(wsMaxMessageSize)
+			conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+			conn.SetPongHandler(func(string) error {
+				return conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+			})
+			for {
+				_, data, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+				var sub wsSubscribe
+				var reply wsReply
+				if err := json.Unmarshal(data, &sub); err != nil {
+					reply.msg = wsMessage{Type: "error", Error: "invalid subscription message: " + err.Error()}
+				} else if msg := validateWSSubscribe(sub, known, metrics); msg != "" {
+					reply.msg = wsMessage{Type: "error", Error: msg}
+				} else {
+					filter := newWSFilter(sub)
+					reply = wsReply{msg: wsMessage{Type: "subscribed", Subscribed: &sub}, filter: &filter}
+				}
+				select {
+				case replies <- reply:
+				case <-stop:
+					return
+				}
+			}
+		}()
+
+		write := func(msg wsMessage) bool {
+			conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := conn.WriteJSON(msg); err != nil {
+				level.Debug(logger).Log("msg", "Closing WebSocket connection", "remote_addr", r.RemoteAddr, "err", err)
+				return false
+			}
+			return true
+		}
+
+		filter := newWSFilter(sub)
+		ping := time.NewTicker(wsPingInterval)
+		defer ping.Stop()
+		for {
+			select {
+			case <-closed:
+				return
+			case <-b.done:
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutting down"),
+					time.Now().Add(wsWriteTimeout))
+				return
+			case <-ping.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+					return
+				}
+			case reply := <-replies:
+				if reply.filter != nil {
+					filter = *reply.filter
+				}
+				if !write(reply.msg) {
+					return
+				}
+			case event := <-s.events:
+				event, ok := filter.apply(event)
+				if !ok {
+					continue
+				}
+				if !write(wsMessage{Type: "reading", Reading: &event}) {
+					return
+				}
+			}
+		}
+	})
+}
+
+// validateWSSubscribe returns an error message if sub names unknown devices
+// or metrics.
+func validateWSSubscribe(sub wsSubscribe, devices, metrics map[string]bool) string {
+	for _, d := range sub.Devices {
+		if !devices[d] {
+			return "unknown device " + d
+		}
+	}
+	for _, m := range sub.Metrics {
+		if !metrics[m] {
+			return "unknown metric " + m
+		}
+	}
+	return ""
+}